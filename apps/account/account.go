@@ -21,6 +21,7 @@ import (
 	"strings"
 	"unicode"
 
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"github.com/tamasd/simplesite/database"
@@ -29,6 +30,15 @@ import (
 	"golang.org/x/text/unicode/norm"
 )
 
+var (
+	// ErrDuplicateUsername is returned by Account.Save when another account
+	// has the same (normalized) username.
+	ErrDuplicateUsername = errors.New("username is already taken")
+	// ErrDuplicateEmail is returned by Account.Save when another account has
+	// the same email address.
+	ErrDuplicateEmail = errors.New("email address is already taken")
+)
+
 // Account represents the main user entity.
 type Account struct {
 	ID       uuid.UUID `json:"id"`
@@ -40,6 +50,10 @@ type Account struct {
 	salt     string
 }
 
+// uniqueViolation is the PostgreSQL error code of the unique constraint
+// violations.
+const uniqueViolation = "23505"
+
 // SchemaSQL returns the schema of the account entity.
 func (a Account) SchemaSQL() string {
 	return `
@@ -87,6 +101,17 @@ func (a *Account) Save(conn database.DB) error {
 		a.Active,
 		NormalizeAccountname(a.Username),
 	)
+	if pqErr, ok := errors.Cause(err).(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		// The unique indexes of the account table have generated names,
+		// e.g. account_email_idx.
+		switch {
+		case strings.Contains(pqErr.Constraint, "email"):
+			return ErrDuplicateEmail
+		case strings.Contains(pqErr.Constraint, "username"):
+			return ErrDuplicateUsername
+		}
+	}
+
 	return errors.Wrap(err, "error saving account")
 }
 
@@ -17,10 +17,29 @@
 package account_test
 
 import (
+	"database/sql"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/account"
+	"github.com/tamasd/simplesite/apps/post"
+	"github.com/tamasd/simplesite/config"
+	"github.com/tamasd/simplesite/form"
+	"github.com/tamasd/simplesite/server"
+	"github.com/tamasd/simplesite/session"
+	"github.com/tamasd/simplesite/site"
+	"github.com/tamasd/simplesite/util"
 	"github.com/tamasd/simplesite/util/testutil"
 )
 
@@ -36,3 +55,695 @@ func TestRegistrationAndLogin(t *testing.T) {
 	resp := c.ClickLink("li.logout a")
 	require.Equal(t, http.StatusFound, resp.StatusCode)
 }
+
+func TestRegistrationCaptchaFailure(t *testing.T) {
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"success": false}`))
+	}))
+	defer verifier.Close()
+
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"captcha_sitekey":    "sitekey",
+		"captcha_secret":     "secret",
+		"captcha_verify_url": verifier.URL,
+	})
+	defer srv.Cleanup()
+	c := srv.CreateClient(t)
+
+	sf := c.Form("/register")
+	require.NotEqual(t, 0, c.Page.Find(`div.h-captcha[data-sitekey="sitekey"]`).Length())
+
+	regdata := testutil.TestRegData()
+	regdata.Set("h-captcha-response", "invalid")
+	resp := sf.Submit(regdata)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, c.Page.Find("div.messages.error").Text(), "CAPTCHA verification failed")
+	require.Len(t, srv.Mailer.Messages, 0)
+}
+
+func TestRegistrationFieldErrors(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+	c := srv.CreateClient(t)
+
+	regdata := testutil.TestRegData()
+	regdata.Del("Email")
+	resp := c.Form("/register").Submit(regdata)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Email is required", c.Page.Find("p.field-email span.error").Text())
+	require.Equal(t, 0, c.Page.Find("p.field-username span.error").Length())
+	require.Equal(t, 0, c.Page.Find("div.messages.error").Length())
+}
+
+func TestRegistrationPasswordMismatch(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+	c := srv.CreateClient(t)
+
+	regdata := testutil.TestRegData()
+	regdata.Set("ConfirmPassword", regdata.Get("Password")+"x")
+	resp := c.Form("/register").Submit(regdata)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Passwords do not match", c.Page.Find("p.field-confirmpassword span.error").Text())
+	require.Equal(t, 0, c.Page.Find("p.field-password span.error").Length())
+	require.Len(t, srv.Mailer.Messages, 0)
+
+	_, err := account.LoadAccountByUsername(srv.Database(), regdata.Get("Username"))
+	require.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestRegistrationShortPassword(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"password_min_length": "12",
+	})
+	defer srv.Cleanup()
+	c := srv.CreateClient(t)
+
+	regdata := testutil.TestRegData()
+	regdata.Set("Password", "abc")
+	regdata.Set("ConfirmPassword", "abc")
+	resp := c.Form("/register").Submit(regdata)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Password must be at least 12 characters long", c.Page.Find("p.field-password span.error").Text())
+	require.Len(t, srv.Mailer.Messages, 0)
+}
+
+func TestRegistrationJSON(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+	c := srv.CreateClient(t)
+
+	regdata := testutil.TestRegData()
+	resp := c.Form("/register").SubmitJSON(map[string]interface{}{
+		"Username":        regdata.Get("Username"),
+		"Email":           regdata.Get("Email"),
+		"Password":        regdata.Get("Password"),
+		"ConfirmPassword": regdata.Get("ConfirmPassword"),
+		"AcceptTOS":       true,
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	result := form.JSONResult{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal(t, "/", result.Redirect)
+	require.Len(t, srv.Mailer.Messages, 1)
+}
+
+func TestOAuthLogin(t *testing.T) {
+	username := util.RandomHexString(16)
+	var verified int32
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			require.Nil(t, r.ParseForm())
+			require.Equal(t, "code", r.PostForm.Get("code"))
+			require.Equal(t, "secret", r.PostForm.Get("client_secret"))
+			_, _ = w.Write([]byte(`{"access_token": "accesstoken", "token_type": "Bearer"}`))
+		case "/userinfo":
+			require.Equal(t, "Bearer accesstoken", r.Header.Get("Authorization"))
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"sub":                username,
+				"email":              username + "@example.com",
+				"preferred_username": username,
+				"email_verified":     atomic.LoadInt32(&verified) == 1,
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer provider.Close()
+
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"oauth_providers":          "test",
+		"oauth_test_client_id":     "client",
+		"oauth_test_client_secret": "secret",
+		"oauth_test_auth_url":      provider.URL + "/auth",
+		"oauth_test_token_url":     provider.URL + "/token",
+		"oauth_test_userinfo_url":  provider.URL + "/userinfo",
+	})
+	defer srv.Cleanup()
+
+	login := func(c *testutil.TestClient) *http.Response {
+		resp := c.Request(http.MethodGet, "/auth/test/start", nil)
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		authURL, err := url.Parse(resp.Header.Get("Location"))
+		require.Nil(t, err)
+		return c.Request(http.MethodGet, "/auth/test/callback?code=code&state="+authURL.Query().Get("state"), nil)
+	}
+
+	resp := login(srv.CreateClient(t))
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, err := account.LoadAccountByIdentity(srv.Database(), "test", username)
+	require.Equal(t, sql.ErrNoRows, err)
+
+	atomic.StoreInt32(&verified, 1)
+	for i := 0; i < 2; i++ {
+		c := srv.CreateClient(t)
+
+		resp := c.Request(http.MethodGet, "/auth/test/start", nil)
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		authURL, err := url.Parse(resp.Header.Get("Location"))
+		require.Nil(t, err)
+		require.Equal(t, "/auth", authURL.Path)
+		require.Equal(t, "client", authURL.Query().Get("client_id"))
+		state := authURL.Query().Get("state")
+		require.NotZero(t, state)
+
+		resp = c.Request(http.MethodGet, "/auth/test/callback?code=code&state=invalid", nil)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = c.Request(http.MethodGet, "/auth/test/callback?code=code&state="+state, nil)
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		require.False(t, uuid.Equal(uuid.Nil, c.CurrentUID()))
+
+		acc, err := account.LoadAccountByIdentity(srv.Database(), "test", username)
+		require.Nil(t, err)
+		require.Equal(t, acc.ID, c.CurrentUID())
+		require.Equal(t, username, acc.Username)
+		require.True(t, acc.Active)
+	}
+}
+
+func TestRememberMe(t *testing.T) {
+	clock, restore := testutil.InstallFakeClock()
+	defer restore()
+
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"session_ttl": "1h",
+	})
+	defer srv.Cleanup()
+
+	remembered := srv.CreateClient(t)
+	regdata := testutil.TestRegData()
+	remembered.RegistrationAndLogin(regdata)
+	remembered.FollowRedirect()
+	resp := remembered.ClickLink("li.logout a")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	logindata := &url.Values{}
+	logindata.Set("Username", regdata.Get("Username"))
+	logindata.Set("Password", regdata.Get("Password"))
+	logindata.Set("RememberMe", "true")
+	resp = remembered.Form("/login").Submit(logindata)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	forgotten := srv.CreateClient(t)
+	forgotten.RegistrationAndLogin(testutil.TestRegData())
+
+	clock.Advance(2 * time.Hour)
+
+	resp = remembered.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, remembered.Page.Find("li.logout a").Length())
+
+	resp = forgotten.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, forgotten.Page.Find("li.logout a").Length())
+
+	resp = remembered.ClickLink("li.logout a")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	clock.Advance(2 * time.Hour)
+
+	resp = remembered.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, remembered.Page.Find("li.logout a").Length())
+}
+
+func TestRememberMeInactiveAccount(t *testing.T) {
+	clock, restore := testutil.InstallFakeClock()
+	defer restore()
+
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"session_ttl": "1h",
+	})
+	defer srv.Cleanup()
+
+	c := srv.CreateClient(t)
+	regdata := testutil.TestRegData()
+	c.RegistrationAndLogin(regdata)
+	uid := c.CurrentUID()
+	c.FollowRedirect()
+	resp := c.ClickLink("li.logout a")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	logindata := &url.Values{}
+	logindata.Set("Username", regdata.Get("Username"))
+	logindata.Set("Password", regdata.Get("Password"))
+	logindata.Set("RememberMe", "true")
+	resp = c.Form("/login").Submit(logindata)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	_, err := srv.Database().Exec(`UPDATE account SET active = false WHERE id = $1`, uid)
+	require.Nil(t, err)
+
+	clock.Advance(2 * time.Hour)
+
+	resp = c.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, c.Page.Find("li.logout a").Length())
+
+	_, err = srv.Database().Exec(`UPDATE account SET active = true WHERE id = $1`, uid)
+	require.Nil(t, err)
+
+	// The rejected token was deleted, so it doesn't work anymore.
+	clock.Advance(2 * time.Hour)
+
+	resp = c.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, c.Page.Find("li.logout a").Length())
+}
+
+func TestGrantRevokePermission(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	c := srv.CreateClient(t)
+	c.RegistrationAndLogin(testutil.TestRegData())
+	uid := c.CurrentUID()
+
+	require.Nil(t, account.GrantPermission(conn, uid, "foo"))
+	require.Nil(t, account.GrantPermission(conn, uid, "foo"))
+	require.Nil(t, account.GrantPermission(conn, uid, "bar"))
+
+	perms, err := account.LoadPermissions(conn, uid)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"foo", "bar"}, []string(perms))
+
+	require.Nil(t, account.RevokePermission(conn, uid, "foo"))
+	require.Nil(t, account.RevokePermission(conn, uid, "foo"))
+	require.Nil(t, account.RevokePermission(conn, uid, "nonexistent"))
+
+	perms, err = account.LoadPermissions(conn, uid)
+	require.Nil(t, err)
+	require.Equal(t, account.Permissions{"bar"}, perms)
+}
+
+func TestOwnershipMiddleware(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	owner := func(r *http.Request) uuid.UUID {
+		return uuid.FromStringOrNil(httprouter.ParamsFromContext(r.Context()).ByName("owner"))
+	}
+	srv.Server.Router().Get("/test/owned/:owner", server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, account.OwnershipMiddleware(owner, "edit-own-test", "edit-any-test")))
+
+	conn := srv.Database()
+	c := srv.CreateClient(t)
+	c.RegistrationAndLogin(testutil.TestRegData())
+	uid := c.CurrentUID()
+	other := uuid.NewV4().String()
+
+	resp := c.Request(http.MethodGet, "/test/owned/"+uid.String(), nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	require.Nil(t, account.GrantPermission(conn, uid, "edit-own-test"))
+	resp = c.Request(http.MethodGet, "/test/owned/"+uid.String(), nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = c.Request(http.MethodGet, "/test/owned/"+other, nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	require.Nil(t, account.GrantPermission(conn, uid, "edit-any-test"))
+	resp = c.Request(http.MethodGet, "/test/owned/"+other, nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	anon := srv.CreateClient(t)
+	resp = anon.Request(http.MethodGet, "/test/owned/"+uuid.Nil.String(), nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestMustBeVerified(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	var loaded *account.Account
+	srv.Server.Router().Get("/test/verified", server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		loaded, err = account.CurrentAccount(r)
+		require.Nil(t, err)
+		w.WriteHeader(http.StatusNoContent)
+	}, account.MustBeVerifiedMiddleware()))
+
+	anon := srv.CreateClient(t)
+	resp := anon.Request(http.MethodGet, "/test/verified", nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	conn := srv.Database()
+	c := srv.CreateClient(t)
+	c.RegistrationAndLogin(testutil.TestRegData())
+
+	resp = c.Request(http.MethodGet, "/test/verified", nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NotNil(t, loaded)
+	require.True(t, uuid.Equal(c.CurrentUID(), loaded.ID))
+
+	acc, err := account.LoadAccount(conn, c.CurrentUID())
+	require.Nil(t, err)
+	acc.Active = false
+	require.Nil(t, acc.Save(conn))
+
+	resp = c.Request(http.MethodGet, "/test/verified", nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestLogoutAll(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	regdata := testutil.TestRegData()
+	c0 := srv.CreateClient(t)
+	c0.RegistrationAndLogin(regdata)
+	uid := c0.CurrentUID()
+
+	logindata := &url.Values{}
+	logindata.Set("Username", regdata.Get("Username"))
+	logindata.Set("Password", regdata.Get("Password"))
+	c1 := srv.CreateClient(t)
+	resp := c1.Form("/login").Submit(logindata)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.True(t, uuid.Equal(uid, c1.CurrentUID()))
+
+	resp = c0.Request(http.MethodGet, "/account/logout-all", nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = c0.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	href := c0.Page.Find("li.logout a").AttrOr("href", "")
+	require.NotZero(t, href)
+	resp = c0.Request(http.MethodGet, strings.Replace(href, "/logout", "/account/logout-all", 1), nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	for _, c := range []*testutil.TestClient{c0, c1} {
+		resp = c.Request(http.MethodGet, "/", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.True(t, uuid.Equal(uuid.Nil, c.CurrentUID()))
+		require.NotEqual(t, 0, c.Page.Find("li.login").Length())
+	}
+}
+
+func TestPasswordChangeRotatesCSRF(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	regdata := testutil.TestRegData()
+	c := srv.CreateClient(t)
+	c.RegistrationAndLogin(regdata)
+
+	resp := c.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	oldLogout := c.Page.Find("li.logout a").AttrOr("href", "")
+	require.NotZero(t, oldLogout)
+
+	newPassword := util.RandomHexString(32)
+	data := &url.Values{}
+	data.Set("CurrentPassword", regdata.Get("Password"))
+	data.Set("NewPassword", newPassword)
+	data.Set("ConfirmPassword", newPassword)
+	resp = c.Form("/account/password").Submit(data)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	c.FollowRedirect()
+
+	newLogout := c.Page.Find("li.logout a").AttrOr("href", "")
+	require.NotZero(t, newLogout)
+	require.NotEqual(t, oldLogout, newLogout)
+
+	resp = c.Request(http.MethodGet, oldLogout, nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	acc, err := account.LoadAccount(srv.Database(), c.CurrentUID())
+	require.Nil(t, err)
+	require.True(t, acc.CheckPassword(newPassword))
+
+	resp = c.Request(http.MethodGet, newLogout, nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestSessionCookieName(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"session_cookie_name": "test-session",
+	})
+	defer srv.Cleanup()
+
+	c := srv.CreateClient(t)
+	c.RegistrationAndLogin(testutil.TestRegData())
+	require.False(t, uuid.Equal(uuid.Nil, c.CurrentUID()))
+
+	var names []string
+	for _, cookie := range c.LastResponse.Cookies() {
+		names = append(names, cookie.Name)
+	}
+	require.Contains(t, names, "test-session")
+	require.NotContains(t, names, session.SessionCookieName)
+}
+
+func TestSecureCookie(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cfg    config.MapStorage
+		secure bool
+	}{
+		{"http", config.MapStorage{}, false},
+		{"https", config.MapStorage{"certfile": "cert.pem", "keyfile": "key.pem"}, true},
+		{"proxy", config.MapStorage{"secure_cookie": "true"}, true},
+		{"override", config.MapStorage{"certfile": "cert.pem", "keyfile": "key.pem", "secure_cookie": "false"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := testutil.SetupTestSiteFromEnvWithConfig(tc.cfg)
+			defer srv.Cleanup()
+
+			c := srv.CreateClient(t)
+			resp := c.Request(http.MethodGet, "/account/login", nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			cookies := resp.Cookies()
+			require.NotEmpty(t, cookies)
+			for _, cookie := range cookies {
+				require.Equal(t, tc.secure, cookie.Secure, cookie.Name)
+			}
+		})
+	}
+}
+
+func TestCreateAdminCommand(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	out, err := srv.RunCommand("create-admin", "admin", "admin@example.com")
+	require.Nil(t, err)
+	password := strings.TrimSpace(out[strings.LastIndex(out, ":")+1:])
+	require.NotEmpty(t, password)
+
+	a, err := account.LoadAccountByUsername(srv.Database(), "admin")
+	require.Nil(t, err)
+	require.True(t, a.Active)
+	require.Equal(t, "admin@example.com", a.Email)
+	require.True(t, a.CheckPassword(password))
+
+	perms, err := account.LoadPermissions(srv.Database(), a.ID)
+	require.Nil(t, err)
+	require.ElementsMatch(t, site.DefaultAdminPermissions, perms)
+
+	c := srv.CreateClient(t)
+	logindata := &url.Values{}
+	logindata.Set("Username", "admin")
+	logindata.Set("Password", password)
+	resp := c.Form("/login").Submit(logindata)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.True(t, uuid.Equal(a.ID, c.CurrentUID()))
+
+	_, err = srv.RunCommand("create-admin", "admin")
+	require.NotNil(t, err)
+	_, err = srv.RunCommand("no-such-command")
+	require.Equal(t, site.UnknownCommandError("no-such-command"), err)
+
+	_, err = srv.RunCommand("create-admin", "admin2", "admin2@example.com")
+	require.Equal(t, account.ErrAdminExists, err)
+	_, err = account.LoadAccountByUsername(srv.Database(), "admin2")
+	require.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestCreateAdminPermissions(t *testing.T) {
+	perms := account.Permissions{post.PermissionCreatePost, "custom-permission"}
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"admin_permissions": strings.Join(perms, " "),
+	})
+	defer srv.Cleanup()
+	conn := srv.Database()
+
+	exists, err := account.AdminExists(conn, perms)
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	editor := &account.Account{Username: "editor", Email: "editor@example.com", Active: true}
+	editor.SetPassword(util.RandomHexString(16))
+	require.Nil(t, editor.Save(conn))
+	require.Nil(t, account.SavePermissions(conn, editor.ID, account.Permissions{post.PermissionCreatePost}))
+
+	_, err = srv.RunCommand("create-admin", "admin", "admin@example.com")
+	require.Nil(t, err)
+
+	a, err := account.LoadAccountByUsername(conn, "admin")
+	require.Nil(t, err)
+	require.True(t, a.Active)
+	loaded, err := account.LoadPermissions(conn, a.ID)
+	require.Nil(t, err)
+	require.ElementsMatch(t, perms, loaded)
+
+	exists, err = account.AdminExists(conn, perms)
+	require.Nil(t, err)
+	require.True(t, exists)
+}
+
+func TestLoggerFields(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	c := srv.CreateClient(t)
+	c.RegistrationAndLogin(testutil.TestRegData())
+
+	resp := c.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	lines := strings.Split(strings.TrimSpace(testutil.GetLog(srv.Logger)), "\n")
+	last := lines[len(lines)-1]
+	require.Contains(t, last, "completed handling request")
+	require.Contains(t, last, "uid="+c.CurrentUID().String())
+	require.Contains(t, last, "session=")
+
+	anon := srv.CreateClient(t)
+	resp = anon.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	lines = strings.Split(strings.TrimSpace(testutil.GetLog(srv.Logger)), "\n")
+	last = lines[len(lines)-1]
+	require.Contains(t, last, "completed handling request")
+	require.NotContains(t, last, "uid=")
+	require.Contains(t, last, "session=")
+}
+
+func TestVerificationTokenExpiry(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+	c := srv.CreateClient(t)
+
+	clock, restore := testutil.InstallFakeClock()
+	defer restore()
+
+	resp := c.Form("/register").Submit(testutil.TestRegData())
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Len(t, srv.Mailer.Messages, 1)
+
+	clock.Advance(25 * time.Hour)
+
+	link := regexp.MustCompile(`https?:[a-zA-Z0-9/.-]+`).FindString(string(srv.Mailer.Messages[0].Message))
+	require.NotZero(t, link)
+	resp = c.Request(http.MethodGet, link, nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestVerificationCode(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"registration_verification": "code",
+	})
+	defer srv.Cleanup()
+	c := srv.CreateClient(t)
+
+	regdata := testutil.TestRegData()
+	resp := c.Form("/register").Submit(regdata)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Len(t, srv.Mailer.Messages, 1)
+	verifyURL := resp.Header.Get("Location")
+	require.True(t, strings.HasPrefix(verifyURL, "/verify/"), verifyURL)
+
+	mail := string(srv.Mailer.Messages[0].Message)
+	match := regexp.MustCompile(`code: ([0-9]{6})`).FindStringSubmatch(mail)
+	require.Len(t, match, 2)
+	code := match[1]
+	require.Contains(t, mail, verifyURL)
+
+	logindata := &url.Values{}
+	logindata.Set("Username", regdata.Get("Username"))
+	logindata.Set("Password", regdata.Get("Password"))
+	resp = c.Form("/login").Submit(logindata)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	resp = c.Form(verifyURL).Submit(&url.Values{"Code": {wrong}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, c.Page.Find(".messages.error").Text(), "Invalid code")
+
+	resp = c.Form(verifyURL).Submit(&url.Values{"Code": {code}})
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = c.Form(verifyURL).Submit(&url.Values{"Code": {code}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = c.Form("/login").Submit(logindata)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+}
+
+func TestVerificationCodeLockout(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"registration_verification": "code",
+	})
+	defer srv.Cleanup()
+	c := srv.CreateClient(t)
+
+	resp := c.Form("/register").Submit(testutil.TestRegData())
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	verifyURL := resp.Header.Get("Location")
+	code := regexp.MustCompile(`code: ([0-9]{6})`).FindStringSubmatch(string(srv.Mailer.Messages[0].Message))[1]
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 0; i < 5; i++ {
+		resp = c.Form(verifyURL).Submit(&url.Values{"Code": {wrong}})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp = c.Form(verifyURL).Submit(&url.Values{"Code": {code}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, c.Page.Find(".messages.error").Text(), "Too many attempts")
+}
+
+func TestDuplicateAccount(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+	conn := srv.Database()
+
+	acc := &account.Account{Username: util.RandomHexString(16), Email: util.RandomHexString(8) + "@example.com"}
+	acc.SetPassword(util.RandomHexString(32))
+	require.Nil(t, acc.Save(conn))
+
+	dup := &account.Account{Username: strings.ToUpper(acc.Username), Email: util.RandomHexString(8) + "@example.com"}
+	dup.SetPassword(util.RandomHexString(32))
+	require.Equal(t, account.ErrDuplicateUsername, errors.Cause(dup.Save(conn)))
+
+	dup = &account.Account{Username: util.RandomHexString(16), Email: acc.Email}
+	dup.SetPassword(util.RandomHexString(32))
+	require.Equal(t, account.ErrDuplicateEmail, errors.Cause(dup.Save(conn)))
+
+	c := srv.CreateClient(t)
+	regdata := testutil.TestRegData()
+	regdata.Set("Username", acc.Username)
+	resp := c.Form("/register").Submit(regdata)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Username is already taken", c.Page.Find("p.field-username span.error").Text())
+
+	regdata = testutil.TestRegData()
+	regdata.Set("Email", acc.Email)
+	resp = c.Form("/register").Submit(regdata)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Email address is already registered", c.Page.Find("p.field-email span.error").Text())
+}
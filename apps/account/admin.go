@@ -0,0 +1,84 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package account
+
+import (
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/tamasd/simplesite/database"
+)
+
+// ErrAdminExists is returned by CreateAdmin when there is an account that
+// already has all of the admin permissions.
+var ErrAdminExists = errors.New("an admin account already exists")
+
+// AdminExists tells if there is an account that has all of the given
+// permissions.
+func AdminExists(conn database.DB, perms Permissions) (bool, error) {
+	if len(perms) == 0 {
+		return false, nil
+	}
+
+	var exists bool
+	err := conn.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1
+			FROM permission
+			WHERE permission = ANY($1)
+			GROUP BY id
+			HAVING COUNT(DISTINCT permission) = $2
+		)
+	`, pq.Array(perms), len(perms)).Scan(&exists)
+
+	return exists, errors.Wrap(err, "error checking admin accounts")
+}
+
+// CreateAdmin creates the first privileged account of a site.
+//
+// The account is active, and has the given permissions. It returns
+// ErrAdminExists without changing anything if there is already an account
+// with the same permissions, so it is safe to run repeatedly. The changes
+// are made in a transaction.
+func CreateAdmin(conn database.DB, username, email, password string, perms Permissions) (*Account, error) {
+	a := &Account{
+		Username: username,
+		Email:    email,
+		Active:   true,
+	}
+	a.SetPassword(password)
+
+	err := database.Transactional(conn, func(tx database.DB) error {
+		exists, err := AdminExists(tx, perms)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrAdminExists
+		}
+
+		if err = a.Save(tx); err != nil {
+			return err
+		}
+
+		return SavePermissions(tx, a.ID, perms)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
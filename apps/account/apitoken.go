@@ -0,0 +1,163 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package account
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/tamasd/simplesite/server"
+	"github.com/tamasd/simplesite/session"
+	"github.com/tamasd/simplesite/util"
+	"github.com/urfave/negroni"
+)
+
+const (
+	apiTokenLength = 64
+)
+
+// APIToken is a bearer token that authenticates an account on the API.
+//
+// Only the hash of the token is stored.
+type APIToken struct {
+	ID      uuid.UUID `json:"id"`
+	Account uuid.UUID `json:"account"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	hash string
+}
+
+// SchemaSQL returns the schema of the API token entity.
+func (t APIToken) SchemaSQL() string {
+	return `
+		CREATE TABLE api_token (
+			id uuid NOT NULL,
+			account uuid NOT NULL
+				REFERENCES account(id) ON UPDATE CASCADE ON DELETE CASCADE,
+			name character varying NOT NULL,
+			hash character(64) NOT NULL,
+			created timestamp with time zone NOT NULL DEFAULT now(),
+			PRIMARY KEY (id)
+		);
+
+		CREATE UNIQUE INDEX api_token_hash ON api_token (hash);
+	`
+}
+
+// CreateAPIToken creates a new API token for an account.
+//
+// The returned token is not stored, so it can't be retrieved later.
+func CreateAPIToken(conn database.DB, account uuid.UUID, name string) (*APIToken, string, error) {
+	token := util.RandomHexString(apiTokenLength)
+	t := &APIToken{
+		ID:      uuid.NewV4(),
+		Account: account,
+		Name:    name,
+		hash:    hashAPIToken(token),
+	}
+
+	err := conn.QueryRow(`
+		INSERT INTO api_token (id, account, name, hash)
+		VALUES($1, $2, $3, $4)
+		RETURNING created
+	`, t.ID, t.Account, t.Name, t.hash).Scan(&t.Created)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error saving api token")
+	}
+
+	return t, token, nil
+}
+
+// Delete revokes the API token.
+func (t *APIToken) Delete(conn database.DB) error {
+	_, err := conn.Exec(`DELETE FROM api_token WHERE id = $1`, t.ID)
+	return errors.Wrap(err, "error deleting api token")
+}
+
+// LoadAPIToken loads an API token by its plain text form.
+//
+// Returns nil if the token is not found.
+func LoadAPIToken(conn database.DB, token string) (*APIToken, error) {
+	t := &APIToken{}
+	err := conn.QueryRow(`
+		SELECT t.id, t.account, t.name, t.hash, t.created
+		FROM api_token t JOIN account a ON t.account = a.id
+		WHERE t.hash = $1 AND a.active
+	`, hashAPIToken(token)).Scan(
+		&t.ID,
+		&t.Account,
+		&t.Name,
+		&t.hash,
+		&t.Created,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading api token")
+	}
+
+	return t, nil
+}
+
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+type apiTokenMiddleware struct{}
+
+// APITokenMiddleware is a middleware that authenticates the request with the
+// bearer token in the Authorization header.
+//
+// The session cookie is ignored on the requests that pass this middleware.
+func APITokenMiddleware() negroni.Handler {
+	return &apiTokenMiddleware{}
+}
+
+func (m *apiTokenMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		respond.JSONError(w, r, http.StatusUnauthorized, "missing api token", nil, nil)
+		return
+	}
+
+	t, err := LoadAPIToken(database.Get(r), strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		respond.JSONError(w, r, http.StatusInternalServerError, "failed to load api token", nil, err)
+		return
+	}
+	if t == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		respond.JSONError(w, r, http.StatusUnauthorized, "invalid api token", nil, nil)
+		return
+	}
+
+	server.AddLoggerField(r, "uid", t.Account.String())
+	r = session.Override(r, &session.Session{ID: t.Account})
+	next(w, util.SetContext(r, permContextKey, &accessChecker{r: r}))
+}
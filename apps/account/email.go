@@ -0,0 +1,187 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package account
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMXTimeout is the default timeout of the DNS lookups of the
+	// MXValidator.
+	DefaultMXTimeout = 5 * time.Second
+	// DefaultMXCacheTTL is the default time the MXValidator caches the
+	// results of the lookups.
+	DefaultMXCacheTTL = 10 * time.Minute
+
+	mxCacheSize = 1024
+)
+
+// EmailValidator checks if an email address can receive mails when users
+// register.
+type EmailValidator interface {
+	Validate(email string) (bool, error)
+}
+
+// EmailValidatorFunc is a single function implementation of EmailValidator.
+type EmailValidatorFunc func(email string) (bool, error)
+
+func (f EmailValidatorFunc) Validate(email string) (bool, error) {
+	return f(email)
+}
+
+// MXResolver looks up the DNS records of a domain.
+//
+// *net.Resolver implements this interface.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type mxCacheEntry struct {
+	valid   bool
+	expires time.Time
+}
+
+// MXValidator is an EmailValidator that checks if the domain of the email
+// address has a mail exchanger.
+//
+// Domains without MX records are accepted if they have an address record,
+// because mails are delivered to the address in that case.
+type MXValidator struct {
+	resolver MXResolver
+	// Timeout is the timeout of the DNS lookups.
+	Timeout time.Duration
+	// CacheTTL is the time the results of the lookups are cached for.
+	CacheTTL time.Duration
+
+	mtx   sync.Mutex
+	cache map[string]mxCacheEntry
+}
+
+// NewMXValidator creates a MXValidator. The default resolver is used if the
+// resolver is nil.
+func NewMXValidator(resolver MXResolver) *MXValidator {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return &MXValidator{
+		resolver: resolver,
+		Timeout:  DefaultMXTimeout,
+		CacheTTL: DefaultMXCacheTTL,
+		cache:    make(map[string]mxCacheEntry),
+	}
+}
+
+// Validate checks the domain of the email address.
+//
+// Returns an error if the DNS lookup fails for a reason other than a missing
+// domain or record.
+func (v *MXValidator) Validate(email string) (bool, error) {
+	at := strings.LastIndex(email, "@")
+	if at == -1 {
+		return false, nil
+	}
+	domain := strings.ToLower(strings.TrimSuffix(email[at+1:], "."))
+	if domain == "" {
+		return false, nil
+	}
+
+	if valid, ok := v.cached(domain); ok {
+		return valid, nil
+	}
+
+	valid, err := v.lookup(domain)
+	if err != nil {
+		return false, err
+	}
+
+	v.store(domain, valid)
+
+	return valid, nil
+}
+
+func (v *MXValidator) lookup(domain string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.Timeout)
+	defer cancel()
+
+	mx, err := v.resolver.LookupMX(ctx, domain)
+	if err != nil && !isDNSNotFound(err) {
+		return false, err
+	}
+	for _, record := range mx {
+		// A single "." is the null MX record (RFC 7505), the domain
+		// doesn't accept mails.
+		if record.Host == "." {
+			return false, nil
+		}
+	}
+	if len(mx) > 0 {
+		return true, nil
+	}
+
+	addrs, err := v.resolver.LookupHost(ctx, domain)
+	if err != nil && !isDNSNotFound(err) {
+		return false, err
+	}
+
+	return len(addrs) > 0, nil
+}
+
+func (v *MXValidator) cached(domain string) (bool, bool) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	entry, ok := v.cache[domain]
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+
+	return entry.valid, true
+}
+
+func (v *MXValidator) store(domain string, valid bool) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	now := time.Now()
+	if len(v.cache) >= mxCacheSize {
+		for d, entry := range v.cache {
+			if now.After(entry.expires) {
+				delete(v.cache, d)
+			}
+		}
+		if len(v.cache) >= mxCacheSize {
+			v.cache = make(map[string]mxCacheEntry)
+		}
+	}
+
+	v.cache[domain] = mxCacheEntry{
+		valid:   valid,
+		expires: now.Add(v.CacheTTL),
+	}
+}
+
+func isDNSNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
@@ -0,0 +1,94 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package account_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/account"
+)
+
+type stubResolver struct {
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	err     error
+	lookups int
+}
+
+func (r *stubResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *stubResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if hosts, ok := r.hosts[host]; ok {
+		return hosts, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestMXValidator(t *testing.T) {
+	resolver := &stubResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com.", Pref: 10}},
+			"null.com":    {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"a-only.com": {"192.0.2.1"},
+		},
+	}
+	v := account.NewMXValidator(resolver)
+
+	for email, expected := range map[string]bool{
+		"foo@example.com": true,
+		"foo@EXAMPLE.com": true,
+		"foo@a-only.com":  true,
+		"foo@gmial.com":   false,
+		"foo@null.com":    false,
+		"foo":             false,
+		"foo@":            false,
+	} {
+		valid, err := v.Validate(email)
+		require.Nil(t, err)
+		require.Equal(t, expected, valid, email)
+	}
+
+	lookups := resolver.lookups
+	valid, err := v.Validate("bar@gmial.com")
+	require.Nil(t, err)
+	require.False(t, valid)
+	require.Equal(t, lookups, resolver.lookups)
+
+	resolver.err = errors.New("timeout")
+	_, err = v.Validate("foo@other.com")
+	require.NotNil(t, err)
+	valid, err = v.Validate("baz@example.com")
+	require.Nil(t, err)
+	require.True(t, valid)
+}
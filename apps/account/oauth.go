@@ -0,0 +1,393 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package account
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/tamasd/simplesite/server"
+	"github.com/tamasd/simplesite/session"
+	"github.com/tamasd/simplesite/util"
+)
+
+const (
+	oauthStateTTL = 10 * time.Minute
+)
+
+// OAuthIdentity is the identity of an account at an external provider.
+type OAuthIdentity struct {
+	Subject  string
+	Email    string
+	Username string
+	// EmailVerified tells if the provider has verified that the email
+	// address belongs to the user.
+	EmailVerified bool
+}
+
+// OAuthProvider is an external identity provider that supports the OAuth2
+// authorization code flow.
+type OAuthProvider interface {
+	// AuthCodeURL returns the url where the user is sent to authenticate.
+	AuthCodeURL(redirectURL, state string) string
+	// Exchange exchanges the authorization code for the user's identity.
+	Exchange(redirectURL, code string) (*OAuthIdentity, error)
+}
+
+// OpenIDConnectProvider is an OAuthProvider that fetches the identity from
+// an OpenID Connect userinfo endpoint.
+type OpenIDConnectProvider struct {
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       []string
+	Client       *http.Client
+}
+
+// NewOpenIDConnectProvider creates an OpenID Connect provider with the
+// default scopes.
+func NewOpenIDConnectProvider(clientID, clientSecret, authURL, tokenURL, userInfoURL string) *OpenIDConnectProvider {
+	return &OpenIDConnectProvider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		AuthURL:      authURL,
+		TokenURL:     tokenURL,
+		UserInfoURL:  userInfoURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OpenIDConnectProvider) AuthCodeURL(redirectURL, state string) string {
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", p.ClientID)
+	values.Set("redirect_uri", redirectURL)
+	values.Set("scope", strings.Join(p.Scopes, " "))
+	values.Set("state", state)
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+
+	return p.AuthURL + sep + values.Encode()
+}
+
+func (p *OpenIDConnectProvider) Exchange(redirectURL, code string) (*OAuthIdentity, error) {
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("code", code)
+	values.Set("redirect_uri", redirectURL)
+	values.Set("client_id", p.ClientID)
+	values.Set("client_secret", p.ClientSecret)
+
+	tok := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	resp, err := p.Client.PostForm(p.TokenURL, values)
+	if err = decodeProviderResponse(resp, err, &tok); err != nil {
+		return nil, errors.Wrap(err, "failed to exchange authorization code")
+	}
+	if tok.AccessToken == "" {
+		return nil, errors.New("no access token in the token response")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+
+	info := struct {
+		Subject           string      `json:"sub"`
+		Email             string      `json:"email"`
+		PreferredUsername string      `json:"preferred_username"`
+		EmailVerified     interface{} `json:"email_verified"`
+	}{}
+	resp, err = p.Client.Do(req)
+	if err = decodeProviderResponse(resp, err, &info); err != nil {
+		return nil, errors.Wrap(err, "failed to load user info")
+	}
+	if info.Subject == "" {
+		return nil, errors.New("no subject in the user info response")
+	}
+
+	// Some providers send the email_verified claim as a string.
+	return &OAuthIdentity{
+		Subject:       info.Subject,
+		Email:         info.Email,
+		Username:      info.PreferredUsername,
+		EmailVerified: info.EmailVerified == true || info.EmailVerified == "true",
+	}, nil
+}
+
+func decodeProviderResponse(resp *http.Response, err error, v interface{}) error {
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("provider returned " + resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// AccountIdentity links an account to an identity at an external provider.
+type AccountIdentity struct {
+	Provider string    `json:"provider"`
+	Subject  string    `json:"subject"`
+	Account  uuid.UUID `json:"account"`
+}
+
+// SchemaSQL returns the schema of the account identity entity.
+func (i AccountIdentity) SchemaSQL() string {
+	return `
+		CREATE TABLE account_identity (
+			provider character varying NOT NULL,
+			subject character varying NOT NULL,
+			account uuid NOT NULL
+				REFERENCES account(id) ON UPDATE CASCADE ON DELETE CASCADE,
+			PRIMARY KEY (provider, subject)
+		);
+
+		CREATE INDEX account_identity_account ON account_identity (account);
+	`
+}
+
+// Save inserts the account identity.
+func (i *AccountIdentity) Save(conn database.DB) error {
+	_, err := conn.Exec(`
+		INSERT INTO account_identity (provider, subject, account)
+		VALUES($1, $2, $3)
+	`, i.Provider, i.Subject, i.Account)
+
+	return errors.Wrap(err, "error saving account identity")
+}
+
+// LoadAccountByIdentity loads the account that is linked to an external
+// identity.
+func LoadAccountByIdentity(conn database.DB, provider, subject string) (*Account, error) {
+	return loadAccountByCondition(conn,
+		"id = (SELECT account FROM account_identity WHERE provider = $1 AND subject = $2)",
+		provider, subject)
+}
+
+// OAuthPages returns the pages of the login with external providers.
+//
+// The store keeps the state parameters of the pending authentications.
+func OAuthPages(store keyvalue.Store, m *session.Middleware, baseurl *server.BaseURL, providers map[string]OAuthProvider) []server.Route {
+	h := &oauthHandler{
+		store:             store,
+		sessionMiddleware: m,
+		baseurl:           baseurl,
+		providers:         providers,
+	}
+	txmw := database.NewTxMiddleware(true)
+
+	return []server.Route{
+		{Method: http.MethodGet, Path: "/auth/:provider/start", Handler: server.WrapF(h.start)},
+		{Method: http.MethodGet, Path: "/auth/:provider/callback", Handler: server.WrapF(h.callback, txmw)},
+	}
+}
+
+type oauthHandler struct {
+	store             keyvalue.Store
+	sessionMiddleware *session.Middleware
+	baseurl           *server.BaseURL
+	providers         map[string]OAuthProvider
+}
+
+func (h *oauthHandler) provider(r *http.Request) (string, OAuthProvider) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+	return name, h.providers[name]
+}
+
+func (h *oauthHandler) redirectURL(name string) string {
+	return h.baseurl.Path("auth", name, "callback")
+}
+
+func (h *oauthHandler) start(w http.ResponseWriter, r *http.Request) {
+	name, provider := h.provider(r)
+	if provider == nil {
+		respond.Error(w, r, http.StatusNotFound, "", nil, nil)
+		return
+	}
+
+	state := util.RandomHexString(32)
+	if err := h.store.SetExpiring(state, name+":"+*session.GetSid(r), oauthStateTTL); err != nil {
+		respond.Error(w, r, http.StatusInternalServerError, "failed to save state", nil, err)
+		return
+	}
+
+	respond.Redirect(w, r, provider.AuthCodeURL(h.redirectURL(name), state), http.StatusFound)
+}
+
+func (h *oauthHandler) callback(w http.ResponseWriter, r *http.Request) {
+	name, provider := h.provider(r)
+	if provider == nil {
+		respond.Error(w, r, http.StatusNotFound, "", nil, nil)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		respond.Error(w, r, http.StatusBadRequest, "missing state", nil, nil)
+		return
+	}
+	saved, err := h.store.Get(state)
+	if err == keyvalue.ErrNotFound {
+		respond.Error(w, r, http.StatusBadRequest, "invalid state", nil, nil)
+		return
+	}
+	if err != nil {
+		respond.Error(w, r, http.StatusInternalServerError, "failed to load state", nil, err)
+		return
+	}
+	if err = h.store.Delete(state); err != nil {
+		respond.Error(w, r, http.StatusInternalServerError, "failed to delete state", nil, err)
+		return
+	}
+	if saved != name+":"+*session.GetSid(r) {
+		respond.Error(w, r, http.StatusBadRequest, "invalid state", nil, nil)
+		return
+	}
+
+	identity, err := provider.Exchange(h.redirectURL(name), r.URL.Query().Get("code"))
+	if err != nil {
+		respond.Error(w, r, http.StatusBadGateway, "authentication failed", nil, err)
+		return
+	}
+
+	acc, status, err := h.account(r, name, identity)
+	if err != nil {
+		respond.Error(w, r, status, "failed to load account", nil, err)
+		return
+	}
+	if !acc.Active {
+		respond.Error(w, r, http.StatusForbidden, "User is inactive", nil, nil)
+		return
+	}
+
+	if err = h.sessionMiddleware.RegenerateSession(w, r, acc.ID); err != nil {
+		respond.Error(w, r, http.StatusInternalServerError, "failed to regenerate session", nil, err)
+		return
+	}
+
+	respond.Redirect(w, r, "/", http.StatusFound)
+}
+
+// account loads the account that is linked to the identity.
+//
+// If there is no such account, then the identity is linked to the current
+// account, or a new account is created when the user is not logged in. New
+// identities are only accepted with an email address that the provider has
+// verified.
+func (h *oauthHandler) account(r *http.Request, provider string, identity *OAuthIdentity) (*Account, int, error) {
+	conn := database.Get(r)
+
+	acc, err := LoadAccountByIdentity(conn, provider, identity.Subject)
+	if err == nil {
+		return acc, 0, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if !identity.EmailVerified {
+		return nil, http.StatusForbidden, errors.New("the provider did not verify the email address")
+	}
+
+	if sess := session.Get(r); sess.LoggedIn() {
+		if acc, err = LoadAccount(conn, sess.ID); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	} else {
+		if identity.Email == "" {
+			return nil, http.StatusBadRequest, errors.New("the provider did not return an email address")
+		}
+		if _, err = LoadAccountByEmail(conn, identity.Email); err != sql.ErrNoRows {
+			if err == nil {
+				return nil, http.StatusConflict, errors.New("email is already registered, log in to link the accounts")
+			}
+			return nil, http.StatusInternalServerError, err
+		}
+
+		var username string
+		if username, err = oauthUsername(conn, identity); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		acc = &Account{
+			Username: username,
+			Email:    identity.Email,
+			Active:   true,
+		}
+		acc.SetPassword(util.RandomHexString(32))
+		if err = acc.Save(conn); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	ai := &AccountIdentity{
+		Provider: provider,
+		Subject:  identity.Subject,
+		Account:  acc.ID,
+	}
+	if err = ai.Save(conn); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return acc, 0, nil
+}
+
+// oauthUsername finds a free username for the identity.
+func oauthUsername(conn database.DB, identity *OAuthIdentity) (string, error) {
+	username := identity.Username
+	if username == "" {
+		username = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+
+	candidate := username
+	for {
+		normalized := NormalizeAccountname(candidate)
+		if !IsAccountnameBlacklisted(normalized) {
+			_, err := loadAccountByCondition(conn, "normalized_username = $1", normalized)
+			if err == sql.ErrNoRows {
+				return candidate, nil
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+
+		candidate = username + "-" + util.RandomHexString(4)
+	}
+}
@@ -18,11 +18,13 @@ package account
 
 import (
 	"bytes"
+	"database/sql"
 	"net/http"
 	"text/template"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/tamasd/simplesite/apps/token"
@@ -34,27 +36,42 @@ import (
 	"github.com/tamasd/simplesite/respond"
 	"github.com/tamasd/simplesite/server"
 	"github.com/tamasd/simplesite/session"
+	"github.com/tamasd/simplesite/util"
 	"github.com/urfave/negroni"
 )
 
-const (
-	tokenCategoryRegistationVerification = "reg-verification"
-)
-
 var (
-	registrationPage = page.SubPage(`
+	tokenCategoryRegistationVerification = token.RegisterCategory("reg-verification")
+
+	registrationPage = page.NamedSubPage("account/registration", `
 {{define "body"}}
 <h1>Register</h1>
 <form method="POST">
 	{{.ErrorMessages}}
 	{{.CSRFToken}}
-	<p><label>Username: <br /><input type="textfield" name="Username" value="{{.Data.Username}}" /></label></p>
-	<p><label>Email: <br /><input type="email" name="Email" value="{{.Data.Email}}" /></label></p>
-	<p><label>Password: <br /><input type="password" name="Password" value="{{.Data.Password}}" /></label></p>
-	<p><label>Accept TOS: <input type="checkbox" name="AcceptTOS" value="true" {{if .Data.AcceptTOS}}checked="checked"{{end}} /></label></p>
+	<p class="field-username"><label>Username: <br /><input type="textfield" name="Username" value="{{.Data.Username}}" /></label>{{.FieldError "Username"}}</p>
+	<p class="field-email"><label>Email: <br /><input type="email" name="Email" value="{{.Data.Email}}" /></label>{{.FieldError "Email"}}</p>
+	<p class="field-password"><label>Password: <br /><input type="password" name="Password" value="{{.Data.Password}}" /></label>{{.FieldError "Password"}}</p>
+	<p class="field-confirmpassword"><label>Confirm Password: <br /><input type="password" name="ConfirmPassword" value="{{.Data.ConfirmPassword}}" /></label>{{.FieldError "ConfirmPassword"}}</p>
+	<p class="field-accepttos"><label>Accept <a href="{{url "/page/terms"}}" target="_blank" rel="noopener">TOS</a>: <input type="checkbox" name="AcceptTOS" value="true" {{.Checked "AcceptTOS" "true"}} /></label>{{.FieldError "AcceptTOS"}}</p>
+	{{.Captcha}}
 	<p><input type="submit" value="Register" /></p>
 </form>
 {{end}}
+`)
+
+	passwordChangePage = page.NamedSubPage("account/password", `
+{{define "body"}}
+<h1>Change password</h1>
+<form method="POST">
+	{{.ErrorMessages}}
+	{{.CSRFToken}}
+	<p class="field-currentpassword"><label>Current Password: <br /><input type="password" name="CurrentPassword" /></label>{{.FieldError "CurrentPassword"}}</p>
+	<p class="field-newpassword"><label>New Password: <br /><input type="password" name="NewPassword" /></label>{{.FieldError "NewPassword"}}</p>
+	<p class="field-confirmpassword"><label>Confirm Password: <br /><input type="password" name="ConfirmPassword" /></label>{{.FieldError "ConfirmPassword"}}</p>
+	<p><input type="submit" value="Change password" /></p>
+</form>
+{{end}}
 `)
 
 	registrationMail = template.Must(template.New("regmail").Parse(
@@ -65,7 +82,17 @@ var (
 			"{{.URL}}\r\n",
 	))
 
-	loginPage = page.SubPage(`
+	registrationCodeMail = template.Must(template.New("regcodemail").Parse(
+		"From: {{.From}}\r\n" +
+			"To: {{.To}}\r\n" +
+			"Subject: Registration validation\r\n" +
+			"\r\n" +
+			"Your verification code: {{.Code}}\r\n" +
+			"\r\n" +
+			"Enter it at {{.URL}}\r\n",
+	))
+
+	loginPage = page.NamedSubPage("account/login", `
 {{define "body"}}
 <h1>Login</h1>
 <form method="POST">
@@ -73,6 +100,7 @@ var (
 	{{.CSRFToken}}
 	<p><label>Username: <br /><input type="textfield" name="Username" value="{{.Data.Username}}" /></label></p>
 	<p><label>Password: <br /><input type="password" name="Password" value="{{.Data.Password}}" /></label></p>
+	<p><label>Remember me: <input type="checkbox" name="RememberMe" value="true" {{.Checked "RememberMe" "true"}} /></label></p>
 	<p><input type="submit" value="Log in" /></p>
 </form>
 {{end}}
@@ -80,35 +108,57 @@ var (
 )
 
 type registrationPageFormData struct {
-	Username  string
-	Email     string
-	Password  string
-	AcceptTOS bool
+	Username        string
+	Email           string
+	Password        string
+	ConfirmPassword string
+	AcceptTOS       bool
+}
+
+type passwordChangePageFormData struct {
+	CurrentPassword string
+	NewPassword     string
+	ConfirmPassword string
 }
 
 type registrationMailData struct {
 	From string
 	To   string
 	URL  string
+	Code string
 }
 
 type loginPageFormData struct {
-	Username string
-	Password string
+	Username   string
+	Password   string
+	RememberMe bool
 }
 
 // Pages returns the html pages for the Account entity.
-func Pages(store keyvalue.Store, m *session.Middleware, passwordValidator PasswordValidator, mailer mailer.Mailer, baseurl *server.BaseURL) []server.Route {
-	rf := NewRegistrationForm(passwordValidator, mailer, baseurl)
+//
+// The captcha is optional, if it is not nil, then the registration form will
+// require it. The email validator is optional too. The verification mode
+// selects how the new accounts are verified, see VerificationMode.
+func Pages(store keyvalue.Store, m *session.Middleware, passwordValidator PasswordValidator, emailValidator EmailValidator, mailer mailer.Mailer, captcha form.Captcha, verification VerificationMode) []server.Route {
+	rf := NewRegistrationForm(passwordValidator, emailValidator, mailer, captcha)
 	anonmw := session.MustBeAnonymousMiddleware()
 	txmw := database.NewTxMiddleware(true)
 
 	r := []server.Route{
 		LogoutPage(m),
-		{http.MethodGet, "/verify/:uuid/:token", server.WrapF(rf.Verify, anonmw, txmw)},
+		LogoutAllPage(m),
+	}
+	if verification == VerificationCode {
+		rf = NewCodeRegistrationForm(passwordValidator, emailValidator, mailer, captcha)
+		r = append(r, form.NewForm(store, "Verify", verificationCodePage, NewVerificationCodeForm(keyvalue.NewPrefixed(store, "verification-attempts:"))).
+			Pages("/verify/:uuid", anonmw, txmw)...)
+	} else {
+		r = append(r, server.Route{Method: http.MethodGet, Path: "/verify/:uuid/:token", Handler: server.WrapF(rf.Verify, anonmw, txmw)})
 	}
 	r = append(r, form.NewForm(store, "Register", registrationPage, rf).Pages("/register", anonmw, txmw)...)
 	r = append(r, form.NewForm(store, "Login", loginPage, NewLoginForm(m)).Pages("/login", anonmw, txmw)...)
+	r = append(r, form.NewForm(store, "Change password", passwordChangePage, NewPasswordChangeForm(m, passwordValidator)).
+		Pages("/account/password", session.MustBeLoggedInMiddleware(), txmw)...)
 
 	return r
 }
@@ -161,14 +211,121 @@ func (f *loginForm) Submit(w http.ResponseWriter, r *http.Request, v interface{}
 		return form.Error("Failed to regenerate session", nil)
 	}
 
+	if data.RememberMe {
+		f.sessionMiddleware.Remember(w, r, acc.ID)
+	}
+
+	return form.Redirect("")
+}
+
+// RememberCheck creates a check for session.Middleware.RememberCheck that only
+// lets existing, active accounts log in with a remember me token.
+func RememberCheck(conn database.DB) func(r *http.Request, id uuid.UUID) (bool, error) {
+	return func(r *http.Request, id uuid.UUID) (bool, error) {
+		acc, err := LoadAccount(database.WithContext(conn, r.Context()), id)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		return acc.Active, nil
+	}
+}
+
+// validateNewPassword validates a new password and its confirmation.
+//
+// The confirmation is checked before the password validator runs.
+func validateNewPassword(errs *form.ValidationErrors, validator PasswordValidator, field, password, confirm string) {
+	if password == "" {
+		errs.AddField(field, "Password is required")
+		return
+	}
+
+	if confirm != password {
+		errs.AddField("ConfirmPassword", "Passwords do not match")
+		return
+	}
+
+	comp, err := validator.Validate(password)
+	var ruleErr *PasswordRuleError
+	if errors.As(err, &ruleErr) {
+		errs.AddField(field, ruleErr.Message)
+	} else if err != nil {
+		errs.Add("Error validating password")
+	} else if comp {
+		errs.AddField(field, "This password is found in a previous data breach")
+	}
+}
+
+type passwordChangeForm struct {
+	AccessCheckLoader
+	sessionMiddleware *session.Middleware
+	passwordValidator PasswordValidator
+}
+
+// NewPasswordChangeForm creates the delegate for the password change form.
+func NewPasswordChangeForm(m *session.Middleware, passwordValidator PasswordValidator) form.Delegate {
+	return &passwordChangeForm{
+		sessionMiddleware: m,
+		passwordValidator: passwordValidator,
+	}
+}
+
+func (f *passwordChangeForm) LoadData(_ *http.Request) (interface{}, error) {
+	return &passwordChangePageFormData{}, nil
+}
+
+func (f *passwordChangeForm) ValidateFields(_ *http.Request, v interface{}) *form.ValidationErrors {
+	errs := &form.ValidationErrors{}
+	data := v.(*passwordChangePageFormData)
+	if data.CurrentPassword == "" {
+		errs.AddField("CurrentPassword", "Current password is required")
+	}
+	validateNewPassword(errs, f.passwordValidator, "NewPassword", data.NewPassword, data.ConfirmPassword)
+
+	return errs
+}
+
+// Submit changes the password.
+//
+// The remember me tokens of the account are revoked, and the CSRF token of
+// the session is rotated.
+func (f *passwordChangeForm) Submit(_ http.ResponseWriter, r *http.Request, v interface{}) form.FormSubmitResult {
+	conn := database.Get(r)
+	data := v.(*passwordChangePageFormData)
+
+	acc, err := LoadAccount(conn, session.Get(r).ID)
+	if err != nil {
+		return form.Error("Failed to load account", err)
+	}
+
+	if !acc.CheckPassword(data.CurrentPassword) {
+		return form.Error("Invalid password", nil)
+	}
+
+	acc.SetPassword(data.NewPassword)
+	if err = acc.Save(conn); err != nil {
+		return form.Error("Failed to save password", err)
+	}
+
+	if err = f.sessionMiddleware.InvalidateRememberTokens(acc.ID); err != nil {
+		return form.Error("Failed to revoke remember me tokens", err)
+	}
+
+	session.RotateCSRF(r)
+
 	return form.Redirect("")
 }
 
 type registrationForm struct {
 	AccessCheckLoader
 	passwordValidator PasswordValidator
+	emailValidator    EmailValidator
 	mailer            mailer.Mailer
-	baseurl           *server.BaseURL
+	captcha           form.Captcha
+	code              bool
 }
 
 // RegistrationFormDelegate expands the form.Delegate with a registration
@@ -179,43 +336,64 @@ type RegistrationFormDelegate interface {
 }
 
 // NewRegistrationForm creates the delegate for the registration form.
-func NewRegistrationForm(passwordValidator PasswordValidator, mailer mailer.Mailer, baseurl *server.BaseURL) RegistrationFormDelegate {
+//
+// The email validator is optional, the email addresses are not checked if it
+// is nil.
+//
+// The links of the verification emails are built with server.AbsoluteURL.
+func NewRegistrationForm(passwordValidator PasswordValidator, emailValidator EmailValidator, mailer mailer.Mailer, captcha form.Captcha) RegistrationFormDelegate {
 	return &registrationForm{
 		passwordValidator: passwordValidator,
+		emailValidator:    emailValidator,
 		mailer:            mailer,
-		baseurl:           baseurl,
+		captcha:           captcha,
 	}
 }
 
+// NewCodeRegistrationForm creates the delegate for the registration form, that
+// verifies the accounts with numeric codes instead of links.
+//
+// The users type the emailed code into the form of NewVerificationCodeForm.
+func NewCodeRegistrationForm(passwordValidator PasswordValidator, emailValidator EmailValidator, mailer mailer.Mailer, captcha form.Captcha) RegistrationFormDelegate {
+	return &registrationForm{
+		passwordValidator: passwordValidator,
+		emailValidator:    emailValidator,
+		mailer:            mailer,
+		captcha:           captcha,
+		code:              true,
+	}
+}
+
+func (f *registrationForm) Captcha() form.Captcha {
+	return f.captcha
+}
+
 func (f *registrationForm) LoadData(_ *http.Request) (interface{}, error) {
 	return &registrationPageFormData{}, nil
 }
 
-func (f *registrationForm) Validate(_ *http.Request, v interface{}) []string {
-	var errs []string
+func (f *registrationForm) ValidateFields(r *http.Request, v interface{}) *form.ValidationErrors {
+	errs := &form.ValidationErrors{}
 	data := v.(*registrationPageFormData)
 	if data.Username == "" {
-		errs = append(errs, "Username is required")
+		errs.AddField("Username", "Username is required")
 	} else if IsAccountnameBlacklisted(data.Username) {
-		errs = append(errs, "Username is blacklisted")
+		errs.AddField("Username", "Username is blacklisted")
 	}
 	if data.Email == "" {
-		errs = append(errs, "Email is required")
-	}
-	if data.Password == "" {
-		errs = append(errs, "Password is required")
-	} else {
-		comp, err := f.passwordValidator.Validate(data.Password)
+		errs.AddField("Email", "Email is required")
+	} else if f.emailValidator != nil {
+		valid, err := f.emailValidator.Validate(data.Email)
 		if err != nil {
-			errs = append(errs, "Error validating password")
-		} else {
-			if comp {
-				errs = append(errs, "This password is found in a previous data breach")
-			}
+			// DNS failures should not block the registration.
+			server.GetLogger(r).WithError(err).Warnln("failed to validate email")
+		} else if !valid {
+			errs.AddField("Email", "This email address can't receive mails")
 		}
 	}
+	validateNewPassword(errs, f.passwordValidator, "Password", data.Password, data.ConfirmPassword)
 	if !data.AcceptTOS {
-		errs = append(errs, "TOS must be accepted")
+		errs.AddField("AcceptTOS", "TOS must be accepted")
 	}
 
 	return errs
@@ -233,23 +411,51 @@ func (f *registrationForm) Submit(_ http.ResponseWriter, r *http.Request, v inte
 	a.SetPassword(data.Password)
 
 	if err := a.Save(conn); err != nil {
-		return form.Error("Account already exists", err)
+		switch errors.Cause(err) {
+		case ErrDuplicateUsername:
+			return form.FieldError("Username", "Username is already taken", err)
+		case ErrDuplicateEmail:
+			return form.FieldError("Email", "Email address is already registered", err)
+		}
+		return form.Error("Failed to create account", err)
 	}
+	server.AddLoggerField(r, "uid", a.ID.String())
+	logger = server.GetLogger(r)
 
 	tokenManager := token.NewTokenFromRequest(r)
+	mail := registrationMail
+	mailData := registrationMailData{
+		From: f.mailer.From(),
+		To:   a.Email,
+	}
+	redirect := ""
 
-	expires := time.Now().Add(24 * time.Hour)
-	t, err := tokenManager.Create(a.ID, tokenCategoryRegistationVerification, &expires)
-	if err != nil {
-		return form.Error("Failed to create account", err)
+	if f.code {
+		expires := util.Now().Add(verificationCodeTTL)
+		code, err := tokenManager.SetGenerator(token.NumericGenerator(verificationCodeLength)).
+			Create(a.ID, tokenCategoryRegistationVerification, &expires)
+		if err != nil {
+			return form.Error("Failed to create account", err)
+		}
+		mail = registrationCodeMail
+		mailData.Code = code
+		if mailData.URL, err = server.AbsoluteURL(r, "/verify/", a.ID.String()); err != nil {
+			return form.Error("Failed to create account", err)
+		}
+		redirect = "/verify/" + a.ID.String()
+	} else {
+		expires := util.Now().Add(24 * time.Hour)
+		t, err := tokenManager.Create(a.ID, tokenCategoryRegistationVerification, &expires)
+		if err != nil {
+			return form.Error("Failed to create account", err)
+		}
+		if mailData.URL, err = server.AbsoluteURL(r, "/verify/", a.ID.String(), t); err != nil {
+			return form.Error("Failed to create account", err)
+		}
 	}
 
 	buf := bytes.NewBuffer(nil)
-	if err = registrationMail.Execute(buf, registrationMailData{
-		From: f.mailer.From(),
-		To:   a.Email,
-		URL:  f.baseurl.Path("/verify/", a.ID.String(), t),
-	}); err != nil {
+	if err := mail.Execute(buf, mailData); err != nil {
 		return form.Error("Failed to create email", err)
 	}
 	body := buf.Bytes()
@@ -263,7 +469,7 @@ func (f *registrationForm) Submit(_ http.ResponseWriter, r *http.Request, v inte
 		return form.Error("Failed to send email", err)
 	}
 
-	return form.Redirect("")
+	return form.Redirect(redirect)
 }
 
 // Verify is the handler for the registration verification endpoint.
@@ -280,6 +486,7 @@ func (f *registrationForm) Verify(w http.ResponseWriter, r *http.Request) {
 		respond.Error(w, r, http.StatusNotFound, "", nil, nil)
 		return
 	}
+	r = server.WithLoggerFields(r, logrus.Fields{"uid": id.String()})
 
 	tokenManager := token.NewTokenFromRequest(r)
 
@@ -293,19 +500,24 @@ func (f *registrationForm) Verify(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err = activateAccount(conn, id); err != nil {
+		respond.Error(w, r, http.StatusInternalServerError, "account activation error", nil, err)
+		return
+	}
+
+	respond.Redirect(w, r, "/", http.StatusFound)
+}
+
+// activateAccount activates a verified account.
+func activateAccount(conn database.DB, id uuid.UUID) error {
 	acc, err := loadAccountByCondition(conn, "id = $1 AND active = $2", id, false)
 	if err != nil {
-		respond.Error(w, r, http.StatusInternalServerError, "account loading error", nil, err)
-		return
+		return err
 	}
 
 	acc.Active = true
-	if err = acc.Save(conn); err != nil {
-		respond.Error(w, r, http.StatusInternalServerError, "account saving error", nil, err)
-		return
-	}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	return acc.Save(conn)
 }
 
 // LogoutPage is the handler for the logout page.
@@ -315,13 +527,34 @@ func LogoutPage(m *session.Middleware, middlewares ...negroni.Handler) server.Ro
 		Path:   "/logout",
 		Handler: server.WrapF(func(w http.ResponseWriter, r *http.Request) {
 			m.DeleteSession(w, r)
-			http.Redirect(w, r, "/", http.StatusFound)
+			respond.Redirect(w, r, "/", http.StatusFound)
+		}, append([]negroni.Handler{session.MustBeLoggedInMiddleware(), session.CSRFTokenMiddleware()}, middlewares...)...),
+	}
+}
+
+// LogoutAllPage is the handler of the page that logs the account out of all
+// of its sessions.
+func LogoutAllPage(m *session.Middleware, middlewares ...negroni.Handler) server.Route {
+	return server.Route{
+		Method: http.MethodGet,
+		Path:   "/account/logout-all",
+		Handler: server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+			id := session.Get(r).ID
+			m.DeleteSession(w, r)
+			if err := m.DeleteAllSessions(id); err != nil {
+				respond.Error(w, r, http.StatusInternalServerError, "failed to delete sessions", nil, err)
+				return
+			}
+			respond.Redirect(w, r, "/", http.StatusFound)
 		}, append([]negroni.Handler{session.MustBeLoggedInMiddleware(), session.CSRFTokenMiddleware()}, middlewares...)...),
 	}
 }
 
 // PasswordValidator checks if a password is valid (strong enough, not
 // compromised) when users register or change password.
+//
+// Validate returns true if the password is compromised, and a
+// PasswordRuleError if it is too weak.
 type PasswordValidator interface {
 	Validate(pw string) (bool, error)
 }
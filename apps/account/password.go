@@ -18,7 +18,12 @@ package account
 
 import (
 	"crypto/rand"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/argon2"
 )
 
@@ -51,3 +56,112 @@ func CompareHashes(h0, h1 []byte) bool {
 
 	return result
 }
+
+// PasswordRuleError is returned by a PasswordValidator when the password breaks
+// a rule. The message is shown to the user.
+type PasswordRuleError struct {
+	Message string
+}
+
+func (e *PasswordRuleError) Error() string {
+	return e.Message
+}
+
+// PasswordValidators chains multiple password validators.
+//
+// The validators run in order, and the first failure is returned, so the
+// cheap local checks should come before the remote ones. A password is
+// compromised if any of the validators says so, and the chain stops at the
+// first error. Wrap a validator with FailOpen to let the chain continue after
+// its errors.
+type PasswordValidators []PasswordValidator
+
+// ChainValidator creates a validator that runs the given validators in order.
+//
+// See PasswordValidators.
+func ChainValidator(validators ...PasswordValidator) PasswordValidator {
+	return PasswordValidators(validators)
+}
+
+func (v PasswordValidators) Validate(pw string) (bool, error) {
+	for _, validator := range v {
+		if comp, err := validator.Validate(pw); comp || err != nil {
+			return comp, err
+		}
+	}
+
+	return false, nil
+}
+
+// FailOpen wraps a validator, so its errors don't block the registration.
+//
+// The errors are logged as warnings and the password is accepted. It is meant
+// for the validators that depend on a remote service (e.g. the breach check),
+// so an outage of the service doesn't take down the registration. Rule
+// violations (PasswordRuleError) are still returned.
+func FailOpen(validator PasswordValidator, logger logrus.FieldLogger) PasswordValidator {
+	return PasswordValidatorFunc(func(pw string) (bool, error) {
+		comp, err := validator.Validate(pw)
+		if err == nil {
+			return comp, nil
+		}
+
+		var ruleErr *PasswordRuleError
+		if errors.As(err, &ruleErr) {
+			return comp, err
+		}
+
+		logger.WithError(err).Warnln("password validation failed, accepting the password")
+
+		return false, nil
+	})
+}
+
+// MinPasswordLength creates a validator that rejects the passwords that are
+// shorter than the given number of characters.
+func MinPasswordLength(length int) PasswordValidator {
+	return PasswordValidatorFunc(func(pw string) (bool, error) {
+		if utf8.RuneCountInString(pw) < length {
+			return false, &PasswordRuleError{
+				Message: fmt.Sprintf("Password must be at least %d characters long", length),
+			}
+		}
+
+		return false, nil
+	})
+}
+
+// MinPasswordCharacterClasses creates a validator that rejects the passwords
+// that don't contain characters from the given number of character classes.
+//
+// The character classes are lowercase letters, uppercase letters, digits and
+// other characters.
+func MinPasswordCharacterClasses(classes int) PasswordValidator {
+	return PasswordValidatorFunc(func(pw string) (bool, error) {
+		if passwordCharacterClasses(pw) < classes {
+			return false, &PasswordRuleError{
+				Message: fmt.Sprintf("Password must contain at least %d of the following: lowercase letters, uppercase letters, digits, symbols", classes),
+			}
+		}
+
+		return false, nil
+	})
+}
+
+func passwordCharacterClasses(pw string) int {
+	var lower, upper, digit, other int
+	for _, c := range pw {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+
+	return lower + upper + digit + other
+}
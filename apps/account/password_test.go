@@ -0,0 +1,139 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package account_test
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/account"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+func requirePasswordRuleError(t *testing.T, err error, message string) {
+	var ruleErr *account.PasswordRuleError
+	require.True(t, errors.As(err, &ruleErr))
+	require.Equal(t, message, ruleErr.Message)
+}
+
+func TestPasswordValidators(t *testing.T) {
+	breached := ""
+	validator := account.PasswordValidators{
+		account.MinPasswordLength(8),
+		account.MinPasswordCharacterClasses(3),
+		account.PasswordValidatorFunc(func(pw string) (bool, error) {
+			breached = pw
+			return pw == "Passw0rd", nil
+		}),
+	}
+
+	comp, err := validator.Validate("abc")
+	require.False(t, comp)
+	requirePasswordRuleError(t, err, "Password must be at least 8 characters long")
+
+	comp, err = validator.Validate("abcdefghijk")
+	require.False(t, comp)
+	requirePasswordRuleError(t, err, "Password must contain at least 3 of the following: lowercase letters, uppercase letters, digits, symbols")
+	require.Equal(t, "", breached)
+
+	comp, err = validator.Validate("Passw0rd")
+	require.Nil(t, err)
+	require.True(t, comp)
+
+	comp, err = validator.Validate("c0rrect-h0rse")
+	require.Nil(t, err)
+	require.False(t, comp)
+	require.Equal(t, "c0rrect-h0rse", breached)
+}
+
+func TestMinPasswordLengthRunes(t *testing.T) {
+	comp, err := account.MinPasswordLength(4).Validate("árvíz")
+	require.False(t, comp)
+	require.Nil(t, err)
+}
+
+func TestPasswordValidatorFailOpen(t *testing.T) {
+	hibpErr := errors.New("hibp is down")
+	hibp := account.PasswordValidatorFunc(func(pw string) (bool, error) {
+		if pw == "breached" {
+			return true, nil
+		}
+		return false, hibpErr
+	})
+
+	// Fail closed.
+	validator := account.PasswordValidators{account.MinPasswordLength(8), hibp}
+	comp, err := validator.Validate("c0rrect-h0rse")
+	require.False(t, comp)
+	require.Equal(t, hibpErr, err)
+
+	// Fail open.
+	logger := testutil.TestLogger()
+	validator = account.PasswordValidators{account.MinPasswordLength(8), account.FailOpen(hibp, logger)}
+	comp, err = validator.Validate("c0rrect-h0rse")
+	require.False(t, comp)
+	require.Nil(t, err)
+	require.Contains(t, testutil.GetLog(logger), "hibp is down")
+
+	comp, err = validator.Validate("breached")
+	require.True(t, comp)
+	require.Nil(t, err)
+
+	comp, err = validator.Validate("abc")
+	require.False(t, comp)
+	requirePasswordRuleError(t, err, "Password must be at least 8 characters long")
+}
+
+func TestChainValidator(t *testing.T) {
+	var called []string
+	validator := func(name string, comp bool, err error) account.PasswordValidator {
+		return account.PasswordValidatorFunc(func(pw string) (bool, error) {
+			called = append(called, name)
+			return comp, err
+		})
+	}
+
+	comp, err := account.ChainValidator().Validate("pw")
+	require.False(t, comp)
+	require.Nil(t, err)
+
+	comp, err = account.ChainValidator(validator("a", false, nil), validator("b", false, nil)).Validate("pw")
+	require.False(t, comp)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b"}, called)
+
+	called = nil
+	comp, err = account.ChainValidator(validator("a", false, nil), validator("b", true, nil), validator("c", false, nil)).Validate("pw")
+	require.True(t, comp)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b"}, called)
+
+	called = nil
+	testErr := errors.New("test")
+	comp, err = account.ChainValidator(validator("a", false, testErr), validator("b", true, nil)).Validate("pw")
+	require.False(t, comp)
+	require.Equal(t, testErr, err)
+	require.Equal(t, []string{"a"}, called)
+
+	called = nil
+	logger := testutil.TestLogger()
+	comp, err = account.ChainValidator(account.FailOpen(validator("a", false, testErr), logger), validator("b", true, nil)).Validate("pw")
+	require.True(t, comp)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b"}, called)
+}
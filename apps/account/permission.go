@@ -18,7 +18,6 @@ package account
 
 import (
 	"net/http"
-	"strconv"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
@@ -164,15 +163,30 @@ func SavePermissions(conn database.DB, id uuid.UUID, p Permissions) error {
 		return nil
 	}
 
-	query := `INSERT INTO permission(id, permission) VALUES `
-	args := make([]interface{}, 1+len(p))
-	args[0] = id
+	rows := make([][]interface{}, len(p))
 	for i, perm := range p {
-		args[i+1] = perm
-		query += `($1, $` + strconv.Itoa(i+2) + `), `
+		rows[i] = []interface{}{id, perm}
 	}
 
-	_, err = conn.Exec(query[:len(query)-2], args...)
+	return database.BulkInsert(conn, "permission", []string{"id", "permission"}, rows)
+}
+
+// GrantPermission adds a single permission to an account.
+//
+// Granting a permission that the account already has is a no-op.
+func GrantPermission(conn database.DB, id uuid.UUID, perm string) error {
+	_, err := conn.Exec(`
+		INSERT INTO permission(id, permission) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, id, perm)
+	return err
+}
+
+// RevokePermission removes a single permission from an account.
+//
+// Revoking a permission that the account doesn't have is a no-op.
+func RevokePermission(conn database.DB, id uuid.UUID, perm string) error {
+	_, err := conn.Exec(`DELETE FROM permission WHERE id = $1 AND permission = $2`, id, perm)
 	return err
 }
 
@@ -208,6 +222,55 @@ func (m *permissionEnforcerMiddleware) ServeHTTP(w http.ResponseWriter, r *http.
 	next(w, r)
 }
 
+// OwnerFunc returns the id of the account that owns the entity of the request.
+type OwnerFunc func(r *http.Request) uuid.UUID
+
+// CanAccessOwned checks if an account can access an entity of a given owner.
+//
+// The account can access any entity with the anyPerm permission, and its own
+// entities with the ownPerm permission. Anonymous accounts can't access any
+// entity.
+func CanAccessOwned(uid, owner uuid.UUID, access page.AccessChecker, ownPerm, anyPerm string) bool {
+	if uuid.Equal(uid, uuid.Nil) {
+		return false
+	}
+
+	if access.Has(anyPerm) {
+		return true
+	}
+
+	return uuid.Equal(uid, owner) && access.Has(ownPerm)
+}
+
+type ownershipMiddleware struct {
+	owner   OwnerFunc
+	ownPerm string
+	anyPerm string
+}
+
+// OwnershipMiddleware is a middleware that makes sure that the current account
+// can access the entity of the request, either by owning it and having the
+// ownPerm permission, or by having the anyPerm permission.
+//
+// The owner func is called after the entity is loaded into the request
+// context, so this middleware must come after the entity loader middlewares.
+func OwnershipMiddleware(owner OwnerFunc, ownPerm, anyPerm string) negroni.Handler {
+	return &ownershipMiddleware{
+		owner:   owner,
+		ownPerm: ownPerm,
+		anyPerm: anyPerm,
+	}
+}
+
+func (m *ownershipMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !CanAccessOwned(session.Get(r).ID, m.owner(r), GetAccessChecker(r), m.ownPerm, m.anyPerm) {
+		RespondPermissionDenied(w, r, m.anyPerm)
+		return
+	}
+
+	next(w, r)
+}
+
 // RespondPermissionDenied responds with a permission denied page.
 func RespondPermissionDenied(w http.ResponseWriter, r *http.Request, permName string) {
 	respond.Error(w, r, http.StatusForbidden, "permission denied", logrus.Fields{
@@ -0,0 +1,153 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package account
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/tamasd/simplesite/apps/token"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/form"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/page"
+	"github.com/tamasd/simplesite/server"
+)
+
+// VerificationMode selects how the new accounts are verified.
+type VerificationMode string
+
+const (
+	// VerificationLink sends a link that verifies the account when it is
+	// opened. This is the default.
+	VerificationLink VerificationMode = "link"
+	// VerificationCode sends a numeric code that the user types into a form.
+	VerificationCode VerificationMode = "code"
+)
+
+// ParseVerificationMode parses a verification mode from the config. An empty
+// value selects VerificationLink.
+func ParseVerificationMode(value string) (VerificationMode, error) {
+	switch mode := VerificationMode(value); mode {
+	case "":
+		return VerificationLink, nil
+	case VerificationLink, VerificationCode:
+		return mode, nil
+	}
+
+	return "", errors.New("unknown verification mode: " + value)
+}
+
+const (
+	verificationCodeLength = 6
+	verificationCodeTTL    = time.Hour
+
+	// maxVerificationAttempts is the number of codes that can be tried for
+	// an account in a verificationLockout window.
+	maxVerificationAttempts = 5
+	verificationLockout     = 15 * time.Minute
+)
+
+var verificationCodePage = page.NamedSubPage("account/verification-code", `
+{{define "body"}}
+<h1>Verify your account</h1>
+<form method="POST">
+	{{.ErrorMessages}}
+	{{.CSRFToken}}
+	<p>Enter the code from the email that we sent you.</p>
+	<p class="field-code"><label>Code: <br /><input type="text" name="Code" inputmode="numeric" autocomplete="one-time-code" value="{{.Data.Code}}" /></label>{{.FieldError "Code"}}</p>
+	<p><input type="submit" value="Verify" /></p>
+</form>
+{{end}}
+`)
+
+type verificationCodePageFormData struct {
+	Code string
+}
+
+type verificationCodeForm struct {
+	AccessCheckLoader
+	attempts keyvalue.Store
+}
+
+// NewVerificationCodeForm creates the delegate for the form where the users
+// type in their registration verification codes.
+//
+// The form must be on a path with an :uuid parameter. Every account can try
+// a limited number of codes in a time window, the failed attempts are counted
+// in the store.
+func NewVerificationCodeForm(attempts keyvalue.Store) form.Delegate {
+	return &verificationCodeForm{
+		attempts: attempts,
+	}
+}
+
+func (f *verificationCodeForm) LoadData(_ *http.Request) (interface{}, error) {
+	return &verificationCodePageFormData{}, nil
+}
+
+func (f *verificationCodeForm) ValidateFields(_ *http.Request, v interface{}) *form.ValidationErrors {
+	errs := &form.ValidationErrors{}
+	data := v.(*verificationCodePageFormData)
+	data.Code = strings.TrimSpace(data.Code)
+	if data.Code == "" {
+		errs.AddField("Code", "Code is required")
+	}
+
+	return errs
+}
+
+func (f *verificationCodeForm) Submit(_ http.ResponseWriter, r *http.Request, v interface{}) form.FormSubmitResult {
+	data := v.(*verificationCodePageFormData)
+	conn := database.Get(r)
+
+	id, err := uuid.FromString(httprouter.ParamsFromContext(r.Context()).ByName("uuid"))
+	if err != nil {
+		return form.Error("Invalid code", err)
+	}
+	server.AddLoggerField(r, "uid", id.String())
+
+	attempts, err := f.attempts.Increment(id.String(), verificationLockout)
+	if err != nil {
+		return form.Error("Failed to verify code", err)
+	}
+	if attempts > maxVerificationAttempts {
+		return form.Error("Too many attempts, try again later", nil)
+	}
+
+	consumed, err := token.NewTokenFromRequest(r).Consume(id, tokenCategoryRegistationVerification, data.Code)
+	if err != nil {
+		return form.Error("Failed to verify code", err)
+	}
+	if !consumed {
+		return form.Error("Invalid code", nil)
+	}
+
+	if err = activateAccount(conn, id); err != nil {
+		return form.Error("Failed to activate account", err)
+	}
+
+	if err = f.attempts.Delete(id.String()); err != nil {
+		server.GetLogger(r).WithError(err).Warnln("failed to reset verification attempts")
+	}
+
+	return form.Redirect("")
+}
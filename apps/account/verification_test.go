@@ -0,0 +1,41 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package account_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/account"
+)
+
+func TestParseVerificationMode(t *testing.T) {
+	for value, expected := range map[string]account.VerificationMode{
+		"":     account.VerificationLink,
+		"link": account.VerificationLink,
+		"code": account.VerificationCode,
+	} {
+		mode, err := account.ParseVerificationMode(value)
+		require.NoError(t, err)
+		require.Equal(t, expected, mode)
+	}
+
+	for _, value := range []string{"Code", "email", " link"} {
+		_, err := account.ParseVerificationMode(value)
+		require.Error(t, err, value)
+	}
+}
@@ -0,0 +1,81 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package account
+
+import (
+	"database/sql"
+	"net/http"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/tamasd/simplesite/session"
+	"github.com/tamasd/simplesite/util"
+	"github.com/urfave/negroni"
+)
+
+const (
+	accountContextKey = "account"
+)
+
+// CurrentAccount returns the account of the current session.
+//
+// The account is loaded once per request, if the request went through
+// MustBeVerifiedMiddleware, the account loaded there is returned. Returns
+// sql.ErrNoRows for anonymous requests.
+func CurrentAccount(r *http.Request) (*Account, error) {
+	if acc, ok := r.Context().Value(accountContextKey).(*Account); ok {
+		return acc, nil
+	}
+
+	uid := session.Get(r).ID
+	if uuid.Equal(uid, uuid.Nil) {
+		return nil, sql.ErrNoRows
+	}
+
+	return LoadAccount(database.Get(r), uid)
+}
+
+type mustBeVerifiedMiddleware struct{}
+
+// MustBeVerifiedMiddleware only lets the request proceed if the account of the
+// session is verified (active).
+//
+// The loaded account is saved into the request context, so the handlers can
+// get it with CurrentAccount without loading it again.
+func MustBeVerifiedMiddleware() negroni.Handler {
+	return &mustBeVerifiedMiddleware{}
+}
+
+func (m *mustBeVerifiedMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	acc, err := CurrentAccount(r)
+	if err == sql.ErrNoRows {
+		respond.Error(w, r, http.StatusForbidden, "must be logged in", nil, nil)
+		return
+	}
+	if err != nil {
+		respond.Error(w, r, http.StatusInternalServerError, "failed to load account", nil, err)
+		return
+	}
+
+	if !acc.Active {
+		respond.Error(w, r, http.StatusForbidden, "account is not verified", nil, nil)
+		return
+	}
+
+	next(w, util.SetContext(r, accountContextKey, acc))
+}
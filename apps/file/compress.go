@@ -0,0 +1,125 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package file
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// AssetsPath is the directory of the files that are served under /assets.
+	AssetsPath = "./assets"
+
+	// DefaultCompressMinSize is the size in bytes under which the files are
+	// not worth compressing.
+	DefaultCompressMinSize = 1024
+)
+
+// CompressibleExtensions lists the extensions of the files that are
+// compressed by CompressAssets.
+var CompressibleExtensions = []string{
+	".css", ".html", ".js", ".json", ".map", ".svg", ".txt", ".xml",
+}
+
+// CompressAssets creates the gzipped version of the compressible files in a
+// directory, so AssetDir can serve them.
+//
+// Files smaller than minSize are skipped. The compressed files get the
+// modification time of the original, so the files that are up to date are
+// not compressed again.
+func CompressAssets(logger logrus.FieldLogger, dir string, minSize int64) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || info.Size() < minSize || !compressible(path) {
+			return nil
+		}
+
+		if gzinfo, err := os.Stat(path + ".gz"); err == nil && gzinfo.ModTime().Equal(info.ModTime()) {
+			return nil
+		}
+
+		logger.WithField("filepath", path).Infoln("compressing asset")
+
+		return compressFile(path, info)
+	})
+}
+
+func compressible(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range CompressibleExtensions {
+		if e == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressFile writes the gzipped version of a file next to it.
+//
+// The compressed data is written to a temporary file first, so the file
+// server never sees a partially written file.
+func compressFile(path string, info os.FileInfo) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open asset")
+	}
+	defer func() { _ = src.Close() }()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".gz-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create compressed asset")
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	gz, err := gzip.NewWriterLevel(tmp, gzip.BestCompression)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err = io.Copy(gz, src); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "failed to compress asset")
+	}
+	if err = gz.Close(); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "failed to compress asset")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write compressed asset")
+	}
+
+	if err = os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return errors.Wrap(err, "failed to write compressed asset")
+	}
+	if err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return errors.Wrap(err, "failed to write compressed asset")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), path+".gz"), "failed to write compressed asset")
+}
@@ -0,0 +1,91 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package file_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/file"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+func TestCompressAssets(t *testing.T) {
+	dir := t.TempDir()
+	logger := testutil.TestLogger()
+	css := bytes.Repeat([]byte("body { margin: 0; }\n"), 100)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "js"), 0755))
+	for name, content := range map[string][]byte{
+		"style.css":  css,
+		"js/app.js":  bytes.Repeat([]byte("console.log(1);\n"), 100),
+		"small.css":  []byte("a {}"),
+		"image.png":  bytes.Repeat([]byte{0}, 2048),
+		"README.txt": bytes.Repeat([]byte("x"), 2048),
+	} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), content, 0644))
+	}
+
+	require.Nil(t, file.CompressAssets(logger, dir, file.DefaultCompressMinSize))
+
+	for _, name := range []string{"style.css", "js/app.js", "README.txt"} {
+		require.FileExists(t, filepath.Join(dir, name+".gz"))
+	}
+	for _, name := range []string{"small.css", "image.png"} {
+		_, err := os.Stat(filepath.Join(dir, name+".gz"))
+		require.True(t, os.IsNotExist(err), name)
+	}
+
+	gzpath := filepath.Join(dir, "style.css.gz")
+	require.Equal(t, css, gunzip(t, gzpath))
+
+	// Up to date files are not compressed again.
+	info, err := os.Stat(filepath.Join(dir, "style.css"))
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(gzpath, []byte("unchanged"), 0644))
+	require.Nil(t, os.Chtimes(gzpath, info.ModTime(), info.ModTime()))
+	require.Nil(t, file.CompressAssets(logger, dir, file.DefaultCompressMinSize))
+	content, err := ioutil.ReadFile(gzpath)
+	require.Nil(t, err)
+	require.Equal(t, "unchanged", string(content))
+
+	// Modified files are compressed again.
+	css = bytes.Repeat([]byte("body { padding: 0; }\n"), 100)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "style.css"), css, 0644))
+	later := info.ModTime().Add(time.Second)
+	require.Nil(t, os.Chtimes(filepath.Join(dir, "style.css"), later, later))
+	require.Nil(t, file.CompressAssets(logger, dir, file.DefaultCompressMinSize))
+	require.Equal(t, css, gunzip(t, gzpath))
+}
+
+func gunzip(t *testing.T, path string) []byte {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	require.Nil(t, err)
+	content, err := ioutil.ReadAll(gz)
+	require.Nil(t, err)
+
+	return content
+}
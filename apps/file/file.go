@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"strings"
 
 	"github.com/lpar/gzipped"
 	"github.com/sirupsen/logrus"
@@ -29,20 +30,52 @@ import (
 // AssetDir returns a route for the assets/ directory.
 //
 // If there is a compressed version of a file available, it will be served
-// instead if the client supports it.
+// instead if the client supports it. See CompressAssets and AssetHandler.
 func AssetDir() server.Route {
 	return server.Route{
 		Method:  http.MethodGet,
 		Path:    "/assets/*filepath",
-		Handler: http.StripPrefix("/assets", gzipped.FileServer(http.Dir("./assets"))),
+		Handler: http.StripPrefix("/assets", AssetHandler(http.Dir(AssetsPath))),
 	}
 }
 
+// AssetHandler serves static files with their pre-compressed versions.
+//
+// The brotli (.br) version of a file is preferred if the client accepts it,
+// then the gzip (.gz) version, and the file itself otherwise.
+//
+// Directories are never listed: a directory path responds with 404, even if
+// the directory has an index file. The request path is cleaned before it is
+// resolved, so it can't point outside of the root.
+func AssetHandler(root http.FileSystem) http.Handler {
+	fs := gzipped.FileServer(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if strings.HasSuffix(r.URL.Path, "/") || isDir(root, path.Clean("/"+r.URL.Path)) {
+			http.NotFound(w, r)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
+
+func isDir(root http.FileSystem, name string) bool {
+	f, err := root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+
+	return err == nil && info.IsDir()
+}
+
 // MiscDir returns routes for the misc/ directory.
 //
 // This is a special directory where each file will be a route under /. The
-// point of this is create a simple solution for paths like favicon.ico or
-// robots.txt.
+// point of this is create a simple solution for paths like favicon.ico.
+// robots.txt is skipped, because RobotsTxt serves it as an override.
 func MiscDir(logger logrus.FieldLogger) []server.Route {
 	var routes []server.Route
 
@@ -53,6 +86,9 @@ func MiscDir(logger logrus.FieldLogger) []server.Route {
 	}
 
 	for _, fn := range files {
+		if fn.Name() == "robots.txt" {
+			continue
+		}
 		func(fn string) {
 			fp := path.Join("misc", fn)
 			logger.WithFields(logrus.Fields{
@@ -0,0 +1,113 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package file_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/file"
+)
+
+func TestAssetHandlerEncoding(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"style.css":    "identity",
+		"style.css.gz": "gzip",
+		"style.css.br": "brotli",
+		"app.js":       "identity",
+		"app.js.gz":    "gzip",
+	} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	handler := file.AssetHandler(http.Dir(dir))
+
+	for _, tc := range []struct {
+		path     string
+		accept   string
+		encoding string
+		body     string
+	}{
+		{"/style.css", "gzip, deflate, br", "br", "brotli"},
+		{"/style.css", "br;q=0, gzip", "gzip", "gzip"},
+		{"/style.css", "gzip", "gzip", "gzip"},
+		{"/style.css", "", "", "identity"},
+		{"/app.js", "br, gzip", "gzip", "gzip"},
+		{"/app.js", "br", "", "identity"},
+		{"/style.css?v=0123456789abcdef", "gzip", "gzip", "gzip"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept-Encoding", tc.accept)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+
+		require.Equal(t, http.StatusOK, rr.Code, tc.path+" "+tc.accept)
+		require.Equal(t, tc.encoding, rr.Header().Get("Content-Encoding"), tc.path+" "+tc.accept)
+		require.Equal(t, tc.body, rr.Body.String(), tc.path+" "+tc.accept)
+		require.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/style.css", nil)
+	r.Header.Set("Accept-Encoding", "br")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	require.Equal(t, "text/css; charset=utf-8", rr.Header().Get("Content-Type"))
+}
+
+func TestAssetHandlerTraversal(t *testing.T) {
+	dir := t.TempDir()
+	assets := filepath.Join(dir, "assets")
+	require.Nil(t, os.MkdirAll(filepath.Join(assets, "js"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(assets, "style.css"), []byte("body {}"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(assets, "js", "index.html"), []byte("index"), 0644))
+
+	handler := http.StripPrefix("/assets", file.AssetHandler(http.Dir(assets)))
+
+	for _, target := range []string{
+		"/assets/../secret.txt",
+		"/assets/%2e%2e/secret.txt",
+		"/assets/..%2fsecret.txt",
+		"/assets/%2e%2e%2fsecret.txt",
+		"/assets/js/../../secret.txt",
+		"/assets/js/%2e%2e/%2e%2e/secret.txt",
+		"/assets/..%5csecret.txt",
+		"/assets/",
+		"/assets/js",
+		"/assets/js/",
+		"/assets/js/..",
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusNotFound, rr.Code, target)
+		require.NotContains(t, rr.Body.String(), "secret", target)
+		require.NotContains(t, rr.Body.String(), "style.css", target)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/assets/js/../style.css", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "body {}", rr.Body.String())
+}
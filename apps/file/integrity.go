@@ -0,0 +1,81 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package file
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HashAssets computes the subresource integrity hashes of the files in a
+// directory.
+//
+// The keys of the result are the slash separated paths relative to dir, the
+// values are SHA-384 hashes in the format of the integrity attribute. The
+// pre-compressed versions and the hidden files are skipped. See
+// page.SetAssetIntegrity.
+func HashAssets(dir string) (map[string]string, error) {
+	hashes := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		if ext := filepath.Ext(path); ext == ".gz" || ext == ".br" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		hashes[filepath.ToSlash(rel)] = hash
+
+		return nil
+	})
+
+	return hashes, err
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open asset")
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha512.New384()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.Wrap(err, "failed to read asset")
+	}
+
+	return "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,78 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package file_test
+
+import (
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/file"
+	"github.com/tamasd/simplesite/page"
+)
+
+func TestAssetIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "js"), 0755))
+	for name, content := range map[string]string{
+		"style.css":    "body { margin: 0; }\n",
+		"style.css.gz": "gzip",
+		"js/app.js":    "console.log(1);\n",
+	} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(content), 0644))
+	}
+
+	hashes, err := file.HashAssets(dir)
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{
+		"style.css": "sha384-OOAocoe9URdSEbKSuC4UfBMdbWnyUwZrR5hgjomiMM3B/YKmdhn8l9D4QtETSrtx",
+		"js/app.js": "sha384-05ppHfj5uUjTrkhigMzhTN1E3gbaEYzbkhXj9PeB826jenLRpBDHbtzVoINFRCvL",
+	}, hashes)
+
+	page.SetAssetHashes(hashes)
+	defer page.SetAssetHashes(nil)
+	page.SetAssetIntegrity(true)
+	defer page.SetAssetIntegrity(false)
+
+	require.Equal(t, template.HTMLAttr(`href="/assets/style.css?v=38e0287287bd5117" integrity="sha384-OOAocoe9URdSEbKSuC4UfBMdbWnyUwZrR5hgjomiMM3B/YKmdhn8l9D4QtETSrtx" crossorigin="anonymous"`), page.Asset("style.css"))
+	require.Equal(t, template.HTMLAttr(`src="/assets/js/app.js?v=d39a691df8f9b948" integrity="sha384-05ppHfj5uUjTrkhigMzhTN1E3gbaEYzbkhXj9PeB826jenLRpBDHbtzVoINFRCvL" crossorigin="anonymous"`), page.Asset("js/app.js"))
+	require.Equal(t, template.HTMLAttr(`href="/assets/missing.css"`), page.Asset("missing.css"))
+}
+
+func TestAssetURL(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "style.css")
+	defer page.SetAssetHashes(nil)
+
+	version := func(content string) string {
+		require.Nil(t, ioutil.WriteFile(filename, []byte(content), 0644))
+		hashes, err := file.HashAssets(dir)
+		require.Nil(t, err)
+		page.SetAssetHashes(hashes)
+
+		return page.AssetURL("style.css")
+	}
+
+	require.Equal(t, "/assets/style.css?v=38e0287287bd5117", version("body { margin: 0; }\n"))
+	require.Equal(t, "/assets/style.css?v=38e0287287bd5117", version("body { margin: 0; }\n"))
+	require.NotEqual(t, "/assets/style.css?v=38e0287287bd5117", version("body { margin: 1em; }\n"))
+	require.Equal(t, template.HTMLAttr(`href="`+page.AssetURL("style.css")+`"`), page.Asset("style.css"))
+	require.Equal(t, "/assets/missing.css", page.AssetURL("missing.css"))
+}
@@ -0,0 +1,365 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package file
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/tamasd/simplesite/server"
+)
+
+const (
+	// MaxThumbnailSize is the largest width or height of a thumbnail.
+	MaxThumbnailSize = 1024
+	// MaxThumbnailSourcePixels is the largest image that is decoded for a
+	// thumbnail. This protects against images that are small files, but
+	// decompress to huge bitmaps.
+	MaxThumbnailSourcePixels = 40 * 1000 * 1000
+	// ThumbnailCacheTTL is the time the generated thumbnails are cached for.
+	ThumbnailCacheTTL = 7 * 24 * time.Hour
+
+	thumbnailJPEGQuality = 85
+)
+
+// FileStore gives access to the stored files.
+//
+// The methods return an error that satisfies os.IsNotExist if the file does
+// not exist.
+type FileStore interface {
+	// Open opens a stored file, and returns its content type.
+	Open(id string) (io.ReadCloser, string, error)
+	// Version returns a value that changes when the file is replaced, e.g.
+	// its modification time or the hash of its content.
+	Version(id string) (string, error)
+}
+
+// DirStore is a FileStore that serves the regular files of a directory. The
+// ids are the file names, subdirectories and hidden files are not served.
+type DirStore struct {
+	root string
+}
+
+// NewDirStore creates a FileStore for a directory.
+func NewDirStore(root string) *DirStore {
+	return &DirStore{
+		root: root,
+	}
+}
+
+func (s *DirStore) Open(id string) (io.ReadCloser, string, error) {
+	fn, err := s.path(id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(fn))
+	if contentType == "" {
+		buf := make([]byte, 512)
+		n, _ := io.ReadFull(f, buf)
+		contentType = http.DetectContentType(buf[:n])
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, "", err
+		}
+	}
+
+	return f, contentType, nil
+}
+
+func (s *DirStore) Version(id string) (string, error) {
+	fn, err := s.path(id)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(fn)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(info.Size(), 36), nil
+}
+
+// path returns the path of a regular file in the directory.
+func (s *DirStore) path(id string) (string, error) {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return "", os.ErrNotExist
+	}
+
+	fn := filepath.Join(s.root, id)
+	info, err := os.Stat(fn)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", os.ErrNotExist
+	}
+
+	return fn, nil
+}
+
+// ThumbnailPage returns the route that serves the thumbnails of the images in
+// a FileStore.
+//
+// The size of the thumbnail is set with the w and h query parameters. The
+// image is scaled down to fit into the size while keeping its aspect ratio,
+// and it is never scaled up. An omitted parameter defaults to
+// MaxThumbnailSize. The thumbnails are cached in the store by the version of
+// the file, so a replaced file gets a new thumbnail.
+func ThumbnailPage(files FileStore, cache keyvalue.Store) server.Route {
+	return server.Route{
+		Method:  http.MethodGet,
+		Path:    "/file/:id/thumb",
+		Handler: ThumbnailHandler(files, cache),
+	}
+}
+
+// ThumbnailHandler is the http handler of ThumbnailPage.
+func ThumbnailHandler(files FileStore, cache keyvalue.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+		width, err := thumbnailDimension(r, "w")
+		if err != nil {
+			respond.Error(w, r, http.StatusBadRequest, "invalid thumbnail width", nil, err)
+			return
+		}
+		height, err := thumbnailDimension(r, "h")
+		if err != nil {
+			respond.Error(w, r, http.StatusBadRequest, "invalid thumbnail height", nil, err)
+			return
+		}
+
+		version, err := files.Version(id)
+		if os.IsNotExist(errors.Cause(err)) {
+			respond.Error(w, r, http.StatusNotFound, "file not found", nil, err)
+			return
+		}
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to load file version", nil, err)
+			return
+		}
+
+		key := id + ":" + version + ":" + strconv.Itoa(width) + "x" + strconv.Itoa(height)
+		if cached, err := cache.Get(key); err == nil {
+			parts := strings.SplitN(cached, "\n", 2)
+			if len(parts) == 2 {
+				writeThumbnail(w, parts[0], []byte(parts[1]))
+				return
+			}
+		} else if err != keyvalue.ErrNotFound {
+			server.GetLogger(r).WithError(err).Warnln("failed to load cached thumbnail")
+		}
+
+		f, contentType, err := files.Open(id)
+		if os.IsNotExist(errors.Cause(err)) {
+			respond.Error(w, r, http.StatusNotFound, "file not found", nil, err)
+			return
+		}
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to open file", nil, err)
+			return
+		}
+		defer func() { _ = f.Close() }()
+
+		if !isThumbnailType(contentType) {
+			respond.Error(w, r, http.StatusUnsupportedMediaType, "file is not an image", nil, nil)
+			return
+		}
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to read file", nil, err)
+			return
+		}
+
+		contentType, thumb, err := Thumbnail(bytes.NewReader(data), width, height)
+		if err == ErrImageTooLarge {
+			respond.Error(w, r, http.StatusRequestEntityTooLarge, "image is too large", nil, err)
+			return
+		}
+		if err != nil {
+			respond.Error(w, r, http.StatusUnsupportedMediaType, "failed to decode image", nil, err)
+			return
+		}
+
+		if err = cache.SetExpiring(key, contentType+"\n"+string(thumb), ThumbnailCacheTTL); err != nil {
+			server.GetLogger(r).WithError(err).Warnln("failed to cache thumbnail")
+		}
+
+		writeThumbnail(w, contentType, thumb)
+	})
+}
+
+// ErrImageTooLarge is returned by Thumbnail when the source image is larger
+// than MaxThumbnailSourcePixels.
+var ErrImageTooLarge = errors.New("image is too large")
+
+// Thumbnail creates a thumbnail of an image that fits into width x height.
+//
+// A zero width or height means that the dimension is not limited. Returns
+// the content type and the encoded thumbnail. PNG and GIF images are encoded
+// as PNG, JPEG images as JPEG.
+func Thumbnail(src io.ReadSeeker, width, height int) (string, []byte, error) {
+	cfg, format, err := image.DecodeConfig(src)
+	if err != nil {
+		return "", nil, err
+	}
+	if cfg.Width*cfg.Height > MaxThumbnailSourcePixels {
+		return "", nil, ErrImageTooLarge
+	}
+
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return "", nil, err
+	}
+
+	thumb := resize(img, thumbnailSize(img.Bounds().Dx(), img.Bounds().Dy(), width, height))
+
+	buf := &bytes.Buffer{}
+	if format == "jpeg" {
+		err = jpeg.Encode(buf, thumb, &jpeg.Options{Quality: thumbnailJPEGQuality})
+		return "image/jpeg", buf.Bytes(), err
+	}
+
+	err = png.Encode(buf, thumb)
+	return "image/png", buf.Bytes(), err
+}
+
+// thumbnailSize calculates the size of the thumbnail of a w x h image.
+func thumbnailSize(w, h, maxWidth, maxHeight int) image.Point {
+	scale := 1.0
+	if maxWidth > 0 && w > maxWidth {
+		scale = float64(maxWidth) / float64(w)
+	}
+	if maxHeight > 0 && h > maxHeight && float64(maxHeight)/float64(h) < scale {
+		scale = float64(maxHeight) / float64(h)
+	}
+
+	size := image.Pt(int(float64(w)*scale+0.5), int(float64(h)*scale+0.5))
+	if size.X < 1 {
+		size.X = 1
+	}
+	if size.Y < 1 {
+		size.Y = 1
+	}
+
+	return size
+}
+
+// resize scales an image by averaging the source pixels that fall into each
+// pixel of the result.
+func resize(src image.Image, size image.Point) image.Image {
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+
+	for y := 0; y < size.Y; y++ {
+		y0 := b.Min.Y + y*b.Dy()/size.Y
+		y1 := b.Min.Y + (y+1)*b.Dy()/size.Y
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < size.X; x++ {
+			x0 := b.Min.X + x*b.Dx()/size.X
+			x1 := b.Min.X + (x+1)*b.Dx()/size.X
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
+
+func thumbnailDimension(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return MaxThumbnailSize, nil
+	}
+
+	d, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 1 || d > MaxThumbnailSize {
+		return 0, errors.Errorf("%s must be between 1 and %d", name, MaxThumbnailSize)
+	}
+
+	return d, nil
+}
+
+func isThumbnailType(contentType string) bool {
+	switch strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]) {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+
+	return false
+}
+
+func writeThumbnail(w http.ResponseWriter, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,192 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package file_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/file"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/tamasd/simplesite/server"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+type stubFile struct {
+	contentType string
+	data        []byte
+}
+
+type stubFileStore struct {
+	files    map[string]stubFile
+	versions map[string]int
+	opens    int
+}
+
+func (s *stubFileStore) Open(id string) (io.ReadCloser, string, error) {
+	f, ok := s.files[id]
+	if !ok {
+		return nil, "", os.ErrNotExist
+	}
+	s.opens++
+
+	return ioutil.NopCloser(bytes.NewReader(f.data)), f.contentType, nil
+}
+
+func (s *stubFileStore) Version(id string) (string, error) {
+	if _, ok := s.files[id]; !ok {
+		return "", os.ErrNotExist
+	}
+
+	return strconv.Itoa(s.versions[id]), nil
+}
+
+func testImage(t *testing.T, w, h int, encode func(io.Writer, image.Image) error) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, encode(buf, img))
+
+	return buf.Bytes()
+}
+
+func TestThumbnail(t *testing.T) {
+	store := &stubFileStore{files: map[string]stubFile{
+		"png": {"image/png", testImage(t, 400, 200, png.Encode)},
+		"jpg": {"image/jpeg", testImage(t, 300, 600, func(w io.Writer, img image.Image) error {
+			return jpeg.Encode(w, img, nil)
+		})},
+		"txt": {"text/plain; charset=utf-8", []byte("hello")},
+		"bad": {"image/png", []byte("not an image")},
+	}}
+
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Router().Add(file.ThumbnailPage(store, keyvalue.NewMemory()))
+	h := srv.CreateHTTPServer().Handler
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		return rr
+	}
+
+	for _, tc := range []struct {
+		target      string
+		contentType string
+		width       int
+		height      int
+	}{
+		{"/file/png/thumb?w=200", "image/png", 200, 100},
+		{"/file/png/thumb?h=50", "image/png", 100, 50},
+		{"/file/png/thumb?w=100&h=100", "image/png", 100, 50},
+		{"/file/png/thumb?w=1000", "image/png", 400, 200},
+		{"/file/jpg/thumb?w=150", "image/jpeg", 150, 300},
+	} {
+		rr := get(tc.target)
+		require.Equal(t, http.StatusOK, rr.Code, tc.target)
+		require.Equal(t, tc.contentType, rr.Header().Get("Content-Type"), tc.target)
+		cfg, _, err := image.DecodeConfig(rr.Body)
+		require.Nil(t, err, tc.target)
+		require.Equal(t, tc.width, cfg.Width, tc.target)
+		require.Equal(t, tc.height, cfg.Height, tc.target)
+	}
+
+	opens := store.opens
+	rr := get("/file/png/thumb?w=200")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, opens, store.opens)
+	img, err := png.Decode(rr.Body)
+	require.Nil(t, err)
+	require.Equal(t, image.Pt(200, 100), img.Bounds().Size())
+
+	// A replaced file gets a new thumbnail.
+	store.files["png"] = stubFile{"image/png", testImage(t, 100, 100, png.Encode)}
+	store.versions = map[string]int{"png": 1}
+	rr = get("/file/png/thumb?w=200")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, opens+1, store.opens)
+	img, err = png.Decode(rr.Body)
+	require.Nil(t, err)
+	require.Equal(t, image.Pt(100, 100), img.Bounds().Size())
+
+	require.Equal(t, http.StatusUnsupportedMediaType, get("/file/txt/thumb?w=200").Code)
+	require.Equal(t, http.StatusUnsupportedMediaType, get("/file/bad/thumb?w=200").Code)
+	require.Equal(t, http.StatusNotFound, get("/file/missing/thumb?w=200").Code)
+	require.Equal(t, http.StatusBadRequest, get("/file/png/thumb?w=0").Code)
+	require.Equal(t, http.StatusBadRequest, get("/file/png/thumb?w=5000").Code)
+	require.Equal(t, http.StatusBadRequest, get("/file/png/thumb?h=foo").Code)
+}
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirstore")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	fn := filepath.Join(dir, "image.png")
+	require.Nil(t, ioutil.WriteFile(fn, testImage(t, 400, 200, png.Encode), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".hidden.png"), testImage(t, 10, 10, png.Encode), 0644))
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Router().Add(file.ThumbnailPage(file.NewDirStore(dir), keyvalue.NewMemory()))
+	h := srv.CreateHTTPServer().Handler
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		return rr
+	}
+	size := func(rr *httptest.ResponseRecorder) image.Point {
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+		cfg, _, err := image.DecodeConfig(rr.Body)
+		require.Nil(t, err)
+		return image.Pt(cfg.Width, cfg.Height)
+	}
+
+	require.Equal(t, image.Pt(100, 50), size(get("/file/image.png/thumb?w=100")))
+
+	require.Nil(t, ioutil.WriteFile(fn, testImage(t, 100, 100, png.Encode), 0644))
+	modified := time.Now().Add(time.Hour)
+	require.Nil(t, os.Chtimes(fn, modified, modified))
+	require.Equal(t, image.Pt(100, 100), size(get("/file/image.png/thumb?w=100")))
+
+	for _, id := range []string{".hidden.png", "sub", "missing.png", "..%2Fimage.png"} {
+		require.Equal(t, http.StatusNotFound, get("/file/"+id+"/thumb").Code, id)
+	}
+}
@@ -0,0 +1,130 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tamasd/simplesite/server"
+)
+
+// RobotsDisallow lists the paths that crawlers are asked to stay away from
+// in the generated robots.txt.
+var RobotsDisallow = []string{
+	"/login",
+	"/register",
+	"/logout",
+	"/account/",
+}
+
+// RobotsTxt returns a route for /robots.txt.
+//
+// If the override file exists, it is served as is. Otherwise a robots.txt is
+// generated from RobotsDisallow. The sitemap line is only added when sitemap
+// is not empty.
+func RobotsTxt(override, sitemap string) server.Route {
+	generated := GenerateRobotsTxt(sitemap)
+	return server.Route{
+		Method: http.MethodGet,
+		Path:   "/robots.txt",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if override != "" {
+				if info, err := os.Stat(override); err == nil && !info.IsDir() {
+					http.ServeFile(w, r, override)
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write(generated)
+		}),
+	}
+}
+
+// GenerateRobotsTxt generates the default robots.txt.
+func GenerateRobotsTxt(sitemap string) []byte {
+	buf := bytes.NewBufferString("User-agent: *\n")
+	for _, p := range RobotsDisallow {
+		fmt.Fprintf(buf, "Disallow: %s\n", p)
+	}
+	if sitemap != "" {
+		fmt.Fprintf(buf, "\nSitemap: %s\n", sitemap)
+	}
+
+	return buf.Bytes()
+}
+
+// SecurityTxt holds the fields of a security.txt file (RFC 9116).
+type SecurityTxt struct {
+	Contact            []string
+	Expires            time.Time
+	Policy             string
+	PreferredLanguages string
+	Canonical          string
+}
+
+// Bytes renders the security.txt file.
+func (s SecurityTxt) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, c := range s.Contact {
+		fmt.Fprintf(buf, "Contact: %s\n", c)
+	}
+	fmt.Fprintf(buf, "Expires: %s\n", s.Expires.UTC().Format(time.RFC3339))
+	if s.Policy != "" {
+		fmt.Fprintf(buf, "Policy: %s\n", s.Policy)
+	}
+	if s.PreferredLanguages != "" {
+		fmt.Fprintf(buf, "Preferred-Languages: %s\n", s.PreferredLanguages)
+	}
+	if s.Canonical != "" {
+		fmt.Fprintf(buf, "Canonical: %s\n", s.Canonical)
+	}
+
+	return buf.Bytes()
+}
+
+// SecurityTxtPage returns a route for /.well-known/security.txt.
+func SecurityTxtPage(s SecurityTxt) server.Route {
+	content := s.Bytes()
+	return server.Route{
+		Method: http.MethodGet,
+		Path:   "/.well-known/security.txt",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write(content)
+		}),
+	}
+}
+
+// SplitContacts splits a space separated list of security contacts.
+//
+// Plain email addresses get the mailto: scheme.
+func SplitContacts(contacts string) []string {
+	var list []string
+	for _, c := range strings.Fields(contacts) {
+		if !strings.Contains(c, ":") && strings.Contains(c, "@") {
+			c = "mailto:" + c
+		}
+		list = append(list, c)
+	}
+
+	return list
+}
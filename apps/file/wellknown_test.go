@@ -0,0 +1,80 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package file_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/file"
+)
+
+func serveRoute(handler http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+	return w
+}
+
+func TestRobotsTxt(t *testing.T) {
+	override := filepath.Join(t.TempDir(), "robots.txt")
+
+	route := file.RobotsTxt(override, "https://example.com/sitemap.xml")
+	require.Equal(t, "/robots.txt", route.Path)
+
+	w := serveRoute(route.Handler, "/robots.txt")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	require.Contains(t, body, "User-agent: *\n")
+	require.Contains(t, body, "Disallow: /login\n")
+	require.Contains(t, body, "Disallow: /register\n")
+	require.Contains(t, body, "Disallow: /account/\n")
+	require.Contains(t, body, "Sitemap: https://example.com/sitemap.xml\n")
+
+	require.Nil(t, ioutil.WriteFile(override, []byte("User-agent: *\nDisallow: /\n"), 0644))
+	w = serveRoute(route.Handler, "/robots.txt")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "User-agent: *\nDisallow: /\n", w.Body.String())
+}
+
+func TestRobotsTxtWithoutSitemap(t *testing.T) {
+	require.NotContains(t, string(file.GenerateRobotsTxt("")), "Sitemap:")
+}
+
+func TestSecurityTxt(t *testing.T) {
+	route := file.SecurityTxtPage(file.SecurityTxt{
+		Contact:   file.SplitContacts("security@example.com https://example.com/security"),
+		Expires:   time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		Policy:    "https://example.com/policy",
+		Canonical: "https://example.com/.well-known/security.txt",
+	})
+	require.Equal(t, "/.well-known/security.txt", route.Path)
+
+	w := serveRoute(route.Handler, route.Path)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "Contact: mailto:security@example.com\n"+
+		"Contact: https://example.com/security\n"+
+		"Expires: 2030-01-02T03:04:05Z\n"+
+		"Policy: https://example.com/policy\n"+
+		"Canonical: https://example.com/.well-known/security.txt\n", w.Body.String())
+}
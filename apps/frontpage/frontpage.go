@@ -17,9 +17,15 @@
 package frontpage
 
 import (
+	"html/template"
 	"net/http"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/tamasd/simplesite/apps/account"
+	"github.com/tamasd/simplesite/apps/post"
+	"github.com/tamasd/simplesite/apps/staticpage"
+	"github.com/tamasd/simplesite/database"
 	"github.com/tamasd/simplesite/page"
 	"github.com/tamasd/simplesite/respond"
 	"github.com/tamasd/simplesite/server"
@@ -27,31 +33,127 @@ import (
 )
 
 var (
-	frontPage = page.SubPage(`
+	frontPage = page.NamedSubPage("frontpage", `
+{{define "secondary-menu-items"}}
+	{{if .CanEdit}}
+		<a class="edit" href="{{url "/frontpage/edit"}}">Edit front page</a>
+	{{end}}
+{{end}}
 {{define "body"}}
+{{template "secondary-menu" .}}
+{{if .Content}}
+	<section class="frontpage">{{.Content}}</section>
+{{end}}
+{{range .Posts}}
+	<article class="teaser">
+		<header><h2><a href="{{url "/p/"}}{{.Slug}}">{{.Title}}</a></h2></header>
+		<section class="teaser">{{.Teaser}}</section>
+		<footer><a class="more" href="{{url "/p/"}}{{.Slug}}">Read more</a></footer>
+	</article>
+{{else}}
+{{if .Content}}
+{{else if .Welcome}}
+<p>{{.Welcome}}</p>
+{{else}}
 <p>Lorem ipsum dolor sit amet, consectetur adipiscing elit. Nulla facilisis lacinia tortor, a pulvinar tellus consectetur at. In id quam sit amet neque condimentum congue et sagittis ante. Donec ut odio leo. Suspendisse massa quam, facilisis eu ultricies et, semper eu est. Curabitur auctor luctus sem, eu eleifend purus porta ultricies. Suspendisse egestas sollicitudin tortor semper molestie. Orci varius natoque penatibus et magnis dis parturient montes, nascetur ridiculus mus.</p>
 <p>Nunc feugiat nulla ut sapien tristique rutrum non non sapien. Nullam nec convallis ligula. Etiam non dui pulvinar, eleifend nulla a, volutpat lectus. Integer non cursus orci. Aenean iaculis ex non sapien fringilla interdum. Ut euismod et est id suscipit. Aenean lacinia bibendum sem iaculis congue. Duis sed turpis viverra, ornare ligula in, aliquet nibh. Cras sapien erat, semper placerat elementum quis, cursus nec lectus. Ut viverra, tortor quis maximus malesuada, arcu odio maximus erat, in malesuada mauris tellus quis eros.</p>
 <p>Donec non feugiat tortor. Orci varius natoque penatibus et magnis dis parturient montes, nascetur ridiculus mus. Mauris laoreet sed dolor vitae gravida. Vivamus quis sapien sed neque mollis iaculis. Nulla eu dolor vel neque facilisis rutrum a feugiat erat. Mauris vel volutpat nisl. In porta magna et purus consectetur maximus. Praesent mattis eleifend metus a rhoncus. Quisque mattis lacinia purus, sit amet ultrices ligula lacinia in. Duis feugiat vulputate sapien vitae aliquet. Quisque risus lacus, maximus a sagittis elementum, mollis molestie arcu. Nullam in metus et urna blandit imperdiet vel vel augue. Morbi ut cursus lacus. Fusce sit amet turpis purus. Proin sit amet ex nisi. Proin lacinia ipsum aliquet, laoreet nunc non, cursus lorem.</p>
 <p>Etiam augue nisl, volutpat non rhoncus sed, auctor vel risus. Vestibulum quis mi a libero fermentum pellentesque. Mauris aliquet mattis nulla vitae faucibus. Sed dignissim enim sit amet massa semper, eu tempor felis finibus. Maecenas suscipit vestibulum elit, vitae accumsan est semper eu. Integer feugiat eros ac velit posuere, sed sollicitudin quam tincidunt. Donec dui ipsum, pharetra ut lacus in, vestibulum tempus mi. Sed vehicula nec dolor at finibus. Vestibulum eget dolor hendrerit, dictum elit eu, laoreet dui. Donec diam erat, ornare in sagittis a, cursus sit amet nulla. Ut ut tristique lacus. Maecenas gravida erat sed orci convallis consequat. Nunc magna mi, maximus eu diam ut, accumsan cursus dolor. Donec eget purus sed ante iaculis rhoncus.</p>
 <p>In condimentum, leo id tempor condimentum, dolor urna ultricies est, eget vulputate justo ex non ligula. Sed aliquam ultricies condimentum. Sed iaculis mauris quis diam posuere rutrum. Vivamus quis tempor justo. Integer ac pellentesque risus, vel egestas nibh. Duis tempus et urna et facilisis. Proin volutpat in dolor eget ornare. Suspendisse ante dolor, malesuada ac cursus ut, tincidunt interdum mi. Nulla facilisi. In nulla diam, vestibulum lobortis sem quis, ornare tincidunt mi. Integer in efficitur lacus. Nunc vitae quam neque. Pellentesque habitant morbi tristique senectus et netus et malesuada fames ac turpis egestas. Nulla a ex non ante blandit varius. Phasellus finibus rutrum felis vitae suscipit. </p>
 {{end}}
+{{end}}
+{{end}}
 `)
 )
 
+const (
+	// DefaultPostCount is the number of posts listed on the front page.
+	DefaultPostCount = 5
+
+	teaserLength = 300
+)
+
 // Page returns the route for the front page.
-func Page() server.Route {
+//
+// The front page shows the content of the front page static page, and lists
+// the most recent posts. The welcome message is shown if there is neither
+// content nor posts.
+func Page(count int, welcome string) server.Route {
 	return server.Route{
 		Method:  http.MethodGet,
 		Path:    "/",
-		Handler: server.WrapF(Handler),
+		Handler: server.WrapF(Handler(count, welcome), database.NewReadOnlyTxMiddleware()),
 	}
 }
 
-type frontPageData struct{}
+type frontPageData struct {
+	Content template.HTML
+	Posts   []postTeaser
+	Welcome string
+	CanEdit bool
+}
+
+type postTeaser struct {
+	Title  string
+	Slug   string
+	Teaser string
+}
 
 // Handler is the http handler for the front page.
-func Handler(w http.ResponseWriter, r *http.Request) {
-	sess := session.Get(r)
-	logger := server.GetLogger(r)
-	respond.Page(logger, w, frontPage, "Welcome", sess, account.GetAccessChecker(r), frontPageData{})
+func Handler(count int, welcome string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := "Welcome"
+		var content template.HTML
+		sp, err := staticpage.LoadStaticPage(database.Get(r), staticpage.FrontPageSlug)
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error loading front page", nil, err)
+			return
+		}
+		if sp != nil {
+			content = sp.Filtered
+			if sp.Title != "" {
+				title = sp.Title
+			}
+		}
+
+		var teasers []postTeaser
+		if count > 0 {
+			records, err := post.ListPosts(database.Get(r), count, 0)
+			if err != nil {
+				respond.Error(w, r, http.StatusInternalServerError, "error listing posts", nil, err)
+				return
+			}
+			for _, rec := range records {
+				teasers = append(teasers, postTeaser{
+					Title:  rec.Post.Title,
+					Slug:   rec.Post.Slug,
+					Teaser: teaser(rec.Revision.Content),
+				})
+			}
+		}
+
+		sess := session.Get(r)
+		logger := server.GetLogger(r)
+		access := account.GetAccessChecker(r)
+		respond.Page(logger, w, r, frontPage, title, sess, access, frontPageData{
+			Content: content,
+			Posts:   teasers,
+			Welcome: welcome,
+			CanEdit: access.Has(staticpage.PermissionEditStaticPages),
+		})
+	}
+}
+
+// teaser shortens the content of a post to its first few words.
+func teaser(content string) string {
+	words := strings.Fields(content)
+	var length int
+	for i, word := range words {
+		length += utf8.RuneCountInString(word) + 1
+		if length > teaserLength {
+			return strings.Join(words[:i], " ") + "…"
+		}
+	}
+
+	return strings.Join(words, " ")
 }
@@ -0,0 +1,223 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/tamasd/simplesite/apps/account"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/page"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/tamasd/simplesite/server"
+	"github.com/tamasd/simplesite/session"
+)
+
+// apiPost is the JSON representation of a post.
+type apiPost struct {
+	ID       uuid.UUID     `json:"id"`
+	Title    string        `json:"title"`
+	Content  string        `json:"content"`
+	Filtered template.HTML `json:"filtered"`
+	Tags     []string      `json:"tags"`
+	Author   uuid.UUID     `json:"author"`
+	Views    int64         `json:"views"`
+	Created  time.Time     `json:"created"`
+	Updated  time.Time     `json:"updated"`
+}
+
+func newAPIPost(rec *PostRecord) apiPost {
+	tags := rec.Post.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return apiPost{
+		ID:       rec.Post.ID,
+		Title:    rec.Post.Title,
+		Content:  rec.Revision.Content,
+		Filtered: rec.Revision.Filtered,
+		Tags:     tags,
+		Author:   rec.Revision.Author,
+		Views:    rec.Post.Views,
+		Created:  rec.Post.Created,
+		Updated:  rec.Post.Updated,
+	}
+}
+
+// apiPostInput is the request body of the create and update endpoints.
+type apiPostInput struct {
+	Title   string   `json:"title"`
+	Content string   `json:"content"`
+	Tags    []string `json:"tags"`
+}
+
+// API returns the JSON API endpoints of the posts.
+//
+// The endpoints are authenticated with API tokens.
+func API(filter func(string) string) []server.Route {
+	h := &apiHandler{filter: filter}
+	tokenmw := account.APITokenMiddleware()
+	txmw := database.NewTxMiddleware(true)
+
+	return []server.Route{
+		{Method: http.MethodGet, Path: "/api/posts", Handler: server.WrapF(h.list, tokenmw)},
+		{Method: http.MethodPost, Path: "/api/posts", Handler: server.WrapF(h.create, tokenmw, txmw)},
+		{Method: http.MethodGet, Path: "/api/post/:id", Handler: server.WrapF(h.get, tokenmw)},
+		{Method: http.MethodPut, Path: "/api/post/:id", Handler: server.WrapF(h.update, tokenmw, txmw)},
+	}
+}
+
+type apiHandler struct {
+	filter func(string) string
+}
+
+func (h *apiHandler) list(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	conn := database.Get(r)
+	total, err := CountPosts(conn)
+	if err != nil {
+		respond.JSONError(w, r, http.StatusInternalServerError, "error counting posts", nil, err)
+		return
+	}
+
+	records, err := ListPosts(conn, PageSize, offset)
+	if err != nil {
+		respond.JSONError(w, r, http.StatusInternalServerError, "error listing posts", nil, err)
+		return
+	}
+
+	posts := make([]apiPost, len(records))
+	for i, rec := range records {
+		posts[i] = newAPIPost(rec)
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	respond.JSON(server.GetLogger(r), w, posts, http.StatusOK)
+}
+
+func (h *apiHandler) get(w http.ResponseWriter, r *http.Request) {
+	rec, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+
+	respond.JSON(server.GetLogger(r), w, newAPIPost(rec), http.StatusOK)
+}
+
+func (h *apiHandler) create(w http.ResponseWriter, r *http.Request) {
+	if !account.GetAccessChecker(r).Has(PermissionCreatePost) {
+		respond.JSONError(w, r, http.StatusForbidden, "permission denied", nil, nil)
+		return
+	}
+
+	h.save(w, r, &PostRecord{
+		Post:     &Post{},
+		Revision: &PostRevision{},
+	}, http.StatusCreated)
+}
+
+func (h *apiHandler) update(w http.ResponseWriter, r *http.Request) {
+	rec, ok := h.load(w, r)
+	if !ok {
+		return
+	}
+
+	if !canEdit(session.Get(r).ID, rec.Revision.Author, account.GetAccessChecker(r)) {
+		respond.JSONError(w, r, http.StatusForbidden, "permission denied", nil, nil)
+		return
+	}
+
+	h.save(w, r, rec, http.StatusOK)
+}
+
+func (h *apiHandler) load(w http.ResponseWriter, r *http.Request) (*PostRecord, bool) {
+	entity, err := LoadEntity(r)
+	if page.IsInvalidParam(err) {
+		respond.JSONError(w, r, http.StatusNotFound, "post not found", nil, err)
+		return nil, false
+	}
+	if err != nil {
+		respond.JSONError(w, r, http.StatusInternalServerError, "failed to load post", nil, err)
+		return nil, false
+	}
+	if entity == nil || !canSee(r, entity.(*PostRecord)) {
+		respond.JSONError(w, r, http.StatusNotFound, "post not found", nil, nil)
+		return nil, false
+	}
+
+	return entity.(*PostRecord), true
+}
+
+func (h *apiHandler) save(w http.ResponseWriter, r *http.Request, rec *PostRecord, code int) {
+	input := apiPostInput{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		respond.JSONError(w, r, http.StatusBadRequest, "invalid request body", nil, err)
+		return
+	}
+
+	if strings.TrimSpace(input.Title) == "" {
+		respond.JSONError(w, r, http.StatusUnprocessableEntity, "Title is required", nil, nil)
+		return
+	}
+
+	rec.Post.Title = input.Title
+	rec.Post.Tags = ParseTags(strings.Join(input.Tags, ","))
+	rec.Revision.Content = applyFrontMatter(server.GetLogger(r), rec.Post, input.Content)
+	rec.Revision.Filtered = template.HTML(h.filter(rec.Revision.Content))
+	rec.Revision.Author = session.Get(r).ID
+
+	conn := database.Get(r)
+	if rec.Post.Slug != "" {
+		taken, err := slugTaken(conn, rec.Post.Slug, rec.Post.ID)
+		if err != nil {
+			respond.JSONError(w, r, http.StatusInternalServerError, "cannot save post", nil, err)
+			return
+		}
+		if taken {
+			respond.JSONError(w, r, http.StatusConflict, ErrDuplicateSlug.Error(), nil, nil)
+			return
+		}
+	}
+	if err := rec.Save(conn); err != nil {
+		if err == ErrDuplicateSlug {
+			respond.JSONError(w, r, http.StatusConflict, err.Error(), nil, err)
+			return
+		}
+		respond.JSONError(w, r, http.StatusInternalServerError, "cannot save post", nil, err)
+		return
+	}
+
+	// Reload the post to get the timestamps and the normalized fields.
+	recs, err := listPostsByCondition(conn, 1, 0, "p.id = $1", rec.Post.ID)
+	if err != nil || len(recs) == 0 {
+		respond.JSONError(w, r, http.StatusInternalServerError, "cannot load post", nil, err)
+		return
+	}
+
+	respond.JSON(server.GetLogger(r), w, newAPIPost(recs[0]), code)
+}
@@ -0,0 +1,159 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"html/template"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/tamasd/simplesite/database"
+)
+
+// Comment represents a comment on a post.
+type Comment struct {
+	ID       uuid.UUID     `json:"id"`
+	Post     uuid.UUID     `json:"post"`
+	Parent   uuid.UUID     `json:"parent"`
+	Author   uuid.UUID     `json:"author"`
+	Content  string        `json:"content"`
+	Filtered template.HTML `json:"filtered"`
+	Created  time.Time     `json:"created"`
+}
+
+// SchemaSQL returns the schema of the comment entity.
+func (c Comment) SchemaSQL() string {
+	return `
+		CREATE TABLE comment (
+			id uuid NOT NULL,
+			post uuid NOT NULL
+				REFERENCES post(id) ON UPDATE CASCADE ON DELETE CASCADE,
+			parent uuid
+				REFERENCES comment(id) ON UPDATE CASCADE ON DELETE CASCADE,
+			author uuid NOT NULL
+				REFERENCES account(id) ON UPDATE CASCADE ON DELETE CASCADE,
+			content text NOT NULL,
+			filtered text NOT NULL,
+			created timestamp with time zone NOT NULL DEFAULT now(),
+			PRIMARY KEY (id)
+		);
+
+		CREATE INDEX comment_post_created ON comment (post, created);
+	`
+}
+
+// Save inserts a new comment.
+func (c *Comment) Save(conn database.DB) error {
+	c.ID = uuid.NewV4()
+
+	var parent interface{}
+	if !uuid.Equal(c.Parent, uuid.Nil) {
+		parent = c.Parent
+	}
+
+	err := conn.QueryRow(`
+		INSERT INTO comment (id, post, parent, author, content, filtered)
+		VALUES($1, $2, $3, $4, $5, $6)
+		RETURNING created
+	`,
+		c.ID,
+		c.Post,
+		parent,
+		c.Author,
+		c.Content,
+		c.Filtered,
+	).Scan(&c.Created)
+
+	return errors.Wrap(err, "error saving comment")
+}
+
+// Delete removes a comment with its replies.
+func (c *Comment) Delete(conn database.DB) error {
+	_, err := conn.Exec(`DELETE FROM comment WHERE id = $1`, c.ID)
+	return errors.Wrap(err, "error deleting comment")
+}
+
+// CommentRecord represents a comment with the name of its author.
+type CommentRecord struct {
+	*Comment
+	AuthorName string
+}
+
+func listCommentsByCondition(conn database.DB, condition string, args ...interface{}) ([]*CommentRecord, error) {
+	var records []*CommentRecord
+
+	if condition != "" {
+		condition = `WHERE ` + condition
+	}
+	rows, err := conn.Query(`
+		SELECT c.id, c.post, c.parent, c.author, c.content, c.filtered, c.created, a.username
+		FROM comment c JOIN account a ON c.author = a.id
+		`+condition+`
+		ORDER BY c.created ASC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		c := &Comment{}
+		rec := &CommentRecord{Comment: c}
+		var parent uuid.NullUUID
+		if err = rows.Scan(
+			&c.ID,
+			&c.Post,
+			&parent,
+			&c.Author,
+			&c.Content,
+			&c.Filtered,
+			&c.Created,
+			&rec.AuthorName,
+		); err != nil {
+			return nil, err
+		}
+		if parent.Valid {
+			c.Parent = parent.UUID
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, rows.Err()
+}
+
+// ListComments lists the comments of a post in chronological order.
+func ListComments(conn database.DB, pid uuid.UUID) ([]*CommentRecord, error) {
+	return listCommentsByCondition(conn, "c.post = $1", pid)
+}
+
+// LoadComment loads a comment of a post.
+//
+// Returns nil if the comment is not found.
+func LoadComment(conn database.DB, pid, id uuid.UUID) (*CommentRecord, error) {
+	recs, err := listCommentsByCondition(conn, "c.post = $1 AND c.id = $2", pid, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recs) == 0 {
+		return nil, nil
+	}
+
+	return recs[0], nil
+}
@@ -0,0 +1,147 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/account"
+	"github.com/tamasd/simplesite/apps/post"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+// baselinePostSchema is the post table before the slug, scheduling, view
+// counter and trash columns.
+const baselinePostSchema = `
+	CREATE TABLE post (
+		id uuid NOT NULL,
+		revision uuid,
+		title character varying NOT NULL,
+		created timestamp with time zone NOT NULL DEFAULT now(),
+		updated timestamp with time zone NOT NULL,
+		PRIMARY KEY (id)
+	);
+
+	CREATE UNIQUE INDEX post_revision_unique ON post (revision)
+		WHERE revision IS NOT NULL;
+`
+
+// setupBaselinePostTable connects to a new database on the server of TEST_DB,
+// and creates the baseline post table in it.
+//
+// The test is skipped if TEST_DB is not set.
+func setupBaselinePostTable(t *testing.T) (database.DB, func()) {
+	dburl := os.Getenv("TEST_DB")
+	if dburl == "" {
+		t.Skip("TEST_DB is not set")
+	}
+
+	testdb, cleanup := testutil.SetupTestDatabase(dburl)
+	conn, err := database.Connect(testdb)
+	require.Nil(t, err)
+	_, err = conn.Exec(baselinePostSchema)
+	require.Nil(t, err)
+
+	return conn, cleanup
+}
+
+func insertBaselinePost(t *testing.T, conn database.DB, id uuid.UUID, title string, created time.Time) {
+	_, err := conn.Exec(`
+		INSERT INTO post (id, title, created, updated) VALUES ($1, $2, $3, $3)
+	`, id, title, created)
+	require.Nil(t, err)
+}
+
+func TestPostSlugMigration(t *testing.T) {
+	conn, cleanup := setupBaselinePostTable(t)
+	defer cleanup()
+
+	first := uuid.FromStringOrNil("aaaaaaaa-0000-4000-8000-000000000001")
+	second := uuid.FromStringOrNil("aaaaaaaa-0000-4000-8000-000000000002")
+	untitled := uuid.FromStringOrNil("bbbbbbbb-0000-4000-8000-000000000003")
+	now := time.Now()
+	insertBaselinePost(t, conn, first, "Hello World", now.Add(-2*time.Hour))
+	insertBaselinePost(t, conn, second, "Hello, world!", now.Add(-time.Hour))
+	insertBaselinePost(t, conn, untitled, "!!!", now)
+
+	logger := testutil.TestLogger()
+	require.Nil(t, database.Ensure(logger, conn, post.Post{}))
+
+	slugs := map[uuid.UUID]string{}
+	for _, id := range []uuid.UUID{first, second, untitled} {
+		var slug string
+		require.Nil(t, conn.QueryRow(`SELECT slug FROM post WHERE id = $1`, id).Scan(&slug))
+		slugs[id] = slug
+	}
+	require.Equal(t, post.GenerateSlug(first, "Hello World"), slugs[first])
+	require.Equal(t, post.GenerateSlug(second, "Hello, world!")+"-2", slugs[second])
+	require.Equal(t, post.GenerateSlug(untitled, "!!!"), slugs[untitled])
+
+	_, err := conn.Exec(`INSERT INTO post (id, title, updated) VALUES ($1, 'no slug', now())`, uuid.NewV4())
+	require.NotNil(t, err)
+	_, err = conn.Exec(`UPDATE post SET slug = $1 WHERE id = $2`, slugs[first], second)
+	require.NotNil(t, err)
+
+	require.Nil(t, database.Ensure(logger, conn, post.Post{}))
+}
+
+func TestPostMigration(t *testing.T) {
+	conn, cleanup := setupBaselinePostTable(t)
+	defer cleanup()
+
+	id := uuid.NewV4()
+	insertBaselinePost(t, conn, id, "Before the upgrade", time.Now())
+
+	logger := testutil.TestLogger()
+	for _, e := range []database.DatabaseEntity{account.Account{}, post.Post{}, post.PostRevision{}, post.PostTag{}} {
+		require.Nil(t, database.Ensure(logger, conn, e))
+	}
+
+	drift, err := database.CheckSchema(conn, post.Post{})
+	require.Nil(t, err)
+	require.False(t, drift.Drifted(), drift.String())
+
+	for _, index := range []string{"post_slug_unique", "post_scheduled", "post_revision_author", "post_revision_post_created"} {
+		var exists bool
+		require.Nil(t, conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_indexes WHERE indexname = $1)`, index).Scan(&exists))
+		require.True(t, exists, index)
+	}
+
+	var views int64
+	var deleted, scheduled bool
+	require.Nil(t, conn.QueryRow(`
+		SELECT views, deleted_at IS NOT NULL, scheduled IS NOT NULL OR publish_at IS NOT NULL FROM post WHERE id = $1
+	`, id).Scan(&views, &deleted, &scheduled))
+	require.Zero(t, views)
+	require.False(t, deleted)
+	require.False(t, scheduled)
+
+	_, err = post.ListPosts(conn, post.PageSize, 0)
+	require.Nil(t, err)
+	_, err = post.ListDeletedPosts(conn, post.PageSize, 0)
+	require.Nil(t, err)
+	_, err = post.PublishScheduled(conn)
+	require.Nil(t, err)
+	p := &post.Post{ID: id}
+	require.Nil(t, p.IncrementViews(conn))
+	require.Equal(t, int64(1), p.Views)
+}
@@ -20,13 +20,19 @@ import (
 	"bytes"
 	"html"
 	"html/template"
+	"mime"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/sirupsen/logrus"
 	"github.com/tamasd/simplesite/apps/account"
 	"github.com/tamasd/simplesite/database"
 	"github.com/tamasd/simplesite/form"
@@ -46,10 +52,29 @@ const (
 	PermissionEditOwnPost = "edit-own-post"
 	// PermissionEditAnyPost is the permission for editing any posts.
 	PermissionEditAnyPost = "edit-any-post"
+	// PermissionModerateComments is the permission for deleting any comments.
+	PermissionModerateComments = "moderate-comments"
+	// PermissionManageTrash is the permission for accessing, restoring and
+	// permanently deleting the deleted posts.
+	PermissionManageTrash = "manage-trash"
 
 	// PageSize is the default page size for post listing pages.
 	PageSize = 15
 
+	// MaxPageSize is the largest allowed page size for post listing pages.
+	MaxPageSize = 100
+
+	// RevisionsPageSize is the default page size of the revisions page.
+	RevisionsPageSize = 20
+
+	// RelatedPostsCount is the maximum number of related posts on the post
+	// page.
+	RelatedPostsCount = 5
+
+	// ViewWindow is the time window in which repeated views of a post from
+	// the same session are counted once.
+	ViewWindow = 30 * time.Minute
+
 	postContextKey = "post"
 )
 
@@ -59,24 +84,47 @@ var (
 	postWidget = `
 {{define "post"}}
 	<article class="post">
-		<header><h2>{{.Post.Title}}</h2></header>
+		<header><h2><a href="{{url "/post/"}}{{.Post.ID}}">{{.Post.Title}}</a></h2></header>
 		<section class="post">
 			{{.Revision.Filtered}}
 		</section>
 		<footer>
+		{{if .Post.Tags}}
+			<ul class="tags">
+			{{range .Post.Tags}}
+				<li class="tag"><a href="{{url "/posts/tag/"}}{{.}}">{{.}}</a></li>
+			{{end}}
+			</ul>
+		{{end}}
+		<span class="views">{{.Post.Views}} views</span>
 		{{if .CanEdit}}
-			<a class="edit" href="/post/{{.Post.ID}}/edit">Edit</a>	|
-			<a class="revisions" href="/post/{{.Post.ID}}/revisions">Revisions</a>
+			{{if not .Post.Published}}| <span class="unpublished">Unpublished</span>{{end}}
+			|
+			<span class="revision-count">{{.Post.RevisionCount}} revisions</span>,
+			<span class="last-edited">last edited <time datetime="{{.Post.LastEdited.Format "2006-01-02T15:04:05Z07:00"}}">{{.Post.LastEdited.Format "2006-01-02 15:04"}}</time></span>
+			|
+			<a class="edit" href="{{url "/post/"}}{{.Post.ID}}/edit">Edit</a>	|
+			<a class="revisions" href="{{url "/post/"}}{{.Post.ID}}/revisions">Revisions</a>
+			{{if not .Post.Deleted}}
+			|
+			<a class="delete" href="{{url "/post/"}}{{.Post.ID}}/delete?token={{.CSRFToken}}">Delete</a>
+			{{end}}
 		{{end}}
 		</footer>
 	</article>
 {{end}}
 `
 
-	listingPage = page.SubPage(`
+	listingPage = page.NamedSubPage("post/listing", `
 {{define "secondary-menu-items"}}
 	{{if .CanCreate}}
-		<a href="/posts/create">Create post</a>
+		<a href="{{url "/posts/create"}}">Create post</a>
+	{{end}}
+	{{if .CanManageTrash}}
+		<a class="trash" href="{{url "/posts/trash"}}">Trash</a>
+	{{end}}
+	{{if .CanViewActivity}}
+		<a class="activity" href="{{url "/admin/activity"}}">Activity</a>
 	{{end}}
 {{end}}
 {{define "body"}}
@@ -86,26 +134,161 @@ var (
 	{{else}}
 	No posts found
 	{{end}}
+	{{if gt .PageCount 1}}
+	<nav class="pager">
+		{{if .HasPrev}}<a href="{{.PrevURL}}" class="prev">Previous</a>{{end}}
+		<span class="current">Page {{.Page}} of {{.PageCount}}</span>
+		{{if .HasNext}}<a href="{{.NextURL}}" class="next">Next</a>{{end}}
+	</nav>
+	{{end}}
 {{end}}
 `, postWidget)
 
-	postFormPage = page.SubPage(`
+	singlePostPage = page.NamedSubPage("post/single", `
+{{define "comment"}}
+	<div class="comment" id="comment-{{.ID}}">
+		<header>
+			<span class="author">{{.AuthorName}}</span>
+			<time datetime="{{.Created.Format "2006-01-02T15:04:05Z07:00"}}">{{.Created.Format "2006-01-02 15:04"}}</time>
+		</header>
+		<section class="comment">
+			{{.Filtered}}
+		</section>
+		<footer>
+		{{if .CanReply}}
+			<a class="reply" href="{{url "/post/"}}{{.Post}}/comment?parent={{.ID}}">Reply</a>
+		{{end}}
+		{{if .CanDelete}}
+			<a class="delete" href="{{url "/post/"}}{{.Post}}/comment/{{.ID}}/delete?token={{.CSRFToken}}">Delete</a>
+		{{end}}
+		</footer>
+		{{range .Replies}}
+			{{template "comment" .}}
+		{{end}}
+	</div>
+{{end}}
+{{define "body"}}
+	{{template "post" .Post}}
+	{{if .Related}}
+	<section class="related">
+		<h3>Related posts</h3>
+		<ul>
+		{{range .Related}}
+			<li><a href="{{url "/post/"}}{{.Post.ID}}">{{.Post.Title}}</a></li>
+		{{end}}
+		</ul>
+	</section>
+	{{end}}
+	<section class="comments">
+		<h3>Comments</h3>
+		{{range .Comments}}
+			{{template "comment" .}}
+		{{else}}
+		No comments yet
+		{{end}}
+		{{if .LoggedIn}}
+		<p><a class="comment" href="{{url "/post/"}}{{.Post.Post.ID}}/comment">Add a comment</a></p>
+		{{end}}
+	</section>
+{{end}}
+`, postWidget)
+
+	trashPage = page.NamedSubPage("post/trash", `
+{{define "body"}}
+<table class="trash">
+	<tbody>
+		{{range .Posts}}
+		<tr>
+			<td class="maxwidth"><a href="{{url "/post/"}}{{.Post.ID}}">{{.Post.Title}}</a></td>
+			<td><time datetime="{{.Post.DeletedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.Post.DeletedAt.Format "2006-01-02 15:04"}}</time></td>
+			<td><a class="restore" href="{{url "/post/"}}{{.Post.ID}}/restore?token={{$.CSRFToken}}">Restore</a></td>
+			<td><a class="purge" href="{{url "/post/"}}{{.Post.ID}}/purge?token={{$.CSRFToken}}">Delete permanently</a></td>
+		</tr>
+		{{else}}
+		<tr><td>The trash is empty</td></tr>
+		{{end}}
+	</tbody>
+</table>
+{{if gt .PageCount 1}}
+<nav class="pager">
+	{{if .HasPrev}}<a href="{{.PrevURL}}" class="prev">Previous</a>{{end}}
+	<span class="current">Page {{.Page}} of {{.PageCount}}</span>
+	{{if .HasNext}}<a href="{{.NextURL}}" class="next">Next</a>{{end}}
+</nav>
+{{end}}
+{{end}}
+`)
+
+	activityPage = page.NamedSubPage("post/activity", `
+{{define "body"}}
+<table class="activity">
+	<thead>
+		<th>Edited</th>
+		<th class="maxwidth">Post</th>
+		<th>Author</th>
+	</thead>
+	<tbody>
+		{{range .Revisions}}
+		<tr>
+			<td><time datetime="{{.Revision.Created.Format "2006-01-02T15:04:05Z07:00"}}">{{.Revision.Created.Format "2006-01-02 15:04"}}</time></td>
+			<td class="post"><a href="{{url "/post/"}}{{.Revision.Post}}/revisions">{{.PostTitle}}</a></td>
+			<td class="author">{{.AuthorName}}</td>
+		</tr>
+		{{else}}
+		<tr><td colspan="3">No revisions found</td></tr>
+		{{end}}
+	</tbody>
+</table>
+{{if gt .PageCount 1}}
+<nav class="pager">
+	{{if .HasPrev}}<a href="{{.PrevURL}}" class="prev">Newer</a>{{end}}
+	<span class="current">Page {{.Page}} of {{.PageCount}}</span>
+	{{if .HasNext}}<a href="{{.NextURL}}" class="next">Older</a>{{end}}
+</nav>
+{{end}}
+{{end}}
+`)
+
+	commentFormPage = page.NamedSubPage("post/comment-form", `
 {{define "body"}}
 <form method="POST">
 	{{.ErrorMessages}}
 	{{.CSRFToken}}
-	<p><label>Title: <br/><input type="textfield" name="Title" value="{{.Data.Title}}" /></label></p>
-	<p><label>Content: <br/><textarea name="Content">{{.Data.Content}}</textarea></label></p>
+	<input type="hidden" name="Parent" value="{{.Data.Parent}}" />
+	<p><label>Comment: <br/><textarea name="Content">{{.Data.Content}}</textarea></label></p>
 	<p><input type="submit" value="Save" /></p>
 </form>
 {{end}}
 `)
 
-	revisionsFormPage = page.SubPage(`
+	postFormPage = page.NamedSubPage("post/form", `
 {{define "body"}}
 <form method="POST">
 	{{.ErrorMessages}}
 	{{.CSRFToken}}
+	{{with .Data.ConflictURL}}<p class="conflict"><a href="{{url .}}" target="_blank">Show the changes since you started editing</a></p>{{end}}
+	<input type="hidden" name="BaseRevision" value="{{.Data.BaseRevision}}" />
+	<p><label>Title: <br/><input type="textfield" name="Title" value="{{.Data.Title}}" /></label></p>
+	<p class="field-content"><label>Content: <br/><textarea name="Content">{{.Data.Content}}</textarea></label>{{.FieldError "Content"}}</p>
+	<p><label>Tags: <br/><input type="textfield" name="Tags" value="{{.Data.Tags}}" /></label></p>
+	<p><label>Publish at: <br/><input type="textfield" name="PublishAt" value="{{.Data.PublishAt}}" placeholder="2006-01-02T15:04:05Z" /></label></p>
+	<p>
+		<input type="submit" value="Save" />
+		{{with .Data.PreviewURL}}<button type="submit" class="preview" formaction="{{url .}}" formtarget="_blank">Preview</button>{{end}}
+	</p>
+</form>
+{{end}}
+`)
+
+	revisionsFormPage = page.NamedSubPage("post/revisions", `
+{{define "body"}}
+<form method="POST">
+	{{.ErrorMessages}}
+	{{.CSRFToken}}
+	<p class="publishing">
+		{{with .Data.UnpublishURL}}<a class="unpublish" href="{{url .}}">Unpublish</a>{{end}}
+		{{with .Data.PublishURL}}<a class="publish" href="{{url .}}">Publish the latest revision</a>{{end}}
+	</p>
 	<table>
 		<thead>
 			<th colspan="4">Created</th>
@@ -119,6 +302,7 @@ var (
 					Current
 					{{else}}
 					<button type="submit" name="Op" value="set:{{.Revision.ID}}">Set</button>
+					<button type="submit" name="Op" value="revert:{{.Revision.ID}}">Revert</button>
 					{{end}}
 				</td>
 				<td class="diff-radio"><input type="radio" name="Diff0" value="{{.Revision.ID}}" /></td>
@@ -130,39 +314,235 @@ var (
 	<div class="align-right">
 		<button type="submit" name="Op" value="diff">Diff</button>
 	</div>
+	{{with .Data.Pager}}{{if gt .PageCount 1}}
+	<nav class="pager">
+		{{if .HasPrev}}<a href="{{.PrevURL}}" class="prev">Newer</a>{{end}}
+		<span class="current">Page {{.Page}} of {{.PageCount}}</span>
+		{{if .HasNext}}<a href="{{.NextURL}}" class="next">Older</a>{{end}}
+	</nav>
+	{{end}}{{end}}
 </form>
 {{end}}
 `)
 
-	postDiffPage = page.SubPage(`
+	postPreviewPage = page.NamedSubPage("post/preview", `
+{{define "body"}}
+	<p class="preview-notice">This is a preview of the unsaved changes.</p>
+	{{template "post" .}}
+{{end}}
+`, postWidget)
+
+	postDiffPage = page.NamedSubPage("post/diff", `
 {{define "body"}}
 	<div class="diff">
 	{{.Diff}}
 	</div>
+	<p class="patch"><a href="{{.PatchURL}}">Download patch</a></p>
 {{end}}
 `)
 )
 
 type postWidgetData struct {
 	*PostRecord
-	CanEdit bool
+	CanEdit   bool
+	CSRFToken string
+}
+
+type activityPageData struct {
+	pager
+	Revisions []*RevisionActivity
+}
+
+type trashPageData struct {
+	pager
+	Posts     []*PostRecord
+	CSRFToken string
 }
 
 type listingPageData struct {
-	Posts     []postWidgetData
-	CanCreate bool
+	pager
+	Posts           []postWidgetData
+	CanCreate       bool
+	CanManageTrash  bool
+	CanViewActivity bool
 }
 
-type postFormPageData struct {
-	Title   string
+// pager holds the position of a listing page.
+type pager struct {
+	Page      int
+	PageCount int
+	Total     int
+
+	size  int
+	query url.Values
+}
+
+// errPageOutOfRange is returned by newPager when the ?page= query parameter
+// is not a page of the listing.
+var errPageOutOfRange = errors.New("page out of range")
+
+// newPager creates a pager from the ?page= query parameter, the total number
+// of items and the page size.
+//
+// The page must be between 1 and the last page, otherwise errPageOutOfRange
+// is returned. An empty listing has one (empty) page.
+func newPager(r *http.Request, total, size int) (pager, error) {
+	p := pager{
+		Page:      1,
+		PageCount: (total + size - 1) / size,
+		Total:     total,
+		size:      size,
+		query:     r.URL.Query(),
+	}
+	if value := p.query.Get("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 || (page > p.PageCount && page > 1) {
+			return p, errPageOutOfRange
+		}
+		p.Page = page
+	}
+
+	return p, nil
+}
+
+// Offset returns the offset of the first item on the page.
+func (p pager) Offset() int {
+	return (p.Page - 1) * p.size
+}
+
+// ClampPageSize limits a page size between 1 and MaxPageSize.
+//
+// Page sizes under 1 fall back to PageSize.
+func ClampPageSize(size int) int {
+	if size < 1 {
+		return PageSize
+	}
+	if size > MaxPageSize {
+		return MaxPageSize
+	}
+
+	return size
+}
+
+func (p pager) HasPrev() bool {
+	return p.Page > 1
+}
+
+func (p pager) HasNext() bool {
+	return p.Page < p.PageCount
+}
+
+func (p pager) PrevPage() int {
+	return p.Page - 1
+}
+
+func (p pager) NextPage() int {
+	return p.Page + 1
+}
+
+// PrevURL returns the relative link to the previous page, keeping the other
+// query parameters.
+func (p pager) PrevURL() string {
+	return p.pageURL(p.PrevPage())
+}
+
+// NextURL returns the relative link to the next page, keeping the other query
+// parameters.
+func (p pager) NextURL() string {
+	return p.pageURL(p.NextPage())
+}
+
+func (p pager) pageURL(page int) string {
+	query := url.Values{}
+	for k, v := range p.query {
+		query[k] = v
+	}
+	query.Set("page", strconv.Itoa(page))
+
+	return new(server.BaseURL).URL("", query)
+}
+
+type singlePostPageData struct {
+	Post     postWidgetData
+	Related  []*PostRecord
+	Comments []*commentWidgetData
+	LoggedIn bool
+}
+
+type commentWidgetData struct {
+	*CommentRecord
+	Replies   []*commentWidgetData
+	CanReply  bool
+	CanDelete bool
+	CSRFToken string
+}
+
+type commentFormPageData struct {
+	Parent  string
 	Content string
 }
 
+type postFormPageData struct {
+	Title     string
+	Content   string
+	Tags      string
+	PublishAt string
+
+	// BaseRevision is the active revision of the post when the form was
+	// loaded. The edit is rejected if the post has a different one when the
+	// form is submitted.
+	BaseRevision string
+
+	previewURL  string
+	conflictURL string
+}
+
+// PreviewURL returns the URL of the preview endpoint of an existing post.
+func (d *postFormPageData) PreviewURL() string {
+	return d.previewURL
+}
+
+// ConflictURL returns the URL of the diff between the base revision and the
+// current one after an edit conflict.
+func (d *postFormPageData) ConflictURL() string {
+	return d.conflictURL
+}
+
+// publishAt parses the publish time of the post.
+//
+// An empty value means that the post is published immediately.
+func (d *postFormPageData) publishAt() (time.Time, error) {
+	if strings.TrimSpace(d.PublishAt) == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, strings.TrimSpace(d.PublishAt))
+}
+
 type revisionsFormPageData struct {
 	Revisions []revisionsFormRecordData
 	Op        string
 	Diff0     string
 	Diff1     string
+
+	pager        pager
+	publishURL   string
+	unpublishURL string
+}
+
+// Pager returns the position of the revisions page.
+func (d *revisionsFormPageData) Pager() pager {
+	return d.pager
+}
+
+// PublishURL returns the URL that publishes an unpublished post.
+func (d *revisionsFormPageData) PublishURL() string {
+	return d.publishURL
+}
+
+// UnpublishURL returns the URL that unpublishes a published post.
+func (d *revisionsFormPageData) UnpublishURL() string {
+	return d.unpublishURL
 }
 
 type revisionsFormRecordData struct {
@@ -171,62 +551,500 @@ type revisionsFormRecordData struct {
 }
 
 type postDiffPageData struct {
-	Diff template.HTML
+	Diff     template.HTML
+	PatchURL string
 }
 
 // Pages returns the list of routes for the post entity.
-func Pages(store keyvalue.Store, filter func(string) string) []server.Route {
+//
+// The views store is used to de-duplicate repeated views of a post from the
+// same session. The page sizes of the listing and the revisions pages are
+// limited by ClampPageSize.
+func Pages(store, views keyvalue.Store, filter func(string) string, pageSize, revisionsPageSize int) []server.Route {
+	pageSize = ClampPageSize(pageSize)
 	txmw := database.NewTxMiddleware(true)
+	rotxmw := database.NewReadOnlyTxMiddleware()
 	el := page.EntityLoaderMiddleware(page.EntityLoaderFunc(LoadEntity))
+	slugel := page.EntityLoaderMiddleware(page.EntityLoaderFunc(LoadEntityBySlug))
 	pmw := EnsurePostMiddleware()
 	eamw := PostEditAccessMiddleware()
+	trashmw := account.EnforcePermission(PermissionManageTrash)
 
 	routes := []server.Route{
-		{http.MethodGet, "/posts", ListPage()},
-		{http.MethodGet, "/post/:id/revisions/:r0/:r1", server.Wrap(RevisionDiffPage(), el, pmw, eamw)},
+		{Method: http.MethodGet, Path: "/posts", Handler: server.Wrap(ListPage(pageSize), rotxmw)},
+		{Method: http.MethodGet, Path: "/posts/tag/:tag", Handler: server.Wrap(TagPage(pageSize), rotxmw)},
+		{Method: http.MethodGet, Path: "/post/:id", Handler: server.Wrap(SinglePage(views), el, pmw)},
+		{Method: http.MethodGet, Path: "/p/:slug", Handler: server.Wrap(SinglePage(views), slugel, pmw)},
+		{Method: http.MethodGet, Path: "/post/:id/revisions/:r0/:r1", Handler: server.Wrap(RevisionDiffPage(), el, pmw, eamw)},
+		{Method: http.MethodPost, Path: "/post/:id/preview", Handler: server.Wrap(PreviewPage(filter),
+			session.MustBeLoggedInMiddleware(), session.CSRFTokenMiddleware(), rotxmw, el, pmw, eamw)},
+		{Method: http.MethodGet, Path: "/post/:id/comment/:cid/delete", Handler: server.Wrap(DeleteCommentPage(),
+			session.MustBeLoggedInMiddleware(), session.CSRFTokenMiddleware(), txmw, el, pmw)},
+		{Method: http.MethodGet, Path: "/post/:id/delete", Handler: server.Wrap(SoftDeletePage(),
+			session.MustBeLoggedInMiddleware(), session.CSRFTokenMiddleware(), txmw, el, pmw, eamw)},
+		{Method: http.MethodGet, Path: "/post/:id/unpublish", Handler: server.Wrap(UnpublishPage(),
+			session.MustBeLoggedInMiddleware(), session.CSRFTokenMiddleware(), txmw, el, pmw, eamw)},
+		{Method: http.MethodGet, Path: "/post/:id/publish", Handler: server.Wrap(PublishPage(),
+			session.MustBeLoggedInMiddleware(), session.CSRFTokenMiddleware(), txmw, el, pmw, eamw)},
+		{Method: http.MethodGet, Path: "/admin/activity", Handler: server.Wrap(ActivityPage(pageSize),
+			account.EnforcePermission(PermissionEditAnyPost), rotxmw)},
+		{Method: http.MethodGet, Path: "/posts/trash", Handler: server.Wrap(TrashPage(pageSize), trashmw, rotxmw)},
+		{Method: http.MethodGet, Path: "/post/:id/restore", Handler: server.Wrap(RestorePage(),
+			trashmw, session.CSRFTokenMiddleware(), txmw, el, pmw)},
+		{Method: http.MethodGet, Path: "/post/:id/purge", Handler: server.Wrap(PurgePage(),
+			trashmw, session.CSRFTokenMiddleware(), txmw, el, pmw)},
 	}
 
 	routes = append(routes, form.NewForm(store, "Create post", postFormPage, NewPostForm(filter)).
 		Pages("/posts/create", account.EnforcePermission(PermissionCreatePost), txmw, el)...)
 	routes = append(routes, form.NewForm(store, "Edit post", postFormPage, NewPostForm(filter)).
 		Pages("/post/:id/edit", txmw, el, pmw, eamw)...)
-	routes = append(routes, form.NewForm(store, "Revisions", revisionsFormPage, NewRevisionsForm()).
+	routes = append(routes, form.NewForm(store, "Revisions", revisionsFormPage, NewRevisionsForm(ClampPageSize(revisionsPageSize))).
 		Pages("/post/:id/revisions", txmw, el, pmw, eamw)...)
+	routes = append(routes, form.NewForm(store, "Comment", commentFormPage, NewCommentForm(filter)).
+		Pages("/post/:id/comment", session.MustBeLoggedInMiddleware(), txmw, el, pmw)...)
 
 	return routes
 }
 
 // ListPage is a http handler that lists posts.
-func ListPage() http.Handler {
+func ListPage(pageSize int) http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		conn := database.Get(r)
+		total, err := CountPosts(conn)
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error counting posts", nil, err)
+			return
+		}
+
+		p, err := newPager(r, total, pageSize)
+		if err != nil {
+			respond.Error(w, r, http.StatusNotFound, "", nil, err)
+			return
+		}
+		records, err := ListPosts(conn, pageSize, p.Offset())
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error listing posts", nil, err)
+			return
+		}
+
+		respondListing(w, r, "Posts", records, p)
+	})
+}
+
+// TagPage is a http handler that lists posts with a given tag.
+//
+// Tags are stored as slugs (see ParseTags), so other forms of a tag are
+// redirected to the slug.
+func TagPage(pageSize int) http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		param := httprouter.ParamsFromContext(r.Context()).ByName("tag")
+		tag := util.Slugify(param)
+		if tag == "" {
+			respond.Error(w, r, http.StatusNotFound, "", nil, nil)
+			return
+		}
+		if tag != param {
+			target := "/posts/tag/" + tag
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			respond.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
+		conn := database.Get(r)
+		total, err := CountPostsByTag(conn, tag)
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error counting posts", nil, err)
+			return
+		}
+
+		p, err := newPager(r, total, pageSize)
+		if err != nil {
+			respond.Error(w, r, http.StatusNotFound, "", nil, err)
+			return
+		}
+		records, err := ListPostsByTag(conn, tag, pageSize, p.Offset())
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error listing posts", nil, err)
+			return
+		}
+
+		respondListing(w, r, "Posts tagged "+tag, records, p)
+	})
+}
+
+func respondListing(w http.ResponseWriter, r *http.Request, title string, records []*PostRecord, p pager) {
+	logger := server.GetLogger(r)
+	sess := session.Get(r)
+	access := account.GetAccessChecker(r)
+
+	data := listingPageData{
+		pager:           p,
+		CanCreate:       access.Has(PermissionCreatePost),
+		CanManageTrash:  access.Has(PermissionManageTrash),
+		CanViewActivity: access.Has(PermissionEditAnyPost),
+	}
+
+	etagParts := []string{
+		sess.ID.String(), sess.CSRFToken, title,
+		strconv.Itoa(p.Page), strconv.Itoa(p.Total),
+		strconv.FormatBool(data.CanCreate), strconv.FormatBool(data.CanManageTrash), strconv.FormatBool(data.CanViewActivity),
+	}
+	var modified time.Time
+	for _, record := range records {
+		data.Posts = append(data.Posts, postWidgetData{
+			PostRecord: record,
+			CanEdit:    canEdit(sess.ID, record.Revision.Author, access),
+			CSRFToken:  sess.CSRFToken,
+		})
+		etagParts = append(etagParts, postETagParts(record)...)
+		modified = latest(modified, record.Post.Updated, record.Post.LastEdited)
+	}
+
+	if respond.NotModified(w, r, respond.ETag(etagParts...), modified) {
+		return
+	}
+
+	respond.Page(logger, w, r, listingPage, title, sess, access, data)
+}
+
+// SinglePage is a http handler that shows a post with its comments.
+//
+// Viewing the page increments the view counter of the post, at most once per
+// session in ViewWindow.
+func SinglePage(views keyvalue.Store) http.Handler {
 	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
 		logger := server.GetLogger(r)
 		sess := session.Get(r)
 		conn := database.Get(r)
 		access := account.GetAccessChecker(r)
+		record := GetPostRecord(r)
 
-		data := listingPageData{
-			CanCreate: access.Has(PermissionCreatePost),
+		if err := countView(r, views, record.Post); err != nil {
+			logger.WithError(err).Warnln("failed to count post view")
 		}
 
-		records, err := listPostsByCondition(conn, PageSize, 0, "")
+		comments, err := ListComments(conn, record.Post.ID)
 		if err != nil {
-			respond.Error(w, r, http.StatusInternalServerError, "error listing posts", nil, err)
+			respond.Error(w, r, http.StatusInternalServerError, "error listing comments", nil, err)
+			return
+		}
+
+		related, err := ListRelatedPosts(conn, record, RelatedPostsCount)
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error listing related posts", nil, err)
 			return
 		}
 
-		for _, record := range records {
-			data.Posts = append(data.Posts, postWidgetData{
+		editable := canEdit(sess.ID, record.Revision.Author, access)
+		etagParts := append([]string{sess.ID.String(), sess.CSRFToken, strconv.FormatBool(editable)}, postETagParts(record)...)
+		modified := record.Post.Updated
+		for _, comment := range comments {
+			etagParts = append(etagParts, comment.ID.String())
+			modified = latest(modified, comment.Created)
+		}
+		for _, rel := range related {
+			etagParts = append(etagParts, postETagParts(rel)...)
+		}
+		if respond.NotModified(w, r, respond.ETag(etagParts...), modified) {
+			return
+		}
+
+		respond.Page(logger, w, r, singlePostPage, record.Post.Title, sess, access, singlePostPageData{
+			Post: postWidgetData{
 				PostRecord: record,
-				CanEdit:    canEdit(sess.ID, record.Revision.Author, access),
-			})
+				CanEdit:    editable,
+				CSRFToken:  sess.CSRFToken,
+			},
+			Related:  related,
+			Comments: commentTree(comments, sess, access),
+			LoggedIn: sess.LoggedIn(),
+		})
+	})
+}
+
+// postETagParts returns the values of a post that change its widget.
+func postETagParts(rec *PostRecord) []string {
+	return []string{
+		rec.Post.ID.String(),
+		rec.Revision.ID.String(),
+		rec.Post.Updated.String(),
+		rec.Post.DeletedAt.String(),
+		strconv.FormatInt(rec.Post.Views, 10),
+		strconv.Itoa(rec.Post.RevisionCount),
+		rec.Post.LastEdited.String(),
+	}
+}
+
+// latest returns the latest of the times.
+func latest(times ...time.Time) time.Time {
+	var l time.Time
+	for _, t := range times {
+		if t.After(l) {
+			l = t
+		}
+	}
+
+	return l
+}
+
+// countView increments the view counter of a post, unless the current session
+// has already viewed it in ViewWindow.
+func countView(r *http.Request, views keyvalue.Store, p *Post) error {
+	sid := session.GetSid(r)
+	if sid == nil || *sid == "" {
+		return nil
+	}
+
+	n, err := views.Increment(p.ID.String()+":"+*sid, ViewWindow)
+	if err != nil || n > 1 {
+		return err
+	}
+
+	return p.IncrementViews(database.Get(r))
+}
+
+// commentTree arranges the comments into threads.
+//
+// The comments must be in chronological order, so the parents always precede
+// their replies.
+func commentTree(comments []*CommentRecord, sess *session.Session, access page.AccessChecker) []*commentWidgetData {
+	var roots []*commentWidgetData
+	byID := make(map[uuid.UUID]*commentWidgetData, len(comments))
+
+	for _, c := range comments {
+		cwd := &commentWidgetData{
+			CommentRecord: c,
+			CanReply:      sess.LoggedIn(),
+			CanDelete:     canDeleteComment(sess.ID, c.Author, access),
+			CSRFToken:     sess.CSRFToken,
+		}
+		byID[c.ID] = cwd
+
+		if parent, ok := byID[c.Parent]; ok {
+			parent.Replies = append(parent.Replies, cwd)
+		} else {
+			roots = append(roots, cwd)
+		}
+	}
+
+	return roots
+}
+
+func canDeleteComment(uid uuid.UUID, author uuid.UUID, access page.AccessChecker) bool {
+	if uuid.Equal(uid, uuid.Nil) {
+		return false
+	}
+
+	return uuid.Equal(uid, author) || access.Has(PermissionModerateComments)
+}
+
+// DeleteCommentPage is a http handler that deletes a comment of a post.
+func DeleteCommentPage() http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		sess := session.Get(r)
+		conn := database.Get(r)
+		access := account.GetAccessChecker(r)
+		record := GetPostRecord(r)
+
+		cid, err := uuid.FromString(httprouter.ParamsFromContext(r.Context()).ByName("cid"))
+		if err != nil {
+			respond.Error(w, r, http.StatusNotFound, "comment not found", nil, err)
+			return
+		}
+
+		comment, err := LoadComment(conn, record.Post.ID, cid)
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to load comment", nil, err)
+			return
+		}
+		if comment == nil {
+			respond.Error(w, r, http.StatusNotFound, "comment not found", nil, nil)
+			return
+		}
+
+		if !canDeleteComment(sess.ID, comment.Author, access) {
+			account.RespondPermissionDenied(w, r, PermissionModerateComments)
+			return
+		}
+
+		if err = comment.Delete(conn); err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to delete comment", nil, err)
+			return
+		}
+
+		respond.Redirect(w, r, "/post/"+record.Post.ID.String(), http.StatusFound)
+	})
+}
+
+// SoftDeletePage is a http handler that moves a post to the trash.
+func SoftDeletePage() http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		if err := GetPostRecord(r).Post.SoftDelete(database.Get(r)); err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to delete post", nil, err)
+			return
+		}
+
+		respond.Redirect(w, r, "/posts", http.StatusFound)
+	})
+}
+
+// UnpublishPage is a http handler that hides a post by removing its active
+// revision.
+func UnpublishPage() http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		post := GetPostRecord(r).Post
+		post.Unpublish()
+		if err := post.Save(database.Get(r)); err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to unpublish post", nil, err)
+			return
+		}
+
+		respond.Redirect(w, r, "/post/"+post.ID.String()+"/revisions", http.StatusFound)
+	})
+}
+
+// PublishPage is a http handler that publishes the latest revision of an
+// unpublished post.
+func PublishPage() http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		rec := GetPostRecord(r)
+		if !rec.Post.Published() {
+			rec.Post.Publish(rec.Revision.ID)
+			if err := rec.Post.Save(database.Get(r)); err != nil {
+				respond.Error(w, r, http.StatusInternalServerError, "failed to publish post", nil, err)
+				return
+			}
+		}
+
+		respond.Redirect(w, r, "/post/"+rec.Post.ID.String(), http.StatusFound)
+	})
+}
+
+// ActivityPage is a http handler that lists the latest revisions of all
+// posts.
+func ActivityPage(pageSize int) http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		conn := database.Get(r)
+
+		total, err := CountAllRevisions(conn)
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error counting revisions", nil, err)
+			return
+		}
+
+		p, err := newPager(r, total, pageSize)
+		if err != nil {
+			respond.Error(w, r, http.StatusNotFound, "", nil, err)
+			return
+		}
+		revisions, err := ListRecentRevisions(conn, pageSize, p.Offset())
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error listing revisions", nil, err)
+			return
+		}
+
+		respond.Page(server.GetLogger(r), w, r, activityPage, "Activity", session.Get(r), account.GetAccessChecker(r), activityPageData{
+			pager:     p,
+			Revisions: revisions,
+		})
+	})
+}
+
+// TrashPage is a http handler that lists the deleted posts.
+func TrashPage(pageSize int) http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		sess := session.Get(r)
+		conn := database.Get(r)
+
+		total, err := CountDeletedPosts(conn)
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error counting posts", nil, err)
+			return
+		}
+
+		p, err := newPager(r, total, pageSize)
+		if err != nil {
+			respond.Error(w, r, http.StatusNotFound, "", nil, err)
+			return
+		}
+		records, err := ListDeletedPosts(conn, pageSize, p.Offset())
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error listing posts", nil, err)
+			return
+		}
+
+		respond.Page(server.GetLogger(r), w, r, trashPage, "Trash", sess, account.GetAccessChecker(r), trashPageData{
+			pager:     p,
+			Posts:     records,
+			CSRFToken: sess.CSRFToken,
+		})
+	})
+}
+
+// RestorePage is a http handler that moves a post out of the trash.
+func RestorePage() http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		if err := GetPostRecord(r).Post.Restore(database.Get(r)); err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to restore post", nil, err)
+			return
+		}
+
+		respond.Redirect(w, r, "/posts/trash", http.StatusFound)
+	})
+}
+
+// PurgePage is a http handler that permanently deletes a post from the trash.
+func PurgePage() http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		post := GetPostRecord(r).Post
+		if !post.Deleted() {
+			respond.Error(w, r, http.StatusBadRequest, "only deleted posts can be purged", nil, nil)
+			return
+		}
+
+		if err := post.Delete(database.Get(r)); err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to delete post", nil, err)
+			return
 		}
 
-		respond.Page(logger, w, listingPage, "Posts", sess, access, data)
+		respond.Redirect(w, r, "/posts/trash", http.StatusFound)
+	})
+}
+
+// PreviewPage is a http handler that renders the submitted title, content and
+// tags of a post in the post layout, without saving them.
+func PreviewPage(filter func(string) string) http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, form.DefaultMaxBodyBytes)
+		if err := r.ParseForm(); err != nil {
+			respond.Error(w, r, http.StatusBadRequest, "error parsing form data", nil, err)
+			return
+		}
+
+		record := GetPostRecord(r)
+		post := *record.Post
+		post.Title = r.PostForm.Get("Title")
+		post.Tags = ParseTags(r.PostForm.Get("Tags"))
+		revision := *record.Revision
+		revision.Content = applyFrontMatter(server.GetLogger(r), &post, r.PostForm.Get("Content"))
+		revision.Filtered = template.HTML(filter(revision.Content))
+
+		respond.Page(server.GetLogger(r), w, r, postPreviewPage, "Preview: "+post.Title, session.Get(r), account.GetAccessChecker(r), postWidgetData{
+			PostRecord: &PostRecord{
+				Post:     &post,
+				Revision: &revision,
+			},
+		})
 	})
 }
 
 // RevisionDiffPage is a http handler that shows a diff page between two
 // revisions of a post.
+//
+// With ?format=patch the diff is downloaded as a unified diff instead.
 func RevisionDiffPage() http.Handler {
 	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
 		logger := server.GetLogger(r)
@@ -242,10 +1060,26 @@ func RevisionDiffPage() http.Handler {
 			return
 		}
 
+		if r.URL.Query().Get("format") == "patch" {
+			patch := unifiedDiff(
+				post.Post.Slug+"@"+revs[1].ID.String(),
+				post.Post.Slug+"@"+revs[0].ID.String(),
+				revs[1].Content,
+				revs[0].Content,
+			)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+				"filename": post.Post.Slug + ".patch",
+			}))
+			_, _ = w.Write([]byte(patch))
+			return
+		}
+
 		diffs := diff.DiffMain(revs[1].Content, revs[0].Content, true)
 
-		respond.Page(logger, w, postDiffPage, "Diff", sess, access, postDiffPageData{
-			Diff: renderDiffs(diffs),
+		respond.Page(logger, w, r, postDiffPage, "Diff", sess, access, postDiffPageData{
+			Diff:     renderDiffs(diffs),
+			PatchURL: "?format=patch",
 		})
 	})
 }
@@ -268,16 +1102,37 @@ func renderDiffs(diffs []diffmatchpatch.Diff) template.HTML {
 	return template.HTML(buf.Bytes())
 }
 
-func canEdit(uid uuid.UUID, author uuid.UUID, access page.AccessChecker) bool {
-	if !uuid.Equal(uid, uuid.Nil) {
-		if access.Has(PermissionEditAnyPost) {
-			return true
-		} else if uuid.Equal(uid, author) {
-			return access.Has(PermissionEditOwnPost)
+// applyFrontMatter sets the tags and the slug of a post from the front-matter
+// of the content, and returns the content without the front-matter.
+//
+// Unknown keys are ignored. A malformed front-matter is left in the content.
+func applyFrontMatter(logger logrus.FieldLogger, p *Post, content string) string {
+	fm, body, err := util.ParseFrontMatter(content)
+	if err != nil {
+		logger.WithError(err).Warnln("ignoring malformed front-matter")
+		return content
+	}
+
+	for key := range fm {
+		switch key {
+		case "tags":
+			if tags, ok := fm.Strings(key); ok {
+				p.Tags = ParseTags(strings.Join(tags, ","))
+			}
+		case "slug":
+			if slug, ok := fm.String(key); ok && util.Slugify(slug) != "" {
+				p.Slug = util.Slugify(slug)
+			}
+		default:
+			logger.WithField("key", key).Warnln("ignoring unknown front-matter key")
 		}
 	}
 
-	return false
+	return body
+}
+
+func canEdit(uid uuid.UUID, author uuid.UUID, access page.AccessChecker) bool {
+	return account.CanAccessOwned(uid, author, access, PermissionEditOwnPost, PermissionEditAnyPost)
 }
 
 type postForm struct {
@@ -297,9 +1152,18 @@ func (p *postForm) LoadData(r *http.Request) (interface{}, error) {
 
 	data := entity.(*PostRecord)
 
+	var publishAt string
+	if !uuid.Equal(data.Post.Scheduled, uuid.Nil) {
+		publishAt = data.Post.PublishAt.Format(time.RFC3339)
+	}
+
 	return &postFormPageData{
-		Title:   data.Post.Title,
-		Content: data.Revision.Content,
+		Title:        data.Post.Title,
+		Content:      data.Revision.Content,
+		Tags:         strings.Join(data.Post.Tags, ", "),
+		PublishAt:    publishAt,
+		BaseRevision: data.Post.Revision.String(),
+		previewURL:   "/post/" + data.Post.ID.String() + "/preview?token=" + url.QueryEscape(session.Get(r).CSRFToken),
 	}, nil
 }
 
@@ -311,6 +1175,10 @@ func (p *postForm) Validate(_ *http.Request, v interface{}) []string {
 		errs = append(errs, "Title is required")
 	}
 
+	if _, err := rec.publishAt(); err != nil {
+		errs = append(errs, "Invalid publish time")
+	}
+
 	return errs
 }
 
@@ -332,18 +1200,71 @@ func (p *postForm) Submit(_ http.ResponseWriter, r *http.Request, v interface{})
 	}
 
 	data := entity.(*PostRecord)
+	if res := p.checkConflict(conn, data, rec); res != nil {
+		return res
+	}
 	data.Post.Title = rec.Title
-	data.Revision.Content = rec.Content
-	data.Revision.Filtered = template.HTML(p.filter(rec.Content))
+	data.Post.Tags = ParseTags(rec.Tags)
+	if data.Post.PublishAt, err = rec.publishAt(); err != nil {
+		return form.Error("Invalid publish time", err)
+	}
+	data.Revision.Content = applyFrontMatter(server.GetLogger(r), data.Post, rec.Content)
+	data.Revision.Filtered = template.HTML(p.filter(data.Revision.Content))
 	data.Revision.Author = sess.ID
 
+	if data.Post.Slug != "" {
+		// The check runs before saving, so the transaction is not aborted
+		// by the unique violation.
+		taken, err := slugTaken(conn, data.Post.Slug, data.Post.ID)
+		if err != nil {
+			return form.Error("Cannot save post", err)
+		}
+		if taken {
+			return form.FieldError("Content", "The slug is already used by another post", nil)
+		}
+	}
+
 	if err = data.Save(conn); err != nil {
+		if err == ErrDuplicateSlug {
+			return form.FieldError("Content", "The slug is already used by another post", err)
+		}
 		return form.Error("Cannot save post", err)
 	}
 
 	return form.Redirect("/posts")
 }
 
+// checkConflict makes sure that the post was not edited since the form was
+// loaded.
+//
+// The post is locked until the end of the transaction. On a conflict the base
+// revision of the form is moved to the current one, so submitting the form
+// again overwrites the other edit.
+func (p *postForm) checkConflict(conn database.DB, data *PostRecord, rec *postFormPageData) form.FormSubmitResult {
+	if uuid.Equal(data.Post.ID, uuid.Nil) || rec.BaseRevision == "" {
+		return nil
+	}
+
+	base, err := uuid.FromString(rec.BaseRevision)
+	if err != nil {
+		return form.Error("Invalid base revision", err)
+	}
+
+	current, err := lockPostRevision(conn, data.Post.ID)
+	if err != nil {
+		return form.Error("Cannot load post", err)
+	}
+
+	if uuid.Equal(base, current) {
+		return nil
+	}
+
+	rec.BaseRevision = current.String()
+	rec.conflictURL = "/post/" + data.Post.ID.String() + "/revisions/" + current.String() + "/" + base.String()
+
+	return form.Error("The post has been changed since you started editing it. Saving again will overwrite the changes.", nil)
+}
+
 // NewPostForm creates the delegate for the post form.
 //
 // This form handles the creating and editing of a post.
@@ -353,20 +1274,100 @@ func NewPostForm(filter func(string) string) form.Delegate {
 	}
 }
 
+type commentForm struct {
+	account.AccessCheckLoader
+	filter func(string) string
+}
+
+// NewCommentForm creates the delegate for the comment form.
+func NewCommentForm(filter func(string) string) form.Delegate {
+	return &commentForm{
+		filter: filter,
+	}
+}
+
+func (f *commentForm) LoadData(r *http.Request) (interface{}, error) {
+	return &commentFormPageData{
+		Parent: r.URL.Query().Get("parent"),
+	}, nil
+}
+
+func (f *commentForm) Validate(_ *http.Request, v interface{}) []string {
+	var errs []string
+	data := v.(*commentFormPageData)
+
+	if strings.TrimSpace(data.Content) == "" {
+		errs = append(errs, "Comment is required")
+	}
+	if data.Parent != "" {
+		if _, err := uuid.FromString(data.Parent); err != nil {
+			errs = append(errs, "Invalid parent comment")
+		}
+	}
+
+	return errs
+}
+
+func (f *commentForm) Submit(_ http.ResponseWriter, r *http.Request, v interface{}) form.FormSubmitResult {
+	conn := database.Get(r)
+	data := v.(*commentFormPageData)
+	sess := session.Get(r)
+	rec := GetPostRecord(r)
+
+	c := &Comment{
+		Post:     rec.Post.ID,
+		Author:   sess.ID,
+		Content:  data.Content,
+		Filtered: template.HTML(f.filter(data.Content)),
+	}
+
+	if data.Parent != "" {
+		c.Parent = uuid.FromStringOrNil(data.Parent)
+		parent, err := LoadComment(conn, rec.Post.ID, c.Parent)
+		if err != nil {
+			return form.Error("Failed to load parent comment", err)
+		}
+		if parent == nil {
+			return form.Error("Parent comment not found", nil)
+		}
+	}
+
+	if err := c.Save(conn); err != nil {
+		return form.Error("Cannot save comment", err)
+	}
+
+	return form.Redirect("/post/" + rec.Post.ID.String())
+}
+
 type revisionsForm struct {
 	account.AccessCheckLoader
+	pageSize int
 }
 
 // NewRevisionsForm creates the delegate for the post revision form page.
-func NewRevisionsForm() form.Delegate {
-	return &revisionsForm{}
+//
+// The revisions are paginated by pageSize, the newest first. Only the
+// revisions on the same page can be diffed with the form.
+func NewRevisionsForm(pageSize int) form.Delegate {
+	return &revisionsForm{
+		pageSize: pageSize,
+	}
 }
 
 func (f *revisionsForm) LoadData(r *http.Request) (interface{}, error) {
 	conn := database.Get(r)
 	record := GetPostRecord(r)
 
-	revs, err := ListRevisions(conn, record.Post.ID)
+	total, err := CountRevisions(conn, record.Post.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := newPager(r, total, f.pageSize)
+	if err != nil {
+		return nil, err
+	}
+	revs, err := ListRevisionsPage(conn, record.Post.ID, f.pageSize, p.Offset())
 	if err != nil {
 		return nil, err
 	}
@@ -379,9 +1380,18 @@ func (f *revisionsForm) LoadData(r *http.Request) (interface{}, error) {
 		}
 	}
 
-	return &revisionsFormPageData{
+	data := &revisionsFormPageData{
 		Revisions: records,
-	}, err
+		pager:     p,
+	}
+	base, token := "/post/"+record.Post.ID.String(), "?token="+url.QueryEscape(session.Get(r).CSRFToken)
+	if record.Post.Published() {
+		data.unpublishURL = base + "/unpublish" + token
+	} else {
+		data.publishURL = base + "/publish" + token
+	}
+
+	return data, nil
 }
 
 func (f *revisionsForm) Validate(_ *http.Request, v interface{}) []string {
@@ -391,7 +1401,7 @@ func (f *revisionsForm) Validate(_ *http.Request, v interface{}) []string {
 		if data.Diff0 == data.Diff1 {
 			errs = append(errs, "Cannot diff the same revision")
 		}
-	} else if !strings.HasPrefix(data.Op, "set:") {
+	} else if !strings.HasPrefix(data.Op, "set:") && !strings.HasPrefix(data.Op, "revert:") {
 		errs = append(errs, "Invalid form operation")
 	}
 
@@ -406,9 +1416,14 @@ func (f *revisionsForm) Submit(_ http.ResponseWriter, r *http.Request, v interfa
 	if data.Op == "diff" {
 		redir := *r.URL
 		redir.Path = path.Join(redir.Path, data.Diff0, data.Diff1)
+		redir.RawQuery = ""
 		return form.Redirect(redir.String())
 	}
 
+	if strings.HasPrefix(data.Op, "revert:") {
+		return f.revert(r, rec, data.Op[7:])
+	}
+
 	newrev, err := uuid.FromString(data.Op[4:])
 	if err != nil {
 		return form.Error("Invalid form operation", err)
@@ -423,50 +1438,90 @@ func (f *revisionsForm) Submit(_ http.ResponseWriter, r *http.Request, v interfa
 	return form.Redirect("/posts")
 }
 
-type postEditAccessMiddleware struct{}
+// revert creates a new revision with the content of an old one, and publishes
+// it.
+func (f *revisionsForm) revert(r *http.Request, rec *PostRecord, idstr string) form.FormSubmitResult {
+	sess := session.Get(r)
+	conn := database.Get(r)
 
-func (p *postEditAccessMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	access := account.GetAccessChecker(r)
+	revs, err := mustLoadRevisionsFromStrings(conn, rec.Post.ID, idstr)
+	if err != nil {
+		return form.Error("Invalid form operation", err)
+	}
 
-	sess := session.Get(r)
-	record := GetPostRecord(r)
+	rev := &PostRevision{
+		Post:     rec.Post.ID,
+		Content:  revs[0].Content,
+		Filtered: revs[0].Filtered,
+		Author:   sess.ID,
+	}
+	if err = rev.Save(conn); err != nil {
+		return form.Error("Cannot revert revision", err)
+	}
 
-	if !canEdit(sess.ID, record.Revision.Author, access) {
-		account.RespondPermissionDenied(w, r, "edit-post")
-		return
+	rec.Post.Publish(rev.ID)
+
+	if err = rec.Post.Save(conn); err != nil {
+		return form.Error("Cannot publish revision", err)
 	}
 
-	next(w, r)
+	return form.Redirect("/posts")
 }
 
 // PostEditAccessMiddleware is a middleware that makes sure that the current
 // account has edit access on the post in the URL.
 func PostEditAccessMiddleware() negroni.Handler {
-	return &postEditAccessMiddleware{}
+	return account.OwnershipMiddleware(postAuthor, PermissionEditOwnPost, PermissionEditAnyPost)
+}
+
+func postAuthor(r *http.Request) uuid.UUID {
+	return GetPostRecord(r).Revision.Author
 }
 
 type ensurePostMiddleware struct{}
 
 // EnsurePostMiddleware loads the post record object from the URL.
+//
+// Deleted and unpublished posts are not found, unless the current account can
+// see them (see canSee).
 func EnsurePostMiddleware() negroni.Handler {
 	return &ensurePostMiddleware{}
 }
 
 func (m *ensurePostMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	entity, err := page.GetEntity(r)
+	if page.IsInvalidParam(err) {
+		respond.Error(w, r, http.StatusNotFound, "entity not found", nil, err)
+		return
+	}
 	if err != nil {
 		respond.Error(w, r, http.StatusInternalServerError, "failed to load entity", nil, err)
 		return
 	}
 
-	if entity == nil {
-		respond.Error(w, r, http.StatusNotFound, "entity not found", nil, err)
+	if entity == nil || !canSee(r, entity.(*PostRecord)) {
+		respond.Error(w, r, http.StatusNotFound, "entity not found", nil, nil)
 		return
 	}
 
+	server.AddLoggerField(r, "post", entity.(*PostRecord).Post.ID.String())
+
 	next(w, util.SetContext(r, postContextKey, entity.(*PostRecord)))
 }
 
+// canSee reports whether a post is visible for the current account.
+//
+// Deleted posts are visible with PermissionManageTrash, unpublished posts for
+// the accounts that can edit them.
+func canSee(r *http.Request, rec *PostRecord) bool {
+	access := account.GetAccessChecker(r)
+	if rec.Post.Deleted() && !access.Has(PermissionManageTrash) {
+		return false
+	}
+
+	return rec.Post.Published() || canEdit(session.Get(r).ID, rec.Revision.Author, access)
+}
+
 // GetPostRecord returns the loaded PostRecord from the request context.
 func GetPostRecord(r *http.Request) *PostRecord {
 	return r.Context().Value(postContextKey).(*PostRecord)
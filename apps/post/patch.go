@@ -0,0 +1,121 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package post
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+const patchContext = 3
+
+type patchLine struct {
+	op   byte
+	text string
+}
+
+// unifiedDiff formats the line diff between two texts as a unified diff.
+func unifiedDiff(oldName, newName, a, b string) string {
+	c1, c2, lines := diff.DiffLinesToChars(a, b)
+	diffs := diff.DiffCharsToLines(diff.DiffMain(c1, c2, false), lines)
+
+	var pl []patchLine
+	for _, d := range diffs {
+		op := byte(' ')
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = '+'
+		case diffmatchpatch.DiffDelete:
+			op = '-'
+		}
+		for _, line := range strings.SplitAfter(d.Text, "\n") {
+			if line != "" {
+				pl = append(pl, patchLine{op: op, text: line})
+			}
+		}
+	}
+
+	// oldBefore and newBefore count the lines of the texts before each line.
+	oldBefore := make([]int, len(pl)+1)
+	newBefore := make([]int, len(pl)+1)
+	for i, l := range pl {
+		oldBefore[i+1] = oldBefore[i]
+		newBefore[i+1] = newBefore[i]
+		if l.op != '+' {
+			oldBefore[i+1]++
+		}
+		if l.op != '-' {
+			newBefore[i+1]++
+		}
+	}
+
+	buf := &strings.Builder{}
+	buf.WriteString("--- " + oldName + "\n+++ " + newName + "\n")
+
+	for i := 0; i < len(pl); {
+		for i < len(pl) && pl[i].op == ' ' {
+			i++
+		}
+		if i == len(pl) {
+			break
+		}
+
+		start := i - patchContext
+		if start < 0 {
+			start = 0
+		}
+		last := i
+		for j := i; j < len(pl) && j-last <= 2*patchContext; j++ {
+			if pl[j].op != ' ' {
+				last = j
+			}
+		}
+		end := last + patchContext + 1
+		if end > len(pl) {
+			end = len(pl)
+		}
+
+		buf.WriteString("@@ -" + hunkRange(oldBefore[start], oldBefore[end]-oldBefore[start]) +
+			" +" + hunkRange(newBefore[start], newBefore[end]-newBefore[start]) + " @@\n")
+		for _, l := range pl[start:end] {
+			buf.WriteByte(l.op)
+			buf.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return buf.String()
+}
+
+// hunkRange formats the range of a hunk, where before is the number of lines
+// before the hunk.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return strconv.Itoa(before) + ",0"
+	}
+	if count == 1 {
+		return strconv.Itoa(before + 1)
+	}
+
+	return strconv.Itoa(before+1) + "," + strconv.Itoa(count)
+}
@@ -18,18 +18,44 @@ package post
 
 import (
 	"database/sql"
-	"fmt"
 	"html/template"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/page"
 	"github.com/tamasd/simplesite/util"
 )
 
+// publishedCondition filters out the deleted and unpublished posts.
+//
+// A post is published if it has a live revision. New posts that are scheduled
+// don't have one until PublishScheduled runs, and scheduling a new revision of
+// a published post keeps the live one listed.
+const publishedCondition = "p.revision IS NOT NULL AND p.deleted_at IS NULL"
+
+// postJoin joins the posts with their active revisions. The posts without an
+// active revision are joined with their latest revision.
+const postJoin = `
+	post p JOIN post_revision r ON r.id = COALESCE(p.revision, (
+		SELECT lr.id FROM post_revision lr WHERE lr.post = p.id ORDER BY lr.created DESC LIMIT 1
+	))`
+
+const deletedCondition = "p.deleted_at IS NOT NULL"
+
+const taggedCondition = " AND EXISTS (SELECT 1 FROM post_tag t WHERE t.post = p.id AND t.tag = $1)"
+
+const uniqueViolation = "23505"
+
+// ErrDuplicateSlug is returned by Post.Save when another post has the same
+// slug.
+var ErrDuplicateSlug = errors.New("the slug is already used by another post")
+
 // PostRecord represents a post and its current revision.
 type PostRecord struct {
 	Post     *Post
@@ -37,7 +63,10 @@ type PostRecord struct {
 }
 
 // Save inserts or updates a post and its active revision.
+//
+// An unpublished post stays unpublished, unless it is scheduled.
 func (pr *PostRecord) Save(conn database.DB) error {
+	unpublished := !uuid.Equal(pr.Post.ID, uuid.Nil) && !pr.Post.Published() && uuid.Equal(pr.Post.Scheduled, uuid.Nil)
 	if uuid.Equal(pr.Post.ID, uuid.Nil) {
 		if err := pr.Post.Save(conn); err != nil {
 			return err
@@ -49,21 +78,35 @@ func (pr *PostRecord) Save(conn database.DB) error {
 		return err
 	}
 
-	pr.Post.Publish(pr.Revision.ID)
+	if pr.Post.PublishAt.After(util.Now()) {
+		pr.Post.Schedule(pr.Revision.ID, pr.Post.PublishAt)
+	} else if !unpublished {
+		pr.Post.Publish(pr.Revision.ID)
+	}
 	if err := pr.Post.Save(conn); err != nil {
 		return err
 	}
 
-	return nil
+	return SaveTags(conn, pr.Post.ID, pr.Post.Tags)
 }
 
 // Post represents the post entity.
 type Post struct {
-	ID       uuid.UUID `json:"id"`
-	Title    string    `json:"title"`
-	Revision uuid.UUID `json:"revision"`
-	Created  time.Time `json:"created"`
-	Updated  time.Time `json:"updated"`
+	ID        uuid.UUID `json:"id"`
+	Title     string    `json:"title"`
+	Slug      string    `json:"slug"`
+	Revision  uuid.UUID `json:"revision"`
+	Scheduled uuid.UUID `json:"scheduled"`
+	PublishAt time.Time `json:"publish_at"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	Tags      []string  `json:"tags"`
+	Views     int64     `json:"views"`
+	DeletedAt time.Time `json:"deleted_at"`
+
+	// RevisionCount and LastEdited are computed when the post is listed.
+	RevisionCount int       `json:"revision_count"`
+	LastEdited    time.Time `json:"last_edited"`
 }
 
 // SchemaSQL returns the schema for the post entity.
@@ -72,20 +115,130 @@ func (p Post) SchemaSQL() string {
 		CREATE TABLE post (
 			id uuid NOT NULL,
 			revision uuid,
+			scheduled uuid,
+			publish_at timestamp with time zone,
 			title character varying NOT NULL,
+			slug character varying NOT NULL,
 			created timestamp with time zone NOT NULL DEFAULT now(),
 			updated timestamp with time zone NOT NULL,
+			views bigint NOT NULL DEFAULT 0,
+			deleted_at timestamp with time zone,
 			PRIMARY KEY (id)
 		);
 	
+		CREATE UNIQUE INDEX post_slug_unique ON post (slug);
+
 		CREATE UNIQUE INDEX post_revision_unique ON post (revision)
 			WHERE revision IS NOT NULL;
+
+		CREATE INDEX post_scheduled ON post (publish_at)
+			WHERE scheduled IS NOT NULL;
 	`
 }
 
+// MigrationSQL adds the columns and indexes to the post table that were
+// introduced after its creation.
+//
+// The slug column is added as nullable, MigrateData fills and constrains it.
+func (p Post) MigrationSQL() string {
+	return `
+		ALTER TABLE post ADD COLUMN IF NOT EXISTS scheduled uuid;
+		ALTER TABLE post ADD COLUMN IF NOT EXISTS publish_at timestamp with time zone;
+		ALTER TABLE post ADD COLUMN IF NOT EXISTS slug character varying;
+		ALTER TABLE post ADD COLUMN IF NOT EXISTS views bigint NOT NULL DEFAULT 0;
+		ALTER TABLE post ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+
+		CREATE INDEX IF NOT EXISTS post_scheduled ON post (publish_at)
+			WHERE scheduled IS NOT NULL;
+	`
+}
+
+// MigrateData generates the slugs of the posts that were created before the
+// slug column, then makes the column required and unique.
+//
+// The slugs are generated with GenerateSlug. A numeric suffix is added if a
+// slug is already taken. Nothing is done once the column is required.
+func (p Post) MigrateData(conn database.DB) error {
+	var nullable bool
+	err := conn.QueryRow(`
+		SELECT NOT a.attnotnull
+		FROM   pg_catalog.pg_attribute a
+		WHERE  a.attrelid = 'post'::regclass
+		AND    a.attname = 'slug'
+	`).Scan(&nullable)
+	if err != nil || !nullable {
+		return errors.Wrap(err, "error checking the post slug column")
+	}
+
+	return database.Transactional(conn, func(tx database.DB) error {
+		used, missing, err := loadPostSlugs(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, post := range missing {
+			base := GenerateSlug(post.ID, post.Title)
+			slug := base
+			for i := 2; used[slug]; i++ {
+				slug = base + "-" + strconv.Itoa(i)
+			}
+			used[slug] = true
+
+			if _, err = tx.Exec(`UPDATE post SET slug = $1 WHERE id = $2`, slug, post.ID); err != nil {
+				return errors.Wrap(err, "error saving post slug")
+			}
+		}
+
+		_, err = tx.Exec(`
+			ALTER TABLE post ALTER COLUMN slug SET NOT NULL;
+			CREATE UNIQUE INDEX IF NOT EXISTS post_slug_unique ON post (slug);
+		`)
+		return errors.Wrap(err, "error constraining post slugs")
+	})
+}
+
+// loadPostSlugs returns the slugs in use, and the posts without a slug.
+func loadPostSlugs(conn database.DB) (map[string]bool, []Post, error) {
+	rows, err := conn.Query(`SELECT id, title, slug FROM post ORDER BY created, id`)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error loading post slugs")
+	}
+	defer rows.Close()
+
+	used := make(map[string]bool)
+	var missing []Post
+	for rows.Next() {
+		var post Post
+		var slug sql.NullString
+		if err = rows.Scan(&post.ID, &post.Title, &slug); err != nil {
+			return nil, nil, errors.Wrap(err, "error loading post slugs")
+		}
+		if slug.Valid {
+			used[slug.String] = true
+		} else {
+			missing = append(missing, post)
+		}
+	}
+
+	return used, missing, errors.Wrap(rows.Err(), "error loading post slugs")
+}
+
 // Publish sets a revision as the active one.
+//
+// This cancels the scheduled publishing of the post.
 func (p *Post) Publish(revision uuid.UUID) {
 	p.Revision = revision
+	p.Scheduled = uuid.Nil
+	p.PublishAt = time.Time{}
+}
+
+// Schedule sets a revision to be published at a given time.
+//
+// The live revision stays published until then. A post without a live
+// revision is hidden from the listing pages.
+func (p *Post) Schedule(revision uuid.UUID, at time.Time) {
+	p.Scheduled = revision
+	p.PublishAt = at
 }
 
 // Unpublish removes the reference to the active revision.
@@ -95,30 +248,125 @@ func (p *Post) Unpublish() {
 	p.Revision = uuid.Nil
 }
 
+// Published reports whether the post has an active revision.
+func (p *Post) Published() bool {
+	return !uuid.Equal(p.Revision, uuid.Nil)
+}
+
 // Save inserts or updates a post.
 func (p *Post) Save(conn database.DB) error {
 	if uuid.Equal(p.ID, uuid.Nil) {
 		p.ID = uuid.NewV4()
 	}
+	if p.Slug == "" {
+		p.Slug = GenerateSlug(p.ID, p.Title)
+	}
 
-	var revision interface{}
+	var revision, scheduled, publishAt interface{}
 	if !uuid.Equal(p.Revision, uuid.Nil) {
 		revision = p.Revision
 	}
+	if !uuid.Equal(p.Scheduled, uuid.Nil) {
+		scheduled = p.Scheduled
+	}
+	if !p.PublishAt.IsZero() {
+		publishAt = p.PublishAt
+	}
 
 	_, err := conn.Exec(`
-		INSERT INTO post (id, title, revision, updated)
-		VALUES($1, $2, $3, $4)
+		INSERT INTO post (id, title, slug, revision, scheduled, publish_at, updated)
+		VALUES($1, $2, $3, $4, $5, $6, $7)
 		ON CONFLICT (id)
 		DO UPDATE SET 
 			title = $2,
-			revision = $3,
-			updated = $4
-	`, p.ID, p.Title, revision, time.Now())
+			slug = $3,
+			revision = $4,
+			scheduled = $5,
+			publish_at = $6,
+			updated = $7
+	`, p.ID, p.Title, p.Slug, revision, scheduled, publishAt, time.Now())
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation && pqErr.Constraint == "post_slug_unique" {
+		return ErrDuplicateSlug
+	}
 
 	return errors.Wrap(err, "error saving post")
 }
 
+// slugTaken checks if a post other than pid has the slug.
+func slugTaken(conn database.DB, slug string, pid uuid.UUID) (bool, error) {
+	var taken bool
+	err := conn.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM post WHERE slug = $1 AND id <> $2)
+	`, slug, pid).Scan(&taken)
+
+	return taken, errors.Wrap(err, "error checking slug")
+}
+
+// Deleted reports whether the post is in the trash.
+func (p *Post) Deleted() bool {
+	return !p.DeletedAt.IsZero()
+}
+
+// SoftDelete moves the post to the trash.
+//
+// The post is hidden from the public pages, but it can be restored.
+func (p *Post) SoftDelete(conn database.DB) error {
+	err := conn.QueryRow(`
+		UPDATE post SET deleted_at = now() WHERE id = $1 RETURNING deleted_at
+	`, p.ID).Scan(&p.DeletedAt)
+
+	return errors.Wrap(err, "error deleting post")
+}
+
+// Restore moves the post out of the trash.
+func (p *Post) Restore(conn database.DB) error {
+	if _, err := conn.Exec(`UPDATE post SET deleted_at = NULL WHERE id = $1`, p.ID); err != nil {
+		return errors.Wrap(err, "error restoring post")
+	}
+	p.DeletedAt = time.Time{}
+
+	return nil
+}
+
+// Delete permanently removes the post with its revisions, tags and comments.
+func (p *Post) Delete(conn database.DB) error {
+	_, err := conn.Exec(`DELETE FROM post WHERE id = $1`, p.ID)
+
+	return errors.Wrap(err, "error deleting post")
+}
+
+// GenerateSlug generates the URL slug of a post.
+//
+// The slug is suffixed with the beginning of the post's id, so posts with the
+// same title get different slugs. It is generated once, the slug does not
+// change when the post is renamed.
+func GenerateSlug(id uuid.UUID, title string) string {
+	suffix := strings.Replace(id.String(), "-", "", -1)[:8]
+	if slug := util.Slugify(title); slug != "" {
+		return slug + "-" + suffix
+	}
+
+	return suffix
+}
+
+// lockPostRevision locks the row of a post until the end of the transaction,
+// and returns its active revision.
+func lockPostRevision(conn database.DB, pid uuid.UUID) (uuid.UUID, error) {
+	var revision uuid.NullUUID
+	err := conn.QueryRow(`SELECT revision FROM post WHERE id = $1 FOR UPDATE`, pid).Scan(&revision)
+
+	return revision.UUID, errors.Wrap(err, "error locking post")
+}
+
+// IncrementViews increments the view counter of the post.
+func (p *Post) IncrementViews(conn database.DB) error {
+	err := conn.QueryRow(`
+		UPDATE post SET views = views + 1 WHERE id = $1 RETURNING views
+	`, p.ID).Scan(&p.Views)
+
+	return errors.Wrap(err, "error incrementing post views")
+}
+
 // PostRevision represents a post's revision.
 type PostRevision struct {
 	ID       uuid.UUID     `json:"id"`
@@ -143,10 +391,27 @@ func (r PostRevision) SchemaSQL() string {
 			created timestamp with time zone NOT NULL DEFAULT now(),
 			PRIMARY KEY (id)
 		);
+
+		CREATE INDEX post_revision_author ON post_revision (author);
+
+		CREATE INDEX post_revision_post_created ON post_revision (post, created);
 	
 		ALTER TABLE post ADD 
 			CONSTRAINT post_revision_fk FOREIGN KEY (revision)
 			REFERENCES post_revision(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+		ALTER TABLE post ADD 
+			CONSTRAINT post_scheduled_fk FOREIGN KEY (scheduled)
+			REFERENCES post_revision(id) ON UPDATE CASCADE ON DELETE SET NULL;
+	`
+}
+
+// MigrationSQL adds the indexes to the post_revision table that were
+// introduced after its creation.
+func (r PostRevision) MigrationSQL() string {
+	return `
+		CREATE INDEX IF NOT EXISTS post_revision_author ON post_revision (author);
+		CREATE INDEX IF NOT EXISTS post_revision_post_created ON post_revision (post, created);
 	`
 }
 
@@ -168,20 +433,105 @@ func (r *PostRevision) Save(conn database.DB) error {
 	return errors.Wrap(err, "error saving post revision")
 }
 
+// PostTag represents the tags of the posts.
+type PostTag struct {
+	Post uuid.UUID `json:"post"`
+	Tag  string    `json:"tag"`
+}
+
+// SchemaSQL returns the schema of the post tags.
+func (t PostTag) SchemaSQL() string {
+	return `
+		CREATE TABLE post_tag (
+			post uuid NOT NULL
+				REFERENCES post(id) ON UPDATE CASCADE ON DELETE CASCADE,
+			tag character varying NOT NULL,
+			PRIMARY KEY (post, tag)
+		);
+
+		CREATE INDEX post_tag_tag ON post_tag (tag);
+	`
+}
+
+// SaveTags overwrites the tags of a post.
+//
+// It is strongly recommended that the database connection given to this
+// function is a transaction.
+func SaveTags(conn database.DB, pid uuid.UUID, tags []string) error {
+	if tags == nil {
+		tags = []string{}
+	}
+
+	if _, err := conn.Exec(`DELETE FROM post_tag WHERE post = $1 AND NOT (tag = ANY($2))`, pid, pq.Array(tags)); err != nil {
+		return errors.Wrap(err, "error removing post tags")
+	}
+
+	for _, tag := range tags {
+		if _, err := conn.Exec(`
+			INSERT INTO post_tag (post, tag)
+			VALUES($1, $2)
+			ON CONFLICT DO NOTHING
+		`, pid, tag); err != nil {
+			return errors.Wrap(err, "error saving post tag")
+		}
+	}
+
+	return nil
+}
+
+// ParseTags converts a comma separated list of tags into a list of unique
+// slugs.
+func ParseTags(tags string) []string {
+	var parsed []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(tags, ",") {
+		tag = util.Slugify(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		parsed = append(parsed, tag)
+	}
+
+	return parsed
+}
+
+func countPostsByCondition(conn database.DB, condition string, args ...interface{}) (int, error) {
+	if condition != "" {
+		condition = `WHERE ` + condition
+	}
+
+	var count int
+	err := conn.QueryRow(`
+		SELECT COUNT(*)
+		FROM `+postJoin+`
+		`+condition, args...).Scan(&count)
+
+	return count, err
+}
+
 func listPostsByCondition(conn database.DB, limit, offset int, condition string, args ...interface{}) ([]*PostRecord, error) {
 	var records []*PostRecord
 	if condition != "" {
 		condition = `WHERE ` + condition
 	}
-	rows, err := conn.Query(fmt.Sprintf(`
+	n := len(args)
+	rows, err := conn.Query(`
 		SELECT 
-			p.id, p.title, p.created, p.updated,
+			p.id, p.title, p.slug, p.revision, p.scheduled, p.publish_at, p.created, p.updated, p.views, p.deleted_at,
+			ARRAY(SELECT t.tag FROM post_tag t WHERE t.post = p.id ORDER BY t.tag),
+			rs.count, rs.last_edited,
 			r.id, r.content, r.filtered, r.author, r.created
-		FROM post p JOIN post_revision r ON p.revision = r.id
+		FROM `+postJoin+`
+		CROSS JOIN LATERAL (
+			SELECT COUNT(*) AS count, MAX(created) AS last_edited
+			FROM post_revision
+			WHERE post = p.id
+		) rs
 		`+condition+`
 		ORDER BY p.updated DESC
-		LIMIT %d OFFSET %d
-	`, limit, offset), args...)
+		LIMIT $`+strconv.Itoa(n+1)+` OFFSET $`+strconv.Itoa(n+2)+`
+	`, append(args, limit, offset)...)
 	if err != nil {
 		return nil, err
 	}
@@ -189,11 +539,22 @@ func listPostsByCondition(conn database.DB, limit, offset int, condition string,
 	for rows.Next() {
 		post := &Post{}
 		revision := &PostRevision{}
+		var active, scheduled uuid.NullUUID
+		var publishAt, deletedAt pq.NullTime
 		if err = rows.Scan(
 			&post.ID,
 			&post.Title,
+			&post.Slug,
+			&active,
+			&scheduled,
+			&publishAt,
 			&post.Created,
 			&post.Updated,
+			&post.Views,
+			&deletedAt,
+			pq.Array(&post.Tags),
+			&post.RevisionCount,
+			&post.LastEdited,
 			&revision.ID,
 			&revision.Content,
 			&revision.Filtered,
@@ -203,7 +564,10 @@ func listPostsByCondition(conn database.DB, limit, offset int, condition string,
 			return nil, err
 		}
 
-		post.Revision = revision.ID
+		post.Revision = active.UUID
+		post.Scheduled = scheduled.UUID
+		post.PublishAt = publishAt.Time
+		post.DeletedAt = deletedAt.Time
 		revision.Post = post.ID
 
 		records = append(records, &PostRecord{
@@ -215,18 +579,27 @@ func listPostsByCondition(conn database.DB, limit, offset int, condition string,
 	return records, nil
 }
 
-func listRevisionsByCondition(conn database.DB, condition string, args ...interface{}) ([]*PostRevision, error) {
+// listRevisionsByCondition lists the revisions, the newest first. A limit of
+// 0 lists all of them.
+func listRevisionsByCondition(conn database.DB, limit, offset int, condition string, args ...interface{}) ([]*PostRevision, error) {
 	var revs []*PostRevision
 
 	if condition != "" {
 		condition = `WHERE ` + condition
 	}
+	// LIMIT NULL is the same as LIMIT ALL.
+	var limitArg interface{}
+	if limit > 0 {
+		limitArg = limit
+	}
+	n := len(args)
 	rows, err := conn.Query(`
 		SELECT id, post, content, filtered, author, created
 		FROM post_revision
 		`+condition+`
 		ORDER BY created DESC
-	`, args...)
+		LIMIT $`+strconv.Itoa(n+1)+` OFFSET $`+strconv.Itoa(n+2)+`
+	`, append(args, limitArg, offset)...)
 	if err != nil {
 		return nil, err
 	}
@@ -252,34 +625,153 @@ func listRevisionsByCondition(conn database.DB, condition string, args ...interf
 
 // ListRevisions lists revisions for a given post.
 func ListRevisions(conn database.DB, pid uuid.UUID) ([]*PostRevision, error) {
-	return listRevisionsByCondition(conn, "post = $1", pid)
+	return listRevisionsByCondition(conn, 0, 0, "post = $1", pid)
 }
 
-// LoadEntityFromUrl loads a post from the URL.
-//
-// The 'param' tells the name of the parameter where the post's uuid is.
-func LoadEntityFromUrl(r *http.Request, param string) (interface{}, error) {
-	conn := database.Get(r)
+// ListRevisionsPage lists a page of the revisions of a post.
+func ListRevisionsPage(conn database.DB, pid uuid.UUID, limit, offset int) ([]*PostRevision, error) {
+	return listRevisionsByCondition(conn, limit, offset, "post = $1", pid)
+}
 
-	idstr := httprouter.ParamsFromContext(r.Context()).ByName(param)
-	if idstr == "" {
-		return nil, nil
-	}
+// CountRevisions returns the number of revisions of a post.
+func CountRevisions(conn database.DB, pid uuid.UUID) (int, error) {
+	var count int
+	err := conn.QueryRow(`SELECT COUNT(*) FROM post_revision WHERE post = $1`, pid).Scan(&count)
 
-	id, err := uuid.FromString(idstr)
+	return count, errors.Wrap(err, "error counting revisions")
+}
+
+// RevisionActivity is a revision with the title of its post and the name of
+// its author.
+type RevisionActivity struct {
+	Revision   *PostRevision
+	PostTitle  string
+	AuthorName string
+}
+
+// ListRecentRevisions lists the revisions of all posts, the newest first.
+func ListRecentRevisions(conn database.DB, limit, offset int) ([]*RevisionActivity, error) {
+	revs, err := listRevisionsByCondition(conn, limit, offset, "")
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse uuid in url")
+		return nil, errors.Wrap(err, "error listing revisions")
 	}
 
-	recs, err := listPostsByCondition(conn, 1, 0, "p.id = $1", id)
+	ids := make([]string, len(revs))
+	for i, rev := range revs {
+		ids[i] = rev.ID.String()
+	}
+
+	rows, err := conn.Query(`
+		SELECT r.id, p.title, a.username
+		FROM post_revision r
+			JOIN post p ON r.post = p.id
+			JOIN account a ON r.author = a.id
+		WHERE r.id = ANY($1::uuid[])
+	`, pq.Array(ids))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+		return nil, errors.Wrap(err, "error loading revision details")
+	}
+	defer rows.Close()
+
+	activities := make(map[uuid.UUID]*RevisionActivity, len(revs))
+	for rows.Next() {
+		var id uuid.UUID
+		a := &RevisionActivity{}
+		if err = rows.Scan(&id, &a.PostTitle, &a.AuthorName); err != nil {
+			return nil, err
 		}
-		return nil, errors.Wrap(err, "failed to load post")
+		activities[id] = a
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*RevisionActivity, 0, len(revs))
+	for _, rev := range revs {
+		if a, ok := activities[rev.ID]; ok {
+			a.Revision = rev
+			list = append(list, a)
+		}
+	}
+
+	return list, nil
+}
+
+// CountAllRevisions returns the number of revisions of all posts.
+func CountAllRevisions(conn database.DB) (int, error) {
+	var count int
+	err := conn.QueryRow(`SELECT COUNT(*) FROM post_revision`).Scan(&count)
+
+	return count, errors.Wrap(err, "error counting revisions")
+}
+
+// ListPosts lists the published posts.
+func ListPosts(conn database.DB, limit, offset int) ([]*PostRecord, error) {
+	return listPostsByCondition(conn, limit, offset, publishedCondition)
+}
 
-	return recs[0], nil
+// CountPosts returns the number of the published posts.
+func CountPosts(conn database.DB) (int, error) {
+	return countPostsByCondition(conn, publishedCondition)
+}
+
+// ListDeletedPosts lists the posts in the trash.
+func ListDeletedPosts(conn database.DB, limit, offset int) ([]*PostRecord, error) {
+	return listPostsByCondition(conn, limit, offset, deletedCondition)
+}
+
+// CountDeletedPosts returns the number of the posts in the trash.
+func CountDeletedPosts(conn database.DB) (int, error) {
+	return countPostsByCondition(conn, deletedCondition)
+}
+
+// ListPostsByTag lists the published posts that have the given tag.
+func ListPostsByTag(conn database.DB, tag string, limit, offset int) ([]*PostRecord, error) {
+	return listPostsByCondition(conn, limit, offset, publishedCondition+taggedCondition, tag)
+}
+
+// CountPostsByTag returns the number of the published posts that have the
+// given tag.
+func CountPostsByTag(conn database.DB, tag string) (int, error) {
+	return countPostsByCondition(conn, publishedCondition+taggedCondition, tag)
+}
+
+// ListRelatedPosts lists the published posts that share a tag with the given
+// post, or have the same author.
+func ListRelatedPosts(conn database.DB, rec *PostRecord, limit int) ([]*PostRecord, error) {
+	return listPostsByCondition(conn, limit, 0, publishedCondition+` AND p.id <> $1 AND (
+		r.author = $2 OR
+		EXISTS (
+			SELECT 1 FROM post_tag t1 JOIN post_tag t2 ON t1.tag = t2.tag
+			WHERE t1.post = p.id AND t2.post = $1
+		)
+	)`, rec.Post.ID, rec.Revision.Author)
+}
+
+// PublishScheduled publishes the scheduled revisions that are due.
+//
+// Returns the number of published posts.
+func PublishScheduled(conn database.DB) (int64, error) {
+	res, err := conn.Exec(`
+		UPDATE post SET
+			revision = scheduled,
+			scheduled = NULL,
+			publish_at = NULL,
+			updated = now()
+		WHERE scheduled IS NOT NULL AND publish_at <= $1
+	`, util.Now())
+	if err != nil {
+		return 0, errors.Wrap(err, "error publishing scheduled posts")
+	}
+
+	return res.RowsAffected()
+}
+
+// LoadEntityFromUrl loads a post from the URL.
+//
+// The 'param' tells the name of the parameter where the post's uuid is.
+func LoadEntityFromUrl(r *http.Request, param string) (interface{}, error) {
+	return page.NewParamLoader(param, page.UUIDParam, loadPostByColumn("id")).Load(r)
 }
 
 // LoadEntity loads an entity from the URL with the default parameter name 'id'.
@@ -287,6 +779,29 @@ func LoadEntity(r *http.Request) (interface{}, error) {
 	return LoadEntityFromUrl(r, "id")
 }
 
+// LoadEntityBySlug loads an entity from the URL by the slug in the 'slug'
+// parameter.
+func LoadEntityBySlug(r *http.Request) (interface{}, error) {
+	return page.NewParamLoader("slug", page.StringParam, loadPostByColumn("slug")).Load(r)
+}
+
+// loadPostByColumn creates a loader function that loads a post by the value of
+// a column of the post table.
+func loadPostByColumn(column string) page.KeyLoaderFunc {
+	return func(r *http.Request, key interface{}) (interface{}, error) {
+		recs, err := listPostsByCondition(database.Get(r), 1, 0, "p."+column+" = $1", key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load post")
+		}
+
+		if len(recs) == 0 {
+			return nil, nil
+		}
+
+		return recs[0], nil
+	}
+}
+
 func mustLoadRevisionsFromStrings(conn database.DB, pid uuid.UUID, idstrs ...string) ([]*PostRevision, error) {
 	revisions := make([]interface{}, len(idstrs))
 	for i, idstr := range idstrs {
@@ -299,7 +814,7 @@ func mustLoadRevisionsFromStrings(conn database.DB, pid uuid.UUID, idstrs ...str
 
 	placeholders := util.GeneratePlaceholders(2, len(revisions))
 
-	revs, err := listRevisionsByCondition(conn, "post = $1 AND id IN ("+placeholders+")",
+	revs, err := listRevisionsByCondition(conn, 0, 0, "post = $1 AND id IN ("+placeholders+")",
 		append([]interface{}{pid}, revisions...)...)
 	if err != nil {
 		return nil, err
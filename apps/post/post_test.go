@@ -17,16 +17,22 @@
 package post_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/PuerkitoBio/goquery"
 	lorem "github.com/drhodes/golorem"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/require"
 	"github.com/tamasd/simplesite/apps/account"
 	"github.com/tamasd/simplesite/apps/post"
+	"github.com/tamasd/simplesite/config"
 	"github.com/tamasd/simplesite/util/testutil"
 )
 
@@ -55,7 +61,7 @@ func TestPostCRUD(t *testing.T) {
 	createPostData.Set("Title", lorem.Sentence(1, 8))
 	createPostData.Set("Content", lorem.Paragraph(8, 16))
 	adminresp := admin.Form("/posts/create").Submit(createPostData)
-	require.Equal(t, http.StatusFound, adminresp.StatusCode)
+	require.Equal(t, http.StatusSeeOther, adminresp.StatusCode)
 	admin.FollowRedirect()
 
 	require.Equal(t, createPostData.Get("Title"), admin.Page.Find("article.post header h2").First().Text())
@@ -78,7 +84,7 @@ func TestPostCRUD(t *testing.T) {
 	require.Equal(t, createPostData.Get("Content"), editPostData.Get("Content"))
 	editPostData.Set("Content", lorem.Paragraph(8, 16))
 	resp := sf.Submit(editPostData)
-	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
 	admin.FollowRedirect()
 
 	require.Equal(t, editPostData.Get("Title"), admin.Page.Find("article.post header h2").First().Text())
@@ -93,9 +99,1088 @@ func TestPostCRUD(t *testing.T) {
 	require.True(t, strings.HasPrefix(setRevisionButton, "set:"))
 	revisionFormData.Set("Op", setRevisionButton)
 	adminresp = sf.Submit(revisionFormData)
-	require.Equal(t, http.StatusFound, adminresp.StatusCode)
+	require.Equal(t, http.StatusSeeOther, adminresp.StatusCode)
 	admin.FollowRedirect()
 
 	require.Equal(t, createPostData.Get("Title"), admin.Page.Find("article.post header h2").First().Text())
 	require.Equal(t, createPostData.Get("Content"), strings.TrimSpace(admin.Page.Find("article.post section.post").First().Text()))
 }
+
+func TestComments(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	commenter := srv.CreateClient(t)
+	other := srv.CreateClient(t)
+
+	admin.RegistrationAndLogin(testutil.TestRegData())
+	commenter.RegistrationAndLogin(testutil.TestRegData())
+	other.RegistrationAndLogin(testutil.TestRegData())
+
+	err := account.SavePermissions(conn, admin.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+	})
+	require.Nil(t, err)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	admin.FollowRedirect()
+	postURL := admin.Page.Find("article.post header h2 a").AttrOr("href", "")
+	require.NotZero(t, postURL)
+
+	commentData := &url.Values{}
+	commentData.Set("Content", lorem.Sentence(4, 8))
+	resp = commenter.Form(postURL + "/comment").Submit(commentData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	commenter.FollowRedirect()
+	require.Equal(t, commentData.Get("Content"), strings.TrimSpace(commenter.Page.Find("div.comment section.comment").First().Text()))
+	require.NotEqual(t, 0, commenter.Page.Find("div.comment footer a.delete").Length())
+	deleteURL := commenter.Page.Find("div.comment footer a.delete").AttrOr("href", "")
+
+	resp = other.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, other.Page.Find("div.comment").Length())
+	require.Equal(t, 0, other.Page.Find("div.comment footer a.delete").Length())
+	logoutURL, err := url.Parse(other.Page.Find("li.logout a").AttrOr("href", ""))
+	require.Nil(t, err)
+	otherDeleteURL := strings.Split(deleteURL, "?")[0] + "?token=" + logoutURL.Query().Get("token")
+	resp = other.Request(http.MethodGet, otherDeleteURL, nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	err = account.SavePermissions(conn, other.CurrentUID(), account.Permissions{
+		post.PermissionModerateComments,
+	})
+	require.Nil(t, err)
+	other.Request(http.MethodGet, postURL, nil)
+	require.NotEqual(t, 0, other.Page.Find("div.comment footer a.delete").Length())
+
+	resp = commenter.ClickLink("div.comment footer a.delete")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	commenter.FollowRedirect()
+	require.Equal(t, 0, commenter.Page.Find("div.comment").Length())
+}
+
+func TestPostTags(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	err := account.SavePermissions(conn, admin.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+	})
+	require.Nil(t, err)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	createPostData.Set("Tags", "Web Development, go")
+	resp := admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	for _, tag := range []string{"web-development", "go"} {
+		resp = admin.Request(http.MethodGet, "/posts/tag/"+tag, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, createPostData.Get("Title"), admin.Page.Find("article.post header h2").First().Text())
+		require.Equal(t, 2, admin.Page.Find("article.post footer li.tag").Length())
+	}
+
+	resp = admin.Request(http.MethodGet, "/posts/tag/nonexistent", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, admin.Page.Find("article.post").Length())
+
+	resp = admin.Request(http.MethodGet, "/posts/tag/Web%20Development?page=1", nil)
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	require.Equal(t, "/posts/tag/web-development?page=1", resp.Header.Get("Location"))
+
+	resp = admin.Request(http.MethodGet, "/posts/tag/%21", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRevertRevision(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	err := account.SavePermissions(conn, admin.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	admin.FollowRedirect()
+
+	href := admin.Page.Find("article.post footer a.edit").AttrOr("href", "")
+	require.NotZero(t, href)
+	sf := admin.Form(href)
+	editPostData := admin.FormValues("")
+	editPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp = sf.Submit(editPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	admin.FollowRedirect()
+
+	href = admin.Page.Find("article.post footer a.revisions").AttrOr("href", "")
+	require.NotZero(t, href)
+	sf = admin.Form(href)
+	revertButton := admin.Page.Find("td.diff-set button[type=submit][name=Op]").Last().AttrOr("value", "")
+	require.True(t, strings.HasPrefix(revertButton, "revert:"))
+	revisionFormData := &url.Values{}
+	revisionFormData.Set("Op", revertButton)
+	resp = sf.Submit(revisionFormData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	admin.FollowRedirect()
+
+	require.Equal(t, createPostData.Get("Content"), strings.TrimSpace(admin.Page.Find("article.post section.post").First().Text()))
+
+	pid, err := uuid.FromString(strings.Split(href, "/")[2])
+	require.Nil(t, err)
+	revs, err := post.ListRevisions(conn, pid)
+	require.Nil(t, err)
+	require.Len(t, revs, 3)
+
+	var reverted int
+	for _, rev := range revs {
+		if rev.Content == createPostData.Get("Content") {
+			reverted++
+		}
+	}
+	require.Equal(t, 2, reverted)
+}
+
+func TestPostViews(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	err := account.SavePermissions(conn, admin.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+	})
+	require.Nil(t, err)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	admin.FollowRedirect()
+
+	href := admin.Page.Find("article.post header h2 a").AttrOr("href", "")
+	require.NotZero(t, href)
+
+	viewer := srv.CreateClient(t)
+	resp = viewer.Request(http.MethodGet, href, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1 views", viewer.Page.Find("article.post footer span.views").Text())
+
+	resp = viewer.Request(http.MethodGet, href, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1 views", viewer.Page.Find("article.post footer span.views").Text())
+
+	resp = admin.Request(http.MethodGet, href, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "2 views", admin.Page.Find("article.post footer span.views").Text())
+}
+
+func TestScheduledPost(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	clock, restore := testutil.InstallFakeClock()
+	defer restore()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.LoginAsWithPermissions(post.PermissionCreatePost, post.PermissionEditOwnPost)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	createPostData.Set("PublishAt", clock.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	resp := admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = admin.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, admin.Page.Find("article.post").Length())
+
+	clock.Advance(2 * time.Hour)
+	published, err := post.PublishScheduled(conn)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), published)
+
+	resp = admin.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, createPostData.Get("Title"), admin.Page.Find("article.post header h2").First().Text())
+
+	// Scheduling a new revision keeps the live one listed.
+	postURL := admin.Page.Find("article.post header h2 a").AttrOr("href", "")
+	require.NotZero(t, postURL)
+	sf := admin.Form(postURL + "/edit")
+	editPostData := admin.FormValues("")
+	editPostData.Set("Content", lorem.Paragraph(8, 16))
+	editPostData.Set("PublishAt", clock.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	resp = sf.Submit(editPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = admin.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, admin.Page.Find("article.post").Length())
+}
+
+func TestRelatedPosts(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	err := account.SavePermissions(conn, admin.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+	})
+	require.Nil(t, err)
+
+	var titles []string
+	for i := 0; i < 3; i++ {
+		createPostData := &url.Values{}
+		createPostData.Set("Title", lorem.Sentence(1, 8))
+		createPostData.Set("Content", lorem.Paragraph(8, 16))
+		resp := admin.Form("/posts/create").Submit(createPostData)
+		require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		titles = append(titles, createPostData.Get("Title"))
+	}
+
+	resp := admin.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = admin.ClickLink("article.post header h2 a")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	current := admin.Page.Find("article.post header h2").First().Text()
+	var related []string
+	admin.Page.Find("section.related li a").Each(func(_ int, s *goquery.Selection) {
+		related = append(related, s.Text())
+	})
+	require.Len(t, related, 2)
+	require.NotContains(t, related, current)
+	for _, title := range titles {
+		if title != current {
+			require.Contains(t, related, title)
+		}
+	}
+}
+
+func TestPostAPI(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	err := account.SavePermissions(conn, admin.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+
+	_, token, err := account.CreateAPIToken(conn, admin.CurrentUID(), "test")
+	require.Nil(t, err)
+	bearer := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	api := srv.CreateClient(t)
+
+	resp := api.Request(http.MethodGet, "/api/posts", nil)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	resp = api.Request(http.MethodGet, "/api/posts", nil, func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer invalid")
+	})
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	title := lorem.Sentence(1, 8)
+	body, err := json.Marshal(map[string]interface{}{
+		"title":   title,
+		"content": lorem.Paragraph(8, 16),
+		"tags":    []string{"API", "Go"},
+	})
+	require.Nil(t, err)
+	resp = api.Request(http.MethodPost, "/api/posts", bytes.NewBuffer(body), bearer)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	created := map[string]interface{}{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&created))
+	require.Equal(t, title, created["title"])
+	require.Equal(t, []interface{}{"api", "go"}, created["tags"])
+
+	resp = api.Request(http.MethodGet, "/api/posts", nil, bearer)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var posts []map[string]interface{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&posts))
+	require.Len(t, posts, 1)
+	require.Equal(t, created["id"], posts[0]["id"])
+
+	body, err = json.Marshal(map[string]interface{}{"title": ""})
+	require.Nil(t, err)
+	resp = api.Request(http.MethodPut, "/api/post/"+created["id"].(string), bytes.NewBuffer(body), bearer)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = api.Request(http.MethodGet, "/api/post/"+uuid.NewV4().String(), nil, bearer)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	require.False(t, uuid.Equal(uuid.Nil, admin.CurrentUID()))
+	require.True(t, uuid.Equal(uuid.Nil, api.CurrentUID()))
+}
+
+func TestPostCount(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	for i := 0; i <= post.PageSize; i++ {
+		rec := &post.PostRecord{
+			Post: &post.Post{Title: lorem.Sentence(1, 8)},
+			Revision: &post.PostRevision{
+				Content: lorem.Paragraph(1, 2),
+				Author:  admin.CurrentUID(),
+			},
+		}
+		require.Nil(t, rec.Save(conn))
+	}
+	scheduled := &post.PostRecord{
+		Post: &post.Post{
+			Title:     lorem.Sentence(1, 8),
+			PublishAt: time.Now().Add(time.Hour),
+		},
+		Revision: &post.PostRevision{
+			Content: lorem.Paragraph(1, 2),
+			Author:  admin.CurrentUID(),
+		},
+	}
+	require.Nil(t, scheduled.Save(conn))
+
+	total, err := post.CountPosts(conn)
+	require.Nil(t, err)
+	require.Equal(t, post.PageSize+1, total)
+
+	resp := admin.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, post.PageSize, admin.Page.Find("article.post").Length())
+	require.Equal(t, "Page 1 of 2", admin.Page.Find("nav.pager span.current").Text())
+
+	resp = admin.Request(http.MethodGet, "/posts?page=2", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, admin.Page.Find("article.post").Length())
+	require.Equal(t, 1, admin.Page.Find("nav.pager a.prev").Length())
+	require.Equal(t, 0, admin.Page.Find("nav.pager a.next").Length())
+
+	for _, page := range []string{"0", "-1", "3", "x"} {
+		resp = admin.Request(http.MethodGet, "/posts?page="+page, nil)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode, page)
+	}
+
+	_, token, err := account.CreateAPIToken(conn, admin.CurrentUID(), "test")
+	require.Nil(t, err)
+	resp = srv.CreateClient(t).Request(http.MethodGet, "/api/posts", nil, func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, strconv.Itoa(post.PageSize+1), resp.Header.Get("X-Total-Count"))
+}
+
+func TestPostBySlug(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	rec := &post.PostRecord{
+		Post: &post.Post{Title: lorem.Sentence(1, 8)},
+		Revision: &post.PostRevision{
+			Content: lorem.Paragraph(1, 2),
+			Author:  admin.CurrentUID(),
+		},
+	}
+	require.Nil(t, rec.Save(conn))
+	require.Equal(t, post.GenerateSlug(rec.Post.ID, rec.Post.Title), rec.Post.Slug)
+
+	c := srv.CreateClient(t)
+	resp := c.Request(http.MethodGet, "/p/"+rec.Post.Slug, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, rec.Post.Title, c.Page.Find("article.post header h2").First().Text())
+
+	resp = c.Request(http.MethodGet, "/p/missing-slug", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = c.Request(http.MethodGet, "/post/not-an-uuid", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestFrontPage(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	admin := srv.CreateClient(t)
+	anon := srv.CreateClient(t)
+
+	admin.RegistrationAndLogin(testutil.TestRegData())
+	uid := admin.CurrentUID()
+	require.False(t, uuid.Equal(uid, uuid.Nil))
+	require.Nil(t, account.SavePermissions(srv.Database(), uid, account.Permissions{
+		post.PermissionCreatePost,
+	}))
+
+	resp := anon.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, anon.Page.Find("article.teaser").Length())
+	require.NotZero(t, anon.Page.Find("#body p").Length())
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp = admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = anon.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	link := anon.Page.Find("article.teaser header h2 a")
+	require.Equal(t, createPostData.Get("Title"), link.Text())
+
+	resp = anon.ClickLink("article.teaser header h2 a")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, createPostData.Get("Title"), anon.Page.Find("article.post header h2").First().Text())
+}
+
+func TestSoftDelete(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	author := srv.CreateClient(t)
+	admin := srv.CreateClient(t)
+	anon := srv.CreateClient(t)
+
+	author.RegistrationAndLogin(testutil.TestRegData())
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	err := account.SavePermissions(conn, author.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+	err = account.SavePermissions(conn, admin.CurrentUID(), account.Permissions{
+		post.PermissionManageTrash,
+	})
+	require.Nil(t, err)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := author.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	author.FollowRedirect()
+	postURL := author.Page.Find("article.post header h2 a").AttrOr("href", "")
+	require.NotZero(t, postURL)
+
+	resp = author.ClickLink("article.post footer a.delete")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	author.FollowRedirect()
+	require.Equal(t, 0, author.Page.Find("article.post").Length())
+
+	resp = anon.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, anon.Page.Find("article.post").Length())
+	resp = anon.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = author.Request(http.MethodGet, postURL+"/edit", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = author.Request(http.MethodGet, postURL+"/revisions", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = author.Request(http.MethodGet, "/posts/trash", nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = admin.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = admin.Request(http.MethodGet, "/posts/trash", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, createPostData.Get("Title"), admin.Page.Find("table.trash td a").First().Text())
+
+	resp = admin.ClickLink("table.trash a.restore")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	admin.FollowRedirect()
+	require.Equal(t, 0, admin.Page.Find("table.trash a.restore").Length())
+
+	resp = anon.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, createPostData.Get("Title"), anon.Page.Find("article.post header h2").First().Text())
+	resp = anon.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPostPreview(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	author := srv.CreateClient(t)
+	other := srv.CreateClient(t)
+
+	author.RegistrationAndLogin(testutil.TestRegData())
+	other.RegistrationAndLogin(testutil.TestRegData())
+
+	err := account.SavePermissions(conn, author.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := author.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	author.FollowRedirect()
+	postURL := author.Page.Find("article.post header h2 a").AttrOr("href", "")
+	require.NotZero(t, postURL)
+
+	resp = author.Request(http.MethodGet, postURL+"/edit", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	previewURL := author.Page.Find("button.preview").AttrOr("formaction", "")
+	require.NotZero(t, previewURL)
+
+	previewData := &url.Values{}
+	previewData.Set("Title", lorem.Sentence(1, 8))
+	previewData.Set("Content", lorem.Paragraph(8, 16))
+	formContentType := func(r *http.Request) {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp = author.Request(http.MethodPost, previewURL, strings.NewReader(previewData.Encode()), formContentType)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, previewData.Get("Title"), author.Page.Find("article.post header h2").First().Text())
+	require.Equal(t, previewData.Get("Content"), strings.TrimSpace(author.Page.Find("article.post section.post").First().Text()))
+
+	resp = author.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, createPostData.Get("Title"), author.Page.Find("article.post header h2").First().Text())
+	require.Equal(t, createPostData.Get("Content"), strings.TrimSpace(author.Page.Find("article.post section.post").First().Text()))
+
+	resp = author.Request(http.MethodPost, postURL+"/preview", strings.NewReader(previewData.Encode()), formContentType)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	other.Request(http.MethodGet, "/posts", nil)
+	logoutURL, err := url.Parse(other.Page.Find("li.logout a").AttrOr("href", ""))
+	require.Nil(t, err)
+	resp = other.Request(http.MethodPost, postURL+"/preview?token="+logoutURL.Query().Get("token"),
+		strings.NewReader(previewData.Encode()), formContentType)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestRevisionCount(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	editor := srv.CreateClient(t)
+	anon := srv.CreateClient(t)
+
+	editor.RegistrationAndLogin(testutil.TestRegData())
+	err := account.SavePermissions(conn, editor.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := editor.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	editor.FollowRedirect()
+	require.Equal(t, "1 revisions", editor.Page.Find("article.post footer span.revision-count").Text())
+
+	for i := 0; i < 2; i++ {
+		href := editor.Page.Find("article.post footer a.edit").AttrOr("href", "")
+		require.NotZero(t, href)
+		sf := editor.Form(href)
+		editPostData := editor.FormValues("")
+		editPostData.Set("Content", lorem.Paragraph(8, 16))
+		resp = sf.Submit(editPostData)
+		require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		editor.FollowRedirect()
+	}
+
+	require.Equal(t, "3 revisions", editor.Page.Find("article.post footer span.revision-count").Text())
+	require.NotZero(t, editor.Page.Find("article.post footer span.last-edited time").AttrOr("datetime", ""))
+
+	resp = anon.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, anon.Page.Find("article.post").Length())
+	require.Equal(t, 0, anon.Page.Find("article.post footer span.revision-count").Length())
+}
+
+func TestPostEditConflict(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	author := srv.CreateClient(t)
+	editor := srv.CreateClient(t)
+
+	author.RegistrationAndLogin(testutil.TestRegData())
+	editor.RegistrationAndLogin(testutil.TestRegData())
+
+	err := account.SavePermissions(conn, author.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+	err = account.SavePermissions(conn, editor.CurrentUID(), account.Permissions{
+		post.PermissionEditAnyPost,
+	})
+	require.Nil(t, err)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := author.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	author.FollowRedirect()
+	postURL := author.Page.Find("article.post header h2 a").AttrOr("href", "")
+	require.NotZero(t, postURL)
+
+	authorForm := author.Form(postURL + "/edit")
+	authorData := author.FormValues("")
+	require.NotZero(t, authorData.Get("BaseRevision"))
+	editorForm := editor.Form(postURL + "/edit")
+	editorData := editor.FormValues("")
+
+	authorData.Set("Content", lorem.Paragraph(8, 16))
+	resp = authorForm.Submit(authorData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	editorData.Set("Content", lorem.Paragraph(8, 16))
+	resp = editorForm.Submit(editorData)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, editor.Page.Find(".messages.error").Text(), "has been changed")
+	diffURL := editor.Page.Find("p.conflict a").AttrOr("href", "")
+	require.True(t, strings.HasPrefix(diffURL, postURL+"/revisions/"))
+
+	resp = author.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, authorData.Get("Content"), strings.TrimSpace(author.Page.Find("article.post section.post").First().Text()))
+
+	resp = editor.Request(http.MethodGet, diffURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, 0, editor.Page.Find("div.diff ins").Length())
+}
+
+func TestPostPageSize(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"post_page_size": "5",
+	})
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	for i := 0; i < 7; i++ {
+		rec := &post.PostRecord{
+			Post: &post.Post{Title: lorem.Sentence(1, 8)},
+			Revision: &post.PostRevision{
+				Content: lorem.Paragraph(1, 2),
+				Author:  admin.CurrentUID(),
+			},
+		}
+		require.Nil(t, rec.Save(conn))
+	}
+
+	resp := admin.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 5, admin.Page.Find("article.post").Length())
+	require.Equal(t, "Page 1 of 2", admin.Page.Find("nav.pager span.current").Text())
+
+	resp = admin.Request(http.MethodGet, "/posts?page=2", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 2, admin.Page.Find("article.post").Length())
+}
+
+func TestClampPageSize(t *testing.T) {
+	require.Equal(t, post.PageSize, post.ClampPageSize(0))
+	require.Equal(t, post.PageSize, post.ClampPageSize(-1))
+	require.Equal(t, 5, post.ClampPageSize(5))
+	require.Equal(t, post.MaxPageSize, post.ClampPageSize(post.MaxPageSize+1))
+}
+
+func TestUnpublish(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	author := srv.CreateClient(t)
+	anon := srv.CreateClient(t)
+
+	author.RegistrationAndLogin(testutil.TestRegData())
+	err := account.SavePermissions(conn, author.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := author.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	author.FollowRedirect()
+	postURL := author.Page.Find("article.post header h2 a").AttrOr("href", "")
+	require.NotZero(t, postURL)
+
+	resp = author.Request(http.MethodGet, postURL+"/revisions", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, author.Page.Find("a.publish").Length())
+	resp = author.ClickLink("a.unpublish")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	author.FollowRedirect()
+	require.Equal(t, 0, author.Page.Find("a.unpublish").Length())
+
+	resp = anon.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 0, anon.Page.Find("article.post").Length())
+	resp = anon.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = author.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, author.Page.Find("article.post footer span.unpublished").Length())
+
+	resp = author.Request(http.MethodGet, postURL+"/revisions", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = author.ClickLink("a.publish")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	resp = anon.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, createPostData.Get("Title"), anon.Page.Find("article.post header h2").First().Text())
+	resp = anon.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRevisionsPagination(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"post_revisions_page_size": "5",
+	})
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	author := srv.CreateClient(t)
+	author.RegistrationAndLogin(testutil.TestRegData())
+	err := account.SavePermissions(conn, author.CurrentUID(), account.Permissions{
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+
+	rec := &post.PostRecord{
+		Post:     &post.Post{Title: lorem.Sentence(1, 8)},
+		Revision: &post.PostRevision{Author: author.CurrentUID()},
+	}
+	for i := 0; i < 8; i++ {
+		rec.Revision.Content = lorem.Paragraph(1, 2)
+		require.Nil(t, rec.Save(conn))
+	}
+
+	revisionsURL := "/post/" + rec.Post.ID.String() + "/revisions"
+	resp := author.Request(http.MethodGet, revisionsURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 5, author.Page.Find("form table tbody tr").Length())
+	require.Equal(t, "Current", strings.TrimSpace(author.Page.Find("td.diff-set").First().Text()))
+	require.Equal(t, "Page 1 of 2", author.Page.Find("nav.pager span.current").Text())
+
+	require.Equal(t, "?page=2", author.Page.Find("nav.pager a.next").AttrOr("href", ""))
+
+	resp = author.Request(http.MethodGet, revisionsURL+"?page=2", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 3, author.Page.Find("form table tbody tr").Length())
+	require.Equal(t, 1, author.Page.Find("nav.pager a.prev").Length())
+
+	resp = author.Request(http.MethodGet, revisionsURL+"?page=3", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestActivity(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	author := srv.CreateClient(t)
+	editor := srv.CreateClient(t)
+
+	authorRegData := testutil.TestRegData()
+	author.RegistrationAndLogin(authorRegData)
+	editorRegData := testutil.TestRegData()
+	editor.RegistrationAndLogin(editorRegData)
+
+	err := account.SavePermissions(conn, author.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+	err = account.SavePermissions(conn, editor.CurrentUID(), account.Permissions{
+		post.PermissionEditAnyPost,
+	})
+	require.Nil(t, err)
+
+	first := &url.Values{}
+	first.Set("Title", lorem.Sentence(1, 8))
+	first.Set("Content", lorem.Paragraph(8, 16))
+	resp := author.Form("/posts/create").Submit(first)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	author.FollowRedirect()
+	postURL := author.Page.Find("article.post header h2 a").AttrOr("href", "")
+	require.NotZero(t, postURL)
+
+	sf := editor.Form(postURL + "/edit")
+	editData := editor.FormValues("")
+	editData.Set("Content", lorem.Paragraph(8, 16))
+	resp = sf.Submit(editData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	second := &url.Values{}
+	second.Set("Title", lorem.Sentence(1, 8))
+	second.Set("Content", lorem.Paragraph(8, 16))
+	resp = author.Form("/posts/create").Submit(second)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = author.Request(http.MethodGet, "/admin/activity", nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = editor.Request(http.MethodGet, "/admin/activity", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	rows := editor.Page.Find("table.activity tbody tr")
+	require.Equal(t, 3, rows.Length())
+	require.Equal(t, []string{second.Get("Title"), first.Get("Title"), first.Get("Title")},
+		rows.Find("td.post").Map(func(_ int, s *goquery.Selection) string { return s.Text() }))
+	require.Equal(t, []string{authorRegData.Get("Username"), editorRegData.Get("Username"), authorRegData.Get("Username")},
+		rows.Find("td.author").Map(func(_ int, s *goquery.Selection) string { return s.Text() }))
+}
+
+func TestFrontMatter(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	admin := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+	err := account.SavePermissions(conn, admin.CurrentUID(), account.Permissions{
+		post.PermissionCreatePost,
+		post.PermissionEditOwnPost,
+	})
+	require.Nil(t, err)
+
+	slug := "front-matter-" + strings.ToLower(lorem.Word(4, 8))
+	body := lorem.Paragraph(8, 16)
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", "---\nslug: "+slug+"\ntags: [alpha, beta]\ndescription: ignored\n---\n"+body)
+	resp := admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = admin.Request(http.MethodGet, "/p/"+slug, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, body, strings.TrimSpace(admin.Page.Find("article.post section.post").First().Text()))
+	require.Equal(t, "alpha beta", strings.Join(strings.Fields(admin.Page.Find("article.post ul.tags").First().Text()), " "))
+
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	resp = admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "The slug is already used by another post", admin.Page.Find("p.field-content span.error").Text())
+
+	malformed := "---\nslug: [broken\n---\n" + body
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", malformed)
+	createPostData.Set("Tags", "gamma")
+	resp = admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	admin.FollowRedirect()
+	require.Equal(t, createPostData.Get("Title"), admin.Page.Find("article.post header h2").First().Text())
+	require.Contains(t, admin.Page.Find("article.post section.post").First().Text(), "slug: [broken")
+	require.Equal(t, "gamma", strings.TrimSpace(admin.Page.Find("article.post ul.tags").First().Text()))
+}
+
+func TestLoginAsWithPermissions(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	admin := srv.CreateClient(t)
+	uid := admin.LoginAsWithPermissions(post.PermissionCreatePost, post.PermissionEditOwnPost)
+	require.False(t, uuid.Equal(uid, uuid.Nil))
+	require.True(t, uuid.Equal(uid, admin.CurrentUID()))
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := admin.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	admin.FollowRedirect()
+
+	require.Equal(t, createPostData.Get("Title"), admin.Page.Find("article.post header h2").First().Text())
+	require.NotEqual(t, 0, admin.Page.Find(`footer a.edit`).Length())
+}
+
+func TestRevisionPatch(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	conn := srv.Database()
+	author := srv.CreateClient(t)
+	author.LoginAsWithPermissions(post.PermissionEditOwnPost)
+
+	rec := &post.PostRecord{
+		Post:     &post.Post{Title: lorem.Sentence(1, 8)},
+		Revision: &post.PostRevision{Author: author.CurrentUID(), Content: "first\nsecond\nthird\n"},
+	}
+	require.Nil(t, rec.Save(conn))
+	rec.Revision.Content = "first\nchanged\nthird\nfourth\n"
+	require.Nil(t, rec.Save(conn))
+
+	revs, err := post.ListRevisions(conn, rec.Post.ID)
+	require.Nil(t, err)
+	require.Len(t, revs, 2)
+	diffURL := "/post/" + rec.Post.ID.String() + "/revisions/" + revs[0].ID.String() + "/" + revs[1].ID.String()
+
+	resp := author.Request(http.MethodGet, diffURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "?format=patch", author.Page.Find("p.patch a").AttrOr("href", ""))
+
+	resp = author.Request(http.MethodGet, diffURL+"?format=patch", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment"))
+
+	body := new(bytes.Buffer)
+	_, err = body.ReadFrom(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "--- "+rec.Post.Slug+"@"+revs[1].ID.String()+"\n"+
+		"+++ "+rec.Post.Slug+"@"+revs[0].ID.String()+"\n"+
+		"@@ -1,3 +1,4 @@\n"+
+		" first\n"+
+		"-second\n"+
+		"+changed\n"+
+		" third\n"+
+		"+fourth\n", body.String())
+}
+
+func TestConditionalGet(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	author := srv.CreateClient(t)
+	anon := srv.CreateClient(t)
+	author.LoginAsWithPermissions(post.PermissionCreatePost, post.PermissionEditOwnPost)
+
+	createPostData := &url.Values{}
+	createPostData.Set("Title", lorem.Sentence(1, 8))
+	createPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp := author.Form("/posts/create").Submit(createPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	author.FollowRedirect()
+	postURL := author.Page.Find("article.post header h2 a").AttrOr("href", "")
+	require.NotZero(t, postURL)
+
+	ifNoneMatch := func(etag string) func(*http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("If-None-Match", etag)
+		}
+	}
+
+	for _, target := range []string{postURL, "/posts"} {
+		resp = author.Request(http.MethodGet, target, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		etag := resp.Header.Get("ETag")
+		lastModified := resp.Header.Get("Last-Modified")
+		require.NotZero(t, etag)
+		require.NotZero(t, lastModified)
+		require.Contains(t, resp.Header.Get("Vary"), "Cookie")
+
+		resp = author.Request(http.MethodGet, target, nil, ifNoneMatch(etag))
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+		require.Zero(t, resp.Header.Get("Content-Security-Policy"))
+
+		resp = author.Request(http.MethodGet, target, nil, func(r *http.Request) {
+			r.Header.Set("If-Modified-Since", lastModified)
+		})
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+		resp = anon.Request(http.MethodGet, target, nil, ifNoneMatch(etag))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp = author.Request(http.MethodGet, postURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+
+	sf := author.Form(postURL + "/edit")
+	editPostData := author.FormValues("")
+	editPostData.Set("Content", lorem.Paragraph(8, 16))
+	resp = sf.Submit(editPostData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = author.Request(http.MethodGet, postURL, nil, ifNoneMatch(etag))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestBasePath(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnvWithConfig(config.MapStorage{
+		"base_path": "/blog",
+	})
+	defer srv.Cleanup()
+
+	c := srv.CreateClient(t)
+
+	resp := c.Request(http.MethodGet, "/posts", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = c.Request(http.MethodGet, "/blog/posts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	stylesheet, ok := c.Page.Find(`link[rel="stylesheet"]`).First().Attr("href")
+	require.True(t, ok)
+	require.True(t, strings.HasPrefix(stylesheet, "/blog/assets/"), stylesheet)
+	c.Page.Find("nav a").Each(func(_ int, a *goquery.Selection) {
+		href, _ := a.Attr("href")
+		require.True(t, strings.HasPrefix(href, "/blog/"), href)
+	})
+
+	resp = c.Request(http.MethodGet, stylesheet, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	regData := testutil.TestRegData()
+	resp = c.Form("/blog/register").Submit(regData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.True(t, strings.HasPrefix(resp.Header.Get("Location"), "/blog/"), resp.Header.Get("Location"))
+}
@@ -0,0 +1,348 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package staticpage
+
+import (
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/tamasd/simplesite/apps/account"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/form"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/page"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/tamasd/simplesite/server"
+	"github.com/tamasd/simplesite/session"
+	"github.com/tamasd/simplesite/util"
+	"github.com/urfave/negroni"
+)
+
+const (
+	// PermissionEditStaticPages is the permission for editing the static
+	// pages.
+	PermissionEditStaticPages = "edit-static-pages"
+
+	staticPageContextKey = "staticpage"
+)
+
+var (
+	slugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+	staticPagePage = page.NamedSubPage("staticpage/page", `
+{{define "secondary-menu-items"}}
+	{{if .CanEdit}}
+		<a class="edit" href="{{url "/page/"}}{{.Page.Slug}}/edit">Edit</a>
+	{{end}}
+{{end}}
+{{define "body"}}
+{{template "secondary-menu" .}}
+<article class="page">
+	<section class="page">
+		{{.Page.Filtered}}
+	</section>
+</article>
+{{end}}
+`)
+
+	staticPageListPage = page.NamedSubPage("staticpage/listing", `
+{{define "secondary-menu-items"}}
+	<a href="{{url "/pages/create"}}">Create page</a>
+{{end}}
+{{define "body"}}
+{{template "secondary-menu" .}}
+<table class="pages">
+	<tbody>
+		{{range .Pages}}
+		<tr>
+			<td class="maxwidth"><a href="{{url "/page/"}}{{.Slug}}">{{.Title}}</a></td>
+			<td><a class="edit" href="{{url "/page/"}}{{.Slug}}/edit">Edit</a></td>
+			<td><a class="delete" href="{{url "/page/"}}{{.Slug}}/delete?token={{$.CSRFToken}}">Delete</a></td>
+		</tr>
+		{{else}}
+		<tr><td>No pages found</td></tr>
+		{{end}}
+	</tbody>
+</table>
+{{end}}
+`)
+
+	staticPageFormPage = page.NamedSubPage("staticpage/form", `
+{{define "body"}}
+<form method="POST">
+	{{.ErrorMessages}}
+	{{.CSRFToken}}
+	<p><label>Title: <br/><input type="textfield" name="Title" value="{{.Data.Title}}" /></label></p>
+	<p><label>Content: <br/><textarea name="Content">{{.Data.Content}}</textarea></label></p>
+	<p><input type="submit" value="Save" /></p>
+</form>
+{{end}}
+`)
+
+	staticPageCreateFormPage = page.NamedSubPage("staticpage/create", `
+{{define "body"}}
+<form method="POST">
+	{{.ErrorMessages}}
+	{{.CSRFToken}}
+	<p><label>Slug: <br/><input type="textfield" name="Slug" value="{{.Data.Slug}}" /></label></p>
+	<p><label>Title: <br/><input type="textfield" name="Title" value="{{.Data.Title}}" /></label></p>
+	<p><label>Content: <br/><textarea name="Content">{{.Data.Content}}</textarea></label></p>
+	<p><input type="submit" value="Save" /></p>
+</form>
+{{end}}
+`)
+)
+
+type staticPageFormPageData struct {
+	Slug    string
+	Title   string
+	Content string
+}
+
+type staticPagePageData struct {
+	Page    *StaticPage
+	CanEdit bool
+}
+
+type staticPageListPageData struct {
+	Pages     []*StaticPage
+	CSRFToken string
+}
+
+// Pages returns the list of routes for the static pages.
+func Pages(store keyvalue.Store, filter func(string) string) []server.Route {
+	txmw := database.NewTxMiddleware(true)
+	rotxmw := database.NewReadOnlyTxMiddleware()
+	el := page.EntityLoaderMiddleware(page.NewParamLoader("slug", page.StringParam, loadStaticPageBySlug))
+	fpl := page.EntityLoaderMiddleware(page.EntityLoaderFunc(LoadFrontPage))
+	spmw := EnsureStaticPageMiddleware()
+	pmw := account.EnforcePermission(PermissionEditStaticPages)
+
+	routes := []server.Route{
+		{Method: http.MethodGet, Path: "/page/:slug", Handler: server.Wrap(SinglePage(), rotxmw, el, spmw)},
+		{Method: http.MethodGet, Path: "/pages", Handler: server.Wrap(ListPage(), pmw, rotxmw)},
+		{Method: http.MethodGet, Path: "/page/:slug/delete", Handler: server.Wrap(DeletePage(),
+			pmw, session.CSRFTokenMiddleware(), txmw, el, spmw)},
+	}
+
+	routes = append(routes, form.NewForm(store, "Edit front page", staticPageFormPage, NewStaticPageForm(FrontPageSlug, "/", filter)).
+		Pages("/frontpage/edit", pmw, txmw, fpl)...)
+	routes = append(routes, form.NewForm(store, "Create page", staticPageCreateFormPage, NewStaticPageForm("", "", filter)).
+		Pages("/pages/create", pmw, txmw, el)...)
+	routes = append(routes, form.NewForm(store, "Edit page", staticPageFormPage, NewStaticPageForm("", "", filter)).
+		Pages("/page/:slug/edit", pmw, txmw, el, spmw)...)
+
+	return routes
+}
+
+// LoadFrontPage is an entity loader function that loads the static page of
+// the front page.
+func LoadFrontPage(r *http.Request) (interface{}, error) {
+	return loadStaticPageBySlug(r, FrontPageSlug)
+}
+
+func loadStaticPageBySlug(r *http.Request, key interface{}) (interface{}, error) {
+	p, err := LoadStaticPage(database.Get(r), key.(string))
+	if p == nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// SinglePage is a http handler that shows a static page.
+func SinglePage() http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		access := account.GetAccessChecker(r)
+		p := GetStaticPage(r)
+
+		respond.Page(server.GetLogger(r), w, r, staticPagePage, p.Title, session.Get(r), access, staticPagePageData{
+			Page:    p,
+			CanEdit: access.Has(PermissionEditStaticPages),
+		})
+	})
+}
+
+// ListPage is a http handler that lists the static pages for the editors.
+func ListPage() http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		sess := session.Get(r)
+
+		pages, err := ListStaticPages(database.Get(r))
+		if err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "error listing pages", nil, err)
+			return
+		}
+
+		respond.Page(server.GetLogger(r), w, r, staticPageListPage, "Pages", sess, account.GetAccessChecker(r), staticPageListPageData{
+			Pages:     pages,
+			CSRFToken: sess.CSRFToken,
+		})
+	})
+}
+
+// DeletePage is a http handler that deletes a static page.
+func DeletePage() http.Handler {
+	return server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		if err := GetStaticPage(r).Delete(database.Get(r)); err != nil {
+			respond.Error(w, r, http.StatusInternalServerError, "failed to delete page", nil, err)
+			return
+		}
+
+		respond.Redirect(w, r, "/pages", http.StatusFound)
+	})
+}
+
+type staticPageForm struct {
+	account.AccessCheckLoader
+	slug     string
+	redirect string
+	filter   func(string) string
+}
+
+// NewStaticPageForm creates the delegate for the static page form.
+//
+// The form edits the page in the request context. If there is no page, then
+// it creates a page with the given slug, or with the slug from the form if
+// the slug is empty. The form redirects to the redirect url after the
+// submission, or to the page if it is empty.
+func NewStaticPageForm(slug, redirect string, filter func(string) string) form.Delegate {
+	return &staticPageForm{
+		slug:     slug,
+		redirect: redirect,
+		filter:   filter,
+	}
+}
+
+func (f *staticPageForm) LoadData(r *http.Request) (interface{}, error) {
+	p, err := f.loadPage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if p == nil {
+		return &staticPageFormPageData{}, nil
+	}
+
+	return &staticPageFormPageData{
+		Slug:    p.Slug,
+		Title:   p.Title,
+		Content: p.Content,
+	}, nil
+}
+
+func (f *staticPageForm) Validate(r *http.Request, v interface{}) []string {
+	var errs []string
+	data := v.(*staticPageFormPageData)
+
+	if strings.TrimSpace(data.Content) == "" {
+		errs = append(errs, "Content is required")
+	}
+
+	p, err := f.loadPage(r)
+	if err != nil {
+		return append(errs, "Failed to load page")
+	}
+	if p != nil || f.slug != "" {
+		return errs
+	}
+
+	if !slugRegexp.MatchString(data.Slug) {
+		return append(errs, "Slug must consist of lowercase letters, numbers and dashes")
+	}
+
+	existing, err := LoadStaticPage(database.Get(r), data.Slug)
+	if err != nil {
+		errs = append(errs, "Failed to load page")
+	} else if existing != nil {
+		errs = append(errs, "Slug is already taken")
+	}
+
+	return errs
+}
+
+func (f *staticPageForm) Submit(_ http.ResponseWriter, r *http.Request, v interface{}) form.FormSubmitResult {
+	data := v.(*staticPageFormPageData)
+
+	p, err := f.loadPage(r)
+	if err != nil {
+		return form.Error("Failed to load page", err)
+	}
+
+	if p == nil {
+		p = &StaticPage{Slug: f.slug}
+		if p.Slug == "" {
+			p.Slug = data.Slug
+		}
+	}
+
+	p.Title = data.Title
+	p.Content = data.Content
+	p.Filtered = template.HTML(f.filter(data.Content))
+
+	if err = p.Save(database.Get(r)); err != nil {
+		return form.Error("Cannot save page", err)
+	}
+
+	if f.redirect != "" {
+		return form.Redirect(f.redirect)
+	}
+
+	return form.Redirect("/page/" + p.Slug)
+}
+
+// loadPage returns the page from the request context.
+//
+// It returns nil if the page does not exist yet.
+func (f *staticPageForm) loadPage(r *http.Request) (*StaticPage, error) {
+	entity, err := page.GetEntity(r)
+	if entity == nil {
+		return nil, err
+	}
+
+	return entity.(*StaticPage), nil
+}
+
+type ensureStaticPageMiddleware struct{}
+
+// EnsureStaticPageMiddleware is a middleware that makes sure that the static
+// page in the URL exists.
+func EnsureStaticPageMiddleware() negroni.Handler {
+	return &ensureStaticPageMiddleware{}
+}
+
+func (m *ensureStaticPageMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	entity, err := page.GetEntity(r)
+	if err != nil {
+		respond.Error(w, r, http.StatusInternalServerError, "failed to load page", nil, err)
+		return
+	}
+
+	if entity == nil {
+		respond.Error(w, r, http.StatusNotFound, "page not found", nil, nil)
+		return
+	}
+
+	next(w, util.SetContext(r, staticPageContextKey, entity.(*StaticPage)))
+}
+
+// GetStaticPage returns the loaded StaticPage from the request context.
+func GetStaticPage(r *http.Request) *StaticPage {
+	return r.Context().Value(staticPageContextKey).(*StaticPage)
+}
@@ -0,0 +1,133 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package staticpage
+
+import (
+	"database/sql"
+	"html/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tamasd/simplesite/database"
+)
+
+// FrontPageSlug is the slug of the static page that holds the content of the
+// front page.
+const FrontPageSlug = "frontpage"
+
+// StaticPage is a page with editable content, identified by its slug.
+type StaticPage struct {
+	Slug     string        `json:"slug"`
+	Title    string        `json:"title"`
+	Content  string        `json:"content"`
+	Filtered template.HTML `json:"filtered"`
+	Updated  time.Time     `json:"updated"`
+}
+
+// SchemaSQL returns the schema of the static page entity.
+func (p StaticPage) SchemaSQL() string {
+	return `
+		CREATE TABLE static_page (
+			slug character varying NOT NULL,
+			title character varying NOT NULL,
+			content text NOT NULL,
+			filtered text NOT NULL,
+			updated timestamp with time zone NOT NULL DEFAULT now(),
+			PRIMARY KEY (slug)
+		);
+	`
+}
+
+// Save inserts or updates a static page.
+func (p *StaticPage) Save(conn database.DB) error {
+	err := conn.QueryRow(`
+		INSERT INTO static_page (slug, title, content, filtered, updated)
+		VALUES($1, $2, $3, $4, now())
+		ON CONFLICT (slug)
+		DO UPDATE SET
+			title = $2,
+			content = $3,
+			filtered = $4,
+			updated = now()
+		RETURNING updated
+	`, p.Slug, p.Title, p.Content, p.Filtered).Scan(&p.Updated)
+
+	return errors.Wrap(err, "error saving static page")
+}
+
+// Delete removes a static page.
+func (p *StaticPage) Delete(conn database.DB) error {
+	_, err := conn.Exec(`DELETE FROM static_page WHERE slug = $1`, p.Slug)
+
+	return errors.Wrap(err, "error deleting static page")
+}
+
+// ListStaticPages lists all static pages, ordered by their slugs.
+func ListStaticPages(conn database.DB) ([]*StaticPage, error) {
+	rows, err := conn.Query(`
+		SELECT slug, title, content, filtered, updated
+		FROM static_page
+		ORDER BY slug
+	`)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing static pages")
+	}
+	defer func() { _ = rows.Close() }()
+
+	var pages []*StaticPage
+	for rows.Next() {
+		p := &StaticPage{}
+		if err = rows.Scan(
+			&p.Slug,
+			&p.Title,
+			&p.Content,
+			&p.Filtered,
+			&p.Updated,
+		); err != nil {
+			return nil, errors.Wrap(err, "error listing static pages")
+		}
+		pages = append(pages, p)
+	}
+
+	return pages, errors.Wrap(rows.Err(), "error listing static pages")
+}
+
+// LoadStaticPage loads a static page by its slug.
+//
+// It returns nil if the page does not exist.
+func LoadStaticPage(conn database.DB, slug string) (*StaticPage, error) {
+	p := &StaticPage{}
+	err := conn.QueryRow(`
+		SELECT slug, title, content, filtered, updated
+		FROM static_page
+		WHERE slug = $1
+	`, slug).Scan(
+		&p.Slug,
+		&p.Title,
+		&p.Content,
+		&p.Filtered,
+		&p.Updated,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading static page")
+	}
+
+	return p, nil
+}
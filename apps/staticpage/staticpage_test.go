@@ -0,0 +1,140 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package staticpage_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/account"
+	"github.com/tamasd/simplesite/apps/staticpage"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+func TestFrontPageContent(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	admin := srv.CreateClient(t)
+	anon := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+
+	resp := admin.Request(http.MethodGet, "/frontpage/edit", nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	err := account.SavePermissions(srv.Database(), admin.CurrentUID(), account.Permissions{
+		staticpage.PermissionEditStaticPages,
+	})
+	require.Nil(t, err)
+
+	resp = admin.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, admin.Page.Find("#body").Text(), "Lorem ipsum")
+	href := admin.Page.Find("a.edit").AttrOr("href", "")
+	require.Equal(t, "/frontpage/edit", href)
+
+	data := &url.Values{}
+	data.Set("Title", "Hello")
+	data.Set("Content", "Welcome to **the site**.")
+	resp = admin.Form(href).Submit(data)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = anon.Request(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Hello", anon.Page.Find("title").Text())
+	require.Equal(t, "Welcome to the site.", strings.TrimSpace(anon.Page.Find("section.frontpage").Text()))
+	require.Equal(t, "the site", anon.Page.Find("section.frontpage strong").Text())
+	require.NotContains(t, anon.Page.Find("#body").Text(), "Lorem ipsum")
+	require.Equal(t, 0, anon.Page.Find("a.edit").Length())
+
+	resp = anon.Request(http.MethodGet, "/frontpage/edit", nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestStaticPageCRUD(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	admin := srv.CreateClient(t)
+	anon := srv.CreateClient(t)
+	admin.RegistrationAndLogin(testutil.TestRegData())
+	err := account.SavePermissions(srv.Database(), admin.CurrentUID(), account.Permissions{
+		staticpage.PermissionEditStaticPages,
+	})
+	require.Nil(t, err)
+
+	resp := anon.Request(http.MethodGet, "/page/terms", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = anon.Request(http.MethodGet, "/pages/create", nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = anon.Request(http.MethodGet, "/register", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 1, anon.Page.Find(`p.field-accepttos a[href="/page/terms"]`).Length())
+
+	data := &url.Values{}
+	data.Set("Slug", "Terms of Service")
+	data.Set("Title", "Terms of Service")
+	data.Set("Content", "Be *nice*.")
+	resp = admin.Form("/pages/create").Submit(data)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, admin.Page.Find("div.messages.error").Text(), "Slug must consist of")
+
+	data.Set("Slug", "terms")
+	resp = admin.Form("/pages/create").Submit(data)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "/page/terms", resp.Header.Get("Location"))
+
+	resp = admin.Form("/pages/create").Submit(data)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, admin.Page.Find("div.messages.error").Text(), "Slug is already taken")
+
+	resp = anon.Request(http.MethodGet, "/page/terms", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Terms of Service", anon.Page.Find("title").Text())
+	require.Equal(t, "nice", anon.Page.Find("section.page em").Text())
+	require.Equal(t, 0, anon.Page.Find("a.edit").Length())
+
+	resp = admin.Request(http.MethodGet, "/page/terms", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	href := admin.Page.Find("a.edit").AttrOr("href", "")
+	require.Equal(t, "/page/terms/edit", href)
+	sf := admin.Form(href)
+	editData := admin.FormValues("")
+	require.Equal(t, data.Get("Content"), editData.Get("Content"))
+	editData.Set("Content", "Be **very** nice.")
+	resp = sf.Submit(editData)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	resp = anon.Request(http.MethodGet, "/page/terms", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "very", anon.Page.Find("section.page strong").Text())
+
+	resp = admin.Request(http.MethodGet, "/pages", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Terms of Service", admin.Page.Find(`a[href="/page/terms"]`).Text())
+	resp = admin.ClickLink("a.delete")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	resp = anon.Request(http.MethodGet, "/page/terms", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = admin.Request(http.MethodGet, "/page/terms/edit", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,70 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package token
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownCategory is returned in strict mode for the categories that are
+// not registered.
+var ErrUnknownCategory = errors.New("unknown token category")
+
+var (
+	categoriesMtx    sync.RWMutex
+	categories       = map[string]bool{}
+	strictCategories bool
+)
+
+// RegisterCategory registers a token category.
+//
+// It returns the name, so it can be used to declare the category:
+//
+//	var inviteCategory = token.RegisterCategory("invite")
+func RegisterCategory(name string) string {
+	categoriesMtx.Lock()
+	defer categoriesMtx.Unlock()
+
+	categories[name] = true
+
+	return name
+}
+
+// SetStrictCategories turns on the validation of the categories.
+//
+// In strict mode, the token manager refuses to create or consume tokens in
+// the categories that are not registered with RegisterCategory. This catches
+// the typos that would make the tokens never match.
+func SetStrictCategories(strict bool) {
+	categoriesMtx.Lock()
+	defer categoriesMtx.Unlock()
+
+	strictCategories = strict
+}
+
+func checkCategory(category string) error {
+	categoriesMtx.RLock()
+	defer categoriesMtx.RUnlock()
+
+	if strictCategories && !categories[category] {
+		return errors.Wrap(ErrUnknownCategory, category)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package token
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/pkg/errors"
+	"github.com/tamasd/simplesite/util"
+)
+
+const (
+	// DefaultLength is the length of the tokens of the default generator.
+	DefaultLength = 64
+
+	// MaxLength is the maximum length of a token.
+	MaxLength = 128
+)
+
+// ErrInvalidLength is the panic value of the generator constructors when the
+// length is out of range.
+var ErrInvalidLength = errors.Errorf("the token length must be between 1 and %d", MaxLength)
+
+// Generator generates the token strings.
+//
+// Short tokens can collide. The token manager generates a new token in that
+// case, so the generators must return random values.
+type Generator func() string
+
+// HexGenerator returns a generator for random hex strings.
+//
+// The length must be between 1 and MaxLength, otherwise it panics with
+// ErrInvalidLength.
+func HexGenerator(length int) Generator {
+	checkLength(length)
+	return func() string {
+		return util.RandomHexString(length)
+	}
+}
+
+// NumericGenerator returns a generator for random decimal codes, e.g. for
+// codes that are typed in by the users.
+//
+// The codes can start with zeros. The number of digits must be between 1 and
+// MaxLength, otherwise it panics with ErrInvalidLength.
+//
+// Short codes are easy to guess, so they should be consumed with their uuid
+// (see Token.Consume), and with a short expiration.
+func NumericGenerator(digits int) Generator {
+	checkLength(digits)
+	ten := big.NewInt(10)
+	return func() string {
+		code := make([]byte, digits)
+		for i := range code {
+			d, err := rand.Int(rand.Reader, ten)
+			if err != nil {
+				panic(err)
+			}
+			code[i] = '0' + byte(d.Int64())
+		}
+
+		return string(code)
+	}
+}
+
+func checkLength(length int) {
+	if length < 1 || length > MaxLength {
+		panic(ErrInvalidLength)
+	}
+}
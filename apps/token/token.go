@@ -17,9 +17,12 @@
 package token
 
 import (
+	"database/sql"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/tamasd/simplesite/database"
@@ -28,23 +31,43 @@ import (
 )
 
 const (
-	tokenLen = 64
+	// maxAttempts is the number of times a colliding token is regenerated.
+	maxAttempts = 10
+
+	// insertBatchSize is the number of tokens in a multi-row INSERT.
+	insertBatchSize = 1000
 )
 
+// ErrCollision is returned when the generator can't produce an unused token.
+var ErrCollision = errors.New("failed to generate a unique token")
+
 // Token is a manager for the token entity.
 type Token struct {
-	conn   database.DB
-	logger logrus.FieldLogger
+	conn      database.DB
+	logger    logrus.FieldLogger
+	generator Generator
 }
 
 // NewToken creates a new manager for the token entity.
 func NewToken(logger logrus.FieldLogger, conn database.DB) *Token {
 	return &Token{
-		conn:   conn,
-		logger: logger,
+		conn:      conn,
+		logger:    logger,
+		generator: HexGenerator(DefaultLength),
 	}
 }
 
+// SetLength sets the length of the hex tokens that the manager generates.
+func (t *Token) SetLength(length int) *Token {
+	return t.SetGenerator(HexGenerator(length))
+}
+
+// SetGenerator sets the generator of the tokens.
+func (t *Token) SetGenerator(g Generator) *Token {
+	t.generator = g
+	return t
+}
+
 // NewTokenFromRequest returns the token manager from the request context.
 func NewTokenFromRequest(r *http.Request) *Token {
 	return NewToken(server.GetLogger(r), database.Get(r))
@@ -67,22 +90,106 @@ func (t Token) SchemaSQL() string {
 // Create generates a token for a given uuid and category, with an optional
 // expiration.
 func (t *Token) Create(uuid uuid.UUID, category string, expires *time.Time) (string, error) {
-	token := util.RandomHexString(tokenLen)
-	return token, t.setToken(uuid, category, token, expires)
-}
+	if err := checkCategory(category); err != nil {
+		return "", err
+	}
 
-func (t *Token) setToken(uuid uuid.UUID, category, token string, expires *time.Time) error {
 	if err := t.autoclean(uuid, category); err != nil {
-		return err
+		return "", err
 	}
 
-	_, err := t.conn.Exec(`INSERT INTO token(uuid, category, token, expires) VALUES($1, $2, $3, $4)`,
-		uuid,
-		category,
-		token,
-		expires,
-	)
-	return err
+	for i := 0; i < maxAttempts; i++ {
+		token := t.generator()
+		res, err := t.conn.Exec(`INSERT INTO token(uuid, category, token, expires) VALUES($1, $2, $3, $4) ON CONFLICT ON CONSTRAINT token_token_key DO NOTHING`,
+			uuid,
+			category,
+			token,
+			expires,
+		)
+		if err != nil {
+			return "", err
+		}
+
+		if aff, err := res.RowsAffected(); err != nil {
+			return "", err
+		} else if aff > 0 {
+			return token, nil
+		}
+	}
+
+	return "", ErrCollision
+}
+
+// CreateBatch generates n tokens in a category, with an optional expiration.
+//
+// Each token gets a new uuid, because a uuid can only have one token per
+// category. The tokens can be consumed without knowing their uuids with
+// ConsumeToken or ConsumeBatch.
+func (t *Token) CreateBatch(n int, category string, expires *time.Time) ([]string, error) {
+	if err := checkCategory(category); err != nil {
+		return nil, err
+	}
+
+	tokens := make([]string, 0, n)
+	for i := 0; len(tokens) < n; i++ {
+		if i == maxAttempts {
+			return nil, ErrCollision
+		}
+
+		for len(tokens) < n {
+			size := n - len(tokens)
+			if size > insertBatchSize {
+				size = insertBatchSize
+			}
+
+			inserted, err := t.insertBatch(size, category, expires)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, inserted...)
+
+			if len(inserted) < size {
+				// Some of the tokens collided, they are generated again.
+				break
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+// insertBatch inserts n new tokens, and returns the ones that didn't collide
+// with an existing token.
+func (t *Token) insertBatch(n int, category string, expires *time.Time) ([]string, error) {
+	values := make([]string, n)
+	args := make([]interface{}, 0, n*4)
+	for i := range values {
+		values[i] = `(` + util.GeneratePlaceholders(len(args)+1, 4) + `)`
+		args = append(args, uuid.NewV4(), category, t.generator(), expires)
+	}
+
+	rows, err := t.conn.Query(`INSERT INTO token(uuid, category, token, expires) VALUES `+strings.Join(values, ", ")+` ON CONFLICT ON CONSTRAINT token_token_key DO NOTHING RETURNING token`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTokens(rows)
+}
+
+func scanTokens(rows *sql.Rows) ([]string, error) {
+	defer func() { _ = rows.Close() }()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		// The token column is fixed length, so the values are padded.
+		tokens = append(tokens, strings.TrimRight(token, " "))
+	}
+
+	return tokens, rows.Err()
 }
 
 func (t *Token) autoclean(uuid uuid.UUID, category string) error {
@@ -93,11 +200,15 @@ func (t *Token) autoclean(uuid uuid.UUID, category string) error {
 // Consume consumes an active (not expired) token that is linked to an uuid
 // and a category.
 func (t *Token) Consume(uuid uuid.UUID, category, token string) (bool, error) {
+	if err := checkCategory(category); err != nil {
+		return false, err
+	}
+
 	res, err := t.conn.Exec(`DELETE FROM token WHERE uuid = $1 AND category = $2 AND token = $3 AND (expires IS NULL OR expires > $4)`,
 		uuid,
 		category,
 		token,
-		time.Now(),
+		util.Now(),
 	)
 
 	if err != nil {
@@ -109,8 +220,58 @@ func (t *Token) Consume(uuid uuid.UUID, category, token string) (bool, error) {
 	return aff > 0, err
 }
 
+// ConsumeToken consumes an active token in a category, regardless of its uuid.
+//
+// It returns the uuid of the token, and false if there is no such token.
+func (t *Token) ConsumeToken(category, token string) (uuid.UUID, bool, error) {
+	if err := checkCategory(category); err != nil {
+		return uuid.Nil, false, err
+	}
+
+	var id uuid.UUID
+	err := t.conn.QueryRow(`DELETE FROM token WHERE category = $1 AND token = $2 AND (expires IS NULL OR expires > $3) RETURNING uuid`,
+		category,
+		token,
+		util.Now(),
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, false, nil
+	}
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	return id, true, nil
+}
+
+// ConsumeBatch consumes the active tokens of a category from a list.
+//
+// It returns the tokens that were consumed. The rest were invalid, expired or
+// already used.
+func (t *Token) ConsumeBatch(category string, tokens []string) ([]string, error) {
+	if err := checkCategory(category); err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	args := []interface{}{category, util.Now()}
+	for _, token := range tokens {
+		args = append(args, token)
+	}
+
+	rows, err := t.conn.Query(`DELETE FROM token WHERE category = $1 AND (expires IS NULL OR expires > $2) AND token IN (`+util.GeneratePlaceholders(3, len(tokens))+`) RETURNING token`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTokens(rows)
+}
+
 // RemoveExpired removes expired tokens from the database.
 func (t *Token) RemoveExpired() error {
-	_, err := t.conn.Exec(`DELETE FROM token WHERE expires < $1`, time.Now())
+	_, err := t.conn.Exec(`DELETE FROM token WHERE expires < $1`, util.Now())
 	return err
 }
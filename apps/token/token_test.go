@@ -0,0 +1,134 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package token_test
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/token"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+func TestBatch(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	tm := token.NewToken(testutil.TestLogger(), srv.Database())
+	expires := time.Now().Add(time.Hour)
+	tokens, err := tm.CreateBatch(5, "invite", &expires)
+	require.Nil(t, err)
+	require.Len(t, tokens, 5)
+
+	ids := map[uuid.UUID]bool{}
+	for _, tok := range tokens[:3] {
+		id, ok, err := tm.ConsumeToken("invite", tok)
+		require.Nil(t, err)
+		require.True(t, ok)
+		require.False(t, ids[id])
+		ids[id] = true
+
+		_, ok, err = tm.ConsumeToken("invite", tok)
+		require.Nil(t, err)
+		require.False(t, ok)
+	}
+
+	_, ok, err := tm.ConsumeToken("other", tokens[3])
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	consumed, err := tm.ConsumeBatch("invite", tokens)
+	require.Nil(t, err)
+	require.ElementsMatch(t, tokens[3:], consumed)
+
+	consumed, err = tm.ConsumeBatch("invite", tokens)
+	require.Nil(t, err)
+	require.Empty(t, consumed)
+}
+
+func TestStrictCategories(t *testing.T) {
+	tm := token.NewToken(testutil.TestLogger(), nil)
+	category := token.RegisterCategory("test-strict")
+
+	token.SetStrictCategories(true)
+	defer token.SetStrictCategories(false)
+
+	_, err := tm.Consume(uuid.NewV4(), "test-stirct", "abc")
+	require.True(t, errors.Is(err, token.ErrUnknownCategory))
+	_, err = tm.Create(uuid.NewV4(), "test-stirct", nil)
+	require.True(t, errors.Is(err, token.ErrUnknownCategory))
+	_, _, err = tm.ConsumeToken("test-stirct", "abc")
+	require.True(t, errors.Is(err, token.ErrUnknownCategory))
+	_, err = tm.ConsumeBatch("test-stirct", []string{"abc"})
+	require.True(t, errors.Is(err, token.ErrUnknownCategory))
+	_, err = tm.CreateBatch(1, "test-stirct", nil)
+	require.True(t, errors.Is(err, token.ErrUnknownCategory))
+
+	consumed, err := tm.ConsumeBatch(category, nil)
+	require.Nil(t, err)
+	require.Empty(t, consumed)
+}
+
+func TestGenerators(t *testing.T) {
+	hex := token.HexGenerator(16)
+	numeric := token.NumericGenerator(6)
+	for i := 0; i < 100; i++ {
+		require.Regexp(t, regexp.MustCompile(`^[0-9a-f]{16}$`), hex())
+		require.Regexp(t, regexp.MustCompile(`^[0-9]{6}$`), numeric())
+	}
+	require.NotEqual(t, hex(), hex())
+
+	for _, length := range []int{0, -1, token.MaxLength + 1} {
+		require.PanicsWithValue(t, token.ErrInvalidLength, func() { token.HexGenerator(length) })
+		require.PanicsWithValue(t, token.ErrInvalidLength, func() { token.NumericGenerator(length) })
+	}
+	require.NotPanics(t, func() { token.HexGenerator(token.MaxLength) })
+}
+
+func TestTokenLength(t *testing.T) {
+	srv := testutil.SetupTestSiteFromEnv()
+	defer srv.Cleanup()
+
+	tm := token.NewToken(testutil.TestLogger(), srv.Database()).SetLength(16)
+	id := uuid.NewV4()
+	tok, err := tm.Create(id, "test-length", nil)
+	require.Nil(t, err)
+	require.Len(t, tok, 16)
+	ok, err := tm.Consume(id, "test-length", tok)
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	// There are only 100 two-digit codes, so the batch has collisions.
+	tm.SetGenerator(token.NumericGenerator(2))
+	codes, err := tm.CreateBatch(30, "test-numeric", nil)
+	require.Nil(t, err)
+	require.Len(t, codes, 30)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		require.Regexp(t, regexp.MustCompile(`^[0-9]{2}$`), code)
+		require.False(t, seen[code], code)
+		seen[code] = true
+	}
+
+	consumed, err := tm.ConsumeBatch("test-numeric", codes)
+	require.Nil(t, err)
+	require.ElementsMatch(t, codes, consumed)
+}
@@ -17,12 +17,48 @@
 package config
 
 import (
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
+const maskedValue = "***"
+
+var (
+	secretKeyRegexp      = regexp.MustCompile(`(?i)(password|secret|key|token)`)
+	dsnPasswordRegexp    = regexp.MustCompile(`(?i)(password=)(\S+)`)
+	urlCredentialsRegexp = regexp.MustCompile(`^[a-z][a-z0-9+.-]*://[^/]*@`)
+)
+
+// MaskValue hides the secrets of a configuration value when it is logged.
+//
+// The values of the keys that look like secrets are replaced completely. The
+// passwords in connection urls and connection strings are replaced, the rest
+// of the value stays visible.
+func MaskValue(key, value string) string {
+	if value == "" {
+		return value
+	}
+
+	if secretKeyRegexp.MatchString(key) {
+		return maskedValue
+	}
+
+	if urlCredentialsRegexp.MatchString(value) {
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), maskedValue)
+				return strings.Replace(u.String(), url.QueryEscape(maskedValue), maskedValue, 1)
+			}
+		}
+	}
+
+	return dsnPasswordRegexp.ReplaceAllString(value, "${1}"+maskedValue)
+}
+
 // Storage represents a configuration storage.
 type Storage interface {
 	Get(key string) string
@@ -34,6 +70,14 @@ type LoggerStorage interface {
 	LogAll(logger logrus.FieldLogger)
 }
 
+// ReloadingStorage is a storage that can change its values while the site is
+// running.
+type ReloadingStorage interface {
+	Storage
+	// OnReload registers a function that runs after the values are reloaded.
+	OnReload(f func())
+}
+
 // PrefixerStorage is an extension of Storage that prefixes each key.
 type PrefixerStorage struct {
 	storage Storage
@@ -58,6 +102,13 @@ func (s *PrefixerStorage) LogAll(logger logrus.FieldLogger) {
 	}
 }
 
+// OnReload registers f on the wrapped storage if it is a ReloadingStorage.
+func (s *PrefixerStorage) OnReload(f func()) {
+	if rs, ok := s.storage.(ReloadingStorage); ok {
+		rs.OnReload(f)
+	}
+}
+
 // EnvStorage loads the configuration from environment variables.
 type EnvStorage struct{}
 
@@ -70,7 +121,7 @@ func (s EnvStorage) LogAll(logger logrus.FieldLogger) {
 	for _, line := range os.Environ() {
 		parts := strings.SplitN(line, "=", 2)
 		if len(parts) == 2 {
-			fields[parts[0]] = parts[1]
+			fields[parts[0]] = MaskValue(parts[0], parts[1])
 		}
 	}
 	logger.WithFields(fields).Debugln("environment variables")
@@ -86,7 +137,7 @@ func (m MapStorage) Get(key string) string {
 func (m MapStorage) LogAll(logger logrus.FieldLogger) {
 	fields := make(logrus.Fields)
 	for k, v := range m {
-		fields[k] = v
+		fields[k] = MaskValue(k, v)
 	}
 	logger.WithFields(fields).Debugln("configuration variables")
 }
@@ -0,0 +1,159 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+)
+
+// FileStorage loads the configuration from a file.
+//
+// The file has the same format as the .env files, and the keys are looked up
+// the same way as in EnvStorage.
+type FileStorage struct {
+	values MapStorage
+}
+
+// NewFileStorage loads a configuration file.
+func NewFileStorage(path string) (*FileStorage, error) {
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{
+		values: values,
+	}, nil
+}
+
+func (s *FileStorage) Get(key string) string {
+	return s.values.Get(strings.ToUpper(key))
+}
+
+func (s *FileStorage) LogAll(logger logrus.FieldLogger) {
+	s.values.LogAll(logger)
+}
+
+// ReloadableStorage is a FileStorage that can be reloaded while the site is
+// running.
+//
+// Only the values that are read on each use (e.g. feature flags) and the
+// values that are re-applied by the OnReload hooks take effect after a reload.
+// The values that are used to set up the site, like the database or the redis
+// connection, need a restart.
+type ReloadableStorage struct {
+	path    string
+	mtx     sync.RWMutex
+	storage *FileStorage
+	hooks   []func()
+}
+
+// NewReloadableStorage loads a configuration file that can be reloaded.
+func NewReloadableStorage(path string) (*ReloadableStorage, error) {
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReloadableStorage{
+		path:    path,
+		storage: storage,
+	}, nil
+}
+
+func (s *ReloadableStorage) Get(key string) string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.storage.Get(key)
+}
+
+func (s *ReloadableStorage) LogAll(logger logrus.FieldLogger) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	s.storage.LogAll(logger)
+}
+
+// Reload reads the configuration file again.
+//
+// The previous values are kept if the file can't be read.
+func (s *ReloadableStorage) Reload() error {
+	storage, err := NewFileStorage(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	s.storage = storage
+	hooks := append([]func(){}, s.hooks...)
+	s.mtx.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+
+	return nil
+}
+
+// OnReload registers a function that runs after each successful reload.
+func (s *ReloadableStorage) OnReload(f func()) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.hooks = append(s.hooks, f)
+}
+
+// ReloadOnSIGHUP reloads the configuration file when the process receives a
+// SIGHUP signal.
+//
+// The returned function stops listening to the signal.
+func (s *ReloadableStorage) ReloadOnSIGHUP(logger logrus.FieldLogger) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+				if err := s.Reload(); err != nil {
+					logger.WithError(err).Errorln("failed to reload configuration")
+					continue
+				}
+				logger.Infoln("configuration reloaded")
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+}
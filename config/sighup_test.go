@@ -0,0 +1,50 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/config"
+)
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.env")
+	require.Nil(t, ioutil.WriteFile(path, []byte("LOG_LEVEL=info\n"), 0600))
+
+	rs, err := config.NewReloadableStorage(path)
+	require.Nil(t, err)
+	stop := rs.ReloadOnSIGHUP(logrus.New())
+	defer stop()
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("LOG_LEVEL=debug\n"), 0600))
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	require.Eventually(t, func() bool {
+		return rs.Get("log_level") == "debug"
+	}, time.Second, 10*time.Millisecond)
+}
@@ -17,6 +17,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"net/http"
 	"reflect"
@@ -39,6 +40,10 @@ const (
 
 var (
 	spaces = regexp.MustCompile(`\s+`)
+
+	// ErrNoTransactions is returned by the connection wrappers when the
+	// wrapped connection can't start transactions.
+	ErrNoTransactions = errors.New("the connection can't start transactions")
 )
 
 // Get returns the database from the request context.
@@ -70,14 +75,32 @@ type DatabaseEntity interface {
 	SchemaSQL() string
 }
 
+// MigratingEntity is a DatabaseEntity that can update the schema of its
+// existing table.
+//
+// MigrationSQL must be safe to run repeatedly, e.g. by using
+// ADD COLUMN IF NOT EXISTS.
+type MigratingEntity interface {
+	DatabaseEntity
+	MigrationSQL() string
+}
+
+// DataMigratingEntity is a MigratingEntity that also updates the existing
+// rows, e.g. to fill a new column with values that are computed in Go.
+//
+// MigrateData runs after MigrationSQL, and it must be safe to run repeatedly.
+type DataMigratingEntity interface {
+	MigratingEntity
+	MigrateData(conn DB) error
+}
+
 // Ensure makes sure that a given DatabaseEntity has its schema in the
 // database.
+//
+// If the table already exists, and the entity is a MigratingEntity, its
+// migrations are run instead.
 func Ensure(logger logrus.FieldLogger, conn DB, v DatabaseEntity) error {
-	t := reflect.TypeOf(v)
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-	}
-	tablename := util.ToSnakeCase(t.Name())
+	tablename := tableName(v)
 	logger = logger.WithField("tablename", tablename)
 	logger.Debugln("determined table name")
 	exists, err := tableExists(conn, tablename)
@@ -86,6 +109,16 @@ func Ensure(logger logrus.FieldLogger, conn DB, v DatabaseEntity) error {
 	}
 
 	if exists {
+		if m, ok := v.(MigratingEntity); ok {
+			logger.Debugln("table exists, migrating")
+			if _, err = conn.Exec(m.MigrationSQL()); err != nil {
+				return errors.Wrap(err, "error migrating table")
+			}
+			if d, ok := m.(DataMigratingEntity); ok {
+				return errors.Wrap(d.MigrateData(conn), "error migrating data")
+			}
+			return nil
+		}
 		logger.Debugln("table exists, skipping")
 		return nil
 	}
@@ -96,6 +129,16 @@ func Ensure(logger logrus.FieldLogger, conn DB, v DatabaseEntity) error {
 	return err
 }
 
+// tableName returns the name of the table of an entity.
+func tableName(v DatabaseEntity) string {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return util.ToSnakeCase(t.Name())
+}
+
 func tableExists(conn DB, tablename string) (bool, error) {
 	var exists bool
 	err := conn.QueryRow(`
@@ -129,12 +172,56 @@ type TransactionFactory interface {
 	Begin() (Transaction, error)
 }
 
+// ContextBinder is a database connection that can bind its queries and
+// transactions to a context.
+type ContextBinder interface {
+	WithContext(ctx context.Context) DB
+}
+
+// WithContext binds a database connection to a context.
+//
+// When the context is cancelled, the running queries are aborted, and the
+// transactions started on the returned connection are rolled back. The
+// connection is returned as is if it doesn't support contexts.
+func WithContext(conn DB, ctx context.Context) DB {
+	if b, ok := conn.(ContextBinder); ok {
+		return b.WithContext(ctx)
+	}
+
+	return conn
+}
+
 type dbWrapper struct {
 	*sql.DB
+	ctx context.Context
+}
+
+func (w *dbWrapper) context() context.Context {
+	if w.ctx == nil {
+		return context.Background()
+	}
+
+	return w.ctx
+}
+
+func (w *dbWrapper) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return w.DB.ExecContext(w.context(), query, args...)
+}
+
+func (w *dbWrapper) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return w.DB.QueryContext(w.context(), query, args...)
+}
+
+func (w *dbWrapper) QueryRow(query string, args ...interface{}) *sql.Row {
+	return w.DB.QueryRowContext(w.context(), query, args...)
 }
 
 func (w *dbWrapper) Begin() (Transaction, error) {
-	return w.DB.Begin()
+	return w.DB.BeginTx(w.context(), nil)
+}
+
+func (w *dbWrapper) WithContext(ctx context.Context) DB {
+	return &dbWrapper{DB: w.DB, ctx: ctx}
 }
 
 type loggerDB struct {
@@ -159,6 +246,10 @@ func NewLoggerDB(logger logrus.FieldLogger, db DB) DB {
 	return &ldb
 }
 
+func (d *loggerDB) WithContext(ctx context.Context) DB {
+	return NewLoggerDB(d.logger, WithContext(d.db, ctx))
+}
+
 func (d *loggerDB) Exec(query string, args ...interface{}) (sql.Result, error) {
 	start := time.Now()
 	res, err := d.db.Exec(query, args...)
@@ -225,7 +316,7 @@ func (d *transactionFactoryLoggerDB) Begin() (Transaction, error) {
 		return NewLoggerDB(logger, tx).(Transaction), nil
 	}
 
-	return nil, nil
+	return nil, ErrNoTransactions
 }
 
 type transactionLoggerDB struct {
@@ -261,15 +352,17 @@ func (d *transactionLoggerDB) Rollback() error {
 }
 
 // Connect creates a database connection to a PostgreSQL database.
+//
+// The queries that fail with a connection error are retried once.
 func Connect(dbUrl string) (DB, error) {
 	conn, err := sql.Open("postgres", dbUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	return &dbWrapper{
+	return NewRetryDB(&dbWrapper{
 		DB: conn,
-	}, nil
+	}), nil
 }
 
 // Middleware stores a database connection in the request context.
@@ -283,14 +376,17 @@ func NewMiddleware(conn DB) *Middleware {
 	}
 }
 
+// ServeHTTP binds the connection to the request context, so the queries of a
+// cancelled or timed out request are aborted.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	r = util.SetContext(r, dbContextKey, m.conn)
+	r = util.SetContext(r, dbContextKey, WithContext(m.conn, r.Context()))
 	next.ServeHTTP(w, r)
 }
 
 // TxMiddleware stores a database transaction in the request context.
 type TxMiddleware struct {
-	auto bool
+	auto     bool
+	readOnly bool
 }
 
 // NewTxMiddleware creates a TxMiddleware.
@@ -304,9 +400,24 @@ func NewTxMiddleware(auto bool) *TxMiddleware {
 	}
 }
 
+// NewReadOnlyTxMiddleware creates a TxMiddleware that starts read-only
+// transactions.
+//
+// The transaction is always rolled back at the end of the request.
+func NewReadOnlyTxMiddleware() *TxMiddleware {
+	return &TxMiddleware{
+		auto:     true,
+		readOnly: true,
+	}
+}
+
 func (m *TxMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	logger := server.GetLogger(r)
-	tx, err := maybeBegin(Get(r))
+	begin := maybeBegin
+	if m.readOnly {
+		begin = maybeBeginReadOnly
+	}
+	tx, err := begin(Get(r))
 	if err != nil || tx == nil {
 		logger.Errorln("transaction failed")
 		respond.Error(w, r, http.StatusInternalServerError, "database error", nil, err)
@@ -325,9 +436,10 @@ func (m *TxMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next ht
 
 	next.ServeHTTP(w, r)
 
-	if m.auto {
+	if m.auto && !m.readOnly {
+		// A cancelled or timed out request is never committed.
 		status := w.(negroni.ResponseWriter).Status()
-		if status < 400 {
+		if status < 400 && r.Context().Err() == nil {
 			if err = tx.Commit(); err != nil && err != sql.ErrTxDone {
 				logger.WithError(err).Errorln("failed to commit transaction")
 			}
@@ -335,14 +447,97 @@ func (m *TxMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next ht
 	}
 }
 
+// Transactional runs f in a transaction.
+//
+// The transaction is committed if f succeeds, and rolled back otherwise. If
+// the connection can't start transactions, f gets the connection itself.
+func Transactional(conn DB, f func(tx DB) error) error {
+	tx, err := maybeBegin(conn)
+	if err != nil {
+		return err
+	}
+	if tx == nil {
+		return f(conn)
+	}
+
+	if err = f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func maybeBegin(conn DB) (Transaction, error) {
 	if f, ok := conn.(TransactionFactory); ok {
-		return f.Begin()
+		tx, err := f.Begin()
+		if errors.Is(err, ErrNoTransactions) {
+			return nil, nil
+		}
+		return tx, err
 	}
 
 	return nil, nil
 }
 
+func maybeBeginReadOnly(conn DB) (Transaction, error) {
+	tx, err := maybeBegin(conn)
+	if err != nil || tx == nil {
+		return tx, err
+	}
+
+	if _, err = tx.Exec(`SET TRANSACTION READ ONLY`); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
 func cleanSQL(query string) string {
 	return spaces.ReplaceAllString(strings.TrimSpace(query), " ")
 }
+
+// maxQueryParameters is the maximum number of parameters of a PostgreSQL
+// query.
+const maxQueryParameters = 65535
+
+// BulkInsert inserts rows into a table.
+//
+// The rows are inserted with multi-row INSERT statements. Large sets are split
+// into batches, so a single statement stays under the parameter limit. The
+// number of columns must be between 1 and the parameter limit.
+func BulkInsert(conn DB, table string, columns []string, rows [][]interface{}) error {
+	if len(columns) == 0 || len(columns) > maxQueryParameters {
+		return errors.Errorf("bulk insert: invalid number of columns: %d", len(columns))
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	batchSize := maxQueryParameters / len(columns)
+	prefix := `INSERT INTO ` + table + `(` + strings.Join(columns, ", ") + `) VALUES `
+
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		for _, row := range rows[start:end] {
+			if len(row) != len(columns) {
+				return errors.Errorf("bulk insert: row has %d values, expected %d", len(row), len(columns))
+			}
+			values = append(values, `(`+util.GeneratePlaceholders(len(args)+1, len(row))+`)`)
+			args = append(args, row...)
+		}
+
+		if _, err := conn.Exec(prefix+strings.Join(values, ", "), args...); err != nil {
+			return errors.Wrap(err, "bulk insert into "+table)
+		}
+	}
+
+	return nil
+}
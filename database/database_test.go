@@ -0,0 +1,301 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/database"
+)
+
+type execRecorder struct {
+	queries []string
+	args    [][]interface{}
+}
+
+func (r *execRecorder) Exec(query string, args ...interface{}) (sql.Result, error) {
+	r.queries = append(r.queries, query)
+	r.args = append(r.args, args)
+	return nil, nil
+}
+
+func (r *execRecorder) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, nil
+}
+
+func (r *execRecorder) QueryRow(query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+func TestBulkInsertNoRows(t *testing.T) {
+	rec := &execRecorder{}
+	require.Nil(t, database.BulkInsert(rec, "permission", []string{"id", "permission"}, nil))
+	require.Len(t, rec.queries, 0)
+}
+
+func TestBulkInsertOneRow(t *testing.T) {
+	rec := &execRecorder{}
+	err := database.BulkInsert(rec, "permission", []string{"id", "permission"}, [][]interface{}{
+		{"a", "foo"},
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"INSERT INTO permission(id, permission) VALUES ($1, $2)"}, rec.queries)
+	require.Equal(t, []interface{}{"a", "foo"}, rec.args[0])
+}
+
+func TestBulkInsertBatches(t *testing.T) {
+	rec := &execRecorder{}
+	rows := make([][]interface{}, 40000)
+	for i := range rows {
+		rows[i] = []interface{}{i, i}
+	}
+
+	require.Nil(t, database.BulkInsert(rec, "t", []string{"a", "b"}, rows))
+	require.Len(t, rec.queries, 2)
+	require.Len(t, rec.args[0], 65534)
+	require.Len(t, rec.args[1], 2*(40000-32767))
+	require.True(t, strings.HasSuffix(rec.queries[1], "($14465, $14466)"))
+	require.Equal(t, 32767, rec.args[1][0])
+}
+
+func TestBulkInsertInvalidRow(t *testing.T) {
+	rec := &execRecorder{}
+	err := database.BulkInsert(rec, "t", []string{"a", "b"}, [][]interface{}{{1}})
+	require.NotNil(t, err)
+	require.Len(t, rec.queries, 0)
+}
+
+func TestBulkInsertNoColumns(t *testing.T) {
+	rec := &execRecorder{}
+	require.NotNil(t, database.BulkInsert(rec, "t", nil, [][]interface{}{{}}))
+	require.NotNil(t, database.BulkInsert(rec, "t", make([]string, 65536), [][]interface{}{{1}}))
+	require.Len(t, rec.queries, 0)
+}
+
+type flakyDB struct {
+	execRecorder
+	failures int
+	pings    int
+	err      error
+}
+
+func (d *flakyDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if d.failures > 0 {
+		d.failures--
+		if d.err != nil {
+			return nil, d.err
+		}
+		return nil, driver.ErrBadConn
+	}
+
+	return d.execRecorder.Exec(query, args...)
+}
+
+func (d *flakyDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if d.failures > 0 {
+		d.failures--
+		return nil, driver.ErrBadConn
+	}
+
+	return nil, errors.New("syntax error")
+}
+
+func (d *flakyDB) Ping() error {
+	d.pings++
+	return nil
+}
+
+func TestRetryDBConnectionError(t *testing.T) {
+	flaky := &flakyDB{failures: 1}
+	db := database.NewRetryDB(flaky)
+
+	_, err := db.Exec("DELETE FROM foo")
+	require.Nil(t, err)
+	require.Equal(t, 1, flaky.pings)
+	require.Equal(t, []string{"DELETE FROM foo"}, flaky.queries)
+
+	flaky.failures = 2
+	_, err = db.Exec("DELETE FROM foo")
+	require.True(t, database.IsConnectionError(err))
+	require.Equal(t, 2, flaky.pings)
+	require.Len(t, flaky.queries, 1)
+}
+
+func TestRetryDBQueryError(t *testing.T) {
+	flaky := &flakyDB{}
+	db := database.NewRetryDB(flaky)
+
+	_, err := db.Query("SELEC 1")
+	require.EqualError(t, err, "syntax error")
+	require.Equal(t, 0, flaky.pings)
+
+	flaky.failures = 1
+	_, err = db.Query("SELEC 1")
+	require.EqualError(t, err, "syntax error")
+	require.Equal(t, 1, flaky.pings)
+}
+
+func TestRetryDBAmbiguousError(t *testing.T) {
+	for _, err := range []error{
+		&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
+		io.ErrUnexpectedEOF,
+		syscall.EPIPE,
+	} {
+		flaky := &flakyDB{failures: 1, err: err}
+		db := database.NewRetryDB(flaky)
+
+		_, rerr := db.Exec("INSERT INTO foo VALUES (1)")
+		require.Equal(t, err, rerr)
+		require.False(t, database.IsConnectionError(rerr))
+		require.Equal(t, 0, flaky.pings)
+		require.Len(t, flaky.queries, 0)
+	}
+}
+
+func TestRetryDBBeginWithoutTransactions(t *testing.T) {
+	db := database.NewRetryDB(&execRecorder{})
+
+	tx, err := db.Begin()
+	require.Nil(t, tx)
+	require.Equal(t, database.ErrNoTransactions, err)
+
+	called := false
+	require.Nil(t, database.Transactional(db, func(tx database.DB) error {
+		called = true
+		require.Equal(t, db, tx)
+		return nil
+	}))
+	require.True(t, called)
+}
+
+type txRecorder struct {
+	execRecorder
+	committed  bool
+	rolledBack bool
+}
+
+func (r *txRecorder) Begin() (database.Transaction, error) {
+	return r, nil
+}
+
+func (r *txRecorder) Commit() error {
+	r.committed = true
+	return nil
+}
+
+func (r *txRecorder) Rollback() error {
+	r.rolledBack = true
+	return nil
+}
+
+func TestTransactional(t *testing.T) {
+	db := &txRecorder{}
+	err := database.Transactional(db, func(tx database.DB) error {
+		_, err := tx.Exec("DELETE FROM foo")
+		return err
+	})
+	require.Nil(t, err)
+	require.True(t, db.committed)
+	require.False(t, db.rolledBack)
+	require.Equal(t, []string{"DELETE FROM foo"}, db.queries)
+
+	db = &txRecorder{}
+	err = database.Transactional(db, func(tx database.DB) error {
+		return errors.New("failed")
+	})
+	require.EqualError(t, err, "failed")
+	require.False(t, db.committed)
+	require.True(t, db.rolledBack)
+
+	rec := &execRecorder{}
+	err = database.Transactional(rec, func(tx database.DB) error {
+		require.Equal(t, rec, tx)
+		return nil
+	})
+	require.Nil(t, err)
+}
+
+type ctxRecorder struct {
+	execRecorder
+	ctx context.Context
+}
+
+func (r *ctxRecorder) WithContext(ctx context.Context) database.DB {
+	r.ctx = ctx
+	return r
+}
+
+func TestWithContext(t *testing.T) {
+	type key string
+	ctx := context.WithValue(context.Background(), key("k"), "v")
+
+	rec := &ctxRecorder{}
+	db := database.NewRetryDB(database.NewLoggerDB(logrus.New(), rec))
+	require.NotNil(t, database.WithContext(db, ctx))
+	require.Equal(t, ctx, rec.ctx)
+
+	rec = &ctxRecorder{}
+	mw := database.NewMiddleware(rec)
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	mw.ServeHTTP(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, rec, database.Get(r))
+	})
+	require.Equal(t, ctx, rec.ctx)
+
+	plain := &execRecorder{}
+	require.Equal(t, plain, database.WithContext(plain, ctx))
+}
+
+func TestReadOnlyTransaction(t *testing.T) {
+	conn, cleanup := connectTestDB(t)
+	defer cleanup()
+
+	_, err := conn.Exec(`INSERT INTO item (id, name) VALUES ($1, $2)`, 1, "foo")
+	require.Nil(t, err)
+
+	var name string
+	var writeErr error
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	rr := httptest.NewRecorder()
+	database.NewMiddleware(conn).ServeHTTP(rr, r, func(w http.ResponseWriter, r *http.Request) {
+		database.NewReadOnlyTxMiddleware().ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+			name, err = loadItemName(database.Get(r), 1)
+			_, writeErr = database.Get(r).Exec(`INSERT INTO item (id, name) VALUES ($1, $2)`, 2, "bar")
+			w.WriteHeader(http.StatusNoContent)
+		})
+	})
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	require.Nil(t, err)
+	require.Equal(t, "foo", name)
+	require.NotNil(t, writeErr)
+	require.Contains(t, writeErr.Error(), "read-only transaction")
+
+	_, err = loadItemName(conn, 2)
+	require.Equal(t, sql.ErrNoRows, err)
+}
@@ -0,0 +1,204 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+const (
+	// DefaultMaxPreparedStatements is the default size of the prepared
+	// statement cache.
+	DefaultMaxPreparedStatements = 256
+)
+
+// Preparer is a database connection that can prepare statements.
+type Preparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// PreparedDB is a database connection that caches prepared statements.
+//
+// The statements are prepared on their first use, and they are looked up by
+// their query string. When the cache is full, the queries run without
+// preparing them.
+type PreparedDB struct {
+	db    DB
+	ctx   context.Context
+	cache *stmtCache
+
+	MaxStatements int
+}
+
+// stmtCache holds the prepared statements shared by the context bound copies
+// of a PreparedDB.
+type stmtCache struct {
+	mtx   sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+// NewPreparedDB wraps a database connection with a prepared statement cache.
+//
+// The connection is returned as is if it can't prepare statements.
+func NewPreparedDB(db DB) DB {
+	if _, ok := db.(Preparer); !ok {
+		return db
+	}
+
+	return &PreparedDB{
+		db:            db,
+		ctx:           context.Background(),
+		cache:         &stmtCache{stmts: make(map[string]*sql.Stmt)},
+		MaxStatements: DefaultMaxPreparedStatements,
+	}
+}
+
+// stmt returns the prepared statement of a query, or nil if the query can't
+// be prepared.
+func (d *PreparedDB) stmt(query string) *sql.Stmt {
+	c := d.cache
+	c.mtx.RLock()
+	stmt := c.stmts[query]
+	c.mtx.RUnlock()
+	if stmt != nil {
+		return stmt
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if stmt = c.stmts[query]; stmt != nil {
+		return stmt
+	}
+	if len(c.stmts) >= d.MaxStatements {
+		return nil
+	}
+
+	stmt, err := d.db.(Preparer).Prepare(query)
+	if err != nil {
+		// The error is reported when the query runs unprepared.
+		return nil
+	}
+	c.stmts[query] = stmt
+
+	return stmt
+}
+
+func (d *PreparedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if stmt := d.stmt(query); stmt != nil {
+		return stmt.ExecContext(d.ctx, args...)
+	}
+
+	return d.db.Exec(query, args...)
+}
+
+func (d *PreparedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt := d.stmt(query); stmt != nil {
+		return stmt.QueryContext(d.ctx, args...)
+	}
+
+	return d.db.Query(query, args...)
+}
+
+func (d *PreparedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	if stmt := d.stmt(query); stmt != nil {
+		return stmt.QueryRowContext(d.ctx, args...)
+	}
+
+	return d.db.QueryRow(query, args...)
+}
+
+// Begin starts a transaction.
+//
+// The cached statements are bound to the transaction. If the underlying
+// transaction is not an *sql.Tx, then the statements are not used.
+func (d *PreparedDB) Begin() (Transaction, error) {
+	f, ok := d.db.(TransactionFactory)
+	if !ok {
+		return nil, ErrNoTransactions
+	}
+
+	tx, err := f.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if sqltx, ok := tx.(*sql.Tx); ok {
+		return &preparedTx{Tx: sqltx, db: d}, nil
+	}
+
+	return tx, nil
+}
+
+// WithContext returns a copy of the connection that runs the cached
+// statements with the given context.
+func (d *PreparedDB) WithContext(ctx context.Context) DB {
+	return &PreparedDB{
+		db:            WithContext(d.db, ctx),
+		ctx:           ctx,
+		cache:         d.cache,
+		MaxStatements: d.MaxStatements,
+	}
+}
+
+// Close closes the cached statements.
+func (d *PreparedDB) Close() error {
+	c := d.cache
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var err error
+	for query, stmt := range c.stmts {
+		if cerr := stmt.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(c.stmts, query)
+	}
+
+	return err
+}
+
+type preparedTx struct {
+	*sql.Tx
+	db *PreparedDB
+}
+
+func (t *preparedTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if stmt := t.db.stmt(query); stmt != nil {
+		return t.Tx.StmtContext(t.db.ctx, stmt).ExecContext(t.db.ctx, args...)
+	}
+
+	return t.Tx.ExecContext(t.db.ctx, query, args...)
+}
+
+func (t *preparedTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt := t.db.stmt(query); stmt != nil {
+		return t.Tx.StmtContext(t.db.ctx, stmt).QueryContext(t.db.ctx, args...)
+	}
+
+	return t.Tx.QueryContext(t.db.ctx, query, args...)
+}
+
+func (t *preparedTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	if stmt := t.db.stmt(query); stmt != nil {
+		return t.Tx.StmtContext(t.db.ctx, stmt).QueryRowContext(t.db.ctx, args...)
+	}
+
+	return t.Tx.QueryRowContext(t.db.ctx, query, args...)
+}
@@ -0,0 +1,133 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+// connectTestDB connects to a new database on the server of TEST_DB.
+//
+// The test is skipped if TEST_DB is not set.
+func connectTestDB(tb testing.TB) (database.DB, func()) {
+	dburl := os.Getenv("TEST_DB")
+	if dburl == "" {
+		tb.Skip("TEST_DB is not set")
+	}
+
+	testdb, cleanup := testutil.SetupTestDatabase(dburl)
+	conn, err := database.Connect(testdb)
+	require.Nil(tb, err)
+
+	_, err = conn.Exec(`
+		CREATE TABLE item (
+			id integer NOT NULL,
+			name text NOT NULL,
+			PRIMARY KEY (id)
+		)
+	`)
+	require.Nil(tb, err)
+
+	return conn, cleanup
+}
+
+func loadItemName(conn database.DB, id int) (string, error) {
+	var name string
+	err := conn.QueryRow(`SELECT name FROM item WHERE id = $1`, id).Scan(&name)
+	return name, err
+}
+
+type prepareOnlyDB struct {
+	execRecorder
+}
+
+func (d *prepareOnlyDB) Prepare(query string) (*sql.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestPreparedDBBeginWithoutTransactions(t *testing.T) {
+	prepared := database.NewPreparedDB(&prepareOnlyDB{})
+
+	tx, err := prepared.(database.TransactionFactory).Begin()
+	require.Nil(t, tx)
+	require.Equal(t, database.ErrNoTransactions, err)
+}
+
+func TestPreparedDB(t *testing.T) {
+	conn, cleanup := connectTestDB(t)
+	defer cleanup()
+
+	prepared := database.NewPreparedDB(conn)
+	defer func() { _ = prepared.(*database.PreparedDB).Close() }()
+
+	_, err := prepared.Exec(`INSERT INTO item (id, name) VALUES ($1, $2)`, 1, "foo")
+	require.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		name, err := loadItemName(prepared, 1)
+		require.Nil(t, err)
+		require.Equal(t, "foo", name)
+	}
+
+	tx, err := prepared.(database.TransactionFactory).Begin()
+	require.Nil(t, err)
+	name, err := loadItemName(tx, 1)
+	require.Nil(t, err)
+	require.Equal(t, "foo", name)
+	_, err = tx.Exec(`INSERT INTO item (id, name) VALUES ($1, $2)`, 2, "bar")
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+
+	name, err = loadItemName(prepared, 2)
+	require.Nil(t, err)
+	require.Equal(t, "bar", name)
+
+	_, err = loadItemName(prepared, 3)
+	require.Equal(t, sql.ErrNoRows, err)
+}
+
+func BenchmarkPreparedDB(b *testing.B) {
+	conn, cleanup := connectTestDB(b)
+	defer cleanup()
+
+	_, err := conn.Exec(`INSERT INTO item (id, name) VALUES ($1, $2)`, 1, "bench")
+	require.Nil(b, err)
+
+	run := func(b *testing.B, db database.DB) {
+		for i := 0; i < b.N; i++ {
+			if _, err := loadItemName(db, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("plain", func(b *testing.B) {
+		run(b, conn)
+	})
+	b.Run("prepared", func(b *testing.B) {
+		prepared := database.NewPreparedDB(conn)
+		defer func() { _ = prepared.(*database.PreparedDB).Close() }()
+		run(b, prepared)
+	})
+}
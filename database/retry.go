@@ -0,0 +1,149 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/pkg/errors"
+)
+
+// Pinger is a database connection that can verify that the database is
+// reachable.
+type Pinger interface {
+	Ping() error
+}
+
+// RetryDB is a database connection that retries the queries once when they
+// fail with a connection error.
+//
+// Only driver.ErrBadConn is retried: the driver returns it when the query
+// couldn't have reached the database, so running it again is safe even for
+// writes. Other network errors can happen after the database has already
+// executed the query, so they are returned as is.
+//
+// Before the retry the connection pool is revalidated with a ping. Query
+// errors are returned as is. Queries in transactions are not retried, because
+// the transaction is lost with its connection.
+type RetryDB struct {
+	db DB
+}
+
+// NewRetryDB wraps a database connection with a retry layer.
+func NewRetryDB(db DB) *RetryDB {
+	return &RetryDB{
+		db: db,
+	}
+}
+
+// retry runs f again if it failed with a connection error and the database is
+// reachable.
+func (d *RetryDB) retry(err error, f func() error) error {
+	if !IsConnectionError(err) {
+		return err
+	}
+
+	if p, ok := d.db.(Pinger); ok {
+		if perr := p.Ping(); perr != nil {
+			return err
+		}
+	}
+
+	return f()
+}
+
+func (d *RetryDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	f := func() (err error) {
+		res, err = d.db.Exec(query, args...)
+		return err
+	}
+
+	return res, d.retry(f(), f)
+}
+
+func (d *RetryDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	f := func() (err error) {
+		rows, err = d.db.Query(query, args...)
+		return err
+	}
+
+	return rows, d.retry(f(), f)
+}
+
+func (d *RetryDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	row := d.db.QueryRow(query, args...)
+	if row != nil && IsConnectionError(row.Err()) {
+		_ = d.retry(row.Err(), func() error {
+			row = d.db.QueryRow(query, args...)
+			return nil
+		})
+	}
+
+	return row
+}
+
+func (d *RetryDB) Begin() (Transaction, error) {
+	f, ok := d.db.(TransactionFactory)
+	if !ok {
+		return nil, ErrNoTransactions
+	}
+
+	var tx Transaction
+	begin := func() (err error) {
+		tx, err = f.Begin()
+		return err
+	}
+
+	return tx, d.retry(begin(), begin)
+}
+
+func (d *RetryDB) Prepare(query string) (*sql.Stmt, error) {
+	p, ok := d.db.(Preparer)
+	if !ok {
+		return nil, errors.New("the connection can't prepare statements")
+	}
+
+	var stmt *sql.Stmt
+	f := func() (err error) {
+		stmt, err = p.Prepare(query)
+		return err
+	}
+
+	return stmt, d.retry(f(), f)
+}
+
+func (d *RetryDB) WithContext(ctx context.Context) DB {
+	return NewRetryDB(WithContext(d.db, ctx))
+}
+
+func (d *RetryDB) Ping() error {
+	if p, ok := d.db.(Pinger); ok {
+		return p.Ping()
+	}
+
+	return nil
+}
+
+// IsConnectionError checks if an error is caused by a broken database
+// connection that was detected before the query was sent.
+func IsConnectionError(err error) bool {
+	return errors.Is(err, driver.ErrBadConn)
+}
@@ -0,0 +1,192 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SchemaDrift describes the differences between the expected and the live
+// columns of a table.
+type SchemaDrift struct {
+	Table   string
+	Missing []string
+	Extra   []string
+}
+
+// Drifted reports whether the live table differs from the expected schema.
+func (d SchemaDrift) Drifted() bool {
+	return len(d.Missing) > 0 || len(d.Extra) > 0
+}
+
+func (d SchemaDrift) String() string {
+	if !d.Drifted() {
+		return d.Table + ": up to date"
+	}
+
+	var parts []string
+	if len(d.Missing) > 0 {
+		parts = append(parts, "missing columns: "+strings.Join(d.Missing, ", "))
+	}
+	if len(d.Extra) > 0 {
+		parts = append(parts, "unexpected columns: "+strings.Join(d.Extra, ", "))
+	}
+
+	return d.Table + ": " + strings.Join(parts, "; ")
+}
+
+// CheckSchema compares the columns of an existing table with the columns in
+// the SchemaSQL of the entity.
+//
+// A table that does not exist is reported with all of its columns missing.
+func CheckSchema(conn DB, v DatabaseEntity) (SchemaDrift, error) {
+	table := tableName(v)
+	expected := ExpectedColumns(v.SchemaSQL(), table)
+	if expected == nil {
+		return SchemaDrift{}, errors.New("no CREATE TABLE statement for " + table)
+	}
+
+	live, err := liveColumns(conn, table)
+	if err != nil {
+		return SchemaDrift{}, errors.Wrap(err, "error loading columns of "+table)
+	}
+
+	return CompareColumns(table, expected, live), nil
+}
+
+func liveColumns(conn DB, table string) ([]string, error) {
+	rows, err := conn.Query(`
+		SELECT column_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1
+		ORDER BY ordinal_position
+	`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+// CompareColumns returns the drift between the expected and the live columns
+// of a table.
+func CompareColumns(table string, expected, live []string) SchemaDrift {
+	drift := SchemaDrift{Table: table}
+	drift.Missing = difference(expected, live)
+	drift.Extra = difference(live, expected)
+
+	return drift
+}
+
+func difference(a, b []string) []string {
+	set := make(map[string]bool, len(b))
+	for _, s := range b {
+		set[s] = true
+	}
+
+	var diff []string
+	for _, s := range a {
+		if !set[s] {
+			diff = append(diff, s)
+		}
+	}
+	sort.Strings(diff)
+
+	return diff
+}
+
+var createTableRegexp = regexp.MustCompile(`(?i)CREATE\s+TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?"?([a-z0-9_]+)"?\s*\(`)
+
+var tableConstraintKeywords = map[string]bool{
+	"constraint": true,
+	"primary":    true,
+	"unique":     true,
+	"foreign":    true,
+	"check":      true,
+	"exclude":    true,
+	"like":       true,
+}
+
+// ExpectedColumns extracts the column names of a table from the CREATE TABLE
+// statement in a schema.
+//
+// It returns nil if the schema does not create the table.
+func ExpectedColumns(schema, table string) []string {
+	for _, loc := range createTableRegexp.FindAllStringSubmatchIndex(schema, -1) {
+		if !strings.EqualFold(schema[loc[2]:loc[3]], table) {
+			continue
+		}
+
+		columns := []string{}
+		for _, def := range splitDefinitions(schema[loc[1]:]) {
+			fields := strings.Fields(def)
+			if len(fields) == 0 || tableConstraintKeywords[strings.ToLower(fields[0])] {
+				continue
+			}
+			name := fields[0]
+			if strings.HasPrefix(name, `"`) {
+				name = strings.Trim(name, `"`)
+			} else {
+				name = strings.ToLower(name)
+			}
+			columns = append(columns, name)
+		}
+
+		return columns
+	}
+
+	return nil
+}
+
+// splitDefinitions splits the body of a CREATE TABLE statement at the top
+// level commas, until the closing parenthesis.
+func splitDefinitions(body string) []string {
+	var defs []string
+	depth, start := 0, 0
+	for i, c := range body {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return append(defs, body[start:i])
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				defs = append(defs, body[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(defs, body[start:])
+}
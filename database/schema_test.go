@@ -0,0 +1,71 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/database"
+)
+
+const oldSchema = `
+	CREATE TABLE article (
+		id uuid NOT NULL,
+		author uuid NOT NULL
+			REFERENCES account(id) ON UPDATE CASCADE ON DELETE CASCADE,
+		title VARCHAR(255) NOT NULL,
+		created timestamp with time zone NOT NULL DEFAULT now(),
+		PRIMARY KEY (id)
+	);
+
+	CREATE INDEX article_author ON article (author);
+`
+
+const newSchema = `
+	CREATE TABLE article (
+		id uuid NOT NULL,
+		author uuid NOT NULL
+			REFERENCES account(id) ON UPDATE CASCADE ON DELETE CASCADE,
+		title VARCHAR(255) NOT NULL,
+		summary text NOT NULL DEFAULT '',
+		created timestamp with time zone NOT NULL DEFAULT now(),
+		PRIMARY KEY (id),
+		CONSTRAINT article_title_unique UNIQUE (title)
+	);
+`
+
+func TestExpectedColumns(t *testing.T) {
+	require.Equal(t, []string{"id", "author", "title", "created"}, database.ExpectedColumns(oldSchema, "article"))
+	require.Equal(t, []string{"id", "author", "title", "summary", "created"}, database.ExpectedColumns(newSchema, "article"))
+	require.Nil(t, database.ExpectedColumns(oldSchema, "account"))
+}
+
+func TestSchemaDrift(t *testing.T) {
+	live := database.ExpectedColumns(oldSchema, "article")
+
+	drift := database.CompareColumns("article", database.ExpectedColumns(newSchema, "article"), live)
+	require.True(t, drift.Drifted())
+	require.Equal(t, []string{"summary"}, drift.Missing)
+	require.Empty(t, drift.Extra)
+	require.Equal(t, "article: missing columns: summary", drift.String())
+
+	drift = database.CompareColumns("article", live, database.ExpectedColumns(newSchema, "article"))
+	require.Equal(t, []string{"summary"}, drift.Extra)
+
+	require.False(t, database.CompareColumns("article", live, live).Drifted())
+}
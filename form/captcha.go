@@ -0,0 +1,144 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package form
+
+import (
+	"encoding/json"
+	"html"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	hCaptchaVerifyURL  = "https://hcaptcha.com/siteverify"
+	reCaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+)
+
+// Captcha verifies that a form submission is made by a human.
+type Captcha interface {
+	// Widget returns the markup that renders the CAPTCHA on the form.
+	Widget() template.HTML
+	// Field returns the name of the form field that holds the response.
+	Field() string
+	// Verify checks the CAPTCHA response decoded from the submitted form.
+	Verify(r *http.Request, response string) (bool, error)
+}
+
+// CaptchaDelegate is a form delegate that opts in to CAPTCHA verification.
+//
+// If Captcha() returns nil, the form works without a CAPTCHA.
+type CaptchaDelegate interface {
+	Delegate
+	Captcha() Captcha
+}
+
+// SiteVerifyCaptcha is a Captcha implementation for providers that follow the
+// reCAPTCHA siteverify API (reCAPTCHA, hCaptcha).
+type SiteVerifyCaptcha struct {
+	SiteKey       string
+	Secret        string
+	VerifyURL     string
+	ScriptURL     string
+	WidgetClass   string
+	ResponseField string
+	Client        *http.Client
+}
+
+// NewHCaptcha creates a Captcha for hCaptcha.
+func NewHCaptcha(siteKey, secret string) *SiteVerifyCaptcha {
+	return &SiteVerifyCaptcha{
+		SiteKey:       siteKey,
+		Secret:        secret,
+		VerifyURL:     hCaptchaVerifyURL,
+		ScriptURL:     "https://hcaptcha.com/1/api.js",
+		WidgetClass:   "h-captcha",
+		ResponseField: "h-captcha-response",
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewReCaptcha creates a Captcha for Google reCAPTCHA v2.
+func NewReCaptcha(siteKey, secret string) *SiteVerifyCaptcha {
+	return &SiteVerifyCaptcha{
+		SiteKey:       siteKey,
+		Secret:        secret,
+		VerifyURL:     reCaptchaVerifyURL,
+		ScriptURL:     "https://www.google.com/recaptcha/api.js",
+		WidgetClass:   "g-recaptcha",
+		ResponseField: "g-recaptcha-response",
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ScriptOrigin returns the origin of the widget script, so it can be allowed
+// in the Content-Security-Policy.
+func (c *SiteVerifyCaptcha) ScriptOrigin() string {
+	u, err := url.Parse(c.ScriptURL)
+	if err != nil {
+		return ""
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+func (c *SiteVerifyCaptcha) Widget() template.HTML {
+	return template.HTML(`
+		<div class="` + html.EscapeString(c.WidgetClass) + `" data-sitekey="` + html.EscapeString(c.SiteKey) + `"></div>
+		<script src="` + html.EscapeString(c.ScriptURL) + `" async defer></script>
+	`)
+}
+
+func (c *SiteVerifyCaptcha) Field() string {
+	return c.ResponseField
+}
+
+func (c *SiteVerifyCaptcha) Verify(r *http.Request, response string) (bool, error) {
+	if response == "" {
+		return false, nil
+	}
+
+	values := url.Values{}
+	values.Set("secret", c.Secret)
+	values.Set("response", response)
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		values.Set("remoteip", ip)
+	}
+
+	resp, err := c.Client.PostForm(c.VerifyURL, values)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to reach captcha provider")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New("captcha provider returned " + resp.Status)
+	}
+
+	result := struct {
+		Success bool `json:"success"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, errors.Wrap(err, "failed to decode captcha response")
+	}
+
+	return result.Success, nil
+}
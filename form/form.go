@@ -17,10 +17,18 @@
 package form
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"html"
 	"html/template"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/monoculum/formam"
@@ -35,6 +43,11 @@ import (
 )
 
 const (
+	// DefaultTokenTTL is the default lifetime of a form token.
+	DefaultTokenTTL = 24 * time.Hour
+	// DefaultMaxBodyBytes is the default size limit of a form submission.
+	DefaultMaxBodyBytes = 10 << 20
+
 	multipartFormBuffer = 64 * 1024
 	formIDLength        = 16
 	formTokenLength     = 32
@@ -46,6 +59,8 @@ type Form struct {
 	title    string
 	page     *template.Template
 	delegate Delegate
+	ttl      time.Duration
+	maxBody  int64
 }
 
 // NewForm creates a new instance of Form.
@@ -58,9 +73,27 @@ func NewForm(store keyvalue.Store, title string, page *template.Template, delega
 		title:    title,
 		page:     page,
 		delegate: delegate,
+		ttl:      DefaultTokenTTL,
+		maxBody:  DefaultMaxBodyBytes,
 	}
 }
 
+// WithTTL sets the lifetime of the form tokens.
+//
+// A form submitted after its token has expired is rejected.
+func (f *Form) WithTTL(ttl time.Duration) *Form {
+	f.ttl = ttl
+	return f
+}
+
+// WithMaxBodyBytes sets the size limit of the request body.
+//
+// Larger submissions are rejected with 413 Request Entity Too Large.
+func (f *Form) WithMaxBodyBytes(n int64) *Form {
+	f.maxBody = n
+	return f
+}
+
 // Page is the main page that shows the form.
 func (f *Form) Page(w http.ResponseWriter, r *http.Request) {
 	sess := session.Get(r)
@@ -77,58 +110,142 @@ func (f *Form) Page(w http.ResponseWriter, r *http.Request) {
 }
 
 // Submit is the endpoint that handles the form submission.
+//
+// Besides the standard form encodings, the submission can be a JSON object.
+// In that case the FormID and FormToken are read from the object or from the
+// X-Form-ID and X-Form-Token headers, and the response is a JSONResult instead
+// of the rebuilt form page.
 func (f *Form) Submit(w http.ResponseWriter, r *http.Request) {
-	if err := parseForm(r); err != nil {
-		respond.Error(w, r, http.StatusBadRequest, "error parsing form data", nil, err)
+	jsonRequest := isJSON(r)
+	r.Body = http.MaxBytesReader(w, r.Body, f.maxBody)
+	var body []byte
+	var err error
+	if jsonRequest {
+		body, err = ioutil.ReadAll(r.Body)
+	} else {
+		err = parseForm(r)
+	}
+	if isBodyTooLarge(err) {
+		f.respondError(w, r, jsonRequest, http.StatusRequestEntityTooLarge, "request body is too large", err)
+		return
+	}
+	if err != nil {
+		f.respondError(w, r, jsonRequest, http.StatusBadRequest, "error parsing form data", err)
 		return
 	}
 	data, err := f.delegate.LoadData(r)
 	if err != nil {
-		respond.Error(w, r, http.StatusNotFound, "not found", nil, err)
+		f.respondError(w, r, jsonRequest, http.StatusNotFound, "not found", err)
 		return
 	}
 	fd := &FormPageData{
-		FormID:    r.Form.Get("FormID"),
-		FormToken: r.Form.Get("FormToken"),
-		Data:      data,
+		Data:    data,
+		captcha: f.captcha(),
+		json:    jsonRequest,
 	}
-	dec := formam.NewDecoder(&formam.DecoderOptions{
-		IgnoreUnknownKeys: true,
-	})
-	if err = dec.Decode(r.Form, fd.Data); err != nil {
-		respond.Error(w, r, http.StatusUnprocessableEntity, "error unserializing form data", nil, err)
+	if jsonRequest {
+		err = fd.decodeJSON(r, body)
+	} else {
+		err = fd.decodeForm(r)
+	}
+	if err != nil {
+		f.respondError(w, r, jsonRequest, http.StatusUnprocessableEntity, "error unserializing form data", err)
 		return
 	}
-	if err = fd.validateFormToken(f.store); err != nil {
-		respond.Error(w, r, http.StatusUnprocessableEntity, "form token error", nil, err)
+	if err = fd.validateFormToken(f.store, *session.GetSid(r)); err != nil {
+		f.respondError(w, r, jsonRequest, http.StatusUnprocessableEntity, "form token error", err)
 		return
 	}
 
 	if err = f.store.Delete(fd.FormID); err != nil {
-		respond.Error(w, r, http.StatusInternalServerError, "form token error", nil, err)
+		f.respondError(w, r, jsonRequest, http.StatusInternalServerError, "form token error", err)
 		return
 	}
 
-	if fd.Errors = f.maybeValidate(r, fd.Data); len(fd.Errors) == 0 {
+	if err = f.maybeVerifyCaptcha(r, fd); err != nil {
+		fd.Errors = append(fd.Errors, err.Error())
+	} else if f.maybeValidate(r, fd); !fd.HasErrors() {
 		if !f.delegate.Submit(w, r, fd.Data).Do(w, r, fd) {
 			return
 		}
 	}
 
+	if jsonRequest {
+		f.respondJSONErrors(w, r, fd)
+		return
+	}
+
 	f.buildForm(w, r, session.Get(r), fd)
 }
 
+func (f *Form) respondError(w http.ResponseWriter, r *http.Request, jsonRequest bool, code int, message string, err error) {
+	if !jsonRequest {
+		respond.Error(w, r, code, message, nil, err)
+		return
+	}
+
+	logger := server.GetLogger(r)
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.Error(message)
+	respond.JSON(logger, w, JSONResult{
+		Errors: []string{message},
+	}, code)
+}
+
+func (f *Form) respondJSONErrors(w http.ResponseWriter, r *http.Request, fd *FormPageData) {
+	logger := server.GetLogger(r)
+	if err := fd.regenerateFormToken(f.store, f.ttl, *session.GetSid(r)); err != nil {
+		logger.WithError(err).Errorln("failed to create form token")
+	}
+	respond.JSON(logger, w, JSONResult{
+		Errors:      fd.Errors,
+		FieldErrors: fd.FieldErrors,
+		FormID:      fd.FormID,
+		FormToken:   fd.FormToken,
+	}, http.StatusUnprocessableEntity)
+}
+
 func (f *Form) buildForm(w http.ResponseWriter, r *http.Request, sess *session.Session, fd *FormPageData) {
 	logger := server.GetLogger(r)
-	if err := fd.regenerateFormToken(f.store); err != nil {
+	if err := fd.regenerateFormToken(f.store, f.ttl, *session.GetSid(r)); err != nil {
 		logger.WithError(err).Errorln("failed to create form token")
 	}
-	respond.Page(logger, w, f.page, f.title, sess, f.delegate.GetAccessCheck(r), fd)
+	fd.captcha = f.captcha()
+	respond.Page(logger, w, r, f.page, f.title, sess, f.delegate.GetAccessCheck(r), fd)
+}
+
+func (f *Form) maybeValidate(r *http.Request, fd *FormPageData) {
+	if vf, ok := f.delegate.(FieldValidator); ok {
+		if errs := vf.ValidateFields(r, fd.Data); errs != nil {
+			fd.Errors = errs.General
+			fd.FieldErrors = errs.Fields
+		}
+	} else if vf, ok := f.delegate.(Validator); ok {
+		fd.Errors = vf.Validate(r, fd.Data)
+	}
 }
 
-func (f *Form) maybeValidate(r *http.Request, v interface{}) []string {
-	if vf, ok := f.delegate.(Validator); ok {
-		return vf.Validate(r, v)
+func (f *Form) captcha() Captcha {
+	if cd, ok := f.delegate.(CaptchaDelegate); ok {
+		return cd.Captcha()
+	}
+
+	return nil
+}
+
+func (f *Form) maybeVerifyCaptcha(r *http.Request, fd *FormPageData) error {
+	if fd.captcha == nil {
+		return nil
+	}
+
+	ok, err := fd.captcha.Verify(r, fd.captchaResponse)
+	if err != nil {
+		server.GetLogger(r).WithError(err).Warnln("failed to verify captcha")
+	}
+	if !ok {
+		return errors.New("CAPTCHA verification failed")
 	}
 
 	return nil
@@ -136,8 +253,8 @@ func (f *Form) maybeValidate(r *http.Request, v interface{}) []string {
 
 func (f *Form) Pages(path string, middlewares ...negroni.Handler) []server.Route {
 	return []server.Route{
-		{http.MethodGet, path, server.WrapF(f.Page, middlewares...)},
-		{http.MethodPost, path, server.WrapF(f.Submit, middlewares...)},
+		{Method: http.MethodGet, Path: path, Handler: server.WrapF(f.Page, middlewares...)},
+		{Method: http.MethodPost, Path: path, Handler: server.WrapF(f.Submit, middlewares...)},
 	}
 }
 
@@ -154,6 +271,35 @@ type Validator interface {
 	Validate(r *http.Request, v interface{}) []string
 }
 
+// FieldValidator is a form delegate that validates the form data, and
+// attaches the errors to the fields where possible.
+//
+// If a delegate implements both Validator and FieldValidator, then only
+// FieldValidator is used.
+type FieldValidator interface {
+	Delegate
+	ValidateFields(r *http.Request, v interface{}) *ValidationErrors
+}
+
+// ValidationErrors holds the general and the per-field validation errors.
+type ValidationErrors struct {
+	General []string
+	Fields  map[string][]string
+}
+
+// Add adds a general error.
+func (e *ValidationErrors) Add(message string) {
+	e.General = append(e.General, message)
+}
+
+// AddField adds an error to a field.
+func (e *ValidationErrors) AddField(field, message string) {
+	if e.Fields == nil {
+		e.Fields = make(map[string][]string)
+	}
+	e.Fields[field] = append(e.Fields[field], message)
+}
+
 // ErrInvalidFormContentType is an error that happens when a form submission
 // happens with an incorrect content type.
 type ErrInvalidFormContentType string
@@ -162,12 +308,32 @@ func (e ErrInvalidFormContentType) Error() string {
 	return "invalid form content type: " + string(e)
 }
 
+func mediaType(r *http.Request) string {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+
+	return mt
+}
+
 func isMultipart(r *http.Request) bool {
-	return r.Header.Get("Content-Type") == "multipart/form-data"
+	return mediaType(r) == "multipart/form-data"
 }
 
 func isUrlEncoded(r *http.Request) bool {
-	return r.Header.Get("Content-Type") == "application/x-www-form-urlencoded"
+	return mediaType(r) == "application/x-www-form-urlencoded"
+}
+
+func isJSON(r *http.Request) bool {
+	return mediaType(r) == "application/json"
+}
+
+// isBodyTooLarge checks if the error is caused by http.MaxBytesReader.
+//
+// The multipart reader wraps the error in its own, so the message is checked.
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
 }
 
 func parseForm(r *http.Request) error {
@@ -192,34 +358,102 @@ func parseForm(r *http.Request) error {
 //
 // The Data attribute has the custom data that is either posted or loaded.
 type FormPageData struct {
-	Errors    []string
-	FormID    string
-	FormToken string
-	Data      interface{}
+	Errors      []string
+	FieldErrors map[string][]string
+	FormID      string
+	FormToken   string
+	Data        interface{}
+
+	captcha         Captcha
+	captchaResponse string
+	json            bool
+}
+
+// JSONResult is the response for a form submission with a JSON body.
+type JSONResult struct {
+	Redirect    string              `json:"redirect,omitempty"`
+	Errors      []string            `json:"errors,omitempty"`
+	FieldErrors map[string][]string `json:"field_errors,omitempty"`
+	FormID      string              `json:"form_id,omitempty"`
+	FormToken   string              `json:"form_token,omitempty"`
+}
+
+func (f *FormPageData) decodeForm(r *http.Request) error {
+	f.FormID = r.Form.Get("FormID")
+	f.FormToken = r.Form.Get("FormToken")
+	if f.captcha != nil {
+		f.captchaResponse = r.Form.Get(f.captcha.Field())
+	}
+	dec := formam.NewDecoder(&formam.DecoderOptions{
+		IgnoreUnknownKeys: true,
+	})
+
+	return dec.Decode(r.Form, f.Data)
+}
+
+func (f *FormPageData) decodeJSON(r *http.Request, body []byte) error {
+	tokens := struct {
+		FormID    string
+		FormToken string
+	}{
+		FormID:    r.Header.Get("X-Form-ID"),
+		FormToken: r.Header.Get("X-Form-Token"),
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return err
+	}
+	f.FormID = tokens.FormID
+	f.FormToken = tokens.FormToken
+	if f.captcha != nil {
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return err
+		}
+		f.captchaResponse, _ = fields[f.captcha.Field()].(string)
+	}
+
+	return json.Unmarshal(body, f.Data)
 }
 
 func (f *FormPageData) generateFormID() {
 	f.FormID = util.RandomHexString(formIDLength)
 }
 
-func (f *FormPageData) regenerateFormToken(storage keyvalue.Store) error {
+// regenerateFormToken creates a new form token, and binds it to the session.
+func (f *FormPageData) regenerateFormToken(storage keyvalue.Store, ttl time.Duration, sid string) error {
 	f.FormToken = util.RandomHexString(formTokenLength)
-	return storage.SetExpiring(f.FormID, f.FormToken, 24*time.Hour)
+	return storage.SetExpiring(f.FormID, formTokenValue(f.FormToken, sid), ttl)
 }
 
-func (f *FormPageData) validateFormToken(storage keyvalue.Store) error {
+// validateFormToken checks that the submitted form token was issued for the
+// same session.
+func (f *FormPageData) validateFormToken(storage keyvalue.Store, sid string) error {
+	if f.FormID == "" || f.FormToken == "" {
+		return errors.New("missing form token")
+	}
+
 	res, err := storage.Get(f.FormID)
+	if err == keyvalue.ErrNotFound {
+		return errors.New("form token expired")
+	}
 	if err != nil {
 		return err
 	}
 
-	if res != f.FormToken {
+	if res != formTokenValue(f.FormToken, sid) {
 		return errors.New("form token mismatch")
 	}
 
 	return nil
 }
 
+// formTokenValue is the stored form of the token. Only a hash of the session
+// id is stored, so the store of the form tokens doesn't leak sessions.
+func formTokenValue(token, sid string) string {
+	hash := sha256.Sum256([]byte(sid))
+	return token + ":" + hex.EncodeToString(hash[:])
+}
+
 func (f *FormPageData) CSRFToken() template.HTML {
 	return template.HTML(`
 		<input type="hidden" name="FormID" value="` + f.FormID + `" />
@@ -227,6 +461,95 @@ func (f *FormPageData) CSRFToken() template.HTML {
 	`)
 }
 
+// Captcha renders the CAPTCHA widget if the form uses one.
+func (f *FormPageData) Captcha() template.HTML {
+	if f.captcha == nil {
+		return ""
+	}
+
+	return f.captcha.Widget()
+}
+
+// Checked renders the checked attribute for a checkbox or a radio button if
+// the given field of the form data has the given value.
+//
+// Usage: <input type="checkbox" name="Foo" value="true" {{.Checked "Foo" "true"}} />
+func (f *FormPageData) Checked(field, value string) template.HTMLAttr {
+	if f.hasValue(field, value) {
+		return `checked="checked"`
+	}
+
+	return ""
+}
+
+// Selected renders the selected attribute for an option if the given field
+// of the form data has the given value.
+//
+// Usage: <option value="foo" {{.Selected "Foo" "foo"}}>Foo</option>
+func (f *FormPageData) Selected(field, value string) template.HTMLAttr {
+	if f.hasValue(field, value) {
+		return `selected="selected"`
+	}
+
+	return ""
+}
+
+// hasValue tells if a field of the form data equals to, or in case of a
+// slice, contains the value.
+//
+// Nested fields can be referenced with a dot-separated path.
+func (f *FormPageData) hasValue(field, value string) bool {
+	v := reflect.ValueOf(f.Data)
+	for _, name := range strings.Split(field, ".") {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return false
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return false
+		}
+		v = v.FieldByName(name)
+		if !v.IsValid() {
+			return false
+		}
+	}
+
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		for i := 0; i < v.Len(); i++ {
+			if fmt.Sprint(v.Index(i).Interface()) == value {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return fmt.Sprint(v.Interface()) == value
+}
+
+// HasErrors tells if the form has either general or field errors.
+func (f *FormPageData) HasErrors() bool {
+	return len(f.Errors) > 0 || len(f.FieldErrors) > 0
+}
+
+// FieldError renders the errors of a given field.
+func (f *FormPageData) FieldError(field string) template.HTML {
+	errs := f.FieldErrors[field]
+	if len(errs) == 0 {
+		return ""
+	}
+
+	tpl := `<span class="messages error">`
+	for _, err := range errs {
+		tpl += `<span class="error">` + html.EscapeString(err) + `</span>`
+	}
+	tpl += `</span>`
+
+	return template.HTML(tpl)
+}
+
 func (f *FormPageData) ErrorMessages() template.HTML {
 	if len(f.Errors) == 0 {
 		return ""
@@ -252,8 +575,15 @@ type redirectResult struct {
 	path string
 }
 
-func (res redirectResult) Do(w http.ResponseWriter, r *http.Request, _ *FormPageData) bool {
-	http.Redirect(w, r, res.path, http.StatusFound)
+func (res redirectResult) Do(w http.ResponseWriter, r *http.Request, fd *FormPageData) bool {
+	if fd.json {
+		respond.JSON(server.GetLogger(r), w, JSONResult{
+			Redirect: page.URL(res.path),
+		}, http.StatusOK)
+		return false
+	}
+
+	respond.Redirect(w, r, res.path, http.StatusSeeOther)
 	return false
 }
 
@@ -268,6 +598,7 @@ func Redirect(path string) FormSubmitResult {
 }
 
 type errorResult struct {
+	field   string
 	message string
 	err     error
 }
@@ -275,7 +606,14 @@ type errorResult struct {
 func (res errorResult) Do(_ http.ResponseWriter, r *http.Request, fd *FormPageData) bool {
 	logger := server.GetLogger(r)
 	logger.WithError(res.err).Warnln("failed to submit form")
-	fd.Errors = append(fd.Errors, res.message)
+	if res.field == "" {
+		fd.Errors = append(fd.Errors, res.message)
+	} else {
+		if fd.FieldErrors == nil {
+			fd.FieldErrors = make(map[string][]string)
+		}
+		fd.FieldErrors[res.field] = append(fd.FieldErrors[res.field], res.message)
+	}
 	if err := database.MaybeRollback(r); err != nil {
 		logger.WithError(err).Errorln("failed to roll back transaction")
 	}
@@ -290,3 +628,12 @@ func Error(message string, err error) FormSubmitResult {
 		err:     err,
 	}
 }
+
+// FieldError is like Error, but the message is attached to a field.
+func FieldError(field, message string, err error) FormSubmitResult {
+	return errorResult{
+		field:   field,
+		message: message,
+		err:     err,
+	}
+}
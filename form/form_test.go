@@ -0,0 +1,447 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package form_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/form"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/page"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/tamasd/simplesite/server"
+	"github.com/tamasd/simplesite/session"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+var testFormPage = page.SubPage(`
+{{define "body"}}
+<form method="POST">
+	{{.ErrorMessages}}
+	{{.CSRFToken}}
+	<p><input type="textfield" name="Name" value="{{.Data.Name}}" /></p>
+	<p><input type="checkbox" name="Agree" value="true" {{.Checked "Agree" "true"}} /></p>
+	<p>
+		<input type="radio" name="Color" value="red" {{.Checked "Color" "red"}} />
+		<input type="radio" name="Color" value="blue" {{.Checked "Color" "blue"}} />
+	</p>
+	<p>
+		<select name="Tags" multiple="multiple">
+			<option value="a" {{.Selected "Tags" "a"}}>A</option>
+			<option value="b" {{.Selected "Tags" "b"}}>B</option>
+			<option value="c" {{.Selected "Tags" "c"}}>C</option>
+		</select>
+	</p>
+</form>
+{{end}}
+`)
+
+type testFormData struct {
+	Name  string
+	Agree bool
+	Color string
+	Tags  []string
+}
+
+type testDelegate struct{}
+
+func (d *testDelegate) Validate(_ *http.Request, v interface{}) []string {
+	if v.(*testFormData).Name == "" {
+		return []string{"Name is required"}
+	}
+
+	return nil
+}
+
+func (d *testDelegate) GetAccessCheck(_ *http.Request) page.AccessChecker {
+	return nil
+}
+
+func (d *testDelegate) LoadData(_ *http.Request) (interface{}, error) {
+	return &testFormData{}, nil
+}
+
+func (d *testDelegate) Submit(_ http.ResponseWriter, _ *http.Request, _ interface{}) form.FormSubmitResult {
+	return form.Redirect("/")
+}
+
+type testClient struct {
+	t       *testing.T
+	handler http.Handler
+	cookies []*http.Cookie
+	page    *goquery.Document
+}
+
+func newTestClient(t *testing.T, f *form.Form) *testClient {
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Use(session.NewMiddleware(logger, keyvalue.NewMemory()))
+	srv.Router().Add(f.Pages("/form")...)
+
+	return &testClient{
+		t:       t,
+		handler: srv.CreateHTTPServer().Handler,
+	}
+}
+
+func (c *testClient) do(r *http.Request) *http.Response {
+	for _, cookie := range c.cookies {
+		r.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	c.handler.ServeHTTP(rr, r)
+	resp := rr.Result()
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		c.cookies = cookies
+	}
+
+	var err error
+	c.page, err = goquery.NewDocumentFromReader(resp.Body)
+	require.Nil(c.t, err)
+
+	return resp
+}
+
+func (c *testClient) get() *url.Values {
+	resp := c.do(httptest.NewRequest(http.MethodGet, "/form", nil))
+	require.Equal(c.t, http.StatusOK, resp.StatusCode)
+
+	v := &url.Values{}
+	v.Set("FormID", c.page.Find("input[name=FormID]").AttrOr("value", ""))
+	v.Set("FormToken", c.page.Find("input[name=FormToken]").AttrOr("value", ""))
+
+	return v
+}
+
+func (c *testClient) submit(v *url.Values) *http.Response {
+	r := httptest.NewRequest(http.MethodPost, "/form", bytes.NewBufferString(v.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(r)
+}
+
+func TestFormSubmit(t *testing.T) {
+	f := form.NewForm(keyvalue.NewMemory(), "Test", testFormPage, &testDelegate{})
+	c := newTestClient(t, f)
+
+	v := c.get()
+	v.Set("Name", "foo")
+	resp := c.submit(v)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+}
+
+func TestFormRedirectSeeOther(t *testing.T) {
+	logger := testutil.TestLogger()
+	f := form.NewForm(keyvalue.NewMemory(), "Test", testFormPage, &testDelegate{})
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Use(session.NewMiddleware(logger, keyvalue.NewMemory()))
+	srv.Router().Add(f.Pages("/form")...)
+	var method string
+	srv.Router().GetF("/", func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	ts := httptest.NewServer(srv.CreateHTTPServer().Handler)
+	defer ts.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.Nil(t, err)
+	var redirectCode int
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			redirectCode = req.Response.StatusCode
+			return nil
+		},
+	}
+
+	resp, err := client.Get(ts.URL + "/form")
+	require.Nil(t, err)
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	v := url.Values{}
+	v.Set("FormID", doc.Find("input[name=FormID]").AttrOr("value", ""))
+	v.Set("FormToken", doc.Find("input[name=FormToken]").AttrOr("value", ""))
+	v.Set("Name", "foo")
+	resp, err = client.PostForm(ts.URL+"/form", v)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusSeeOther, redirectCode)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, http.MethodGet, method)
+}
+
+func TestFormTokenTTL(t *testing.T) {
+	clock, restore := testutil.InstallFakeClock()
+	defer restore()
+
+	f := form.NewForm(keyvalue.NewMemory(), "Test", testFormPage, &testDelegate{}).WithTTL(time.Second)
+	c := newTestClient(t, f)
+
+	v := c.get()
+	v.Set("Name", "foo")
+	clock.Advance(1100 * time.Millisecond)
+	resp := c.submit(v)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Equal(t, "form token error", c.page.Find("p").First().Text())
+}
+
+func TestFormSubmitJSON(t *testing.T) {
+	f := form.NewForm(keyvalue.NewMemory(), "Test", testFormPage, &testDelegate{})
+	c := newTestClient(t, f)
+
+	v := c.get()
+	body, err := json.Marshal(map[string]string{
+		"FormToken": v.Get("FormToken"),
+		"Name":      "foo",
+	})
+	require.Nil(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/form", bytes.NewBuffer(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Form-ID", v.Get("FormID"))
+	resp := c.do(r)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+}
+
+type testCaptcha struct {
+	responses []string
+}
+
+func (c *testCaptcha) Widget() template.HTML {
+	return ""
+}
+
+func (c *testCaptcha) Field() string {
+	return "captcha-response"
+}
+
+func (c *testCaptcha) Verify(_ *http.Request, response string) (bool, error) {
+	c.responses = append(c.responses, response)
+	return response == "human", nil
+}
+
+type testCaptchaDelegate struct {
+	testDelegate
+	captcha *testCaptcha
+}
+
+func (d *testCaptchaDelegate) Captcha() form.Captcha {
+	return d.captcha
+}
+
+func TestFormCaptchaJSON(t *testing.T) {
+	captcha := &testCaptcha{}
+	f := form.NewForm(keyvalue.NewMemory(), "Test", testFormPage, &testCaptchaDelegate{captcha: captcha})
+	c := newTestClient(t, f)
+
+	submit := func(response string) (*http.Response, form.JSONResult) {
+		v := c.get()
+		body, err := json.Marshal(map[string]string{
+			"FormID":           v.Get("FormID"),
+			"FormToken":        v.Get("FormToken"),
+			"Name":             "foo",
+			"captcha-response": response,
+		})
+		require.Nil(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "/form", bytes.NewBuffer(body))
+		r.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		for _, cookie := range c.cookies {
+			r.AddCookie(cookie)
+		}
+		c.handler.ServeHTTP(rr, r)
+
+		var result form.JSONResult
+		require.Nil(t, json.NewDecoder(rr.Body).Decode(&result))
+		return rr.Result(), result
+	}
+
+	resp, result := submit("robot")
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Equal(t, []string{"CAPTCHA verification failed"}, result.Errors)
+
+	resp, result = submit("human")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, result.Errors)
+	require.Equal(t, "/", result.Redirect)
+
+	require.Equal(t, []string{"robot", "human"}, captcha.responses)
+}
+
+func TestFormRepopulateOnError(t *testing.T) {
+	f := form.NewForm(keyvalue.NewMemory(), "Test", testFormPage, &testDelegate{})
+	c := newTestClient(t, f)
+
+	v := c.get()
+	v.Set("Agree", "true")
+	v.Set("Color", "blue")
+	v.Add("Tags", "a")
+	v.Add("Tags", "c")
+	resp := c.submit(v)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Name is required", c.page.Find("div.messages p.error").Text())
+
+	require.Equal(t, "checked", c.page.Find(`input[name=Agree]`).AttrOr("checked", ""))
+	require.Equal(t, "blue", c.page.Find(`input[name=Color][checked]`).AttrOr("value", ""))
+	var selected []string
+	c.page.Find(`select[name=Tags] option[selected]`).Each(func(_ int, s *goquery.Selection) {
+		selected = append(selected, s.AttrOr("value", ""))
+	})
+	require.Equal(t, []string{"a", "c"}, selected)
+}
+
+func TestFormBodyTooLarge(t *testing.T) {
+	f := form.NewForm(keyvalue.NewMemory(), "Test", testFormPage, &testDelegate{}).WithMaxBodyBytes(1024)
+	c := newTestClient(t, f)
+
+	v := c.get()
+	v.Set("Name", strings.Repeat("a", 2048))
+	resp := c.submit(v)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	v = c.get()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.Nil(t, mw.WriteField("FormID", v.Get("FormID")))
+	require.Nil(t, mw.WriteField("FormToken", v.Get("FormToken")))
+	require.Nil(t, mw.WriteField("Name", strings.Repeat("a", 2048)))
+	require.Nil(t, mw.Close())
+	r := httptest.NewRequest(http.MethodPost, "/form", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	resp = c.do(r)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestFormTokenSessionBinding(t *testing.T) {
+	f := form.NewForm(keyvalue.NewMemory(), "Test", testFormPage, &testDelegate{})
+	c := newTestClient(t, f)
+	other := &testClient{t: t, handler: c.handler}
+	other.get()
+
+	v := c.get()
+	v.Set("Name", "foo")
+	resp := other.submit(v)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Equal(t, "form token error", other.page.Find("p").First().Text())
+
+	v = c.get()
+	v.Set("Name", "foo")
+	resp = c.submit(v)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+}
+
+func TestFormTokenMissing(t *testing.T) {
+	f := form.NewForm(keyvalue.NewMemory(), "Test", testFormPage, &testDelegate{})
+	c := newTestClient(t, f)
+	c.get()
+
+	v := &url.Values{}
+	v.Set("Name", "foo")
+	resp := c.submit(v)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+var uploadFormPage = page.SubPage(`
+{{define "body"}}
+<form method="POST" enctype="multipart/form-data">
+	{{.ErrorMessages}}
+	{{.CSRFToken}}
+	<p><input type="text" name="Title" value="{{.Data.Title}}" /></p>
+	<p><input type="file" name="Attachment" /></p>
+</form>
+{{end}}
+`)
+
+type uploadFormData struct {
+	Title string
+}
+
+type uploadDelegate struct {
+	title    string
+	filename string
+	content  []byte
+}
+
+func (d *uploadDelegate) Validate(_ *http.Request, _ interface{}) []string {
+	return nil
+}
+
+func (d *uploadDelegate) GetAccessCheck(_ *http.Request) page.AccessChecker {
+	return nil
+}
+
+func (d *uploadDelegate) LoadData(_ *http.Request) (interface{}, error) {
+	return &uploadFormData{}, nil
+}
+
+func (d *uploadDelegate) Submit(_ http.ResponseWriter, r *http.Request, v interface{}) form.FormSubmitResult {
+	d.title = v.(*uploadFormData).Title
+
+	f, h, err := r.FormFile("Attachment")
+	if err != nil {
+		return form.Error("missing attachment", err)
+	}
+	defer f.Close()
+
+	d.filename = h.Filename
+	if d.content, err = ioutil.ReadAll(f); err != nil {
+		return form.Error("failed to read attachment", err)
+	}
+
+	return form.Redirect("/")
+}
+
+func TestSubmitMultipart(t *testing.T) {
+	d := &uploadDelegate{}
+	c := newTestClient(t, form.NewForm(keyvalue.NewMemory(), "Upload", uploadFormPage, d))
+
+	v := c.get()
+	v.Set("Title", "hello")
+	body, contentType := testutil.MultipartBody(t, *v, map[string]testutil.FileUpload{
+		"Attachment": {
+			Filename:    "hello.txt",
+			ContentType: "text/plain",
+			Content:     []byte("hello world"),
+		},
+	})
+	r := httptest.NewRequest(http.MethodPost, "/form", body)
+	r.Header.Set("Content-Type", contentType)
+	resp := c.do(r)
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "hello", d.title)
+	require.Equal(t, "hello.txt", d.filename)
+	require.Equal(t, "hello world", string(d.content))
+}
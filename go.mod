@@ -25,6 +25,7 @@ require (
 	golang.org/x/crypto v0.0.0-20200115085410-6d4e4cb37c7d
 	golang.org/x/net v0.0.0-20211020060615-d418f374d309
 	golang.org/x/text v0.3.6
+	gopkg.in/yaml.v2 v2.2.4
 )
 
 require (
@@ -36,5 +37,4 @@ require (
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
-	gopkg.in/yaml.v2 v2.2.4 // indirect
 )
@@ -17,19 +17,80 @@
 package keyvalue
 
 import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v7"
+	"github.com/tamasd/simplesite/util"
 )
 
+// ErrNotFound is returned when a key does not exist in the store.
+var ErrNotFound = errors.New("key not found")
+
+// Ping checks if the store is reachable.
+func Ping(store Store) error {
+	if _, err := store.Get("ping"); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// Error is an error of the storage backend.
+type Error struct {
+	Op  string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return "keyvalue: " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError wraps the backend errors, so the callers don't depend on the
+// backend.
+func wrapError(op string, err error) error {
+	if err == nil || err == ErrNotFound {
+		return err
+	}
+
+	return &Error{Op: op, Err: err}
+}
+
 // Store represents a key-value storage.
 type Store interface {
+	// Get returns the value of a key, or ErrNotFound if the key does not
+	// exist.
 	Get(key string) (string, error)
 	Set(key, value string) error
 	SetExpiring(key, value string, expires time.Duration) error
 	Delete(key string) error
+	// Increment atomically increments the integer value of a key, and returns
+	// the new value. The expiration is only set when the key is created.
+	Increment(key string, expires time.Duration) (int64, error)
+	// GetMulti returns the values of multiple keys. The keys that are not
+	// found are omitted from the result.
+	GetMulti(keys []string) (map[string]string, error)
+	// SetMulti sets multiple values with the same expiration.
+	SetMulti(pairs map[string]string, expires time.Duration) error
+	// Keys returns the keys that start with the given prefix.
+	Keys(prefix string) ([]string, error)
+	// CompareAndSwap atomically replaces the value of a key if its current
+	// value is old. An empty old value matches a missing key. Returns false
+	// if the value was not replaced.
+	CompareAndSwap(key, old, new string, expires time.Duration) (bool, error)
 }
 
+const (
+	redisScanBatchSize = 1000
+)
+
 // Prefixed is a key-value store that prefixes each key.
 type Prefixed struct {
 	store  Store
@@ -59,6 +120,55 @@ func (s *Prefixed) Delete(key string) error {
 	return s.store.Delete(s.prefix + key)
 }
 
+func (s *Prefixed) Increment(key string, expires time.Duration) (int64, error) {
+	return s.store.Increment(s.prefix+key, expires)
+}
+
+func (s *Prefixed) GetMulti(keys []string) (map[string]string, error) {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.prefix + key
+	}
+
+	values, err := s.store.GetMulti(prefixed)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string, len(values))
+	for key, value := range values {
+		res[key[len(s.prefix):]] = value
+	}
+
+	return res, nil
+}
+
+func (s *Prefixed) SetMulti(pairs map[string]string, expires time.Duration) error {
+	prefixed := make(map[string]string, len(pairs))
+	for key, value := range pairs {
+		prefixed[s.prefix+key] = value
+	}
+
+	return s.store.SetMulti(prefixed, expires)
+}
+
+func (s *Prefixed) Keys(prefix string) ([]string, error) {
+	keys, err := s.store.Keys(s.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		keys[i] = key[len(s.prefix):]
+	}
+
+	return keys, nil
+}
+
+func (s *Prefixed) CompareAndSwap(key, old, new string, expires time.Duration) (bool, error) {
+	return s.store.CompareAndSwap(s.prefix+key, old, new, expires)
+}
+
 type Redis struct {
 	client *redis.Client
 }
@@ -72,10 +182,10 @@ func NewRedis(client *redis.Client) *Redis {
 func (s *Redis) Get(key string) (string, error) {
 	val, err := s.client.Get(key).Result()
 	if err == redis.Nil {
-		return "", nil
+		return "", ErrNotFound
 	}
 
-	return val, err
+	return val, wrapError("get", err)
 }
 
 func (s *Redis) Set(key, value string) error {
@@ -83,9 +193,268 @@ func (s *Redis) Set(key, value string) error {
 }
 
 func (s *Redis) SetExpiring(key, value string, expires time.Duration) error {
-	return s.client.Set(key, value, expires).Err()
+	return wrapError("set", s.client.Set(key, value, expires).Err())
 }
 
 func (s *Redis) Delete(key string) error {
-	return s.client.Del(key).Err()
+	return wrapError("delete", s.client.Del(key).Err())
+}
+
+// redisIncrement increments a key and sets its expiration in one step, so a
+// counter can't be left without an expiration.
+var redisIncrement = redis.NewScript(`
+	local val = redis.call("INCR", KEYS[1])
+	if val == 1 and tonumber(ARGV[1]) > 0 then
+		redis.call("PEXPIRE", KEYS[1], ARGV[1])
+	end
+	return val
+`)
+
+func (s *Redis) Increment(key string, expires time.Duration) (int64, error) {
+	val, err := redisIncrement.Run(s.client, []string{key}, expires.Milliseconds()).Int64()
+	if err != nil {
+		return 0, wrapError("increment", err)
+	}
+
+	return val, nil
+}
+
+func (s *Redis) GetMulti(keys []string) (map[string]string, error) {
+	res := make(map[string]string)
+	if len(keys) == 0 {
+		return res, nil
+	}
+
+	values, err := s.client.MGet(keys...).Result()
+	if err != nil {
+		return nil, wrapError("get multi", err)
+	}
+
+	for i, value := range values {
+		if str, ok := value.(string); ok {
+			res[keys[i]] = str
+		}
+	}
+
+	return res, nil
+}
+
+func (s *Redis) SetMulti(pairs map[string]string, expires time.Duration) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	_, err := s.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for key, value := range pairs {
+			pipe.Set(key, value, expires)
+		}
+		return nil
+	})
+
+	return wrapError("set multi", err)
+}
+
+func (s *Redis) Keys(prefix string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	pattern := redisGlobEscaper.Replace(prefix) + "*"
+	for {
+		batch, next, err := s.client.Scan(cursor, pattern, redisScanBatchSize).Result()
+		if err != nil {
+			return nil, wrapError("keys", err)
+		}
+		keys = append(keys, batch...)
+
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	return keys, nil
+}
+
+var redisCompareAndSwap = redis.NewScript(`
+	local current = redis.call("GET", KEYS[1])
+	if current == false then
+		current = ""
+	end
+	if current ~= ARGV[1] then
+		return 0
+	end
+	if tonumber(ARGV[3]) > 0 then
+		redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	else
+		redis.call("SET", KEYS[1], ARGV[2])
+	end
+	return 1
+`)
+
+func (s *Redis) CompareAndSwap(key, old, new string, expires time.Duration) (bool, error) {
+	swapped, err := redisCompareAndSwap.Run(s.client, []string{key}, old, new, expires.Milliseconds()).Int()
+	if err != nil {
+		return false, wrapError("compare and swap", err)
+	}
+
+	return swapped == 1, nil
+}
+
+// redisGlobEscaper escapes the special characters of the SCAN patterns.
+var redisGlobEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`*`, `\*`,
+	`?`, `\?`,
+	`[`, `\[`,
+	`]`, `\]`,
+)
+
+// Memory is an in-memory key-value store.
+//
+// It is meant to be used in tests and in single process setups. The expiration
+// follows util.Now.
+type Memory struct {
+	mtx   sync.Mutex
+	items map[string]memoryItem
+}
+
+type memoryItem struct {
+	value   string
+	expires time.Time
+}
+
+func (i memoryItem) expired() bool {
+	return !i.expires.IsZero() && util.Now().After(i.expires)
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		items: make(map[string]memoryItem),
+	}
+}
+
+func (s *Memory) Get(key string) (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	item, ok := s.items[key]
+	if !ok || item.expired() {
+		delete(s.items, key)
+		return "", ErrNotFound
+	}
+
+	return item.value, nil
+}
+
+func (s *Memory) Set(key, value string) error {
+	return s.SetExpiring(key, value, -1)
+}
+
+func (s *Memory) SetExpiring(key, value string, expires time.Duration) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	item := memoryItem{value: value}
+	if expires > 0 {
+		item.expires = util.Now().Add(expires)
+	}
+	s.items[key] = item
+
+	return nil
+}
+
+func (s *Memory) Delete(key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.items, key)
+
+	return nil
+}
+
+func (s *Memory) Increment(key string, expires time.Duration) (int64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	item, ok := s.items[key]
+	if !ok || item.expired() {
+		item = memoryItem{value: "0"}
+		if expires > 0 {
+			item.expires = util.Now().Add(expires)
+		}
+	}
+
+	val, err := strconv.ParseInt(item.value, 10, 64)
+	if err != nil {
+		return 0, wrapError("increment", err)
+	}
+	val++
+	item.value = strconv.FormatInt(val, 10)
+	s.items[key] = item
+
+	return val, nil
+}
+
+func (s *Memory) GetMulti(keys []string) (map[string]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	res := make(map[string]string)
+	for _, key := range keys {
+		item, ok := s.items[key]
+		if !ok || item.expired() {
+			delete(s.items, key)
+			continue
+		}
+		res[key] = item.value
+	}
+
+	return res, nil
+}
+
+func (s *Memory) SetMulti(pairs map[string]string, expires time.Duration) error {
+	for key, value := range pairs {
+		if err := s.SetExpiring(key, value, expires); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Memory) Keys(prefix string) ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var keys []string
+	for key, item := range s.items {
+		if item.expired() {
+			delete(s.items, key)
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *Memory) CompareAndSwap(key, old, new string, expires time.Duration) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	item, ok := s.items[key]
+	if !ok || item.expired() {
+		item = memoryItem{}
+	}
+	if item.value != old {
+		return false, nil
+	}
+
+	item = memoryItem{value: new}
+	if expires > 0 {
+		item.expires = util.Now().Add(expires)
+	}
+	s.items[key] = item
+
+	return true, nil
 }
@@ -0,0 +1,214 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package keyvalue_test
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/util"
+)
+
+func testMulti(t *testing.T, store keyvalue.Store) {
+	require.Nil(t, store.SetMulti(map[string]string{
+		"a": "1",
+		"b": "2",
+	}, 0))
+	require.Nil(t, store.SetMulti(map[string]string{
+		"c": "3",
+	}, 50*time.Millisecond))
+
+	values, err := store.GetMulti([]string{"a", "b", "c", "d"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"a": "1", "b": "2", "c": "3"}, values)
+
+	time.Sleep(100 * time.Millisecond)
+
+	values, err = store.GetMulti([]string{"a", "c", "d"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"a": "1"}, values)
+
+	values, err = store.GetMulti(nil)
+	require.Nil(t, err)
+	require.Empty(t, values)
+}
+
+func TestMemoryMulti(t *testing.T) {
+	testMulti(t, keyvalue.NewMemory())
+}
+
+func TestPrefixedMulti(t *testing.T) {
+	mem := keyvalue.NewMemory()
+	testMulti(t, keyvalue.NewPrefixed(mem, "prefix:"))
+
+	value, err := mem.Get("prefix:a")
+	require.Nil(t, err)
+	require.Equal(t, "1", value)
+
+	values, err := mem.GetMulti([]string{"a", "prefix:b"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"prefix:b": "2"}, values)
+}
+
+func TestMemoryKeys(t *testing.T) {
+	mem := keyvalue.NewMemory()
+	require.Nil(t, mem.Set("session:a", "1"))
+	require.Nil(t, mem.Set("session:b", "2"))
+	require.Nil(t, mem.Set("form:c", "3"))
+	require.Nil(t, mem.SetExpiring("session:d", "4", time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+
+	keys, err := mem.Keys("session:")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"session:a", "session:b"}, keys)
+
+	keys, err = mem.Keys("nothing:")
+	require.Nil(t, err)
+	require.Empty(t, keys)
+}
+
+func TestPrefixedKeys(t *testing.T) {
+	mem := keyvalue.NewMemory()
+	store := keyvalue.NewPrefixed(mem, "site:")
+	require.Nil(t, store.Set("session:a", "1"))
+	require.Nil(t, store.Set("session:b", "2"))
+	require.Nil(t, store.Set("form:c", "3"))
+	require.Nil(t, mem.Set("session:x", "4"))
+
+	keys, err := store.Keys("session:")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"session:a", "session:b"}, keys)
+
+	keys, err = store.Keys("")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"session:a", "session:b", "form:c"}, keys)
+}
+
+func TestGetNotFound(t *testing.T) {
+	mem := keyvalue.NewMemory()
+	for _, store := range []keyvalue.Store{mem, keyvalue.NewPrefixed(mem, "prefix:")} {
+		_, err := store.Get("missing")
+		require.Equal(t, keyvalue.ErrNotFound, err)
+
+		require.Nil(t, store.SetExpiring("expiring", "1", time.Millisecond))
+		time.Sleep(10 * time.Millisecond)
+		_, err = store.Get("expiring")
+		require.Equal(t, keyvalue.ErrNotFound, err)
+
+		require.Nil(t, store.Set("empty", ""))
+		value, err := store.Get("empty")
+		require.Nil(t, err)
+		require.Equal(t, "", value)
+	}
+}
+
+func TestIncrementError(t *testing.T) {
+	mem := keyvalue.NewMemory()
+	require.Nil(t, mem.Set("counter", "foo"))
+
+	_, err := mem.Increment("counter", 0)
+	var kverr *keyvalue.Error
+	require.True(t, errors.As(err, &kverr))
+	require.Equal(t, "increment", kverr.Op)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	mem := keyvalue.NewMemory()
+	for _, store := range []keyvalue.Store{mem, keyvalue.NewPrefixed(mem, "prefix:")} {
+		swapped, err := store.CompareAndSwap("key", "", "1", 0)
+		require.Nil(t, err)
+		require.True(t, swapped)
+
+		swapped, err = store.CompareAndSwap("key", "1", "2", 0)
+		require.Nil(t, err)
+		require.True(t, swapped)
+
+		swapped, err = store.CompareAndSwap("key", "1", "3", 0)
+		require.Nil(t, err)
+		require.False(t, swapped)
+
+		value, err := store.Get("key")
+		require.Nil(t, err)
+		require.Equal(t, "2", value)
+	}
+}
+
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	store := keyvalue.NewMemory()
+	require.Nil(t, store.Set("key", "0"))
+
+	const workers = 16
+	var wg sync.WaitGroup
+	results := make(chan bool, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			swapped, err := store.CompareAndSwap("key", "0", strconv.Itoa(i+1), 0)
+			require.Nil(t, err)
+			results <- swapped
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	winners := 0
+	for swapped := range results {
+		if swapped {
+			winners++
+		}
+	}
+	require.Equal(t, 1, winners)
+}
+
+func TestRedisIncrement(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS")
+	if addr == "" {
+		t.Skip("TEST_REDIS is not set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer func() { _ = client.Close() }()
+	store := keyvalue.NewRedis(client)
+
+	key := "test-increment:" + util.RandomHexString(8)
+	persistent := key + ":persistent"
+	defer client.Del(key, persistent)
+
+	val, err := store.Increment(key, time.Minute)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), val)
+	ttl := client.PTTL(key).Val()
+	require.True(t, ttl > 0 && ttl <= time.Minute)
+
+	val, err = store.Increment(key, time.Hour)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), val)
+	require.True(t, client.PTTL(key).Val() <= time.Minute)
+
+	val, err = store.Increment(persistent, 0)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), val)
+	require.True(t, client.PTTL(persistent).Val() < 0)
+}
@@ -17,11 +17,49 @@
 package main
 
 import (
+	"os"
+
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/sirupsen/logrus"
 	"github.com/tamasd/simplesite/config"
 	"github.com/tamasd/simplesite/site"
 )
 
 func main() {
-	site.NewSite(config.NewPrefixerStorage(config.EnvStorage{}, "simplesite_")).Start()
+	var storage config.Storage = config.EnvStorage{}
+
+	// The configuration is read from a file instead of the environment if
+	// SIMPLESITE_CONFIG_FILE is set. The file is reloaded on SIGHUP.
+	if path := os.Getenv("SIMPLESITE_CONFIG_FILE"); path != "" {
+		rs, err := config.NewReloadableStorage(path)
+		if err != nil {
+			logrus.WithError(err).Fatalln("failed to load configuration file")
+			return
+		}
+		defer rs.ReloadOnSIGHUP(logrus.StandardLogger())()
+		storage = rs
+	}
+
+	s := site.NewSite(config.NewPrefixerStorage(storage, "simplesite_"))
+
+	args := os.Args[1:]
+
+	// With --check-schema the startup fails if the database schema differs
+	// from the entities.
+	if len(args) > 0 && args[0] == "--check-schema" {
+		s.SetStrictSchema(true)
+		args = args[1:]
+	}
+
+	// Maintenance commands (see site.Commands) run instead of the server when
+	// they are given as arguments.
+	if len(args) > 0 {
+		logger := s.Logger()
+		if err := s.RunCommand(logger, os.Stdout, args); err != nil {
+			logger.WithError(err).Fatalln("command failed")
+		}
+		return
+	}
+
+	s.Start()
 }
@@ -0,0 +1,118 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package page
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	assetVersionLength = 16
+)
+
+var (
+	assetMtx       sync.RWMutex
+	assetHashes    map[string]string
+	assetIntegrity bool
+)
+
+// SetAssetHashes sets the content hashes of the assets.
+//
+// The keys are the paths relative to the assets directory, the values are
+// subresource integrity values, e.g. "sha384-...". See file.HashAssets.
+func SetAssetHashes(hashes map[string]string) {
+	assetMtx.Lock()
+	defer assetMtx.Unlock()
+
+	assetHashes = hashes
+}
+
+// SetAssetIntegrity enables the integrity attributes in the asset links.
+func SetAssetIntegrity(enabled bool) {
+	assetMtx.Lock()
+	defer assetMtx.Unlock()
+
+	assetIntegrity = enabled
+}
+
+func assetHash(name string) (string, bool) {
+	assetMtx.RLock()
+	defer assetMtx.RUnlock()
+
+	hash, ok := assetHashes[name]
+
+	return hash, ok
+}
+
+func cleanAssetName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// AssetURL returns the url of an asset.
+//
+// If the hash of the asset is known, a version is added to the query string,
+// so the browsers fetch the asset again when its content changes. The asset
+// server ignores the query string.
+func AssetURL(name string) string {
+	name = cleanAssetName(name)
+	u := URL("/assets/" + name)
+
+	hash, ok := assetHash(name)
+	if !ok {
+		return u
+	}
+
+	digest, err := base64.StdEncoding.DecodeString(hash[strings.IndexByte(hash, '-')+1:])
+	if err != nil {
+		return u
+	}
+	version := hex.EncodeToString(digest)
+	if len(version) > assetVersionLength {
+		version = version[:assetVersionLength]
+	}
+
+	return u + "?v=" + version
+}
+
+// Asset returns the attributes that link an asset.
+//
+// Scripts get a src attribute, everything else gets href. See AssetURL. If
+// the integrity attributes are enabled and the hash of the asset is known,
+// the integrity and crossorigin attributes are added too.
+func Asset(name string) template.HTMLAttr {
+	name = cleanAssetName(name)
+
+	attr := "href"
+	if path.Ext(name) == ".js" {
+		attr = "src"
+	}
+	attrs := attr + `="` + template.HTMLEscapeString(AssetURL(name)) + `"`
+
+	assetMtx.RLock()
+	integrity := assetIntegrity
+	assetMtx.RUnlock()
+	if hash, ok := assetHash(name); ok && integrity {
+		attrs += ` integrity="` + template.HTMLEscapeString(hash) + `" crossorigin="anonymous"`
+	}
+
+	return template.HTMLAttr(attrs)
+}
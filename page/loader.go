@@ -0,0 +1,110 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package page
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// InvalidParamError is returned by the ParamLoader when the URL parameter
+// can't be parsed.
+type InvalidParamError struct {
+	Param string
+	Value string
+	Err   error
+}
+
+func (e *InvalidParamError) Error() string {
+	return fmt.Sprintf("invalid url parameter %s=%q: %v", e.Param, e.Value, e.Err)
+}
+
+func (e *InvalidParamError) Unwrap() error {
+	return e.Err
+}
+
+// IsInvalidParam tells if an error is an InvalidParamError.
+func IsInvalidParam(err error) bool {
+	var ipe *InvalidParamError
+	return errors.As(err, &ipe)
+}
+
+// ParamParser converts a URL parameter to the key of an entity.
+type ParamParser func(value string) (interface{}, error)
+
+// UUIDParam parses the URL parameter as an uuid.
+func UUIDParam(value string) (interface{}, error) {
+	return uuid.FromString(value)
+}
+
+// StringParam uses the URL parameter as it is.
+func StringParam(value string) (interface{}, error) {
+	return value, nil
+}
+
+// KeyLoaderFunc loads an entity by its key.
+//
+// It can return sql.ErrNoRows or a nil entity when the entity does not exist.
+type KeyLoaderFunc func(r *http.Request, key interface{}) (interface{}, error)
+
+// ParamLoader is an EntityLoader that loads an entity by a URL parameter.
+//
+// A missing entity is reported as a nil entity without an error, and an
+// unparseable parameter as an InvalidParamError, so the handlers can respond
+// with a 404 in both cases instead of a 500.
+type ParamLoader struct {
+	Param  string
+	Parse  ParamParser
+	Loader KeyLoaderFunc
+}
+
+// NewParamLoader creates a ParamLoader.
+func NewParamLoader(param string, parse ParamParser, loader KeyLoaderFunc) *ParamLoader {
+	return &ParamLoader{
+		Param:  param,
+		Parse:  parse,
+		Loader: loader,
+	}
+}
+
+func (l *ParamLoader) Load(r *http.Request) (interface{}, error) {
+	value := httprouter.ParamsFromContext(r.Context()).ByName(l.Param)
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := l.Parse(value)
+	if err != nil {
+		return nil, &InvalidParamError{
+			Param: l.Param,
+			Value: value,
+			Err:   err,
+		}
+	}
+
+	entity, err := l.Loader(r, key)
+	if errors.Cause(err) == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return entity, err
+}
@@ -0,0 +1,60 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package page
+
+import (
+	"sync"
+)
+
+var (
+	menuMtx   sync.RWMutex
+	menuItems []MenuItem
+)
+
+// MenuItem is a custom link in the main navigation menu.
+type MenuItem struct {
+	Name  string
+	Title string
+	URL   string
+	// Permission hides the item from the accounts that don't have it. The
+	// item is visible to everyone if it is empty.
+	Permission string
+}
+
+// SetMenu sets the custom items of the main navigation menu.
+//
+// The items are rendered after the built-in items of BasePage.
+func SetMenu(items ...MenuItem) {
+	menuMtx.Lock()
+	defer menuMtx.Unlock()
+	menuItems = append([]MenuItem(nil), items...)
+}
+
+// Menu returns the custom menu items that are visible for the current page.
+func (d Data) Menu() []MenuItem {
+	menuMtx.RLock()
+	defer menuMtx.RUnlock()
+
+	var items []MenuItem
+	for _, item := range menuItems {
+		if item.Permission == "" || d.Has(item.Permission) {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,68 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package page_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/page"
+)
+
+type testAccess []string
+
+func (a testAccess) Has(name string) bool {
+	for _, perm := range a {
+		if perm == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestMenu(t *testing.T) {
+	page.SetMenu(
+		page.MenuItem{Name: "about", Title: "About", URL: "/page/about"},
+		page.MenuItem{Name: "pages", Title: "Pages", URL: "/pages", Permission: "edit-static-pages"},
+	)
+	defer page.SetMenu()
+
+	render := func(access page.AccessChecker) *goquery.Document {
+		buf := &bytes.Buffer{}
+		require.Nil(t, testSubPage.Execute(buf, page.Data{Access: access}))
+		doc, err := goquery.NewDocumentFromReader(buf)
+		require.Nil(t, err)
+		return doc
+	}
+
+	doc := render(testAccess{"edit-static-pages"})
+	require.Equal(t, "/page/about", doc.Find("header li.menu-about a").AttrOr("href", ""))
+	require.Equal(t, "Pages", doc.Find("header li.menu-pages a").Text())
+	require.Equal(t, 1, doc.Find("header li.posts").Length())
+	require.Equal(t, 1, doc.Find("header li.login").Length())
+
+	doc = render(testAccess{})
+	require.Equal(t, "About", doc.Find("header li.menu-about a").Text())
+	require.Equal(t, 0, doc.Find("header li.menu-pages").Length())
+
+	doc = render(nil)
+	require.Equal(t, 1, doc.Find("header li.menu-about").Length())
+	require.Equal(t, 0, doc.Find("header li.menu-pages").Length())
+}
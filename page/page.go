@@ -19,6 +19,7 @@ package page
 import (
 	"html/template"
 	"net/http"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/tamasd/simplesite/server"
@@ -28,17 +29,17 @@ import (
 
 const (
 	entityLoaderContextKey = "entity-loader"
-)
 
-var (
-	// BasePage is the main page template.
-	BasePage = template.Must(template.New("BasePage").Parse(`<!DOCTYPE HTML>
+	// baseTemplateName is the name of the BasePage override file.
+	baseTemplateName = "base"
+
+	baseTemplate = `<!DOCTYPE HTML>
 <html>
 <head>
 	<meta http-equiv="X-UA-Compatible" content="IE=edge,chrome=1" />
 	<meta charset="utf8" />
-	<link rel="stylesheet" href="/assets/style.css" />
-	<link rel="author" href="/humans.txt" />
+	<link rel="stylesheet" {{asset "style.css"}} />
+	<link rel="author" href="{{url "/humans.txt"}}" />
 	<title>{{.Title}}</title>
     <script type="text/javascript" nonce="{{.Nonce}}">
         window.CSRF_TOKEN = "{{.CSRFToken}}";
@@ -48,13 +49,16 @@ var (
 	<header>
 		<nav>
 			<ul>
-				<li class="home"><a href="/">Home</a></li>
-				<li class="posts"><a href="/posts">Posts</a></li>
+				<li class="home"><a href="{{url "/"}}">Home</a></li>
+				<li class="posts"><a href="{{url "/posts"}}">Posts</a></li>
+				{{range .Menu}}
+				<li class="menu-{{.Name}}"><a href="{{url .URL}}">{{.Title}}</a></li>
+				{{end}}
 				{{if .LoggedIn}}
-				<li class="logout"><a href="/logout?token={{.CSRFToken}}">Logout</a></li>
+				<li class="logout"><a href="{{url "/logout"}}?token={{.CSRFToken}}">Logout</a></li>
 				{{else}}
-				<li class="login"><a href="/login">Log In</a></li>
-				<li class="register"><a href="/register">Register</a></li>
+				<li class="login"><a href="{{url "/login"}}">Log In</a></li>
+				<li class="register"><a href="{{url "/register"}}">Register</a></li>
 				{{end}}
 			</ul>
 		</nav>
@@ -69,9 +73,50 @@ var (
 	</ul>
 </nav>
 {{end}}
-`))
+`
+)
+
+var (
+	basePath string
+
+	// Funcs are the functions that are available in every template.
+	//
+	// url prefixes a local path with the base path (see SetBasePath), asset
+	// links a file in the assets directory (see Asset) and assetURL returns
+	// the versioned url of an asset (see AssetURL).
+	Funcs = template.FuncMap{
+		"url":      URL,
+		"asset":    Asset,
+		"assetURL": AssetURL,
+	}
+
+	// BasePage is the main page template.
+	BasePage = template.Must(template.New("BasePage").Funcs(Funcs).Parse(baseTemplate))
 )
 
+// SetBasePath sets the path prefix of the site, when it is hosted in a
+// subdirectory behind a reverse proxy, e.g. /blog.
+func SetBasePath(p string) {
+	basePath = strings.TrimSuffix(p, "/")
+}
+
+// BasePath returns the path prefix of the site without a trailing slash.
+func BasePath() string {
+	return basePath
+}
+
+// URL prefixes a local path with the base path.
+//
+// Urls that don't start with a single slash (relative, protocol-relative and
+// absolute ones) are returned as is.
+func URL(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") {
+		return p
+	}
+
+	return basePath + p
+}
+
 // AccessChecker checks if the current account has a permission.
 type AccessChecker interface {
 	Has(name string) bool
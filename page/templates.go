@@ -0,0 +1,166 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package page
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// templateSource holds the built-in source of a named template.
+type templateSource struct {
+	name  string
+	text  string
+	extra []string
+	// subPage tells if the template extends the BasePage.
+	subPage bool
+}
+
+var (
+	templateMtx     sync.RWMutex
+	templateSources = map[*template.Template]*templateSource{}
+	overrides       = map[*template.Template]*template.Template{}
+	templateDir     string
+	reloadTemplates bool
+)
+
+// Named creates a template that can be overridden with the <name>.html file
+// of the template directory.
+func Named(name, text string) *template.Template {
+	tpl := template.Must(template.New(name).Funcs(Funcs).Parse(text))
+	register(tpl, &templateSource{name: name, text: text})
+
+	return tpl
+}
+
+// NamedSubPage creates a sub page like SubPage, that can be overridden with
+// the <name>.html file of the template directory.
+//
+// The file only replaces the text of the sub page, the BasePage and the extra
+// templates come from their own sources.
+func NamedSubPage(name, text string, extra ...string) *template.Template {
+	tpl := SubPage(text, extra...)
+	register(tpl, &templateSource{name: name, text: text, extra: extra, subPage: true})
+
+	return tpl
+}
+
+func register(tpl *template.Template, src *templateSource) {
+	templateMtx.Lock()
+	defer templateMtx.Unlock()
+	templateSources[tpl] = src
+}
+
+// LoadTemplates loads the template overrides from a directory.
+//
+// The overrides are parsed once, unless reload is set. In that case the files
+// are re-read on each render, so the templates can be edited without a
+// restart. Reloading is slow, it is only meant for development.
+func LoadTemplates(dir string, reload bool) error {
+	templateMtx.Lock()
+	defer templateMtx.Unlock()
+
+	templateDir = dir
+	reloadTemplates = reload
+	overrides = map[*template.Template]*template.Template{}
+
+	if dir == "" || reload {
+		return nil
+	}
+
+	for tpl, src := range templateSources {
+		override, err := buildTemplate(dir, src)
+		if err != nil {
+			return err
+		}
+		overrides[tpl] = override
+	}
+
+	return nil
+}
+
+// Lookup returns the current version of a template.
+//
+// Templates that are not created with Named or NamedSubPage are returned as
+// they are.
+func Lookup(tpl *template.Template) (*template.Template, error) {
+	templateMtx.RLock()
+	defer templateMtx.RUnlock()
+
+	src := templateSources[tpl]
+	if src == nil || templateDir == "" {
+		return tpl, nil
+	}
+
+	if reloadTemplates {
+		return buildTemplate(templateDir, src)
+	}
+
+	if override := overrides[tpl]; override != nil {
+		return override, nil
+	}
+
+	return tpl, nil
+}
+
+func buildTemplate(dir string, src *templateSource) (*template.Template, error) {
+	text, err := readTemplate(dir, src.name, src.text)
+	if err != nil {
+		return nil, err
+	}
+
+	if !src.subPage {
+		tpl, err := template.New(src.name).Funcs(Funcs).Parse(text)
+		return tpl, errors.Wrap(err, "failed to parse template "+src.name)
+	}
+
+	base, err := readTemplate(dir, baseTemplateName, baseTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	tpl, err := template.New("BasePage").Funcs(Funcs).Parse(base)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse template "+baseTemplateName)
+	}
+
+	for _, t := range append(src.extra, text) {
+		if tpl, err = tpl.Parse(t); err != nil {
+			return nil, errors.Wrap(err, "failed to parse template "+src.name)
+		}
+	}
+
+	return tpl, nil
+}
+
+// readTemplate reads the text of a template from the template directory, or
+// returns the built-in text if there is no file for it.
+func readTemplate(dir, name, builtin string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)+".html"))
+	if os.IsNotExist(err) {
+		return builtin, nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read template "+name)
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,171 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package page_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/page"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/urfave/negroni"
+)
+
+var (
+	testPage    = page.Named("test/page", `<p>{{.}}</p>`)
+	testSubPage = page.NamedSubPage("test/subpage", `{{define "body"}}<p>{{.}}</p>{{end}}`)
+)
+
+func renderTemplate(t *testing.T, srv *httptest.Server) string {
+	resp, err := http.Get(srv.URL)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+
+	return string(body)
+}
+
+func writeTemplate(t *testing.T, dir, name, text string) {
+	filename := filepath.Join(dir, filepath.FromSlash(name)+".html")
+	require.Nil(t, os.MkdirAll(filepath.Dir(filename), 0755))
+	require.Nil(t, ioutil.WriteFile(filename, []byte(text), 0644))
+}
+
+func TestTemplateReload(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, page.LoadTemplates(dir, true))
+	defer func() { require.Nil(t, page.LoadTemplates("", false)) }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond.Template(nil, w, testPage, "foo", http.StatusOK)
+	}))
+	defer srv.Close()
+
+	require.Equal(t, "<p>foo</p>", renderTemplate(t, srv))
+
+	writeTemplate(t, dir, "test/page", `<div>{{.}}</div>`)
+	require.Equal(t, "<div>foo</div>", renderTemplate(t, srv))
+
+	writeTemplate(t, dir, "test/page", `<span>{{.}}</span>`)
+	require.Equal(t, "<span>foo</span>", renderTemplate(t, srv))
+
+	writeTemplate(t, dir, "test/page", `{{.`)
+	require.Equal(t, "<p>foo</p>", renderTemplate(t, srv))
+}
+
+func TestTemplateOverride(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "test/page", `<div>{{.}}</div>`)
+	require.Nil(t, page.LoadTemplates(dir, false))
+	defer func() { require.Nil(t, page.LoadTemplates("", false)) }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond.Template(nil, w, testPage, "foo", http.StatusOK)
+	}))
+	defer srv.Close()
+
+	require.Equal(t, "<div>foo</div>", renderTemplate(t, srv))
+
+	writeTemplate(t, dir, "test/page", `<span>{{.}}</span>`)
+	require.Equal(t, "<div>foo</div>", renderTemplate(t, srv))
+}
+
+func TestSubPageReload(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, page.LoadTemplates(dir, true))
+	defer func() { require.Nil(t, page.LoadTemplates("", false)) }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond.Template(nil, w, testSubPage, page.Data{Title: "Test", Body: "foo"}, http.StatusOK)
+	}))
+	defer srv.Close()
+
+	body := renderTemplate(t, srv)
+	require.Contains(t, body, "<title>Test</title>")
+	require.Contains(t, body, "<p>foo</p>")
+
+	writeTemplate(t, dir, "base", `<main>{{block "body" .Body}}{{end}}</main>`)
+	writeTemplate(t, dir, "test/subpage", `{{define "body"}}<div>{{.}}</div>{{end}}`)
+	require.Equal(t, "<main><div>foo</div></main>", renderTemplate(t, srv))
+}
+
+func TestBasePathURL(t *testing.T) {
+	page.SetBasePath("/blog/")
+	defer page.SetBasePath("")
+
+	require.Equal(t, "/blog", page.BasePath())
+	require.Equal(t, "/blog/posts", page.URL("/posts"))
+	require.Equal(t, "/blog/", page.URL("/"))
+	require.Equal(t, "//cdn.example.com/x.js", page.URL("//cdn.example.com/x.js"))
+	require.Equal(t, "https://example.com/", page.URL("https://example.com/"))
+	require.Equal(t, "?page=2", page.URL("?page=2"))
+}
+
+type testSession struct{}
+
+func (testSession) GetCSRFToken() string { return "token" }
+func (testSession) LoggedIn() bool       { return false }
+
+func TestNonce(t *testing.T) {
+	var nonce string
+	n := negroni.New(respond.NonceMiddleware())
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = respond.Nonce(r)
+		require.Equal(t, nonce, respond.Nonce(r))
+		respond.Page(nil, w, r, testSubPage, "Test", testSession{}, testAccess{}, nonce)
+	})
+
+	rr := httptest.NewRecorder()
+	n.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NotEmpty(t, nonce)
+	require.Contains(t, rr.Header().Get("Content-Security-Policy"), "'nonce-"+nonce+"'")
+	require.Contains(t, rr.Body.String(), `nonce="`+nonce+`"`)
+	require.Contains(t, rr.Body.String(), "<p>"+nonce+"</p>")
+
+	first := nonce
+	n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NotEqual(t, first, nonce)
+}
+
+func TestCSPMiddleware(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		respond.Page(nil, w, r, testSubPage, "Test", testSession{}, testAccess{}, "")
+	}
+
+	csp := respond.NewContentSecurityPolicy()
+	csp.Allow("frame-src", "https://widget.example.com")
+	n := negroni.New(respond.CSPMiddleware(csp))
+	n.UseHandlerFunc(handler)
+	rr := httptest.NewRecorder()
+	n.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Contains(t, rr.Header().Get("Content-Security-Policy"), "frame-src https://widget.example.com")
+
+	n = negroni.New(respond.NonceMiddleware())
+	n.UseHandlerFunc(handler)
+	rr = httptest.NewRecorder()
+	n.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NotContains(t, rr.Header().Get("Content-Security-Policy"), "widget.example.com")
+}
@@ -17,20 +17,26 @@
 package respond
 
 import (
+	"encoding/json"
 	"html/template"
 	"net/http"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tamasd/simplesite/page"
 	"github.com/tamasd/simplesite/server"
 	"github.com/urfave/negroni"
 )
 
 const (
+	// APIPathPrefix is the path prefix of the JSON API routes.
+	APIPathPrefix = "/api/"
+
 	errorPageContextKey = "errorPage"
 )
 
 var (
-	errorPage = template.Must(template.New("ErrorPage").Parse(`<!DOCTYPE HTML>
+	errorPage = page.Named("error", `<!DOCTYPE HTML>
 <html>
 <head>
 	<meta http-equiv="X-UA-Compatible" content="IE=edge,chrome=1" />
@@ -48,9 +54,9 @@ var (
 	<p>{{.Message}}</p>
 </body>
 </html>
-`))
+`)
 
-	panicPage = template.Must(template.New("PanicPage").Parse(`<!DOCTYPE HTML>
+	panicPage = page.Named("panic", `<!DOCTYPE HTML>
 <html>
 <head>
 	<meta http-equiv="X-UA-Compatible" content="IE=edge,chrome=1" />
@@ -70,6 +76,7 @@ var (
 	</style>
 </head>
 <body>
+	{{if .Debug}}
 	<h1>HTTP Panic: {{.RequestDescription}}</h1>
 	<p>{{.RecoveredPanic}}</p>
 
@@ -79,11 +86,21 @@ var (
 		<pre>{{.StackAsString}}</pre>
 	</div>
 	{{end}}
+	{{else}}
+	<h1>HTTP Error 500</h1>
+	<p>Internal Server Error</p>
+	{{end}}
 </body>
 </html>
-`))
+`)
 )
 
+func init() {
+	server.TimeoutResponder = func(w http.ResponseWriter, r *http.Request) {
+		Error(w, r, http.StatusServiceUnavailable, "request timeout", nil, r.Context().Err())
+	}
+}
+
 // ErrorPageData represents the data given to the error page template.
 type ErrorPageData struct {
 	Code    int
@@ -146,10 +163,69 @@ func (p *ErrorPage) RespondError(w http.ResponseWriter, r *http.Request, code in
 }
 
 // Error displays the default error page.
+//
+// JSON clients (see wantsJSON) get a JSON error object instead.
 func Error(w http.ResponseWriter, r *http.Request, code int, errorMessage string, fields logrus.Fields, err error) {
+	if wantsJSON(r) {
+		JSONError(w, r, code, errorMessage, fields, err)
+		return
+	}
+
 	getErrorPage(r).RespondError(w, r, code, errorMessage, fields, err)
 }
 
+// NotFoundHandler is a handler that responds with a 404 error page.
+//
+// It is meant to be set as the handler of the unknown routes.
+func NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Error(w, r, http.StatusNotFound, "Page not found", logrus.Fields{
+			"path": r.URL.Path,
+		}, nil)
+	})
+}
+
+// MethodNotAllowedHandler is a handler that responds with a 405 error page.
+func MethodNotAllowedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Error(w, r, http.StatusMethodNotAllowed, "Method not allowed", logrus.Fields{
+			"method": r.Method,
+			"allow":  w.Header().Get("Allow"),
+		}, nil)
+	})
+}
+
+// JSONError responds with an error in a JSON object.
+func JSONError(w http.ResponseWriter, r *http.Request, code int, errorMessage string, fields logrus.Fields, err error) {
+	logger := server.GetLoggerOrDefault(r, nil)
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	JSON(logger, w, ErrorResponse{
+		Error:   errorMessage,
+		Code:    code,
+		Message: errorMessage,
+	}, code)
+
+	if fields != nil {
+		logger = logger.WithFields(fields)
+	}
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.Error(errorMessage)
+}
+
+// ErrorResponse is the body of a JSON error response.
+//
+// Error and Message hold the same text, Error is kept for the older clients.
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
 func getErrorPage(r *http.Request) *ErrorPage {
 	item := r.Context().Value(errorPageContextKey)
 	if item != nil {
@@ -161,22 +237,65 @@ func getErrorPage(r *http.Request) *ErrorPage {
 	return DefaultErrorPage(nil)
 }
 
-type panicFormatter struct {
+// PanicFormatter displays the panics.
+type PanicFormatter struct {
 	logger logrus.FieldLogger
+
+	// Debug shows the panic and the stack trace on the panic page. They are
+	// only logged otherwise.
+	Debug bool
 }
 
 // NewPanicFormatter creates a formatter to display panics.
-func NewPanicFormatter(logger logrus.FieldLogger) negroni.PanicFormatter {
-	return &panicFormatter{
+func NewPanicFormatter(logger logrus.FieldLogger) *PanicFormatter {
+	return &PanicFormatter{
 		logger: logger,
 	}
 }
 
-func (p *panicFormatter) FormatPanicError(w http.ResponseWriter, _ *http.Request, infos *negroni.PanicInformation) {
+type panicPageData struct {
+	*negroni.PanicInformation
+	Debug bool
+}
+
+// FormatPanicError renders the panic page.
+//
+// The requests of JSON clients get a JSON error object instead, without the
+// details of the panic.
+func (p *PanicFormatter) FormatPanicError(w http.ResponseWriter, r *http.Request, infos *negroni.PanicInformation) {
+	if wantsJSON(r) {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if err := json.NewEncoder(w).Encode(ErrorResponse{
+			Error:   http.StatusText(http.StatusInternalServerError),
+			Code:    http.StatusInternalServerError,
+			Message: http.StatusText(http.StatusInternalServerError),
+		}); err != nil {
+			p.logger.WithError(err).Errorln("failed to render panic")
+		}
+		return
+	}
+
 	if w.Header().Get("Content-Type") == "" {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	}
-	if err := panicPage.Execute(w, infos); err != nil {
+	tpl, err := page.Lookup(panicPage)
+	if err != nil {
+		p.logger.WithError(err).Errorln("failed to load panic page override")
+		tpl = panicPage
+	}
+	if err = tpl.Execute(w, panicPageData{PanicInformation: infos, Debug: p.Debug}); err != nil {
 		p.logger.WithError(err).Errorln("failed to render panic")
 	}
 }
+
+// wantsJSON checks if the request comes from a JSON client.
+func wantsJSON(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+
+	return strings.HasPrefix(strings.TrimPrefix(r.URL.Path, page.BasePath()), APIPathPrefix) ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
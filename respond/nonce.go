@@ -0,0 +1,92 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package respond
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/tamasd/simplesite/util"
+	"github.com/urfave/negroni"
+)
+
+const (
+	nonceContextKey  = "csp-nonce"
+	policyContextKey = "csp-policy"
+)
+
+type nonce struct {
+	once  sync.Once
+	value string
+}
+
+func (n *nonce) get() string {
+	n.once.Do(func() {
+		n.value = util.RandomHexString(cspNonceLength)
+	})
+
+	return n.value
+}
+
+type cspMiddleware struct {
+	policy *ContentSecurityPolicy
+}
+
+// CSPMiddleware sets the Content-Security-Policy of the page-type responses,
+// and makes room for the CSP nonce of the response in the request context.
+//
+// See Page and Nonce.
+func CSPMiddleware(policy *ContentSecurityPolicy) negroni.Handler {
+	return &cspMiddleware{
+		policy: policy,
+	}
+}
+
+// NonceMiddleware is a CSPMiddleware with the default policy.
+func NonceMiddleware() negroni.Handler {
+	return CSPMiddleware(NewContentSecurityPolicy())
+}
+
+func (m *cspMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ctx := context.WithValue(r.Context(), policyContextKey, m.policy)
+	next(w, r.WithContext(context.WithValue(ctx, nonceContextKey, &nonce{})))
+}
+
+// Nonce returns the CSP nonce of the response.
+//
+// The nonce is generated on the first call, and the same nonce is returned
+// for the rest of the request, so handlers can add their own inline scripts
+// next to the ones of the page. Without NonceMiddleware, every call returns a
+// new nonce.
+func Nonce(r *http.Request) string {
+	if n, ok := r.Context().Value(nonceContextKey).(*nonce); ok {
+		return n.get()
+	}
+
+	return new(nonce).get()
+}
+
+// getPolicy returns the policy of CSPMiddleware, or the default policy without
+// the middleware.
+func getPolicy(r *http.Request) *ContentSecurityPolicy {
+	if policy, ok := r.Context().Value(policyContextKey).(*ContentSecurityPolicy); ok {
+		return policy
+	}
+
+	return NewContentSecurityPolicy()
+}
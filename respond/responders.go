@@ -20,16 +20,107 @@ import (
 	"encoding/json"
 	"html/template"
 	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 	"github.com/tamasd/simplesite/page"
-	"github.com/tamasd/simplesite/util"
+	"github.com/tamasd/simplesite/server"
 )
 
 const (
 	cspNonceLength = 16
 )
 
+var (
+	cspDirectiveOrder = []string{
+		"default-src",
+		"script-src",
+		"connect-src",
+		"img-src",
+		"style-src",
+		"font-src",
+		"frame-src",
+	}
+)
+
+// ContentSecurityPolicy holds the sources for each CSP directive.
+//
+// The policy is sent with the page-type responses of the requests that went
+// through CSPMiddleware. Extra sources (e.g. third party widgets) should be
+// added at startup with Allow.
+type ContentSecurityPolicy struct {
+	mtx     sync.RWMutex
+	sources map[string][]string
+}
+
+// NewContentSecurityPolicy creates the default, strict policy.
+func NewContentSecurityPolicy() *ContentSecurityPolicy {
+	return &ContentSecurityPolicy{
+		sources: map[string][]string{
+			"default-src": {"'none'"},
+			"script-src":  {"'self'"},
+			"connect-src": {"'self'"},
+			"img-src":     {"data:", "blob:", "'self'"},
+			"style-src":   {"'self'"},
+			"font-src":    {"'self'"},
+		},
+	}
+}
+
+// Allow adds sources to a directive.
+func (c *ContentSecurityPolicy) Allow(directive string, sources ...string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, source := range sources {
+		if !containsString(c.sources[directive], source) {
+			c.sources[directive] = append(c.sources[directive], source)
+		}
+	}
+}
+
+// Header renders the policy with a nonce for the inline scripts.
+func (c *ContentSecurityPolicy) Header(nonce string) string {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	var directives []string
+	for directive := range c.sources {
+		if !containsString(cspDirectiveOrder, directive) {
+			directives = append(directives, directive)
+		}
+	}
+	sort.Strings(directives)
+	directives = append(append([]string{}, cspDirectiveOrder...), directives...)
+
+	var csp string
+	for _, directive := range directives {
+		sources := c.sources[directive]
+		if directive == "script-src" {
+			sources = append(sources[:len(sources):len(sources)], "'nonce-"+nonce+"'")
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		csp += directive + " " + strings.Join(sources, " ") + "; "
+	}
+
+	return strings.TrimSpace(csp)
+}
+
+func containsString(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+
+	return false
+}
+
 // SessionInfo stores important information about the session.
 type SessionInfo interface {
 	GetCSRFToken() string
@@ -57,11 +148,11 @@ func JSON(l logrus.FieldLogger, w http.ResponseWriter, v interface{}, code int)
 // Page formats a page-type response.
 //
 // A page-type response is supposed to be a subpage (see the page package), and
-// it sets strict CSP.
-func Page(l logrus.FieldLogger, w http.ResponseWriter, tpl *template.Template, title string, sess SessionInfo, access page.AccessChecker, bodyData interface{}) {
-	nonce := util.RandomHexString(cspNonceLength)
-	csp := `default-src 'none'; script-src 'self' 'nonce-` + nonce + `'; connect-src 'self'; img-src data: blob: 'self'; style-src 'self'; font-src 'self';`
-	w.Header().Set("Content-Security-Policy", csp)
+// it sets strict CSP. The policy is the one of CSPMiddleware, and its nonce is
+// the one returned by Nonce.
+func Page(l logrus.FieldLogger, w http.ResponseWriter, r *http.Request, tpl *template.Template, title string, sess SessionInfo, access page.AccessChecker, bodyData interface{}) {
+	nonce := Nonce(r)
+	w.Header().Set("Content-Security-Policy", getPolicy(r).Header(nonce))
 	Template(l, w, tpl, page.Data{
 		Title:     title,
 		Nonce:     nonce,
@@ -72,8 +163,56 @@ func Page(l logrus.FieldLogger, w http.ResponseWriter, tpl *template.Template, t
 	}, http.StatusOK)
 }
 
+// Redirect redirects the request to a url.
+//
+// Use http.StatusSeeOther after a POST request, so the browser follows the
+// redirect with a GET request, and http.StatusFound otherwise. Local paths are
+// prefixed with the base path (see page.URL).
+func Redirect(w http.ResponseWriter, r *http.Request, url string, code int) {
+	if !strings.HasPrefix(url, "/") && !strings.Contains(url, "://") {
+		// Resolve relative urls the same way as http.Redirect, but before
+		// prefixing, because r.URL.Path doesn't contain the base path.
+		dir, _ := path.Split(r.URL.Path)
+		url = dir + url
+	}
+	url = page.URL(url)
+	if l := server.GetLoggerOrDefault(r, nil); l != nil {
+		l.WithFields(logrus.Fields{
+			"location":    url,
+			"status-code": code,
+		}).Debugln("redirect")
+	}
+
+	http.Redirect(w, r, url, code)
+}
+
+// RedirectAbsolute redirects to a path under the base url of the request.
+//
+// See server.AbsoluteURL.
+func RedirectAbsolute(w http.ResponseWriter, r *http.Request, path string, code int) {
+	url, err := server.AbsoluteURL(r, path)
+	if err != nil {
+		Error(w, r, http.StatusInternalServerError, "", nil, err)
+		return
+	}
+
+	Redirect(w, r, url, code)
+}
+
 // Template renders a html template.
+//
+// Templates that are overridden in the template directory (see
+// page.LoadTemplates) are rendered from their override. The built-in version
+// is rendered if the override can't be loaded.
 func Template(l logrus.FieldLogger, w http.ResponseWriter, tpl *template.Template, data interface{}, code int) {
+	if override, err := page.Lookup(tpl); err != nil {
+		if l != nil {
+			l.WithError(err).WithField("template", tpl.Name()).Warnln("failed to load template override")
+		}
+	} else {
+		tpl = override
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Header().Set("Referrer-Policy", "no-referrer")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
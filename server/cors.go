@@ -0,0 +1,120 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrWildcardCredentials is returned by CORS.Validate when the wildcard origin
+// is combined with credentials.
+var ErrWildcardCredentials = errors.New("the * origin can't be allowed with credentials")
+
+// CORS is a middleware that adds the CORS headers to the responses of the
+// routes under a path prefix.
+//
+// Only the allowed origins are echoed back. Requests from other origins are
+// served without the CORS headers, so the browser blocks them.
+type CORS struct {
+	prefix string
+
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// NewCORS creates a CORS middleware for the routes under the prefix.
+func NewCORS(prefix string, origins ...string) *CORS {
+	return &CORS{
+		prefix:         prefix,
+		AllowedOrigins: origins,
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+// Validate checks the configuration of the middleware.
+//
+// Echoing back any origin with credentials would let every site make
+// authenticated requests on behalf of the users, so it is rejected.
+func (c *CORS) Validate() error {
+	if !c.AllowCredentials {
+		return nil
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return ErrWildcardCredentials
+		}
+	}
+
+	return nil
+}
+
+func (c *CORS) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !strings.HasPrefix(r.URL.Path, c.prefix) {
+		next(w, r)
+		return
+	}
+
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	w.Header().Add("Vary", "Origin")
+
+	if !c.originAllowed(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(w, r)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		next(w, r)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *CORS) originAllowed(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,113 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HealthCheck checks if a dependency of the server is available.
+type HealthCheck func() error
+
+// LivenessHandler responds with 200 as long as the process is able to serve
+// requests.
+//
+// It doesn't check the dependencies, so a dependency outage doesn't get the
+// process restarted.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+}
+
+// ReadinessHandler runs the checks, and responds with 503 if any of them
+// fails.
+//
+// The body has a line for each check.
+func ReadinessHandler(checks map[string]HealthCheck) http.Handler {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		lines := make([]string, len(names))
+		for i, name := range names {
+			if err := checks[name](); err != nil {
+				GetLogger(r).WithError(err).WithFields(logrus.Fields{
+					"check": name,
+				}).Warnln("readiness check failed")
+				status = http.StatusServiceUnavailable
+				lines[i] = name + ": failed"
+			} else {
+				lines[i] = name + ": ok"
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	})
+}
+
+const (
+	waitForMinInterval = 100 * time.Millisecond
+	waitForMaxInterval = 5 * time.Second
+)
+
+// WaitFor runs the check until it succeeds or the timeout expires, and
+// returns the last error.
+//
+// With a zero timeout the check only runs once. The interval between the
+// attempts doubles up to 5 seconds.
+func WaitFor(logger logrus.FieldLogger, name string, check HealthCheck, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	interval := waitForMinInterval
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		if interval > remaining {
+			interval = remaining
+		}
+
+		logger.WithError(err).WithFields(logrus.Fields{
+			"check": name,
+			"retry": interval,
+		}).Warnln("dependency is unavailable")
+
+		time.Sleep(interval)
+		if interval *= 2; interval > waitForMaxInterval {
+			interval = waitForMaxInterval
+		}
+	}
+}
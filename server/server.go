@@ -19,12 +19,16 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/tamasd/simplesite/util"
 	"github.com/urfave/negroni"
@@ -32,12 +36,36 @@ import (
 )
 
 const (
-	loggerContextKey = "logger"
+	loggerContextKey  = "logger"
+	routeContextKey   = "route"
+	baseURLContextKey = "baseurl"
 )
 
+// requestLogger holds the logger of a request.
+//
+// The logger can be replaced by the middlewares, so the access log line also
+// gets the fields that are added later.
+type requestLogger struct {
+	logger logrus.FieldLogger
+}
+
+var defaultLogger logrus.FieldLogger = logrus.StandardLogger()
+
+// ErrNoBaseURL is returned by GetBaseURL when BaseURLMiddleware didn't run.
+var ErrNoBaseURL = errors.New("the base url is not configured")
+
+// SetDefaultLogger sets the logger that GetLogger returns for the requests that
+// weren't handled by a Server, e.g. when a handler is called directly.
+func SetDefaultLogger(l logrus.FieldLogger) {
+	defaultLogger = l
+}
+
 // GetLogger returns the logger from the request context.
+//
+// It falls back to the default logger (see SetDefaultLogger) if the request
+// didn't go through the middleware of a Server.
 func GetLogger(r *http.Request) logrus.FieldLogger {
-	return r.Context().Value(loggerContextKey).(logrus.FieldLogger)
+	return GetLoggerOrDefault(r, defaultLogger)
 }
 
 // GetLoggerOrDefault returns the logger from the request context, or the given
@@ -45,14 +73,50 @@ func GetLogger(r *http.Request) logrus.FieldLogger {
 func GetLoggerOrDefault(r *http.Request, l logrus.FieldLogger) logrus.FieldLogger {
 	item := r.Context().Value(loggerContextKey)
 	if item != nil {
-		if logger, ok := item.(logrus.FieldLogger); ok {
-			return logger
+		if rl, ok := item.(*requestLogger); ok {
+			return rl.logger
 		}
 	}
 
 	return l
 }
 
+// AddLoggerFields adds fields to the request logger.
+//
+// The fields are added to every log line of the request, including the access
+// log line.
+func AddLoggerFields(r *http.Request, fields logrus.Fields) {
+	if rl, ok := r.Context().Value(loggerContextKey).(*requestLogger); ok {
+		rl.logger = rl.logger.WithFields(fields)
+	}
+}
+
+// AddLoggerField adds a single field to the request logger.
+//
+// See AddLoggerFields.
+func AddLoggerField(r *http.Request, key string, value interface{}) {
+	AddLoggerFields(r, logrus.Fields{key: value})
+}
+
+// WithLoggerFields returns a copy of the request with a child logger that has
+// the given fields.
+//
+// Unlike AddLoggerFields, the fields only appear on the log lines of the
+// handlers that get the returned request, and not on the access log line.
+func WithLoggerFields(r *http.Request, fields logrus.Fields) *http.Request {
+	rl := &requestLogger{logger: GetLogger(r).WithFields(fields)}
+	return r.WithContext(context.WithValue(r.Context(), loggerContextKey, rl))
+}
+
+// RoutePattern returns the path pattern of the route that matched the request,
+// e.g. /post/:id/edit.
+//
+// It returns an empty string when no route matched.
+func RoutePattern(r *http.Request) string {
+	pattern, _ := r.Context().Value(routeContextKey).(string)
+	return pattern
+}
+
 // Route represents a set of method, path and http.Handler.
 type Route struct {
 	Method  string
@@ -67,6 +131,11 @@ type Server struct {
 	router     *Router
 	middleware *negroni.Negroni
 	logger     logrus.FieldLogger
+	probes     map[string]http.Handler
+
+	jobs      sync.WaitGroup
+	done      chan struct{}
+	closeOnce sync.Once
 
 	HTTPS struct {
 		LetsEncrypt struct {
@@ -78,6 +147,17 @@ type Server struct {
 			Keyfile  string
 		}
 	}
+
+	// AccessLog configures the log lines that are emitted after each request.
+	//
+	// Error responses (400 and above) are always logged.
+	AccessLog struct {
+		// ExcludePrefixes are the path prefixes that are not logged.
+		ExcludePrefixes []string
+		// SampleRate is the fraction of the successful requests that are
+		// logged.
+		SampleRate float64
+	}
 }
 
 // New creates a new server.
@@ -88,17 +168,39 @@ func New(logger logrus.FieldLogger, addr string, panicFormatter negroni.PanicFor
 
 		router:     NewRouter(),
 		middleware: negroni.New(),
+		probes:     make(map[string]http.Handler),
+		done:       make(chan struct{}),
 	}
+	s.AccessLog.SampleRate = 1
 
 	recovery := negroni.NewRecovery()
 	recovery.Logger = logger
 	recovery.Formatter = panicFormatter
 	s.middleware.Use(recovery)
 	s.middleware.UseFunc(s.profiler)
+	s.middleware.UseFunc(s.serveProbes)
 
 	return s
 }
 
+// Probe adds a handler for a path that is served before the middlewares that
+// are added with Use.
+//
+// This is meant for health checks (see LivenessHandler and ReadinessHandler),
+// which should not depend on e.g. the session store.
+func (s *Server) Probe(path string, handler http.Handler) {
+	s.probes[path] = handler
+}
+
+func (s *Server) serveProbes(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if probe, ok := s.probes[r.URL.Path]; ok {
+		probe.ServeHTTP(w, r)
+		return
+	}
+
+	next(w, r)
+}
+
 func (s *Server) profiler(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	start := time.Now()
 
@@ -110,18 +212,37 @@ func (s *Server) profiler(w http.ResponseWriter, r *http.Request, next http.Hand
 	})
 
 	w.Header().Set("Server", "Unknown")
-	r = r.WithContext(context.WithValue(r.Context(), loggerContextKey, l))
+	rl := &requestLogger{logger: l}
+	r = r.WithContext(context.WithValue(r.Context(), loggerContextKey, rl))
 
 	next(w, r)
 
 	status := w.(negroni.ResponseWriter).Status()
-	l.WithFields(logrus.Fields{
+	if !s.shouldLog(r, status) {
+		return
+	}
+
+	rl.logger.WithFields(logrus.Fields{
 		"status-code": status,
 		"status":      http.StatusText(status),
 		"latency":     time.Since(start),
 	}).Infoln("completed handling request")
 }
 
+func (s *Server) shouldLog(r *http.Request, status int) bool {
+	if status >= 400 {
+		return true
+	}
+
+	for _, prefix := range s.AccessLog.ExcludePrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+
+	return s.AccessLog.SampleRate >= 1 || rand.Float64() < s.AccessLog.SampleRate
+}
+
 // Router returns the server's router.
 func (s *Server) Router() *Router {
 	return s.router
@@ -186,6 +307,35 @@ func (s *Server) IsHTTPS() bool {
 	return s.HTTPS.LetsEncrypt.Directory != "" || (s.HTTPS.Certificate.Certfile != "" && s.HTTPS.Certificate.Keyfile != "")
 }
 
+// Every runs a job periodically in the background until the server is closed.
+func (s *Server) Every(interval time.Duration, name string, job func() error) {
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				if err := job(); err != nil {
+					s.logger.WithError(err).WithField("job", name).Errorln("background job failed")
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the background jobs of the server.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.jobs.Wait()
+}
+
 // Use adds middlewares to the end of the server's middleware chain.
 func (s *Server) Use(middlewares ...negroni.Handler) {
 	for _, m := range middlewares {
@@ -198,17 +348,58 @@ type Router struct {
 	router *httprouter.Router
 }
 
-// NewRouter creates a router.
+// RouterOptions configures the automatic behavior of a router.
+//
+// The redirects use 301 for GET requests and 307 for the other methods. A
+// client that doesn't follow 307 properly, or rewrites it to a GET, loses
+// the body of a POST. Routes that accept form or API submissions should be
+// requested with their exact path, or the redirects should be turned off.
+type RouterOptions struct {
+	// RedirectTrailingSlash redirects to the path with or without the
+	// trailing slash if only that one has a route.
+	RedirectTrailingSlash bool
+	// RedirectFixedPath redirects to the cleaned, case-insensitively matched
+	// path if it has a route.
+	RedirectFixedPath bool
+	// HandleMethodNotAllowed responds with 405 instead of 404 if the path
+	// has a route with a different method.
+	HandleMethodNotAllowed bool
+	// HandleOPTIONS responds to the OPTIONS requests automatically.
+	HandleOPTIONS bool
+}
+
+// DefaultRouterOptions returns the options of NewRouter.
+func DefaultRouterOptions() RouterOptions {
+	return RouterOptions{
+		RedirectTrailingSlash:  true,
+		RedirectFixedPath:      true,
+		HandleMethodNotAllowed: true,
+		HandleOPTIONS:          true,
+	}
+}
+
+// NewRouter creates a router with DefaultRouterOptions.
 func NewRouter() *Router {
-	router := httprouter.New()
-	router.RedirectTrailingSlash = true
-	router.RedirectFixedPath = true
-	router.HandleMethodNotAllowed = true
-	router.HandleOPTIONS = true
-
-	return &Router{
-		router: router,
+	return NewRouterWithOptions(DefaultRouterOptions())
+}
+
+// NewRouterWithOptions creates a router.
+func NewRouterWithOptions(opts RouterOptions) *Router {
+	r := &Router{
+		router: httprouter.New(),
 	}
+
+	return r.SetOptions(opts)
+}
+
+// SetOptions changes the options of the router.
+func (r *Router) SetOptions(opts RouterOptions) *Router {
+	r.router.RedirectTrailingSlash = opts.RedirectTrailingSlash
+	r.router.RedirectFixedPath = opts.RedirectFixedPath
+	r.router.HandleMethodNotAllowed = opts.HandleMethodNotAllowed
+	r.router.HandleOPTIONS = opts.HandleOPTIONS
+
+	return r
 }
 
 // Handler returns the underlying http.Handler of the router.
@@ -216,9 +407,33 @@ func (r *Router) Handler() http.Handler {
 	return r.router
 }
 
+// SetNotFound sets the handler of the requests that don't match any route.
+func (r *Router) SetNotFound(handler http.Handler) *Router {
+	r.router.NotFound = handler
+	return r
+}
+
+// SetMethodNotAllowed sets the handler of the requests that match a route with
+// a different method.
+//
+// The Allow header is set before the handler is called.
+func (r *Router) SetMethodNotAllowed(handler http.Handler) *Router {
+	r.router.MethodNotAllowed = handler
+	return r
+}
+
 // Handle adds a handler to the router.
+//
+// The path is stored in the request context (see RoutePattern) and added to
+// the request logger as the "route" field, which, unlike the raw path, is
+// suitable for aggregating logs.
 func (r *Router) Handle(method, path string, handler http.Handler) *Router {
-	r.router.Handler(method, path, handler)
+	r.router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		AddLoggerFields(req, logrus.Fields{
+			"route": path,
+		})
+		handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), routeContextKey, path)))
+	}))
 	return r
 }
 
@@ -307,11 +522,68 @@ func PrefixRoutes(prefix string, routes []Route) []Route {
 	return ret
 }
 
+// MountRoutes mounts the routes under a path prefix, e.g. when the site is
+// hosted in a subdirectory behind a reverse proxy.
+//
+// Unlike PrefixRoutes, the prefix is stripped from the request path before
+// the handlers are called, so they see the same paths as without the prefix.
+func MountRoutes(prefix string, routes []Route) []Route {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return routes
+	}
+
+	ret := PrefixRoutes(prefix, routes)
+	for i := range ret {
+		ret[i].Handler = http.StripPrefix(prefix, ret[i].Handler)
+	}
+
+	return ret
+}
+
 // BaseURL represents the server's base url.
 type BaseURL struct {
 	base url.URL
 }
 
+type baseURLMiddleware struct {
+	baseurl *BaseURL
+}
+
+// BaseURLMiddleware stores the base url in the request context.
+//
+// See GetBaseURL and AbsoluteURL.
+func BaseURLMiddleware(baseurl *BaseURL) negroni.Handler {
+	return &baseURLMiddleware{baseurl: baseurl}
+}
+
+func (m *baseURLMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(w, r.WithContext(context.WithValue(r.Context(), baseURLContextKey, m.baseurl)))
+}
+
+// GetBaseURL returns the base url from the request context.
+//
+// The url is never guessed from the Host header of the request, because it
+// is controlled by the client. ErrNoBaseURL is returned if
+// BaseURLMiddleware didn't run.
+func GetBaseURL(r *http.Request) (*BaseURL, error) {
+	if b, ok := r.Context().Value(baseURLContextKey).(*BaseURL); ok {
+		return b, nil
+	}
+
+	return nil, ErrNoBaseURL
+}
+
+// AbsoluteURL creates an absolute url from the base url of the request.
+func AbsoluteURL(r *http.Request, parts ...string) (string, error) {
+	b, err := GetBaseURL(r)
+	if err != nil {
+		return "", err
+	}
+
+	return b.Path(parts...), nil
+}
+
 // ParseBaseURL creates a new BaseURL by parsing the string form.
 func ParseBaseURL(rawurl string) (*BaseURL, error) {
 	u, err := url.Parse(rawurl)
@@ -331,3 +603,27 @@ func (b *BaseURL) Path(parts ...string) string {
 
 	return base.String()
 }
+
+// URL creates a new url from the base url by appending p to its path and
+// adding the query parameters.
+//
+// The query parameters of the base url are kept, unless they are overridden.
+func (b *BaseURL) URL(p string, query url.Values) string {
+	return b.ResolveURL(p, query).String()
+}
+
+// ResolveURL is like URL, but it returns a *url.URL.
+func (b *BaseURL) ResolveURL(p string, query url.Values) *url.URL {
+	base := b.base
+	if p != "" {
+		base.Path = path.Join(base.Path, p)
+	}
+
+	q := base.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	base.RawQuery = q.Encode()
+
+	return &base
+}
@@ -0,0 +1,534 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/respond"
+	"github.com/tamasd/simplesite/server"
+	"github.com/tamasd/simplesite/util/testutil"
+	"github.com/urfave/negroni"
+)
+
+func newTestServer() (*server.Server, http.Handler, logrus.FieldLogger) {
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Router().
+		GetF("/assets/style.css", func(w http.ResponseWriter, r *http.Request) {}).
+		GetF("/page", func(w http.ResponseWriter, r *http.Request) {}).
+		GetF("/assets/error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+
+	return srv, srv.CreateHTTPServer().Handler, logger
+}
+
+func completedLines(logger string) int {
+	return strings.Count(logger, "completed handling request")
+}
+
+func TestAccessLogExclude(t *testing.T) {
+	srv, h, logger := newTestServer()
+	srv.AccessLog.ExcludePrefixes = []string{"/assets"}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/assets/style.css", nil))
+	require.Equal(t, 0, completedLines(testutil.GetLog(logger)))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/page", nil))
+	require.Equal(t, 1, completedLines(testutil.GetLog(logger)))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/assets/error", nil))
+	require.Equal(t, 2, completedLines(testutil.GetLog(logger)))
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	srv, h, logger := newTestServer()
+	srv.AccessLog.SampleRate = 0
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/page", nil))
+	require.Equal(t, 0, completedLines(testutil.GetLog(logger)))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/assets/error", nil))
+	require.Equal(t, 1, completedLines(testutil.GetLog(logger)))
+}
+
+func newCORSTestHandler() http.Handler {
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Use(server.NewCORS("/api/", "https://app.example.com"))
+	srv.Router().
+		GetF("/api/posts", func(w http.ResponseWriter, r *http.Request) {}).
+		GetF("/page", func(w http.ResponseWriter, r *http.Request) {})
+
+	return srv.CreateHTTPServer().Handler
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := newCORSTestHandler()
+
+	r := httptest.NewRequest(http.MethodOptions, "/api/posts", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	require.Equal(t, "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	require.Contains(t, rr.Header().Get("Access-Control-Allow-Methods"), http.MethodPost)
+	require.Contains(t, rr.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+	r = httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	h := newCORSTestHandler()
+
+	r := httptest.NewRequest(http.MethodOptions, "/api/posts", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	require.Equal(t, http.StatusForbidden, rr.Code)
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+
+	r = httptest.NewRequest(http.MethodGet, "/api/posts", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestPanicJSON(t *testing.T) {
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	panicHandler := func(w http.ResponseWriter, r *http.Request) {
+		panic("test panic")
+	}
+	srv.Router().
+		GetF("/api/panic", panicHandler).
+		GetF("/panic", panicHandler)
+	h := srv.CreateHTTPServer().Handler
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/panic", nil),
+		func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/panic", nil)
+			r.Header.Set("Accept", "application/json")
+			return r
+		}(),
+	} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		require.Equal(t, http.StatusInternalServerError, rr.Code)
+		body := respond.ErrorResponse{}
+		require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		require.Equal(t, http.StatusText(http.StatusInternalServerError), body.Error)
+		require.NotContains(t, rr.Body.String(), "test panic")
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Contains(t, rr.Body.String(), "<html>")
+}
+
+func TestErrorJSON(t *testing.T) {
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Router().GetF("/missing", func(w http.ResponseWriter, r *http.Request) {
+		respond.Error(w, r, http.StatusNotFound, "entity not found", nil, nil)
+	})
+	h := srv.CreateHTTPServer().Handler
+
+	r := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	r.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	body := respond.ErrorResponse{}
+	require.Nil(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	require.Equal(t, http.StatusNotFound, body.Code)
+	require.Equal(t, "entity not found", body.Message)
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.Contains(t, rr.Body.String(), "<html>")
+	require.Contains(t, rr.Body.String(), "entity not found")
+}
+
+func TestNotFound(t *testing.T) {
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Router().
+		SetNotFound(respond.NotFoundHandler()).
+		SetMethodNotAllowed(respond.MethodNotAllowedHandler()).
+		GetF("/page", func(w http.ResponseWriter, r *http.Request) {})
+	h := srv.CreateHTTPServer().Handler
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	require.Contains(t, rr.Body.String(), "HTTP Error 404")
+	require.Contains(t, rr.Body.String(), "Page not found")
+	require.Contains(t, testutil.GetLog(logger), "path=/unknown")
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/page", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	require.Contains(t, rr.Header().Get("Allow"), http.MethodGet)
+	require.Contains(t, rr.Body.String(), "HTTP Error 405")
+}
+
+func TestPanicPageStack(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		logger := testutil.TestLogger()
+		pf := respond.NewPanicFormatter(logger)
+		pf.Debug = debug
+		srv := server.New(logger, "", pf)
+		srv.Router().GetF("/panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("test panic")
+		})
+
+		rr := httptest.NewRecorder()
+		srv.CreateHTTPServer().Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/panic", nil))
+		require.Equal(t, http.StatusInternalServerError, rr.Code)
+
+		body := rr.Body.String()
+		if debug {
+			require.Contains(t, body, "test panic")
+			require.Contains(t, body, "Runtime stack")
+		} else {
+			require.NotContains(t, body, "test panic")
+			require.NotContains(t, body, "Runtime stack")
+			require.Contains(t, body, "Internal Server Error")
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Router().
+		Get("/slow", server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+				_, _ = w.Write([]byte("too late"))
+			case <-r.Context().Done():
+			}
+		}, server.Timeout(50*time.Millisecond))).
+		Get("/fast", server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Test", "fast")
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte("done"))
+		}, server.Timeout(time.Second)))
+	h := srv.CreateHTTPServer().Handler
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Contains(t, rr.Body.String(), "request timeout")
+	require.NotContains(t, rr.Body.String(), "too late")
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	require.Equal(t, "fast", rr.Header().Get("X-Test"))
+	require.Equal(t, "done", rr.Body.String())
+}
+
+func TestTimeoutStreaming(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	hook := logtest.NewLocal(logger)
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	panicked := make(chan struct{})
+	srv.Router().
+		Get("/stream", server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("started"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			_, _ = w.Write([]byte(" finished"))
+		}, server.Timeout(50*time.Millisecond))).
+		Get("/panic", server.WrapF(func(w http.ResponseWriter, r *http.Request) {
+			defer close(panicked)
+			<-r.Context().Done()
+			panic("late panic")
+		}, server.Timeout(50*time.Millisecond)))
+	h := srv.CreateHTTPServer().Handler
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.True(t, rr.Flushed)
+	require.Equal(t, "started finished", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	<-panicked
+	require.Eventually(t, func() bool {
+		for _, e := range hook.AllEntries() {
+			if e.Message == "panic after request timeout: late panic" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRouterTrailingSlash(t *testing.T) {
+	srv, h, _ := newTestServer()
+	srv.Router().GetF("/posts", func(w http.ResponseWriter, r *http.Request) {})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/posts/", nil))
+	require.Equal(t, http.StatusMovedPermanently, rr.Code)
+	require.Equal(t, "/posts", rr.Header().Get("Location"))
+
+	opts := server.DefaultRouterOptions()
+	opts.RedirectTrailingSlash = false
+	srv.Router().SetOptions(opts)
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/posts/", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/posts", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestRoutePattern(t *testing.T) {
+	srv, h, logger := newTestServer()
+	var pattern string
+	srv.Router().GetF("/post/:id/edit", func(w http.ResponseWriter, r *http.Request) {
+		pattern = server.RoutePattern(r)
+	})
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/post/0b7e2b6e-3a0c-4f4e-9a55-1a2c3d4e5f60/edit", nil))
+	require.Equal(t, "/post/:id/edit", pattern)
+	require.Contains(t, testutil.GetLog(logger), `route="/post/:id/edit"`)
+}
+
+func TestGetLoggerWithoutMiddleware(t *testing.T) {
+	var logger logrus.FieldLogger
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger = server.GetLogger(r)
+	})
+
+	require.NotPanics(t, func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/page", nil))
+	})
+	require.NotNil(t, logger)
+}
+
+func TestLoggerFields(t *testing.T) {
+	srv, h, logger := newTestServer()
+	srv.Router().GetF("/fields", func(w http.ResponseWriter, r *http.Request) {
+		server.GetLogger(r).Infoln("before")
+		server.AddLoggerField(r, "post", "42")
+		r = server.WithLoggerFields(r, logrus.Fields{"form": "edit"})
+		server.GetLogger(r).Infoln("after")
+	})
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fields", nil))
+	lines := strings.Split(strings.TrimSpace(testutil.GetLog(logger)), "\n")
+	require.Len(t, lines, 3)
+	require.NotContains(t, lines[0], "post=42")
+	require.Contains(t, lines[1], "post=42")
+	require.Contains(t, lines[1], "form=edit")
+	require.Contains(t, lines[2], "completed handling request")
+	require.Contains(t, lines[2], "post=42")
+	require.NotContains(t, lines[2], "form=edit")
+}
+
+func TestBaseURLWithQuery(t *testing.T) {
+	b, err := server.ParseBaseURL("https://example.com/blog")
+	require.Nil(t, err)
+
+	require.Equal(t, "https://example.com/blog/posts", b.URL("/posts", nil))
+	require.Equal(t, "https://example.com/blog/posts", b.URL("/posts", url.Values{}))
+	require.Equal(t, "https://example.com/blog/posts?page=2&tag=go", b.URL("/posts", url.Values{
+		"tag":  {"go"},
+		"page": {"2"},
+	}))
+	require.Equal(t, "https://example.com/blog/search?q=a%26b+c%3Dd%2F%C3%A9", b.URL("/search", url.Values{
+		"q": {"a&b c=d/é"},
+	}))
+
+	u := b.ResolveURL("/posts", url.Values{"page": {"3"}})
+	require.Equal(t, "/blog/posts", u.Path)
+	require.Equal(t, "3", u.Query().Get("page"))
+
+	b, err = server.ParseBaseURL("https://example.com/?lang=en&page=1")
+	require.Nil(t, err)
+	require.Equal(t, "https://example.com/posts?lang=en&page=2", b.URL("/posts", url.Values{"page": {"2"}}))
+
+	require.Equal(t, "?page=2", new(server.BaseURL).URL("", url.Values{"page": {"2"}}))
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	b, err := server.ParseBaseURL("https://example.com/blog")
+	require.Nil(t, err)
+
+	var absolute string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		absolute, _ = server.AbsoluteURL(r, "/verify/", "id", "token")
+	})
+
+	server.BaseURLMiddleware(b).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://internal:8080/register", nil), h)
+	require.Equal(t, "https://example.com/blog/verify/id/token", absolute)
+
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		absolute, err = server.AbsoluteURL(r, "/verify/", "id", "token")
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://evil.example.com/register", nil))
+	require.Equal(t, server.ErrNoBaseURL, err)
+	require.Equal(t, "", absolute)
+}
+
+func TestHealthProbes(t *testing.T) {
+	logger := testutil.TestLogger()
+	srv := server.New(logger, "", respond.NewPanicFormatter(logger))
+	srv.Router().GetF("/page", func(w http.ResponseWriter, r *http.Request) {})
+	redisDown := false
+	srv.Use(negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if redisDown {
+			http.Error(w, "session store unavailable", http.StatusInternalServerError)
+			return
+		}
+		next(w, r)
+	}))
+	srv.Probe("/livez", server.LivenessHandler())
+	srv.Probe("/readyz", server.ReadinessHandler(map[string]server.HealthCheck{
+		"database": func() error { return nil },
+		"redis": func() error {
+			if redisDown {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+	}))
+	h := srv.CreateHTTPServer().Handler
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "database: ok\nredis: ok\n", rr.Body.String())
+
+	redisDown = true
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, "database: ok\nredis: failed\n", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/page", nil))
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+type unavailableStore struct {
+	*keyvalue.Memory
+	failures int
+	calls    int
+}
+
+func (s *unavailableStore) Get(key string) (string, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return "", errors.New("connection refused")
+	}
+
+	return s.Memory.Get(key)
+}
+
+func TestWaitFor(t *testing.T) {
+	logger := testutil.TestLogger()
+	store := &unavailableStore{Memory: keyvalue.NewMemory(), failures: 2}
+	check := func() error {
+		return keyvalue.Ping(store)
+	}
+
+	require.Nil(t, server.WaitFor(logger, "redis", check, 5*time.Second))
+	require.Equal(t, 3, store.calls)
+	testutil.AssertLogContains(t, logger, logrus.WarnLevel, "dependency is unavailable")
+
+	store = &unavailableStore{Memory: keyvalue.NewMemory(), failures: 1}
+	require.NotNil(t, server.WaitFor(logger, "redis", check, 0))
+	require.Equal(t, 1, store.calls)
+}
+
+func TestMountRoutes(t *testing.T) {
+	srv, h, _ := newTestServer()
+	var path, pattern string
+	srv.Router().Add(server.MountRoutes("/blog/", []server.Route{
+		{Method: http.MethodGet, Path: "/post/:id", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+			pattern = server.RoutePattern(r)
+		})},
+	})...)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/blog/post/1", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "/post/1", path)
+	require.Equal(t, "/blog/post/:id", pattern)
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/post/1", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	routes := []server.Route{{Method: http.MethodGet, Path: "/"}}
+	require.Equal(t, routes, server.MountRoutes("", routes))
+}
+
+func TestCORSValidate(t *testing.T) {
+	cors := server.NewCORS("/api/", "*")
+	require.NoError(t, cors.Validate())
+
+	cors.AllowCredentials = true
+	require.Equal(t, server.ErrWildcardCredentials, cors.Validate())
+
+	cors.AllowedOrigins = []string{"https://app.example.com"}
+	require.NoError(t, cors.Validate())
+}
@@ -0,0 +1,206 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/negroni"
+)
+
+// TimeoutResponder writes the response of the requests that time out.
+//
+// The respond package replaces it with one that renders the error page.
+var TimeoutResponder = func(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+type timeoutMiddleware struct {
+	timeout time.Duration
+}
+
+// Timeout is a middleware that limits the time of the request handling.
+//
+// The handler runs with a context that is cancelled after the timeout, which
+// also aborts its database queries and rolls back its transaction. If the
+// handler hasn't started the response by then, the request is answered with
+// the TimeoutResponder, and the later writes of the handler fail with
+// http.ErrHandlerTimeout. A response that is already being written is not
+// cut off.
+func Timeout(d time.Duration) negroni.Handler {
+	return &timeoutMiddleware{timeout: d}
+}
+
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (m *timeoutMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), m.timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	tw := &timeoutWriter{w: w, header: make(http.Header)}
+	done := make(chan struct{})
+	panicChan := make(chan handlerPanic, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicChan <- handlerPanic{value: p, stack: debug.Stack()}
+			}
+		}()
+		next(negroni.NewResponseWriter(tw), r)
+		close(done)
+	}()
+
+	select {
+	case p := <-panicChan:
+		panic(p.value)
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	if !tw.timeout() {
+		// The response is already being written. The handler's context is
+		// cancelled, so it should finish soon.
+		select {
+		case p := <-panicChan:
+			panic(p.value)
+		case <-done:
+		}
+		return
+	}
+
+	logger := GetLoggerOrDefault(r, nil)
+	if ctx.Err() == context.DeadlineExceeded {
+		if logger != nil {
+			logger.WithField("timeout", m.timeout).Warnln("request timed out")
+		}
+		TimeoutResponder(w, r)
+	}
+
+	// The handler is still running, its panic can only be logged.
+	go func() {
+		select {
+		case p := <-panicChan:
+			if logger != nil {
+				logger.WithField("stack", string(p.stack)).Errorf("panic after request timeout: %v", p.value)
+			}
+		case <-done:
+		}
+	}()
+}
+
+// timeoutWriter passes the response through until the request times out.
+type timeoutWriter struct {
+	w           http.ResponseWriter
+	mtx         sync.Mutex
+	header      http.Header
+	wroteHeader bool
+	timedOut    bool
+}
+
+// timeout marks the writer as timed out, unless the response is already
+// started.
+func (tw *timeoutWriter) timeout() bool {
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+
+	if tw.wroteHeader {
+		return false
+	}
+	tw.timedOut = true
+
+	return true
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) writeHeader(code int) {
+	dst := tw.w.Header()
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(code)
+	tw.wroteHeader = true
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeader(http.StatusOK)
+	}
+
+	return tw.w.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.writeHeader(code)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+
+	if tw.timedOut {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.writeHeader(http.StatusOK)
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mtx.Lock()
+	defer tw.mtx.Unlock()
+
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	h, ok := tw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+	tw.wroteHeader = true
+
+	return h.Hijack()
+}
@@ -0,0 +1,106 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/negroni"
+)
+
+type cacheGuardMiddleware struct{}
+
+// CacheGuardMiddleware is a middleware that keeps the personalized responses
+// out of the shared caches.
+//
+// The html and JSON responses, and the responses that vary by cookie (see
+// respond.NotModified) get a "Vary: Cookie" header. They are marked
+// "private, no-store" for logged in users and for requests with an
+// Authorization header, and "private, no-cache" for everyone else, unless
+// the handler marked them cacheable (see Cacheable). Other responses, like
+// the assets, are left alone.
+//
+// It must come after the session middleware.
+func CacheGuardMiddleware() negroni.Handler {
+	return &cacheGuardMiddleware{}
+}
+
+func (m *cacheGuardMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	nw, ok := w.(negroni.ResponseWriter)
+	if !ok {
+		nw = negroni.NewResponseWriter(w)
+	}
+
+	sess := Get(r)
+	authorized := r.Header.Get("Authorization") != ""
+	nw.Before(func(w negroni.ResponseWriter) {
+		h := w.Header()
+		if !personalized(h) {
+			return
+		}
+
+		if !headerContains(h, "Vary", "Cookie") {
+			h.Add("Vary", "Cookie")
+		}
+		if sess.LoggedIn() || authorized {
+			h.Set("Cache-Control", "private, no-store")
+		} else if h.Get("Cache-Control") == "" {
+			h.Set("Cache-Control", "private, no-cache")
+		}
+	})
+
+	next(nw, r)
+}
+
+func personalized(h http.Header) bool {
+	if headerContains(h, "Vary", "Cookie") {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+
+	return err == nil && (mediaType == "text/html" || mediaType == "application/json")
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, line := range h.Values(name) {
+		for _, v := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Cacheable marks a public page cacheable for shared caches for maxAge.
+//
+// It does nothing for logged in users. The session cookie is not sent with
+// the cacheable responses, so the caches can't hand it out to other clients.
+func Cacheable(w http.ResponseWriter, r *http.Request, maxAge time.Duration) {
+	if Get(r).LoggedIn() || r.Header.Get("Authorization") != "" {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+	w.Header().Del("Set-Cookie")
+}
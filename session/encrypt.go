@@ -0,0 +1,112 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// encryptedPrefix marks the encrypted session data in the store.
+	encryptedPrefix = "enc1:"
+)
+
+// ErrUndecryptable is returned when the stored session data can't be
+// decrypted, because it was tampered with, it was encrypted with a different
+// secret, or the encryption is turned off.
+var ErrUndecryptable = errors.New("undecryptable session data")
+
+// SetSecret turns on the encryption of the session data in the store.
+//
+// The data is encrypted with AES-256-GCM, using a key derived from the secret,
+// so it should be a long random string. The session id is authenticated with
+// the data, so the data of one session can't be copied to another. An empty
+// secret turns the encryption off.
+//
+// Sessions that can't be decrypted are replaced with new, anonymous ones, so
+// turning the encryption on or off, or changing the secret logs everyone out.
+func (m *Middleware) SetSecret(secret string) error {
+	if secret == "" {
+		m.aead = nil
+		return nil
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return errors.Wrap(err, "failed to create session cipher")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.Wrap(err, "failed to create session cipher")
+	}
+
+	m.aead = aead
+
+	return nil
+}
+
+// seal encrypts the session data if the encryption is turned on.
+func (m *Middleware) seal(sid string, data []byte) (string, error) {
+	if m.aead == nil {
+		return string(data), nil
+	}
+
+	nonce := make([]byte, m.aead.NonceSize(), m.aead.NonceSize()+len(data)+m.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "failed to generate session nonce")
+	}
+
+	sealed := m.aead.Seal(nonce, nonce, data, []byte(sid))
+
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts the session data.
+func (m *Middleware) open(sid, data string) ([]byte, error) {
+	encrypted := strings.HasPrefix(data, encryptedPrefix)
+	if m.aead == nil {
+		if encrypted {
+			return nil, ErrUndecryptable
+		}
+		return []byte(data), nil
+	}
+	if !encrypted {
+		return nil, ErrUndecryptable
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(data, encryptedPrefix))
+	if err != nil || len(sealed) < m.aead.NonceSize() {
+		return nil, ErrUndecryptable
+	}
+
+	nonce := sealed[:m.aead.NonceSize()]
+	plain, err := m.aead.Open(nil, nonce, sealed[m.aead.NonceSize():], []byte(sid))
+	if err != nil {
+		return nil, ErrUndecryptable
+	}
+
+	return plain, nil
+}
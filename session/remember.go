@@ -0,0 +1,198 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/server"
+	"github.com/tamasd/simplesite/util"
+)
+
+const (
+	// RememberCookieName is the default name of the remember me cookie.
+	RememberCookieName = "remember"
+	// DefaultRememberTTL is the default lifetime of the remember me tokens.
+	DefaultRememberTTL = 30 * 24 * time.Hour
+
+	rememberTokenLength = 64
+	rememberPrefix      = "remember:"
+	rememberGenPrefix   = "remember-generation:"
+
+	// rememberClaimed replaces the value of a used remember me token, so the
+	// concurrent requests with the same token can't use it again.
+	rememberClaimed    = "claimed"
+	rememberClaimedTTL = time.Minute
+)
+
+// Remember issues a remember me token for the account.
+//
+// The token logs the account in when its session expires. Each token can be
+// used once, a new one is issued in place of the used one.
+func (m *Middleware) Remember(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	m.issueRememberToken(w, r, id)
+}
+
+// Forget revokes the remember me token of the current request.
+func (m *Middleware) Forget(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(m.RememberCookieName); err == nil && c.Value != "" {
+		if err = m.store.Delete(rememberPrefix + hashRememberToken(c.Value)); err != nil {
+			server.GetLoggerOrDefault(r, m.logger).WithError(err).Errorln("cannot delete remember token")
+		}
+	}
+
+	m.setRememberCookie(w, "", time.Unix(0, 0))
+}
+
+// InvalidateRememberTokens revokes all remember me tokens of an account.
+//
+// This should be called when the password of the account changes.
+func (m *Middleware) InvalidateRememberTokens(id uuid.UUID) error {
+	_, err := m.store.Increment(rememberGenPrefix+id.String(), 0)
+	return err
+}
+
+func (m *Middleware) rememberGeneration(id uuid.UUID) (string, error) {
+	gen, err := m.store.Get(rememberGenPrefix + id.String())
+	if err == keyvalue.ErrNotFound {
+		return "0", nil
+	}
+
+	return gen, err
+}
+
+func (m *Middleware) issueRememberToken(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	logger := server.GetLoggerOrDefault(r, m.logger)
+
+	gen, err := m.rememberGeneration(id)
+	if err != nil {
+		logger.WithError(err).Errorln("failed to load remember token generation")
+		return
+	}
+
+	token := util.RandomHexString(rememberTokenLength)
+	if err = m.store.SetExpiring(rememberPrefix+hashRememberToken(token), id.String()+":"+gen, m.RememberTTL); err != nil {
+		logger.WithError(err).Errorln("failed to save remember token")
+		return
+	}
+
+	m.setRememberCookie(w, token, util.Now().Add(m.RememberTTL))
+}
+
+// consumeRememberToken checks the remember me token of the request, and
+// returns the id of its account.
+//
+// The token is claimed atomically, so it can be used only once, even by
+// concurrent requests. Invalid tokens and the tokens of accounts rejected by
+// RememberCheck are claimed as well.
+func (m *Middleware) consumeRememberToken(w http.ResponseWriter, r *http.Request) uuid.UUID {
+	c, err := r.Cookie(m.RememberCookieName)
+	if err != nil || c.Value == "" {
+		return uuid.Nil
+	}
+
+	logger := server.GetLoggerOrDefault(r, m.logger)
+	key := rememberPrefix + hashRememberToken(c.Value)
+
+	val, err := m.store.Get(key)
+	if err == keyvalue.ErrNotFound {
+		m.setRememberCookie(w, "", time.Unix(0, 0))
+		return uuid.Nil
+	}
+	if err != nil {
+		logger.WithError(err).Warnln("failed to load remember token")
+		return uuid.Nil
+	}
+	if val == rememberClaimed {
+		// Another request used the token, and it sets the new cookie.
+		return uuid.Nil
+	}
+
+	id, err := m.checkRememberToken(r, val)
+	if err != nil {
+		// The token is kept, so it can be used when the check works again.
+		logger.WithError(err).Warnln("failed to check remember token")
+		return uuid.Nil
+	}
+
+	claimed, err := m.store.CompareAndSwap(key, val, rememberClaimed, rememberClaimedTTL)
+	if err != nil {
+		logger.WithError(err).Warnln("failed to claim remember token")
+		return uuid.Nil
+	}
+	if !claimed {
+		return uuid.Nil
+	}
+	if uuid.Equal(id, uuid.Nil) {
+		m.setRememberCookie(w, "", time.Unix(0, 0))
+	}
+
+	return id
+}
+
+// checkRememberToken returns the account id of a stored remember me token,
+// or uuid.Nil if the token must not log in.
+func (m *Middleware) checkRememberToken(r *http.Request, val string) (uuid.UUID, error) {
+	parts := strings.SplitN(val, ":", 2)
+	id := uuid.FromStringOrNil(parts[0])
+	if len(parts) != 2 || uuid.Equal(id, uuid.Nil) {
+		return uuid.Nil, nil
+	}
+
+	gen, err := m.rememberGeneration(id)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if gen != parts[1] {
+		return uuid.Nil, nil
+	}
+
+	if m.RememberCheck != nil {
+		ok, err := m.RememberCheck(r, id)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if !ok {
+			return uuid.Nil, nil
+		}
+	}
+
+	return id, nil
+}
+
+func (m *Middleware) setRememberCookie(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.RememberCookieName,
+		Value:    token,
+		Path:     m.CookiePath,
+		Expires:  expires,
+		Secure:   m.SecureCookie,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func hashRememberToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
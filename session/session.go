@@ -18,9 +18,13 @@ package session
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -61,10 +65,22 @@ func GetSid(r *http.Request) *string {
 	return r.Context().Value(sidKey).(*string)
 }
 
+// Override replaces the session in the request context for the rest of the
+// request.
+//
+// The replacement session is not saved, so it can be used to authenticate
+// stateless requests.
+func Override(r *http.Request, sess *Session) *http.Request {
+	return util.SetContext(r, sessionKey, sess)
+}
+
 // Session represents the session that is saved to the key-value storage.
 type Session struct {
 	ID        uuid.UUID
 	CSRFToken string
+	// Expires is the time when the idle session expires. The store expires
+	// the session as well, but this follows util.Now.
+	Expires time.Time
 }
 
 func (s *Session) GetCSRFToken() string {
@@ -75,6 +91,11 @@ func (s *Session) LoggedIn() bool {
 	return !uuid.Equal(s.ID, uuid.Nil)
 }
 
+// LoggedInAs checks if the session belongs to the given account.
+func (s *Session) LoggedInAs(id uuid.UUID) bool {
+	return s.LoggedIn() && uuid.Equal(s.ID, id)
+}
+
 func (s *Session) Read(p []byte) (int, error) {
 	return len(p), json.Unmarshal(p, s)
 }
@@ -96,13 +117,31 @@ type Middleware struct {
 	store        keyvalue.Store
 	SecureCookie bool
 	CookieName   string
+	// CookiePath is the path of the session and remember me cookies.
+	CookiePath string
+	// TTL is the time after an idle session expires. Sessions don't expire
+	// if it is 0.
+	TTL time.Duration
+	// RememberCookieName is the name of the cookie that stores the remember
+	// me token.
+	RememberCookieName string
+	// RememberTTL is the lifetime of the remember me tokens.
+	RememberTTL time.Duration
+	// RememberCheck decides if the account of a remember me token can still
+	// log in. The token is deleted if the check rejects the account.
+	RememberCheck func(r *http.Request, id uuid.UUID) (bool, error)
+
+	aead cipher.AEAD
 }
 
 func NewMiddleware(logger logrus.FieldLogger, store keyvalue.Store) *Middleware {
 	return &Middleware{
-		logger:     logger,
-		store:      store,
-		CookieName: SessionCookieName,
+		logger:             logger,
+		store:              store,
+		CookieName:         SessionCookieName,
+		CookiePath:         "/",
+		RememberCookieName: RememberCookieName,
+		RememberTTL:        DefaultRememberTTL,
 	}
 }
 
@@ -114,6 +153,19 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http
 		return
 	}
 
+	if !sess.LoggedIn() {
+		if id := m.consumeRememberToken(w, r); !uuid.Equal(id, uuid.Nil) {
+			if err := m.store.Delete(sid); err != nil {
+				respond.Error(w, r, http.StatusInternalServerError, "session error", nil, err)
+				return
+			}
+			sid = GenerateSid(id)
+			sess.ID = id
+			sess.CSRFToken = ""
+			m.issueRememberToken(w, r, id)
+		}
+	}
+
 	if sess.CSRFToken == "" {
 		sess.CSRFToken = GenerateCSRFToken()
 	}
@@ -124,6 +176,10 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http
 
 	next.ServeHTTP(w, r)
 
+	if m.TTL > 0 {
+		sess.Expires = util.Now().Add(m.TTL)
+	}
+
 	buf := sessionBufferPool.Get().(*bytes.Buffer)
 	defer func() {
 		buf.Reset()
@@ -137,7 +193,12 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http
 	}
 
 	if sid != "" {
-		if err := m.store.Set(sid, string(buf.Bytes())); err != nil {
+		data, err := m.seal(sid, buf.Bytes())
+		if err != nil {
+			logger.WithError(err).Errorln("failed to encrypt session data")
+			return
+		}
+		if err = m.store.SetExpiring(sid, data, m.TTL); err != nil {
 			logger.WithError(err).Errorln("failed to save session")
 			return
 		}
@@ -173,21 +234,42 @@ func (m *Middleware) DeleteSession(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     m.CookieName,
 		Value:    "",
-		Path:     "/",
+		Path:     m.CookiePath,
 		Expires:  time.Unix(0, 0),
 		HttpOnly: true,
 		Secure:   m.SecureCookie,
 	})
+	m.Forget(w, r)
 
 	*sid = ""
 }
 
+// DeleteAllSessions removes every session of an account, and revokes its
+// remember me tokens.
+//
+// The sessions are found by the account id prefix of the session ids (see
+// GenerateSid).
+func (m *Middleware) DeleteAllSessions(id uuid.UUID) error {
+	keys, err := m.store.Keys(id.String() + ":")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = m.store.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return m.InvalidateRememberTokens(id)
+}
+
 func (m *Middleware) setSessionCookie(w http.ResponseWriter, sid string) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     m.CookieName,
 		Value:    sid,
-		Path:     "/",
-		Expires:  time.Now().AddDate(1, 0, 0),
+		Path:     m.CookiePath,
+		Expires:  util.Now().AddDate(1, 0, 0),
 		Secure:   m.SecureCookie,
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
@@ -214,16 +296,38 @@ func (m *Middleware) load(r *http.Request, sess *Session) string {
 	}
 
 	sessdata, err := m.store.Get(sid)
+	if err == keyvalue.ErrNotFound {
+		// The session has expired, so the old id is not reused.
+		return GenerateSid(uuid.Nil)
+	}
 	if err != nil {
 		l.WithError(err).Warnln("failed to load session from store")
 		return ""
 	}
 
-	if sessdata != "" {
-		if _, err = sess.Read([]byte(sessdata)); err != nil {
-			l.WithError(err).Warnln("failed to decode session data")
-			return ""
-		}
+	plain, err := m.open(sid, sessdata)
+	if err != nil {
+		// The data is not trusted, so the session starts over as anonymous.
+		l.WithError(err).Warnln("failed to decrypt session data")
+		return GenerateSid(uuid.Nil)
+	}
+
+	if _, err = sess.Read(plain); err != nil {
+		l.WithError(err).Warnln("failed to decode session data")
+		return ""
+	}
+
+	// The account id prefix of the session id is used to find the sessions
+	// of an account, so it must match the account of the session.
+	if !uuid.Equal(SidAccount(sid), sess.ID) {
+		l.Warnln("session id does not match the session's account")
+		*sess = Session{}
+		return GenerateSid(uuid.Nil)
+	}
+
+	if !sess.Expires.IsZero() && util.Now().After(sess.Expires) {
+		*sess = Session{}
+		return GenerateSid(uuid.Nil)
 	}
 
 	l.WithFields(logrus.Fields{
@@ -233,6 +337,35 @@ func (m *Middleware) load(r *http.Request, sess *Session) string {
 	return sid
 }
 
+type loggerFieldsMiddleware struct{}
+
+// LoggerFieldsMiddleware is a middleware that adds the account id and the
+// session to the request logger.
+//
+// The session id is hashed, so the logs can't be used to hijack sessions. The
+// account id is omitted for anonymous requests.
+func LoggerFieldsMiddleware() negroni.Handler {
+	return &loggerFieldsMiddleware{}
+}
+
+func (m *loggerFieldsMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	fields := logrus.Fields{}
+
+	if sid, ok := r.Context().Value(sidKey).(*string); ok && *sid != "" {
+		hash := sha256.Sum256([]byte(*sid))
+		fields["session"] = hex.EncodeToString(hash[:8])
+	}
+	if sess, ok := r.Context().Value(sessionKey).(*Session); ok && sess.LoggedIn() {
+		fields["uid"] = sess.ID.String()
+	}
+
+	if len(fields) > 0 {
+		server.AddLoggerFields(r, fields)
+	}
+
+	next(w, r)
+}
+
 // GenerateSid generates a new session id.
 //
 // The session id gets prefixed with the user id, so sessions can be invalidated
@@ -241,6 +374,25 @@ func GenerateSid(id uuid.UUID) string {
 	return id.String() + ":" + util.RandomHexString(sidLength)
 }
 
+// RotateCSRF replaces the CSRF token of the current session.
+//
+// It should be called when the privileges of the session change (e.g. after a
+// password change), so the previously issued tokens can't be used anymore.
+// The new token is saved with the session at the end of the request.
+func RotateCSRF(r *http.Request) string {
+	sess := Get(r)
+	sess.CSRFToken = GenerateCSRFToken()
+
+	return sess.CSRFToken
+}
+
+// SidAccount returns the account id prefix of a session id.
+//
+// Returns uuid.Nil if the session id has no valid prefix.
+func SidAccount(sid string) uuid.UUID {
+	return uuid.FromStringOrNil(strings.SplitN(sid, ":", 2)[0])
+}
+
 // GenerateCSRFToken generates a new csrf token.
 func GenerateCSRFToken() string {
 	return util.RandomHexString(csrfLength)
@@ -0,0 +1,269 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/keyvalue"
+	"github.com/tamasd/simplesite/session"
+	"github.com/tamasd/simplesite/util/testutil"
+	"github.com/urfave/negroni"
+)
+
+func serveSession(t *testing.T, m *session.Middleware, sid string) (*session.Session, string) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: session.SessionCookieName, Value: sid})
+
+	var sess *session.Session
+	var newSid string
+	m.ServeHTTP(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) {
+		sess = session.Get(r)
+		newSid = *session.GetSid(r)
+	})
+	require.NotNil(t, sess)
+
+	return sess, newSid
+}
+
+func TestForgedSid(t *testing.T) {
+	store := keyvalue.NewMemory()
+	m := session.NewMiddleware(testutil.TestLogger(), store)
+
+	victim := uuid.NewV4()
+	attacker := uuid.NewV4()
+
+	valid := session.GenerateSid(victim)
+	require.Nil(t, store.Set(valid, `{"ID":"`+victim.String()+`"}`))
+	sess, sid := serveSession(t, m, valid)
+	require.True(t, sess.LoggedInAs(victim))
+	require.Equal(t, valid, sid)
+
+	forged := session.GenerateSid(victim)
+	require.Nil(t, store.Set(forged, `{"ID":"`+attacker.String()+`"}`))
+	sess, sid = serveSession(t, m, forged)
+	require.False(t, sess.LoggedIn())
+	require.NotEqual(t, forged, sid)
+	require.True(t, uuid.Equal(uuid.Nil, session.SidAccount(sid)))
+
+	missing := session.GenerateSid(victim)
+	sess, sid = serveSession(t, m, missing)
+	require.False(t, sess.LoggedIn())
+	require.True(t, uuid.Equal(uuid.Nil, session.SidAccount(sid)))
+}
+
+func TestEncryptedSession(t *testing.T) {
+	store := keyvalue.NewMemory()
+	m := session.NewMiddleware(testutil.TestLogger(), store)
+	require.Nil(t, m.SetSecret("secret"))
+
+	id := uuid.NewV4()
+	sid := session.GenerateSid(id)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	m.ServeHTTP(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, m.RegenerateSession(w, r, id))
+		sid = *session.GetSid(r)
+	})
+
+	data, err := store.Get(sid)
+	require.Nil(t, err)
+	require.NotContains(t, data, id.String())
+
+	sess, newSid := serveSession(t, m, sid)
+	require.True(t, sess.LoggedInAs(id))
+	require.Equal(t, sid, newSid)
+
+	tampered := []byte(data)
+	tampered[len(tampered)/2] ^= 1
+	require.Nil(t, store.Set(sid, string(tampered)))
+	sess, newSid = serveSession(t, m, sid)
+	require.False(t, sess.LoggedIn())
+	require.NotEqual(t, sid, newSid)
+
+	other := session.GenerateSid(id)
+	require.Nil(t, store.Set(other, data))
+	sess, _ = serveSession(t, m, other)
+	require.False(t, sess.LoggedIn())
+
+	require.Nil(t, store.Set(sid, `{"ID":"`+id.String()+`"}`))
+	sess, _ = serveSession(t, m, sid)
+	require.False(t, sess.LoggedIn())
+
+	require.Nil(t, store.Set(sid, data))
+	require.Nil(t, m.SetSecret("other"))
+	sess, _ = serveSession(t, m, sid)
+	require.False(t, sess.LoggedIn())
+}
+
+func TestCacheGuard(t *testing.T) {
+	store := keyvalue.NewMemory()
+	m := session.NewMiddleware(testutil.TestLogger(), store)
+
+	serve := func(sid string, cacheable bool, contentType string) *httptest.ResponseRecorder {
+		n := negroni.New(m, session.CacheGuardMiddleware())
+		n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cacheable {
+				session.Cacheable(w, r, time.Minute)
+			}
+			w.Header().Set("Content-Type", contentType)
+			_, _ = w.Write([]byte("ok"))
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if sid != "" {
+			r.AddCookie(&http.Cookie{Name: session.SessionCookieName, Value: sid})
+		}
+		rr := httptest.NewRecorder()
+		n.ServeHTTP(rr, r)
+
+		return rr
+	}
+
+	id := uuid.NewV4()
+	sid := session.GenerateSid(id)
+	require.Nil(t, store.Set(sid, `{"ID":"`+id.String()+`"}`))
+
+	for _, cacheable := range []bool{false, true} {
+		rr := serve(sid, cacheable, "text/html; charset=utf-8")
+		require.Equal(t, "private, no-store", rr.Header().Get("Cache-Control"))
+		require.Equal(t, []string{"Cookie"}, rr.Header().Values("Vary"))
+		require.NotZero(t, rr.Header().Get("Set-Cookie"))
+	}
+
+	rr := serve("", false, "text/html; charset=utf-8")
+	require.Equal(t, "private, no-cache", rr.Header().Get("Cache-Control"))
+	require.Equal(t, "Cookie", rr.Header().Get("Vary"))
+
+	rr = serve("", true, "text/html; charset=utf-8")
+	require.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"))
+	require.Equal(t, "Cookie", rr.Header().Get("Vary"))
+	require.Zero(t, rr.Header().Get("Set-Cookie"))
+
+	rr = serve(sid, false, "text/css; charset=utf-8")
+	require.Zero(t, rr.Header().Get("Cache-Control"))
+	require.Zero(t, rr.Header().Get("Vary"))
+}
+
+func TestRememberCheck(t *testing.T) {
+	store := keyvalue.NewMemory()
+	m := session.NewMiddleware(testutil.TestLogger(), store)
+	id := uuid.NewV4()
+
+	remember := func() *http.Cookie {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+			m.Remember(w, r, id)
+		})
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == session.RememberCookieName {
+				return c
+			}
+		}
+		t.Fatal("missing remember cookie")
+		return nil
+	}
+	login := func(c *http.Cookie) bool {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(c)
+		var sess *session.Session
+		m.ServeHTTP(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) {
+			sess = session.Get(r)
+		})
+		return sess.LoggedInAs(id)
+	}
+
+	var checkErr error
+	active := false
+	m.RememberCheck = func(_ *http.Request, checked uuid.UUID) (bool, error) {
+		require.Equal(t, id, checked)
+		return active, checkErr
+	}
+
+	// The token survives a failed check.
+	cookie := remember()
+	checkErr = errors.New("database is down")
+	active = true
+	require.False(t, login(cookie))
+	checkErr = nil
+	require.True(t, login(cookie))
+
+	// The token of a rejected account is deleted.
+	cookie = remember()
+	active = false
+	require.False(t, login(cookie))
+	active = true
+	require.False(t, login(cookie))
+}
+
+func TestRememberConcurrentRedemption(t *testing.T) {
+	store := keyvalue.NewMemory()
+	m := session.NewMiddleware(testutil.TestLogger(), store)
+	id := uuid.NewV4()
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		m.Remember(w, r, id)
+	})
+	var cookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == session.RememberCookieName {
+			cookie = c
+		}
+	}
+	require.NotNil(t, cookie)
+
+	// Both requests load the token before any of them claims it.
+	const requests = 2
+	var arrived sync.WaitGroup
+	arrived.Add(requests)
+	m.RememberCheck = func(_ *http.Request, _ uuid.UUID) (bool, error) {
+		arrived.Done()
+		arrived.Wait()
+		return true, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan bool, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.AddCookie(cookie)
+			m.ServeHTTP(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) {
+				results <- session.Get(r).LoggedInAs(id)
+			})
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	logins := 0
+	for loggedIn := range results {
+		if loggedIn {
+			logins++
+		}
+	}
+	require.Equal(t, 1, logins)
+}
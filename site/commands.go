@@ -0,0 +1,253 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package site
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tamasd/simplesite/apps/account"
+	"github.com/tamasd/simplesite/apps/post"
+	"github.com/tamasd/simplesite/apps/staticpage"
+	"github.com/tamasd/simplesite/apps/token"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/util"
+)
+
+const (
+	generatedPasswordLength = 16
+)
+
+// DefaultAdminPermissions are the permissions of the accounts created by the
+// create-admin command, unless the admin_permissions config sets them.
+var DefaultAdminPermissions = account.Permissions{
+	post.PermissionCreatePost,
+	post.PermissionEditOwnPost,
+	post.PermissionEditAnyPost,
+	post.PermissionModerateComments,
+	post.PermissionManageTrash,
+	staticpage.PermissionEditStaticPages,
+}
+
+// CommandContext holds the resources that are available for a command.
+type CommandContext struct {
+	Site   *Site
+	Logger logrus.FieldLogger
+	DB     database.DB
+	// Out is where the command prints its results.
+	Out io.Writer
+}
+
+// Command is a maintenance command that runs against the configured storage
+// without starting the server.
+type Command struct {
+	Args        string
+	Description string
+	// MinArgs is the minimum number of the arguments of the command.
+	MinArgs int
+	// Migrates tells RunCommand that the command sets up the database
+	// schema itself, so it is run even if the schema differs from the
+	// entities.
+	Migrates bool
+	Run      func(ctx *CommandContext, args []string) error
+}
+
+// Commands are the maintenance commands of the site, by their names.
+var Commands = map[string]*Command{
+	"migrate": {
+		Description: "Creates the missing database tables, migrates the existing ones, and reports the tables that still differ from the entities.",
+		Migrates:    true,
+		Run:         migrateCommand,
+	},
+	"create-admin": {
+		Args:        "<username> <email>",
+		Description: "Creates an active account with the admin permissions, and prints its generated password. Refuses to run if an admin already exists.",
+		MinArgs:     2,
+		Run:         createAdminCommand,
+	},
+	"grant-permission": {
+		Args:        "<username> <permission>...",
+		Description: "Grants permissions to an account.",
+		MinArgs:     2,
+		Run:         grantPermissionCommand,
+	},
+	"send-test-email": {
+		Args:        "<address>",
+		Description: "Sends a test email with the configured SMTP server.",
+		MinArgs:     1,
+		Run:         sendTestEmailCommand,
+	},
+	"cleanup-tokens": {
+		Description: "Removes the expired tokens.",
+		Run:         cleanupTokensCommand,
+	},
+}
+
+// UnknownCommandError is returned by RunCommand when the command does not
+// exist.
+type UnknownCommandError string
+
+func (e UnknownCommandError) Error() string {
+	return "unknown command: " + string(e)
+}
+
+// RunCommand runs a maintenance command.
+//
+// The first argument is the name of the command, the rest are passed to the
+// command. The help command prints the list of the commands to out.
+func (s *Site) RunCommand(logger logrus.FieldLogger, out io.Writer, args []string) error {
+	if len(args) == 0 || args[0] == "help" {
+		return PrintCommands(out)
+	}
+
+	cmd, ok := Commands[args[0]]
+	if !ok {
+		return UnknownCommandError(args[0])
+	}
+	if len(args)-1 < cmd.MinArgs {
+		return errors.New("usage: " + args[0] + " " + cmd.Args)
+	}
+
+	var conn database.DB
+	var err error
+	if cmd.Migrates {
+		conn, err = s.connect(logger)
+	} else {
+		conn, err = s.database(logger)
+	}
+	if err != nil {
+		return err
+	}
+
+	return cmd.Run(&CommandContext{
+		Site:   s,
+		Logger: logger,
+		DB:     conn,
+		Out:    out,
+	}, args[1:])
+}
+
+// PrintCommands prints the usage of the commands.
+func PrintCommands(out io.Writer) error {
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmd := Commands[name]
+		usage := strings.TrimSpace(name + " " + cmd.Args)
+		if _, err := fmt.Fprintf(out, "%s\n\t%s\n", usage, cmd.Description); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateCommand(ctx *CommandContext, _ []string) error {
+	if err := ensureEntities(ctx.Logger, ctx.DB); err != nil {
+		return err
+	}
+
+	drifts, err := schemaDrifts(ctx.DB)
+	if err != nil {
+		return err
+	}
+	for _, drift := range drifts {
+		if _, err = fmt.Fprintln(ctx.Out, drift.String()); err != nil {
+			return err
+		}
+	}
+	if len(drifts) > 0 {
+		return errors.New("the database schema differs from the entities")
+	}
+
+	_, err = fmt.Fprintln(ctx.Out, "The database schema is up to date.")
+	return err
+}
+
+func createAdminCommand(ctx *CommandContext, args []string) error {
+	username, email := args[0], args[1]
+	password := util.RandomHexString(generatedPasswordLength)
+
+	if _, err := account.CreateAdmin(ctx.DB, username, email, password, ctx.Site.adminPermissions()); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(ctx.Out, "Created account %s with password: %s\n", username, password)
+	return err
+}
+
+// adminPermissions returns the permissions of the admin accounts.
+func (s *Site) adminPermissions() account.Permissions {
+	if perms := strings.Fields(s.config.Get("admin_permissions")); len(perms) > 0 {
+		return perms
+	}
+
+	return DefaultAdminPermissions
+}
+
+func grantPermissionCommand(ctx *CommandContext, args []string) error {
+	a, err := account.LoadAccountByUsername(ctx.DB, args[0])
+	if err != nil {
+		return errors.New("failed to load account " + args[0] + ": " + err.Error())
+	}
+
+	for _, perm := range args[1:] {
+		if err = account.GrantPermission(ctx.DB, a.ID, perm); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(ctx.Out, "Granted %s to %s.\n", strings.Join(args[1:], ", "), a.Username)
+	return err
+}
+
+func sendTestEmailCommand(ctx *CommandContext, args []string) error {
+	m, err := ctx.Site.smtpMailer()
+	if err != nil {
+		return err
+	}
+
+	msg := "From: " + m.From() + "\r\n" +
+		"To: " + args[0] + "\r\n" +
+		"Subject: Test email\r\n" +
+		"\r\n" +
+		"This is a test email, sent at " + time.Now().Format(time.RFC1123Z) + ".\r\n"
+	if err = m.Send([]string{args[0]}, []byte(msg)); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(ctx.Out, "Sent a test email to "+args[0]+".")
+	return err
+}
+
+func cleanupTokensCommand(ctx *CommandContext, _ []string) error {
+	if err := token.NewToken(ctx.Logger, ctx.DB).RemoveExpired(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintln(ctx.Out, "Removed the expired tokens.")
+	return err
+}
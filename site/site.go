@@ -17,9 +17,14 @@
 package site
 
 import (
+	"crypto/tls"
+	"errors"
+	"net"
 	"net/smtp"
 	"os"
+	"path"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,11 +35,14 @@ import (
 	"github.com/tamasd/simplesite/apps/file"
 	"github.com/tamasd/simplesite/apps/frontpage"
 	"github.com/tamasd/simplesite/apps/post"
+	"github.com/tamasd/simplesite/apps/staticpage"
 	"github.com/tamasd/simplesite/apps/token"
 	"github.com/tamasd/simplesite/config"
 	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/form"
 	"github.com/tamasd/simplesite/keyvalue"
 	"github.com/tamasd/simplesite/mailer"
+	"github.com/tamasd/simplesite/page"
 	"github.com/tamasd/simplesite/respond"
 	"github.com/tamasd/simplesite/server"
 	"github.com/tamasd/simplesite/session"
@@ -46,9 +54,44 @@ var (
 	loggerExitFunc = os.Exit
 )
 
+// DefaultPasswordMinLength is the default minimum length of the passwords.
+const DefaultPasswordMinLength = 8
+
+// RequiredConfigKeys are the configuration keys that must be set.
+var RequiredConfigKeys = []string{
+	"baseurl",
+	"db",
+	"redis",
+}
+
+// MissingConfigKeysError is returned when required configuration keys are not
+// set.
+type MissingConfigKeysError []string
+
+func (e MissingConfigKeysError) Error() string {
+	return "missing required configuration: " + strings.Join(e, ", ")
+}
+
+// ValidateConfig checks that all required configuration keys are set.
+func ValidateConfig(cfg config.Storage) error {
+	var missing MissingConfigKeysError
+	for _, key := range RequiredConfigKeys {
+		if strings.TrimSpace(cfg.Get(key)) == "" {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) > 0 {
+		return missing
+	}
+
+	return nil
+}
+
 // Site is the main package of this website.
 type Site struct {
-	config config.Storage
+	config       config.Storage
+	strictSchema bool
 }
 
 // NewSite creates a new site from the given configuration.
@@ -58,58 +101,203 @@ func NewSite(config config.Storage) *Site {
 	}
 }
 
+// SetStrictSchema makes the startup fail when the database schema differs
+// from the schema of the entities. Otherwise the differences are only logged.
+func (s *Site) SetStrictSchema(strict bool) {
+	s.strictSchema = strict
+}
+
 // Logger creates the configured logger for the site.
 func (s *Site) Logger() logrus.FieldLogger {
 	logger := logrus.New()
 	logger.Out = loggerOut
 	logger.ExitFunc = loggerExitFunc
 
-	if level := s.config.Get("log_level"); level != "" {
-		lvl, err := logrus.ParseLevel(level)
+	if err := setLogLevel(logger, s.config.Get("log_level")); err != nil {
+		logger.WithError(err).Fatalln("failed to parse log level")
+		return nil
+	}
+	s.onReload(func() {
+		if err := setLogLevel(logger, s.config.Get("log_level")); err != nil {
+			logger.WithError(err).Errorln("failed to parse reloaded log level")
+		}
+	})
+
+	switch output := s.config.Get("log_output"); output {
+	case "", "stdout":
+	case "stderr":
+		logger.Out = os.Stderr
+	default:
+		// The file is opened in append mode, so it works with log rotation
+		// tools that truncate the file.
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
 		if err != nil {
-			logger.WithError(err).Fatalln("failed to parse log level")
+			logger.WithError(err).Fatalln("failed to open log file")
 			return nil
 		}
-		logger.SetLevel(lvl)
+		logger.Out = f
 	}
 
+	timestampFormat := s.config.Get("log_timestamp_format")
 	switch s.config.Get("log_format") {
 	case "json":
-		logger.Formatter = &logrus.JSONFormatter{}
+		fieldMap, err := parseLogFieldMap(s.config.Get("log_json_fields"))
+		if err != nil {
+			logger.WithError(err).Fatalln("failed to parse log json fields")
+			return nil
+		}
+		logger.Formatter = &logrus.JSONFormatter{
+			TimestampFormat: timestampFormat,
+			FieldMap:        fieldMap,
+		}
+	default:
+		logger.Formatter = &logrus.TextFormatter{
+			TimestampFormat: timestampFormat,
+			FullTimestamp:   timestampFormat != "",
+			DisableColors:   s.config.Get("log_disable_colors") == "true",
+		}
 	}
 
 	hostname, _ := os.Hostname()
 	return logger.WithField("hostname", hostname)
 }
 
+// setLogLevel sets the level of the logger. An empty level means info.
+func setLogLevel(logger *logrus.Logger, level string) error {
+	lvl := logrus.InfoLevel
+	if level != "" {
+		var err error
+		if lvl, err = logrus.ParseLevel(level); err != nil {
+			return err
+		}
+	}
+	logger.SetLevel(lvl)
+
+	return nil
+}
+
+// onReload registers a function that runs when the configuration is reloaded,
+// if the configuration storage supports reloading.
+func (s *Site) onReload(f func()) {
+	if rs, ok := s.config.(config.ReloadingStorage); ok {
+		rs.OnReload(f)
+	}
+}
+
+// parseLogFieldMap parses the renamed fields of the JSON log lines.
+//
+// The format is a space separated list of name=newname pairs, where name is
+// time, msg, level or func.
+func parseLogFieldMap(fields string) (logrus.FieldMap, error) {
+	if fields == "" {
+		return nil, nil
+	}
+
+	fieldMap := logrus.FieldMap{}
+	for _, pair := range strings.Fields(fields) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.New("invalid field mapping: " + pair)
+		}
+
+		switch parts[0] {
+		case "time":
+			fieldMap[logrus.FieldKeyTime] = parts[1]
+		case "msg":
+			fieldMap[logrus.FieldKeyMsg] = parts[1]
+		case "level":
+			fieldMap[logrus.FieldKeyLevel] = parts[1]
+		case "func":
+			fieldMap[logrus.FieldKeyFunc] = parts[1]
+		default:
+			return nil, errors.New("unknown log field: " + parts[0])
+		}
+	}
+
+	return fieldMap, nil
+}
+
 func (s *Site) server(logger logrus.FieldLogger) *server.Server {
 	host := os.Getenv("HOST")
 	port := os.Getenv("PORT")
 
-	srv := server.New(logger, host+":"+port, respond.NewPanicFormatter(logger))
+	panicFormatter := respond.NewPanicFormatter(logger)
+	panicFormatter.Debug = s.config.Get("debug") == "true"
+
+	srv := server.New(logger, host+":"+port, panicFormatter)
+	server.SetDefaultLogger(logger)
 	srv.HTTPS.LetsEncrypt.Directory = s.config.Get("letsencrypt")
 	srv.HTTPS.LetsEncrypt.WhiteList = strings.Fields(s.config.Get("letsencrypt_whitelist"))
 	srv.HTTPS.Certificate.Certfile = s.config.Get("certfile")
 	srv.HTTPS.Certificate.Keyfile = s.config.Get("keyfile")
+	srv.AccessLog.ExcludePrefixes = strings.Fields(s.config.Get("access_log_exclude"))
+	srv.Router().SetOptions(server.RouterOptions{
+		RedirectTrailingSlash:  s.config.Get("router_redirect_trailing_slash") != "false",
+		RedirectFixedPath:      s.config.Get("router_redirect_fixed_path") != "false",
+		HandleMethodNotAllowed: s.config.Get("router_method_not_allowed") != "false",
+		HandleOPTIONS:          s.config.Get("router_handle_options") != "false",
+	})
+	if rate := s.config.Get("access_log_sample_rate"); rate != "" {
+		var err error
+		if srv.AccessLog.SampleRate, err = strconv.ParseFloat(rate, 64); err != nil {
+			logger.WithError(err).Fatalln("failed to parse access log sample rate")
+			return nil
+		}
+	}
 
 	return srv
 }
 
-func (s *Site) redisClient() *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr: s.config.Get("redis"),
-	})
+// RedisOptions creates the redis connection options from the configuration.
+//
+// Only the address is required. The password, the database number and TLS
+// are optional.
+func RedisOptions(cfg config.Storage) (*redis.Options, error) {
+	opts := &redis.Options{
+		Addr:     cfg.Get("redis"),
+		Password: cfg.Get("redis_password"),
+	}
+
+	if db := cfg.Get("redis_db"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid redis database number: " + db)
+		}
+		opts.DB = n
+	}
+
+	switch tlsEnabled := cfg.Get("redis_tls"); tlsEnabled {
+	case "", "false":
+	case "true":
+		host, _, err := net.SplitHostPort(opts.Addr)
+		if err != nil {
+			host = opts.Addr
+		}
+		opts.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: host,
+		}
+	default:
+		return nil, errors.New("invalid redis tls value: " + tlsEnabled)
+	}
+
+	return opts, nil
 }
 
-func (s *Site) kvstore() keyvalue.Store {
+func (s *Site) kvstore() (keyvalue.Store, error) {
+	opts, err := RedisOptions(s.config)
+	if err != nil {
+		return nil, err
+	}
+
 	prefix := s.config.Get("redis_prefix")
-	var store keyvalue.Store = keyvalue.NewRedis(s.redisClient())
+	var store keyvalue.Store = keyvalue.NewRedis(redis.NewClient(opts))
 
 	if prefix != "" {
 		store = keyvalue.NewPrefixed(store, prefix)
 	}
 
-	return store
+	return store, nil
 }
 
 func (s *Site) smtpMailer() (mailer.Mailer, error) {
@@ -134,15 +322,273 @@ func (s *Site) smtpMailer() (mailer.Mailer, error) {
 	), nil
 }
 
+func (s *Site) captcha(csp *respond.ContentSecurityPolicy) (form.Captcha, error) {
+	secret := s.config.Get("captcha_secret")
+	if secret == "" {
+		return nil, nil
+	}
+
+	var c *form.SiteVerifyCaptcha
+	sitekey := s.config.Get("captcha_sitekey")
+	switch provider := s.config.Get("captcha_provider"); provider {
+	case "", "hcaptcha":
+		c = form.NewHCaptcha(sitekey, secret)
+		csp.Allow("frame-src", "https://hcaptcha.com", "https://*.hcaptcha.com")
+		csp.Allow("style-src", "https://hcaptcha.com", "https://*.hcaptcha.com")
+		csp.Allow("connect-src", "https://hcaptcha.com", "https://*.hcaptcha.com")
+	case "recaptcha":
+		c = form.NewReCaptcha(sitekey, secret)
+		csp.Allow("frame-src", "https://www.google.com/recaptcha/")
+	default:
+		return nil, errors.New("unknown captcha provider: " + provider)
+	}
+
+	if verifyURL := s.config.Get("captcha_verify_url"); verifyURL != "" {
+		c.VerifyURL = verifyURL
+	}
+	csp.Allow("script-src", c.ScriptOrigin())
+
+	return c, nil
+}
+
+func (s *Site) configureCSP(csp *respond.ContentSecurityPolicy) {
+	for _, directive := range []string{"script-src", "style-src", "img-src", "connect-src", "font-src", "frame-src"} {
+		if sources := s.config.Get("csp_" + strings.Replace(directive, "-", "_", -1)); sources != "" {
+			csp.Allow(directive, strings.Fields(sources)...)
+		}
+	}
+}
+
+// oauthProviders creates the external identity providers.
+//
+// The provider names are listed in the oauth_providers config value, and each
+// provider is configured with the oauth_<name>_* values.
+func (s *Site) oauthProviders() map[string]account.OAuthProvider {
+	providers := make(map[string]account.OAuthProvider)
+	for _, name := range strings.Fields(s.config.Get("oauth_providers")) {
+		prefix := "oauth_" + name + "_"
+		p := account.NewOpenIDConnectProvider(
+			s.config.Get(prefix+"client_id"),
+			s.config.Get(prefix+"client_secret"),
+			s.config.Get(prefix+"auth_url"),
+			s.config.Get(prefix+"token_url"),
+			s.config.Get(prefix+"userinfo_url"),
+		)
+		if scopes := s.config.Get(prefix + "scopes"); scopes != "" {
+			p.Scopes = strings.Fields(scopes)
+		}
+		providers[name] = p
+	}
+
+	return providers
+}
+
+// MenuItems reads the custom items of the main navigation menu from the
+// config.
+//
+// The menu config lists the names of the items, and each item is configured
+// with the menu_<name>_title, menu_<name>_url and menu_<name>_permission
+// values.
+func MenuItems(cfg config.Storage) []page.MenuItem {
+	var items []page.MenuItem
+	for _, name := range strings.Fields(cfg.Get("menu")) {
+		prefix := "menu_" + name + "_"
+		title := cfg.Get(prefix + "title")
+		if title == "" {
+			title = name
+		}
+		items = append(items, page.MenuItem{
+			Name:       name,
+			Title:      title,
+			URL:        cfg.Get(prefix + "url"),
+			Permission: cfg.Get(prefix + "permission"),
+		})
+	}
+
+	return items
+}
+
+// cors returns the CORS middleware of the JSON API, or nil if no origins are
+// allowed.
+func (s *Site) cors() (*server.CORS, error) {
+	origins := strings.Fields(s.config.Get("cors_allowed_origins"))
+	if len(origins) == 0 {
+		return nil, nil
+	}
+
+	cors := server.NewCORS("/api/", origins...)
+	if methods := strings.Fields(s.config.Get("cors_allowed_methods")); len(methods) > 0 {
+		cors.AllowedMethods = methods
+	}
+	if headers := strings.Fields(s.config.Get("cors_allowed_headers")); len(headers) > 0 {
+		cors.AllowedHeaders = headers
+	}
+	switch credentials := s.config.Get("cors_allow_credentials"); credentials {
+	case "", "false":
+	case "true":
+		cors.AllowCredentials = true
+	default:
+		return nil, errors.New("invalid cors allow credentials value: " + credentials)
+	}
+
+	if err := cors.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cors, nil
+}
+
+// duration reads a duration from the config, with a default value if it is
+// not set.
+func (s *Site) duration(key string, def time.Duration) (time.Duration, error) {
+	value := s.config.Get(key)
+	if value == "" {
+		return def, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// wellKnownRoutes returns the routes for robots.txt and security.txt.
+//
+// security.txt is only served when a contact is configured.
+func (s *Site) wellKnownRoutes(baseurl *server.BaseURL) ([]server.Route, error) {
+	sitemap := ""
+	if sitemapPath := s.config.Get("sitemap_path"); sitemapPath != "" {
+		sitemap = baseurl.URL(sitemapPath, nil)
+	}
+	routes := []server.Route{file.RobotsTxt(path.Join("misc", "robots.txt"), sitemap)}
+
+	contact := s.config.Get("security_contact")
+	if contact == "" {
+		return routes, nil
+	}
+
+	expires := time.Now().AddDate(1, 0, 0).Truncate(24 * time.Hour)
+	if value := s.config.Get("security_expires"); value != "" {
+		var err error
+		if expires, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, errors.New("invalid security.txt expiry: " + value)
+		}
+	}
+
+	return append(routes, file.SecurityTxtPage(file.SecurityTxt{
+		Contact:            file.SplitContacts(contact),
+		Expires:            expires,
+		Policy:             s.config.Get("security_policy"),
+		PreferredLanguages: s.config.Get("security_preferred_languages"),
+		Canonical:          baseurl.Path("/.well-known/security.txt"),
+	})), nil
+}
+
+func (s *Site) integer(key string, def int) (int, error) {
+	value := s.config.Get(key)
+	if value == "" {
+		return def, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+// passwordValidator creates the password validator of the registration form.
+//
+// The length and complexity rules are checked before the breach check, so
+// the weak passwords are not sent to the breach API.
+func (s *Site) passwordValidator(logger logrus.FieldLogger, compromised account.PasswordValidator) (account.PasswordValidator, error) {
+	minLength, err := s.integer("password_min_length", DefaultPasswordMinLength)
+	if err != nil {
+		return nil, errors.New("invalid password minimum length: " + s.config.Get("password_min_length"))
+	}
+
+	classes, err := s.integer("password_min_character_classes", 0)
+	if err != nil {
+		return nil, errors.New("invalid password character classes: " + s.config.Get("password_min_character_classes"))
+	}
+
+	var validators []account.PasswordValidator
+	if minLength > 0 {
+		validators = append(validators, account.MinPasswordLength(minLength))
+	}
+	if classes > 0 {
+		validators = append(validators, account.MinPasswordCharacterClasses(classes))
+	}
+
+	switch failOpen := s.config.Get("hibp_fail_open"); failOpen {
+	case "true":
+		compromised = account.FailOpen(compromised, logger)
+	case "", "false":
+	default:
+		return nil, errors.New("invalid hibp fail open value: " + failOpen)
+	}
+
+	return account.ChainValidator(append(validators, compromised)...), nil
+}
+
+// emailValidator creates the email validator of the registration form.
+//
+// The MX check is disabled by default.
+func (s *Site) emailValidator() (account.EmailValidator, error) {
+	if s.config.Get("email_mx_check") != "true" {
+		return nil, nil
+	}
+
+	timeout, err := s.duration("email_mx_timeout", account.DefaultMXTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	v := account.NewMXValidator(nil)
+	v.Timeout = timeout
+
+	return v, nil
+}
+
 func (s *Site) baseURL() (*server.BaseURL, error) {
 	return server.ParseBaseURL(s.config.Get("baseurl"))
 }
 
 // CreateServer creates the server instance with all middlewares and pages.
 func (s *Site) CreateServer(logger logrus.FieldLogger, mailerFactory func() (mailer.Mailer, error)) *server.Server {
-	kvstore := s.kvstore()
+	if ls, ok := s.config.(config.LoggerStorage); ok {
+		ls.LogAll(logger)
+	}
+
+	if err := ValidateConfig(s.config); err != nil {
+		logger.WithError(err).Fatalln("invalid configuration")
+		return nil
+	}
+
+	if err := page.LoadTemplates(s.config.Get("template_dir"), s.config.Get("dev_mode") == "true"); err != nil {
+		logger.WithError(err).Fatalln("failed to load templates")
+		return nil
+	}
+
+	kvstore, err := s.kvstore()
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to configure redis")
+		return nil
+	}
+	startupWait, err := s.duration("startup_wait", 0)
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to parse startup wait")
+		return nil
+	}
+	if err = server.WaitFor(logger, "redis", func() error { return keyvalue.Ping(kvstore) }, startupWait); err != nil {
+		logger.WithError(err).Fatalln("redis is unavailable")
+		return nil
+	}
 	formTokenStore := keyvalue.NewPrefixed(kvstore, "form:")
 	pwned := hibp.NewClient(time.Hour)
+	passwordValidator, err := s.passwordValidator(logger, account.PasswordValidatorFunc(pwned.Pwned.Compromised))
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to configure password validation")
+		return nil
+	}
+	emailValidator, err := s.emailValidator()
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to configure email validation")
+		return nil
+	}
 
 	mail, err := mailerFactory()
 	if err != nil {
@@ -156,41 +602,167 @@ func (s *Site) CreateServer(logger logrus.FieldLogger, mailerFactory func() (mai
 		return nil
 	}
 
+	csp := respond.NewContentSecurityPolicy()
+	s.configureCSP(csp)
+	page.SetMenu(MenuItems(s.config)...)
+	s.onReload(func() {
+		page.SetMenu(MenuItems(s.config)...)
+	})
+	captcha, err := s.captcha(csp)
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to initialize captcha")
+		return nil
+	}
+
 	srv := s.server(logger)
 
-	conn, err := database.Connect(s.config.Get("db"))
+	conn, err := s.database(logger)
 	if err != nil {
-		logger.WithError(err).Fatalln("failed to connect to database")
+		logger.WithError(err).Fatalln("failed to set up database")
 		return nil
 	}
 
-	for _, e := range []database.DatabaseEntity{
-		token.Token{},
-		account.Account{},
-		account.Permission{},
-		post.Post{},
-		post.PostRevision{},
-	} {
-		if err = database.Ensure(logger, conn, e); err != nil {
-			logger.
-				WithError(err).
-				WithField("entity", reflect.TypeOf(e).Name()).
-				Fatalln("failed to register entity")
-			return nil
-		}
+	if s.config.Get("db_prepared_statements") == "true" {
+		conn = database.NewPreparedDB(conn)
 	}
 
+	srv.Probe("/livez", server.LivenessHandler())
+	srv.Probe("/readyz", server.ReadinessHandler(map[string]server.HealthCheck{
+		"database": pingDatabase(conn),
+		"redis": func() error {
+			return keyvalue.Ping(kvstore)
+		},
+	}))
+
+	schedulerInterval, err := s.duration("post_scheduler_interval", time.Minute)
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to parse post scheduler interval")
+		return nil
+	}
+	srv.Every(schedulerInterval, "post-scheduler", func() error {
+		_, err := post.PublishScheduled(conn)
+		return err
+	})
+
+	page.SetBasePath(s.config.Get("base_path"))
+
 	sess := session.NewMiddleware(logger, keyvalue.NewPrefixed(kvstore, "session:"))
+	sess.CookiePath = page.URL("/")
+	if cookieName := s.config.Get("session_cookie_name"); cookieName != "" {
+		sess.CookieName = cookieName
+	}
+	switch secure := s.config.Get("secure_cookie"); secure {
+	case "":
+		sess.SecureCookie = srv.IsHTTPS()
+	case "true":
+		sess.SecureCookie = true
+	case "false":
+	default:
+		logger.WithField("secure_cookie", secure).Fatalln("invalid secure cookie value")
+		return nil
+	}
+	if sess.TTL, err = s.duration("session_ttl", 24*time.Hour); err != nil {
+		logger.WithError(err).Fatalln("failed to parse session ttl")
+		return nil
+	}
+	if sess.RememberTTL, err = s.duration("remember_ttl", session.DefaultRememberTTL); err != nil {
+		logger.WithError(err).Fatalln("failed to parse remember ttl")
+		return nil
+	}
+	sess.RememberCheck = account.RememberCheck(database.NewLoggerDB(logger, conn))
+	if err = sess.SetSecret(s.config.Get("session_secret")); err != nil {
+		logger.WithError(err).Fatalln("failed to set up session encryption")
+		return nil
+	}
 	dbmw := database.NewMiddleware(database.NewLoggerDB(logger, conn))
 
-	srv.Use(sess, dbmw, account.PreloadPermissions())
+	cors, err := s.cors()
+	if err != nil {
+		logger.WithError(err).Fatalln("invalid CORS configuration")
+		return nil
+	}
+	if cors != nil {
+		srv.Use(cors)
+	}
+	requestTimeout, err := s.duration("request_timeout", 0)
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to parse request timeout")
+		return nil
+	}
+	if requestTimeout > 0 {
+		srv.Use(server.Timeout(requestTimeout))
+	}
+	srv.Use(server.BaseURLMiddleware(baseurl), respond.CSPMiddleware(csp), sess, session.CacheGuardMiddleware(), session.LoggerFieldsMiddleware(), dbmw, account.PreloadPermissions())
+
+	if s.config.Get("asset_precompress") == "true" {
+		minSize, err := s.integer("asset_precompress_min_size", file.DefaultCompressMinSize)
+		if err != nil {
+			logger.WithError(err).Fatalln("failed to parse asset compression minimum size")
+			return nil
+		}
+		if err = file.CompressAssets(logger, file.AssetsPath, int64(minSize)); err != nil {
+			logger.WithError(err).Errorln("failed to compress assets")
+		}
+	}
+
+	hashes, err := file.HashAssets(file.AssetsPath)
+	if err != nil {
+		logger.WithError(err).Errorln("failed to hash assets")
+		hashes = nil
+	}
+	page.SetAssetHashes(hashes)
+	page.SetAssetIntegrity(s.config.Get("asset_integrity") == "true")
+	token.SetStrictCategories(s.config.Get("token_strict_categories") == "true")
+
+	frontPagePosts, err := s.integer("frontpage_posts", frontpage.DefaultPostCount)
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to parse front page post count")
+		return nil
+	}
+
+	postPageSize, err := s.integer("post_page_size", post.PageSize)
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to parse post page size")
+		return nil
+	}
+
+	revisionsPageSize, err := s.integer("post_revisions_page_size", post.RevisionsPageSize)
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to parse post revisions page size")
+		return nil
+	}
+
+	verification, err := account.ParseVerificationMode(s.config.Get("registration_verification"))
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to parse registration verification mode")
+		return nil
+	}
+
+	wellKnown, err := s.wellKnownRoutes(baseurl)
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to configure robots.txt and security.txt")
+		return nil
+	}
+
+	filter := util.NewFilter(logger).Filter
+
+	routes := []server.Route{file.AssetDir()}
+	routes = append(routes, file.MiscDir(logger)...)
+	routes = append(routes, wellKnown...)
+	if dir := s.config.Get("files_dir"); dir != "" {
+		routes = append(routes, file.ThumbnailPage(file.NewDirStore(dir), keyvalue.NewPrefixed(kvstore, "thumbnail:")))
+	}
+	routes = append(routes, frontpage.Page(frontPagePosts, s.config.Get("frontpage_welcome")))
+	routes = append(routes, account.Pages(formTokenStore, sess, passwordValidator, emailValidator, mail, captcha, verification)...)
+	routes = append(routes, account.OAuthPages(keyvalue.NewPrefixed(kvstore, "oauth:"), sess, baseurl, s.oauthProviders())...)
+	routes = append(routes, post.Pages(formTokenStore, keyvalue.NewPrefixed(kvstore, "post-view:"), filter, postPageSize, revisionsPageSize)...)
+	routes = append(routes, post.API(filter)...)
+	routes = append(routes, staticpage.Pages(formTokenStore, filter)...)
 
 	srv.Router().
-		Add(file.AssetDir()).
-		Add(file.MiscDir(logger)...).
-		Add(frontpage.Page()).
-		Add(account.Pages(formTokenStore, sess, account.PasswordValidatorFunc(pwned.Pwned.Compromised), mail, baseurl)...).
-		Add(post.Pages(formTokenStore, util.NewFilter(logger).Filter)...)
+		SetNotFound(respond.NotFoundHandler()).
+		SetMethodNotAllowed(respond.MethodNotAllowedHandler()).
+		Add(server.MountRoutes(page.BasePath(), routes)...)
 
 	logger.Infoln("Starting server")
 
@@ -204,6 +776,111 @@ func (s *Site) CreateServer(logger logrus.FieldLogger, mailerFactory func() (mai
 	return srv
 }
 
+// entities lists the database entities of the site.
+func entities() []database.DatabaseEntity {
+	return []database.DatabaseEntity{
+		token.Token{},
+		account.Account{},
+		account.AccountIdentity{},
+		account.APIToken{},
+		account.Permission{},
+		post.Post{},
+		post.PostRevision{},
+		post.PostTag{},
+		post.Comment{},
+		staticpage.StaticPage{},
+	}
+}
+
+// pingDatabase checks if the database is reachable.
+func pingDatabase(conn database.DB) server.HealthCheck {
+	return func() error {
+		if p, ok := conn.(database.Pinger); ok {
+			return p.Ping()
+		}
+
+		var one int
+		return conn.QueryRow("SELECT 1").Scan(&one)
+	}
+}
+
+// database connects to the database, and creates the tables of the entities
+// that don't exist yet. The existing tables are checked for schema drift.
+func (s *Site) database(logger logrus.FieldLogger) (database.DB, error) {
+	conn, err := s.connect(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ensureEntities(logger, conn); err != nil {
+		return nil, err
+	}
+
+	drifts, err := schemaDrifts(conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, drift := range drifts {
+		logger.WithFields(logrus.Fields{
+			"table":   drift.Table,
+			"missing": drift.Missing,
+			"extra":   drift.Extra,
+		}).Warnln("database schema differs from the entity")
+	}
+	if s.strictSchema && len(drifts) > 0 {
+		return nil, errors.New("database schema differs from the entities: " + drifts[0].String())
+	}
+
+	return conn, nil
+}
+
+// connect connects to the database, and waits until it is available.
+func (s *Site) connect(logger logrus.FieldLogger) (database.DB, error) {
+	conn, err := database.Connect(s.config.Get("db"))
+	if err != nil {
+		return nil, errors.New("failed to connect to database: " + err.Error())
+	}
+
+	startupWait, err := s.duration("startup_wait", 0)
+	if err != nil {
+		return nil, errors.New("invalid startup wait: " + s.config.Get("startup_wait"))
+	}
+	if err = server.WaitFor(logger, "database", pingDatabase(conn), startupWait); err != nil {
+		return nil, errors.New("database is unavailable: " + err.Error())
+	}
+
+	return conn, nil
+}
+
+// ensureEntities creates the missing tables of the entities, and migrates the
+// existing ones.
+func ensureEntities(logger logrus.FieldLogger, conn database.DB) error {
+	for _, e := range entities() {
+		if err := database.Ensure(logger, conn, e); err != nil {
+			return errors.New("failed to register entity " + reflect.TypeOf(e).Name() + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// schemaDrifts returns the tables that differ from the schema of their
+// entities.
+func schemaDrifts(conn database.DB) ([]database.SchemaDrift, error) {
+	var drifts []database.SchemaDrift
+	for _, e := range entities() {
+		drift, err := database.CheckSchema(conn, e)
+		if err != nil {
+			return nil, errors.New("failed to check schema of entity " + reflect.TypeOf(e).Name() + ": " + err.Error())
+		}
+		if drift.Drifted() {
+			drifts = append(drifts, drift)
+		}
+	}
+
+	return drifts, nil
+}
+
 // Start starts the site.
 func (s *Site) Start() {
 	logger := s.Logger()
@@ -0,0 +1,196 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package site_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/config"
+	"github.com/tamasd/simplesite/database"
+	"github.com/tamasd/simplesite/page"
+	"github.com/tamasd/simplesite/site"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+func TestRedisOptions(t *testing.T) {
+	opts, err := site.RedisOptions(config.MapStorage{
+		"redis": "localhost:6379",
+	})
+	require.Nil(t, err)
+	require.Equal(t, "localhost:6379", opts.Addr)
+	require.Equal(t, "", opts.Password)
+	require.Equal(t, 0, opts.DB)
+	require.Nil(t, opts.TLSConfig)
+
+	opts, err = site.RedisOptions(config.MapStorage{
+		"redis":          "redis.example.com:6380",
+		"redis_password": "secret",
+		"redis_db":       "3",
+		"redis_tls":      "true",
+	})
+	require.Nil(t, err)
+	require.Equal(t, "secret", opts.Password)
+	require.Equal(t, 3, opts.DB)
+	require.NotNil(t, opts.TLSConfig)
+	require.Equal(t, "redis.example.com", opts.TLSConfig.ServerName)
+
+	for _, cfg := range []config.MapStorage{
+		{"redis_db": "foo"},
+		{"redis_db": "-1"},
+		{"redis_tls": "yes"},
+	} {
+		_, err = site.RedisOptions(cfg)
+		require.NotNil(t, err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := config.MapStorage{
+		"baseurl": "http://example.com",
+		"db":      "dbname=simplesite",
+		"redis":   "localhost:6379",
+	}
+	require.Nil(t, site.ValidateConfig(cfg))
+
+	delete(cfg, "baseurl")
+	cfg["redis"] = " "
+	err := site.ValidateConfig(cfg)
+	require.Equal(t, site.MissingConfigKeysError{"baseurl", "redis"}, err)
+	require.Equal(t, "missing required configuration: baseurl, redis", err.Error())
+}
+
+func TestLoggerJSONFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "site.log")
+	logger := site.NewSite(config.MapStorage{
+		"log_output":           path,
+		"log_format":           "json",
+		"log_json_fields":      "time=@timestamp msg=message",
+		"log_timestamp_format": time.RFC3339Nano,
+	}).Logger()
+
+	logger.WithField("foo", "bar").Infoln("first")
+	logger.Warnln("second")
+
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	line := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &line))
+	require.Equal(t, "first", line["message"])
+	require.Equal(t, "bar", line["foo"])
+	require.Equal(t, "info", line["level"])
+	_, err = time.Parse(time.RFC3339Nano, line["@timestamp"].(string))
+	require.Nil(t, err)
+}
+
+func TestMenuItems(t *testing.T) {
+	require.Nil(t, site.MenuItems(config.MapStorage{}))
+
+	items := site.MenuItems(config.MapStorage{
+		"menu":                  "about pages",
+		"menu_about_title":      "About us",
+		"menu_about_url":        "/page/about",
+		"menu_pages_url":        "/pages",
+		"menu_pages_permission": "edit-static-pages",
+	})
+	require.Equal(t, []page.MenuItem{
+		{Name: "about", Title: "About us", URL: "/page/about"},
+		{Name: "pages", Title: "pages", URL: "/pages", Permission: "edit-static-pages"},
+	}, items)
+}
+
+func TestLoggerReload(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "site.log")
+	cfgPath := filepath.Join(dir, "config.env")
+	writeConfig := func(level string) {
+		require.Nil(t, ioutil.WriteFile(cfgPath, []byte("LOG_OUTPUT="+logPath+"\nLOG_LEVEL="+level+"\n"), 0600))
+	}
+
+	writeConfig("info")
+	rs, err := config.NewReloadableStorage(cfgPath)
+	require.Nil(t, err)
+	logger := site.NewSite(rs).Logger()
+	logger.Debugln("hidden")
+
+	writeConfig("debug")
+	require.Nil(t, rs.Reload())
+	logger.Debugln("visible")
+
+	writeConfig("nonsense")
+	require.Nil(t, rs.Reload())
+	logger.Debugln("still visible")
+
+	data, err := ioutil.ReadFile(logPath)
+	require.Nil(t, err)
+	require.NotContains(t, string(data), "hidden")
+	require.Contains(t, string(data), "msg=visible")
+	require.Contains(t, string(data), "failed to parse reloaded log level")
+	require.Contains(t, string(data), `msg="still visible"`)
+}
+
+func TestMigrateCommand(t *testing.T) {
+	dburl := os.Getenv("TEST_DB")
+	if dburl == "" {
+		t.Skip("TEST_DB is not set")
+	}
+
+	testdb, cleanup := testutil.SetupTestDatabase(dburl)
+	defer cleanup()
+	conn, err := database.Connect(testdb)
+	require.Nil(t, err)
+
+	// The post table before the slug, scheduling, view counter and trash
+	// columns.
+	_, err = conn.Exec(`
+		CREATE TABLE post (
+			id uuid NOT NULL,
+			revision uuid,
+			title character varying NOT NULL,
+			created timestamp with time zone NOT NULL DEFAULT now(),
+			updated timestamp with time zone NOT NULL,
+			PRIMARY KEY (id)
+		)
+	`)
+	require.Nil(t, err)
+	_, err = conn.Exec(`INSERT INTO post (id, title, updated) VALUES ($1, 'Old post', now())`, uuid.NewV4())
+	require.Nil(t, err)
+
+	s := site.NewSite(config.MapStorage{"db": testdb})
+	s.SetStrictSchema(true)
+	out := bytes.NewBuffer(nil)
+	require.Nil(t, s.RunCommand(testutil.TestLogger(), out, []string{"migrate"}))
+	require.Equal(t, "The database schema is up to date.\n", out.String())
+
+	var slug string
+	require.Nil(t, conn.QueryRow(`SELECT slug FROM post`).Scan(&slug))
+	require.NotEmpty(t, slug)
+
+	out.Reset()
+	require.Nil(t, s.RunCommand(testutil.TestLogger(), out, []string{"cleanup-tokens"}))
+}
@@ -0,0 +1,65 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock returns the clock that uses the real time.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+var (
+	clockMtx sync.RWMutex
+	clock    = SystemClock()
+)
+
+// SetClock replaces the clock that Now uses, and returns the previous one.
+//
+// This is meant to be used in tests that depend on expiration. The expiration
+// of the Redis keys can't be changed this way.
+func SetClock(c Clock) Clock {
+	clockMtx.Lock()
+	defer clockMtx.Unlock()
+
+	prev := clock
+	clock = c
+
+	return prev
+}
+
+// Now returns the current time of the clock.
+func Now() time.Time {
+	clockMtx.RLock()
+	defer clockMtx.RUnlock()
+
+	return clock.Now()
+}
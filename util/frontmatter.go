@@ -0,0 +1,228 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	yamlFrontMatterDelimiter = "---"
+	tomlFrontMatterDelimiter = "+++"
+)
+
+// FrontMatter holds the metadata from the beginning of a markdown document.
+type FrontMatter map[string]interface{}
+
+// String returns a value as a string.
+func (fm FrontMatter) String(key string) (string, bool) {
+	v, ok := fm[key]
+	if !ok || v == nil {
+		return "", false
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []interface{}:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// Strings returns a value as a list of strings.
+//
+// A single string value is split at the commas.
+func (fm FrontMatter) Strings(key string) ([]string, bool) {
+	v, ok := fm[key]
+	if !ok || v == nil {
+		return nil, false
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			list = append(list, fmt.Sprint(item))
+		}
+		return list, true
+	case []string:
+		return v, true
+	default:
+		return strings.Split(fmt.Sprint(v), ","), true
+	}
+}
+
+// ParseFrontMatter splits a markdown document into its front-matter and body.
+//
+// The front-matter is either YAML between "---" lines or TOML between "+++"
+// lines at the very beginning of the document. Only a subset of TOML is
+// supported: key/value pairs with strings, numbers, booleans and arrays of
+// those on a single line.
+//
+// The front-matter is nil and the body is the whole document if the document
+// has no front-matter. A malformed front-matter returns an error, with the
+// whole document as the body.
+func ParseFrontMatter(document string) (FrontMatter, string, error) {
+	normalized := strings.Replace(document, "\r\n", "\n", -1)
+	lines := strings.SplitAfter(normalized, "\n")
+
+	delimiter := strings.TrimSpace(lines[0])
+	if delimiter != yamlFrontMatterDelimiter && delimiter != tomlFrontMatterDelimiter {
+		return nil, document, nil
+	}
+
+	end := -1
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == delimiter {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return nil, document, errors.New("unterminated front-matter")
+	}
+
+	block := strings.Join(lines[1:end], "")
+	body := strings.TrimLeft(strings.Join(lines[end+1:], ""), "\n")
+
+	var fm FrontMatter
+	var err error
+	if delimiter == yamlFrontMatterDelimiter {
+		fm, err = parseYAMLFrontMatter(block)
+	} else {
+		fm, err = parseTOMLFrontMatter(block)
+	}
+	if err != nil {
+		return nil, document, err
+	}
+
+	return fm, body, nil
+}
+
+func parseYAMLFrontMatter(block string) (FrontMatter, error) {
+	fm := FrontMatter{}
+	if err := yaml.Unmarshal([]byte(block), &fm); err != nil {
+		return nil, errors.Wrap(err, "invalid yaml front-matter")
+	}
+
+	return fm, nil
+}
+
+func parseTOMLFrontMatter(block string) (FrontMatter, error) {
+	fm := FrontMatter{}
+	for n, line := range strings.Split(block, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid toml front-matter on line %d", n+1)
+		}
+
+		key := strings.Trim(strings.TrimSpace(parts[0]), `"`)
+		value, err := parseTOMLValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid toml front-matter on line %d", n+1)
+		}
+		fm[key] = value
+	}
+
+	return fm, nil
+}
+
+func parseTOMLValue(value string) (interface{}, error) {
+	if strings.HasPrefix(value, "[") {
+		if !strings.HasSuffix(value, "]") {
+			return nil, errors.New("unterminated array")
+		}
+		list := []interface{}{}
+		inner := strings.TrimSpace(value[1 : len(value)-1])
+		if inner == "" {
+			return list, nil
+		}
+		for _, item := range splitTOMLArray(inner) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			v, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	}
+
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return nil, errors.New("unterminated string")
+		}
+		return value[1 : len(value)-1], nil
+	case value == "true" || value == "false":
+		return value == "true", nil
+	}
+
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f, nil
+	}
+
+	return nil, errors.Errorf("unsupported value %q", value)
+}
+
+// splitTOMLArray splits the items of an array at the commas outside of the
+// strings.
+func splitTOMLArray(inner string) []string {
+	var items []string
+	var quote rune
+	start := 0
+	escaped := false
+	for i, c := range inner {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, inner[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(items, inner[start:])
+}
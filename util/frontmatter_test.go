@@ -0,0 +1,87 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package util_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/util"
+)
+
+func TestParseFrontMatterWithoutFrontMatter(t *testing.T) {
+	for _, doc := range []string{
+		"",
+		"# Title\n\nSome text.",
+		"Text\n---\nafter a thematic break",
+	} {
+		fm, body, err := util.ParseFrontMatter(doc)
+		require.Nil(t, err)
+		require.Nil(t, fm)
+		require.Equal(t, doc, body)
+	}
+}
+
+func TestParseFrontMatterYAML(t *testing.T) {
+	fm, body, err := util.ParseFrontMatter("---\r\nslug: hello-world\r\ntags: [go, web]\r\ndescription: A post\r\n---\r\n\r\n# Hello\r\n")
+	require.Nil(t, err)
+	require.Equal(t, "# Hello\n", body)
+
+	slug, ok := fm.String("slug")
+	require.True(t, ok)
+	require.Equal(t, "hello-world", slug)
+
+	tags, ok := fm.Strings("tags")
+	require.True(t, ok)
+	require.Equal(t, []string{"go", "web"}, tags)
+
+	_, ok = fm.String("missing")
+	require.False(t, ok)
+}
+
+func TestParseFrontMatterTOML(t *testing.T) {
+	fm, body, err := util.ParseFrontMatter("+++\n# comment\nslug = \"hello-world\"\ntags = [\"go\", 'web, net']\ndraft = true\n+++\nBody")
+	require.Nil(t, err)
+	require.Equal(t, "Body", body)
+
+	slug, _ := fm.String("slug")
+	require.Equal(t, "hello-world", slug)
+	tags, _ := fm.Strings("tags")
+	require.Equal(t, []string{"go", "web, net"}, tags)
+	draft, _ := fm.String("draft")
+	require.Equal(t, "true", draft)
+
+	fm, _, err = util.ParseFrontMatter("+++\ntags = \"go,web\"\n+++\n")
+	require.Nil(t, err)
+	tags, _ = fm.Strings("tags")
+	require.Equal(t, []string{"go", "web"}, tags)
+}
+
+func TestParseFrontMatterMalformed(t *testing.T) {
+	for _, doc := range []string{
+		"---\nslug: hello\n\nno closing delimiter",
+		"---\nslug: [unterminated\n---\nBody",
+		"+++\nnot a key value pair\n+++\nBody",
+		"+++\ntags = [\"go\"\n+++\nBody",
+		"+++\n[table]\n+++\nBody",
+	} {
+		fm, body, err := util.ParseFrontMatter(doc)
+		require.NotNil(t, err, doc)
+		require.Nil(t, fm)
+		require.Equal(t, doc, body)
+	}
+}
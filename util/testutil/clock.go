@@ -0,0 +1,64 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tamasd/simplesite/util"
+)
+
+// FakeClock is a util.Clock that only moves when it is told to.
+type FakeClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock creates a fake clock that is stopped at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// InstallFakeClock replaces the clock of util.Now with a fake clock that
+// starts at the current time.
+//
+// The returned function restores the previous clock.
+func InstallFakeClock() (*FakeClock, func()) {
+	c := NewFakeClock(time.Now())
+	prev := util.SetClock(c)
+
+	return c, func() {
+		util.SetClock(prev)
+	}
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.now = c.now.Add(d)
+}
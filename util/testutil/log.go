@@ -0,0 +1,194 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// LogEntry is a parsed log line.
+type LogEntry struct {
+	Level   logrus.Level
+	Message string
+	// Fields contain every key of the line except the level, message and
+	// time, with the values formatted as strings.
+	Fields map[string]string
+	Raw    string
+}
+
+// TestJSONLogger is like TestLogger, but the log lines are JSON objects.
+func TestJSONLogger() logrus.FieldLogger {
+	logger := TestLogger()
+	logger.(*testLogger).FieldLogger.(*logrus.Logger).Formatter = &logrus.JSONFormatter{}
+
+	return logger
+}
+
+// ParseLog parses the output of TestLogger() or TestJSONLogger().
+//
+// Lines that can't be parsed fail the test.
+func ParseLog(t require.TestingT, logger logrus.FieldLogger) []LogEntry {
+	var entries []LogEntry
+	for _, line := range strings.Split(GetLog(logger), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		entry, err := ParseLogLine(line)
+		require.NoError(t, err, line)
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// ParseLogLine parses a single line in the logrus JSON or text format.
+func ParseLogLine(line string) (LogEntry, error) {
+	var values map[string]string
+	var err error
+	if strings.HasPrefix(line, "{") {
+		values, err = parseJSONLogLine(line)
+	} else {
+		values, err = parseTextLogLine(line)
+	}
+	if err != nil {
+		return LogEntry{}, err
+	}
+
+	level, err := logrus.ParseLevel(values[logrus.FieldKeyLevel])
+	if err != nil {
+		return LogEntry{}, err
+	}
+
+	entry := LogEntry{
+		Level:   level,
+		Message: values[logrus.FieldKeyMsg],
+		Fields:  values,
+		Raw:     line,
+	}
+	delete(values, logrus.FieldKeyLevel)
+	delete(values, logrus.FieldKeyMsg)
+	delete(values, logrus.FieldKeyTime)
+
+	return entry, nil
+}
+
+func parseJSONLogLine(line string) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			values[k] = s
+		} else {
+			values[k] = fmt.Sprint(v)
+		}
+	}
+
+	return values, nil
+}
+
+func parseTextLogLine(line string) (map[string]string, error) {
+	values := make(map[string]string)
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimLeft(line, " ") {
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("missing key at %q", line)
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+
+		if strings.HasPrefix(line, `"`) {
+			end := quotedEnd(line)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated value of %q", key)
+			}
+			value, err := strconv.Unquote(line[:end])
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+			line = line[end:]
+		} else {
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			values[key] = line[:end]
+			line = line[end:]
+		}
+	}
+
+	return values, nil
+}
+
+// quotedEnd returns the index after the closing quote of a quoted string at the
+// beginning of s, or -1.
+func quotedEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// FindLogEntries returns the log entries of the given level that contain the
+// substring.
+func FindLogEntries(t require.TestingT, logger logrus.FieldLogger, level logrus.Level, substring string) []LogEntry {
+	var found []LogEntry
+	for _, entry := range ParseLog(t, logger) {
+		if entry.Level == level && strings.Contains(entry.Raw, substring) {
+			found = append(found, entry)
+		}
+	}
+
+	return found
+}
+
+// AssertLogContains asserts that a log line of the given level contains the
+// substring, and returns the first one of them.
+func AssertLogContains(t require.TestingT, logger logrus.FieldLogger, level logrus.Level, substring string) LogEntry {
+	found := FindLogEntries(t, logger, level, substring)
+	if len(found) == 0 {
+		require.FailNow(t, fmt.Sprintf("no %s log line contains %q", level, substring), GetLog(logger))
+		return LogEntry{}
+	}
+
+	return found[0]
+}
+
+// AssertLogNotContains asserts that no log line of the given level contains the
+// substring.
+func AssertLogNotContains(t require.TestingT, logger logrus.FieldLogger, level logrus.Level, substring string) {
+	if found := FindLogEntries(t, logger, level, substring); len(found) > 0 {
+		require.FailNow(t, fmt.Sprintf("%s log line contains %q", level, substring), found[0].Raw)
+	}
+}
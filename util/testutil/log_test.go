@@ -0,0 +1,78 @@
+// A simple website in Go.
+// Copyright (c) 2020. Tamás Demeter-Haludka
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testutil_test
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/util/testutil"
+)
+
+type failingT struct {
+	failed bool
+}
+
+func (t *failingT) Errorf(format string, args ...interface{}) {}
+
+func (t *failingT) FailNow() {
+	t.failed = true
+}
+
+func TestParseLogLine(t *testing.T) {
+	entry, err := testutil.ParseLogLine(`time="2020-01-02T03:04:05Z" level=warning msg="failed to load \"x\"" post=42 route="/post/:id/edit"`)
+	require.NoError(t, err)
+	require.Equal(t, logrus.WarnLevel, entry.Level)
+	require.Equal(t, `failed to load "x"`, entry.Message)
+	require.Equal(t, map[string]string{"post": "42", "route": "/post/:id/edit"}, entry.Fields)
+
+	entry, err = testutil.ParseLogLine(`{"level":"info","msg":"done","status-code":200,"time":"2020-01-02T03:04:05Z"}`)
+	require.NoError(t, err)
+	require.Equal(t, logrus.InfoLevel, entry.Level)
+	require.Equal(t, "done", entry.Message)
+	require.Equal(t, map[string]string{"status-code": "200"}, entry.Fields)
+
+	_, err = testutil.ParseLogLine(`level=info msg="unterminated`)
+	require.Error(t, err)
+}
+
+func TestAssertLog(t *testing.T) {
+	for name, logger := range map[string]logrus.FieldLogger{
+		"text": testutil.TestLogger(),
+		"json": testutil.TestJSONLogger(),
+	} {
+		logger := logger
+		t.Run(name, func(t *testing.T) {
+			logger.WithField("post", "42").Warnln("failed to load post")
+			logger.Infoln("completed handling request")
+
+			entry := testutil.AssertLogContains(t, logger, logrus.WarnLevel, "failed to load")
+			require.Equal(t, "42", entry.Fields["post"])
+			testutil.AssertLogNotContains(t, logger, logrus.InfoLevel, "failed to load")
+			require.Len(t, testutil.ParseLog(t, logger), 2)
+
+			ft := &failingT{}
+			testutil.AssertLogContains(ft, logger, logrus.ErrorLevel, "failed to load")
+			require.True(t, ft.failed)
+
+			ft = &failingT{}
+			testutil.AssertLogNotContains(ft, logger, logrus.WarnLevel, "post")
+			require.True(t, ft.failed)
+		})
+	}
+}
@@ -18,10 +18,14 @@ package testutil
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path"
@@ -34,6 +38,7 @@ import (
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"github.com/tamasd/simplesite/apps/account"
 	"github.com/tamasd/simplesite/config"
 	"github.com/tamasd/simplesite/database"
 	"github.com/tamasd/simplesite/keyvalue"
@@ -60,8 +65,9 @@ var (
 func TestRegData() *url.Values {
 	regdata := &url.Values{}
 	regdata.Set("Username", util.RandomHexString(16))
-	regdata.Set("Email", testEmail)
+	regdata.Set("Email", util.RandomHexString(8)+"."+testEmail)
 	regdata.Set("Password", util.RandomHexString(32))
+	regdata.Set("ConfirmPassword", regdata.Get("Password"))
 	regdata.Set("AcceptTOS", "true")
 
 	return regdata
@@ -182,8 +188,25 @@ func SetupTestSiteFromEnv() *TestSite {
 	)
 }
 
+// SetupTestSiteFromEnvWithConfig creates a test site from environment
+// variables with extra configuration.
+func SetupTestSiteFromEnvWithConfig(extra config.MapStorage) *TestSite {
+	return SetupTestSiteWithConfig(
+		os.Getenv("TEST_DB"),
+		os.Getenv("TEST_REDIS"),
+		extra,
+	)
+}
+
 // SetupTestSite creates a test site.
 func SetupTestSite(dburl, redisurl string) *TestSite {
+	return SetupTestSiteWithConfig(dburl, redisurl, nil)
+}
+
+// SetupTestSiteWithConfig creates a test site with extra configuration.
+//
+// The extra configuration values override the defaults.
+func SetupTestSiteWithConfig(dburl, redisurl string, extra config.MapStorage) *TestSite {
 	redisPrefix := util.RandomHexString(8) + ":"
 	testdb, dbcleanup := SetupTestDatabase(dburl)
 
@@ -194,6 +217,15 @@ func SetupTestSite(dburl, redisurl string) *TestSite {
 		"baseurl":      baseurl,
 		"db":           testdb,
 	}
+	for k, v := range extra {
+		cfg[k] = v
+	}
+	redisOptions, err := site.RedisOptions(cfg)
+	Must(err)
+	sessionCookieName := cfg.Get("session_cookie_name")
+	if sessionCookieName == "" {
+		sessionCookieName = session.SessionCookieName
+	}
 	s := site.NewSite(cfg)
 	logger := TestLogger()
 	mail := NewTestMailer()
@@ -202,23 +234,39 @@ func SetupTestSite(dburl, redisurl string) *TestSite {
 		Server: s.CreateServer(logger, func() (mailer.Mailer, error) {
 			return mail, nil
 		}),
-		Mailer:      mail,
-		testdb:      testdb,
-		dbcleanup:   dbcleanup,
-		redisurl:    redisurl,
-		redisPrefix: redisPrefix,
+		Mailer:            mail,
+		Logger:            logger,
+		testdb:            testdb,
+		dbcleanup:         dbcleanup,
+		redisOptions:      redisOptions,
+		redisPrefix:       redisPrefix,
+		sessionCookieName: sessionCookieName,
+		site:              s,
 	}
 }
 
 // TestSite represents a version of *site.Site that is meant to be used for
 // general integration testing.
 type TestSite struct {
-	Server      *server.Server
-	Mailer      *TestMailer
-	testdb      string
-	dbcleanup   func()
-	redisurl    string
-	redisPrefix string
+	Server       *server.Server
+	Mailer       *TestMailer
+	Logger       logrus.FieldLogger
+	testdb       string
+	dbcleanup    func()
+	redisOptions *redis.Options
+	redisPrefix  string
+	// sessionCookieName is the configured name of the session cookie.
+	sessionCookieName string
+	site              *site.Site
+}
+
+// RunCommand runs a maintenance command (see site.Commands) against the test
+// site, and returns its output.
+func (ts *TestSite) RunCommand(args ...string) (string, error) {
+	out := &bytes.Buffer{}
+	err := ts.site.RunCommand(ts.Logger, out, args)
+
+	return out.String(), err
 }
 
 func (ts *TestSite) Database() database.DB {
@@ -228,19 +276,16 @@ func (ts *TestSite) Database() database.DB {
 }
 
 func (ts *TestSite) KeyValueStore() keyvalue.Store {
-	return keyvalue.NewPrefixed(keyvalue.NewRedis(redis.NewClient(&redis.Options{
-		Addr: ts.redisurl,
-	})), ts.redisPrefix)
+	return keyvalue.NewPrefixed(keyvalue.NewRedis(redis.NewClient(ts.redisOptions)), ts.redisPrefix)
 }
 
 // Cleanup cleans the database and redis.
 //
 // This function is meant to be deferred after CreateTestSite is called.
 func (ts *TestSite) Cleanup() {
-	rc := redis.NewClient(&redis.Options{
-		Addr: ts.redisurl,
-	})
+	rc := redis.NewClient(ts.redisOptions)
 
+	ts.Server.Close()
 	Must(RedisDeletePattern(rc, ts.redisPrefix+"*"))
 	ts.dbcleanup()
 }
@@ -294,7 +339,7 @@ func (c *TestClient) CurrentUID() uuid.UUID {
 	cookies := c.jar.Cookies(u)
 
 	for _, cookie := range cookies {
-		if cookie.Name != session.SessionCookieName {
+		if cookie.Name != c.testSite.sessionCookieName {
 			continue
 		}
 
@@ -386,7 +431,7 @@ func (c *TestClient) FormValues(formid string) *url.Values {
 		case "button", "submit", "image", "reset":
 			return
 		case "file":
-			// TODO support file type input?
+			// Files are submitted with SubmitMultipart.
 			return
 		case "checkbox":
 			if input.AttrOr("checked", "") == "checked" {
@@ -468,12 +513,13 @@ func (c *TestClient) Form(url string, alter ...func(*http.Request)) SubmittableF
 
 // RegistrationAndLogin emulates a registration and a login of an account.
 func (c *TestClient) RegistrationAndLogin(regdata *url.Values) {
+	sent := len(c.testSite.Mailer.Messages)
 	resp := c.Form("/register").Submit(regdata)
-	require.Equal(c.t, http.StatusFound, resp.StatusCode)
+	require.Equal(c.t, http.StatusSeeOther, resp.StatusCode)
 
-	require.Len(c.t, c.testSite.Mailer.Messages, 1)
+	require.Len(c.t, c.testSite.Mailer.Messages, sent+1)
 
-	verificationLink := extractVerificationLink(c.testSite.Mailer.Messages[0].Message)
+	verificationLink := extractVerificationLink(c.testSite.Mailer.Messages[sent].Message)
 	resp = c.Request(http.MethodGet, verificationLink, nil)
 	require.Equal(c.t, http.StatusFound, resp.StatusCode)
 
@@ -481,13 +527,85 @@ func (c *TestClient) RegistrationAndLogin(regdata *url.Values) {
 	logindata.Set("Username", regdata.Get("Username"))
 	logindata.Set("Password", regdata.Get("Password"))
 	resp = c.Form("/login").Submit(logindata)
-	require.Equal(c.t, http.StatusFound, resp.StatusCode)
+	require.Equal(c.t, http.StatusSeeOther, resp.StatusCode)
+}
+
+// LoginAsWithPermissions creates a verified account with the given permissions,
+// and logs the client in with it.
+//
+// It returns the id of the account.
+func (c *TestClient) LoginAsWithPermissions(perms ...string) uuid.UUID {
+	regdata := TestRegData()
+	a := &account.Account{
+		Username: regdata.Get("Username"),
+		Email:    regdata.Get("Email"),
+		Active:   true,
+	}
+	a.SetPassword(regdata.Get("Password"))
+
+	require.Nil(c.t, database.Transactional(c.testSite.Database(), func(tx database.DB) error {
+		if err := a.Save(tx); err != nil {
+			return err
+		}
+
+		return account.SavePermissions(tx, a.ID, perms)
+	}))
+
+	logindata := &url.Values{}
+	logindata.Set("Username", regdata.Get("Username"))
+	logindata.Set("Password", regdata.Get("Password"))
+	resp := c.Form("/login").Submit(logindata)
+	require.Equal(c.t, http.StatusSeeOther, resp.StatusCode)
+
+	return a.ID
 }
 
 // SubmittableForm represents a form that is ready to be submitted with the
 // given values.
 type SubmittableForm interface {
 	Submit(postValues *url.Values, alter ...func(*http.Request)) *http.Response
+	SubmitJSON(data map[string]interface{}, alter ...func(*http.Request)) *http.Response
+	SubmitMultipart(postValues *url.Values, files map[string]FileUpload, alter ...func(*http.Request)) *http.Response
+}
+
+// FileUpload is a file that is submitted with SubmitMultipart.
+type FileUpload struct {
+	Filename string
+	// ContentType defaults to application/octet-stream.
+	ContentType string
+	Content     []byte
+}
+
+// MultipartBody encodes form values and files as a multipart/form-data
+// request body. It returns the body and its content type.
+func MultipartBody(t require.TestingT, postValues url.Values, files map[string]FileUpload) (*bytes.Buffer, string) {
+	body := bytes.NewBuffer(nil)
+	mw := multipart.NewWriter(body)
+	for name, values := range postValues {
+		for _, value := range values {
+			require.Nil(t, mw.WriteField(name, value))
+		}
+	}
+	for name, file := range files {
+		contentType := file.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+			"name":     name,
+			"filename": file.Filename,
+		}))
+		h.Set("Content-Type", contentType)
+		part, err := mw.CreatePart(h)
+		require.Nil(t, err)
+		_, err = part.Write(file.Content)
+		require.Nil(t, err)
+	}
+	require.Nil(t, mw.Close())
+
+	return body, mw.FormDataContentType()
 }
 
 type submittableForm struct {
@@ -514,6 +632,45 @@ func (sf *submittableForm) Submit(postValues *url.Values, alter ...func(*http.Re
 	)
 }
 
+func (sf *submittableForm) SubmitMultipart(postValues *url.Values, files map[string]FileUpload, alter ...func(*http.Request)) *http.Response {
+	if postValues.Get("FormID") == "" {
+		postValues.Set("FormID", sf.formid)
+	}
+	if postValues.Get("FormToken") == "" {
+		postValues.Set("FormToken", sf.formtoken)
+	}
+
+	body, contentType := MultipartBody(sf.t, *postValues, files)
+
+	return sf.Request(http.MethodPost, sf.url, body,
+		append([]func(*http.Request){
+			func(r *http.Request) {
+				r.Header.Set("Content-Type", contentType)
+			},
+		}, alter...)...,
+	)
+}
+
+func (sf *submittableForm) SubmitJSON(data map[string]interface{}, alter ...func(*http.Request)) *http.Response {
+	if _, ok := data["FormID"]; !ok {
+		data["FormID"] = sf.formid
+	}
+	if _, ok := data["FormToken"]; !ok {
+		data["FormToken"] = sf.formtoken
+	}
+
+	body, err := json.Marshal(data)
+	require.Nil(sf.t, err)
+
+	return sf.Request(http.MethodPost, sf.url, bytes.NewBuffer(body),
+		append([]func(*http.Request){
+			func(r *http.Request) {
+				r.Header.Set("Content-Type", "application/json")
+			},
+		}, alter...)...,
+	)
+}
+
 func formSelector(formid string) string {
 	if formid == "" {
 		return "form"
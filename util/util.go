@@ -25,11 +25,17 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
 	matchFirstCap = regexp.MustCompile("(.)([A-Z][a-z]+)")
 	matchAllCap   = regexp.MustCompile("([a-z0-9])([A-Z])")
+	nonSlugChars  = regexp.MustCompile("[^a-z0-9]+")
 )
 
 // ToSnakeCase converts camel case to snake case.
@@ -39,6 +45,17 @@ func ToSnakeCase(str string) string {
 	return strings.ToLower(snake)
 }
 
+// Slugify converts a string into a lowercase, URL-safe form.
+//
+// Accents are removed, and every other character that is not an ASCII letter
+// or digit is collapsed into a single dash.
+func Slugify(str string) string {
+	t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFKC)
+	str, _, _ = transform.String(t, strings.ToLower(str))
+
+	return strings.Trim(nonSlugChars.ReplaceAllString(str, "-"), "-")
+}
+
 // SetContext sets a value in a request's context.
 func SetContext(r *http.Request, key, value interface{}) *http.Request {
 	return r.WithContext(context.WithValue(r.Context(), key, value))
@@ -65,6 +65,21 @@ func TestToSnakeCase(t *testing.T) {
 	require.Equal(t, "test_uuid_foo", util.ToSnakeCase("TestUUIDFoo"))
 }
 
+func TestSlugify(t *testing.T) {
+	table := map[string]string{
+		"":                 "",
+		"Go":               "go",
+		"Hello, World!":    "hello-world",
+		"  árvíztűrő  ":    "arvizturo",
+		"foo--bar__baz":    "foo-bar-baz",
+		"web development ": "web-development",
+	}
+
+	for input, result := range table {
+		require.Equal(t, result, util.Slugify(input))
+	}
+}
+
 func TestFilter_Filter(t *testing.T) {
 	logger := testutil.TestLogger()
 	f := util.NewFilter(logger)